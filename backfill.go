@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const backfillDateFormat = "2006-01-02"
+
+// runBackfill runs the backfill command and returns the exit code
+func runBackfill(scrapers []collector.Scraper, filters map[string]kubecost_api.Filters, scrapeOpts collector.ScrapeOptions, logger log.Logger) int {
+	// the days are in the local time, the same as the windows of the live exporter
+	from, err := time.ParseInLocation(backfillDateFormat, *backfillFrom, time.Local)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing --from", "err", err)
+		return 1
+	}
+	// by default backfill up to the day that the exporter starts from
+	to, _ := scrapeOpts.Window(time.Now())
+	if len(*backfillTo) > 0 {
+		if to, err = time.ParseInLocation(backfillDateFormat, *backfillTo, time.Local); err != nil {
+			level.Error(logger).Log("msg", "Error parsing --to", "err", err)
+			return 1
+		}
+	}
+	if !from.Before(to) {
+		level.Error(logger).Log("msg", "Nothing to backfill, --from must be before --to", "from", from.Format(backfillDateFormat), "to", to.Format(backfillDateFormat))
+		return 1
+	}
+
+	backfill := collector.NewBackfill(kubecostUrl, scrapers, filtersParams(filters), logger, scrapeOpts)
+	ctx := context.Background()
+	if *backfillPush {
+		remoteWrite, err := newRemoteWriteSink(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error configuring remote write", "err", err)
+			return 1
+		}
+		// every day is pushed as soon as it's gathered
+		err = backfill.Run(ctx, from, to, func(day time.Time, families []*dto.MetricFamily) error {
+			return remoteWrite.Send(ctx, families)
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "Backfill finished with errors", "err", err)
+			return 1
+		}
+		level.Info(logger).Log("msg", "Backfill pushed", "from", from.Format(backfillDateFormat), "to", to.Format(backfillDateFormat))
+		return 0
+	}
+
+	// the days are spooled to the temporary files, OpenMetrics needs the samples of a series together
+	spool, err := collector.NewOpenMetricsSpool("")
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating the temporary directory", "err", err)
+		return 1
+	}
+	defer spool.Close()
+	backfillErr := backfill.Run(ctx, from, to, func(day time.Time, families []*dto.MetricFamily) error {
+		return spool.Add(families)
+	})
+	if backfillErr != nil {
+		level.Error(logger).Log("msg", "Backfill finished with errors", "err", backfillErr)
+	}
+
+	out := os.Stdout
+	if *backfillOutput != "-" {
+		if out, err = os.Create(*backfillOutput); err != nil {
+			level.Error(logger).Log("msg", "Error creating output file", "err", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	if err := spool.Write(w); err != nil {
+		level.Error(logger).Log("msg", "Error writing OpenMetrics", "err", err)
+		return 1
+	}
+	if err := w.Flush(); err != nil {
+		level.Error(logger).Log("msg", "Error writing OpenMetrics", "err", err)
+		return 1
+	}
+	level.Info(logger).Log("msg", "Backfill written", "from", from.Format(backfillDateFormat), "to", to.Format(backfillDateFormat), "output", *backfillOutput)
+	if backfillErr != nil {
+		return 1
+	}
+	return 0
+}
@@ -19,6 +19,34 @@ const (
 	promDesc = "cost_cluster_allocation"
 )
 
+var (
+	allocationCostName          = prometheus.BuildFQName(namespace, promDesc, "total")
+	allocationComponentCostName = prometheus.BuildFQName(namespace, promDesc, "component")
+)
+
+// costComponentLabelName is the label of the component cost series, it replaces a Kubecost label with the same name
+const costComponentLabelName = "cost_component"
+
+// costComponent is a part of the allocation total cost, the adjustments are included,
+// so the components sum up to the total
+type costComponent struct {
+	name  string
+	value float64
+}
+
+func allocationCostComponents(allocation kubecost_api.Allocation) []costComponent {
+	return []costComponent{
+		{"cpu", allocation.CPUCost + allocation.CPUCostAdjustment},
+		{"gpu", allocation.GPUCost + allocation.GPUCostAdjustment},
+		{"ram", allocation.RAMCost + allocation.RAMCostAdjustment},
+		{"pv", allocation.PVCost + allocation.PVCostAdjustment},
+		{"network", allocation.NetworkCost + allocation.NetworkCostAdjustment},
+		{"load_balancer", allocation.LoadBalancerCost + allocation.LoadBalancerCostAdjustment},
+		{"shared", allocation.SharedCost},
+		{"external", allocation.ExternalCost},
+	}
+}
+
 type ScrapeAllocation struct{}
 
 func (ScrapeAllocation) Name() string {
@@ -29,94 +57,126 @@ func (ScrapeAllocation) Help() string {
 	return "Scrapes the information about Cost Allocation API"
 }
 
-func (s ScrapeAllocation) Scrape(ctx context.Context, apiBaseUrl **url.URL, scraperParams []string, ch chan<- prometheus.Metric, logger log.Logger, skipTLSVerify bool, offset int64) error {
-	//2021-12-14T00:00:00Z,2021-12-15T00:00:00Z
-	RFC3339local := "2006-01-02T15:04:05Z"
+func (s ScrapeAllocation) Scrape(ctx context.Context, apiBaseUrl **url.URL, scraperParams []string, ch chan<- prometheus.Metric, logger log.Logger, opts ScrapeOptions) error {
 	now := time.Now()
-	dateFrom := now.AddDate(0, 0, int(-offset))
-	dateTo := now.AddDate(0, 0, int(-offset+1))
-	scraperParams = append(scraperParams, fmt.Sprintf("window=%s,%s", TruncateDate(dateFrom).Format(RFC3339local), TruncateDate(dateTo).Format(RFC3339local)))
-	scraperParams = append(scraperParams, "accumulate=true")
+	scraperParams = append(scraperParams, opts.WindowParams(now)...)
 	level.Debug(logger).Log("msg", scrapeAllocationSubsystemName, "scraperParams", fmt.Sprintf("%+v, len(%d)", scraperParams, len(scraperParams)))
-	apiClient := kubecost_api.NewApiClient(*apiBaseUrl, namespace, skipTLSVerify)
-	costs, err := apiClient.GetAllocation(scraperParams)
+	apiClient := opts.newClient(*apiBaseUrl)
+	series := opts.newSeriesSet(ch, s.Name())
+	clusters := opts.clusterInfo(ctx, apiClient, logger)
+	var allocations []kubecost_api.Allocation
+	items := 0
+	// weird response, that has map in a first element of an array
+	// when accumulate=false, there is a set (map) per each step interval.
+	// The metrics are generated as the allocations are decoded, they're kept only for the records
+	sets, err := apiClient.StreamAllocation(ctx, scraperParams, func(allocation kubecost_api.Allocation) error {
+		if opts.Records != nil {
+			allocations = append(allocations, allocation)
+		}
+		items++
+		opts.Debug.item(allocation)
+		if err := s.generateMetric(allocation, clusters, series); err != nil {
+			opts.Debug.drop(err.Error())
+			return err
+		}
+		return nil
+	})
+	opts.decoded(s.Name(), map[string]int{"allocation": items})
+	// the buffered series are sent even if the response is broken, like the ones sent before the error
+	if flushErr := series.flushTraced(ctx); err == nil {
+		err = flushErr
+	}
 	if err != nil {
 		return err
 	}
-	if len(costs.Data) == 0 {
+	if sets == 0 {
 		return fmt.Errorf("empty allocations")
 	}
 
-	// weird response, that has map in a first element of an array
-	for _,cost := range costs.Data[0]{
-		s.generateMetric(cost, ch, logger)
+	if opts.Records != nil {
+		start, end := opts.Window(now)
+		records := &Records{Scraper: s.Name(), Start: start, End: end, Allocations: allocations}
+		// the metrics are still exported, if the records couldn't be written
+		if err := opts.Records.WriteRecords(ctx, records); err != nil {
+			level.Error(logger).Log("msg", "Error writing records", "err", err)
+		}
 	}
 	return nil
 }
 
 // This function maps labels with their values for prometheus metric construction
-func (s ScrapeAllocation) getDefaultLabels(allocation kubecost_api.Allocation) ([]string, []string, error){
+func (s ScrapeAllocation) getDefaultLabels(l *labelSet, allocation kubecost_api.Allocation) error {
 	// if there is an idle resources allocation
 	// we mark namespace as __idle__
 	// so we can calculcate idle resources for cluster via that label
 	if allocation.Name == "__idle__" {
-		return []string{"property_cluster", "property_namespace"}, []string{allocation.Properties.Cluster, allocation.Name}, nil
+		l.add("property_cluster", allocation.Properties.Cluster)
+		l.add("property_namespace", allocation.Name)
+		return nil
 	}
 	// TODO: refactor this after POC testing
-	var enabledPropsLabels []string
-	var enabledPropsValues []string
 	if len(allocation.Properties.Namespace) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_namespace")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Namespace)
+		l.add("property_namespace", allocation.Properties.Namespace)
 	}
 	if len(allocation.Properties.Node) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_node")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Node)
+		l.add("property_node", allocation.Properties.Node)
 	}
 	if len(allocation.Properties.Cluster) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_cluster")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Cluster)
+		l.add("property_cluster", allocation.Properties.Cluster)
 	}
 	if len(allocation.Properties.ProviderID) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_provider_id")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.ProviderID)
+		l.add("property_provider_id", allocation.Properties.ProviderID)
 	}
 	if len(allocation.Properties.Container) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_container")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Container)
+		l.add("property_container", allocation.Properties.Container)
 	}
 	if len(allocation.Properties.Controller) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_controller")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Controller)
+		l.add("property_controller", allocation.Properties.Controller)
 	}
 	if len(allocation.Properties.Pod) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_pod")
-		enabledPropsValues = append(enabledPropsValues, allocation.Properties.Pod)
+		l.add("property_pod", allocation.Properties.Pod)
 	}
-	s.getDefaultAllocationLabels(&enabledPropsLabels, &enabledPropsValues, allocation.Properties.Labels)
-	return enabledPropsLabels,enabledPropsValues, nil
+	s.getDefaultAllocationLabels(l, allocation.Properties.Labels)
+	return nil
 }
 
-func (s ScrapeAllocation) getDefaultAllocationLabels(labelNames *[]string, labelValues *[]string, labels kubecost_api.AllocationLabels) error{
+func (s ScrapeAllocation) getDefaultAllocationLabels(l *labelSet, labels kubecost_api.AllocationLabels) {
 	for name, value := range labels {
-		*labelNames = append(*labelNames, strings.ReplaceAll(name, "-", "_"))
-		*labelValues = append(*labelValues, strings.ReplaceAll(value, "-", "_"))
+		l.add(strings.ReplaceAll(name, "-", "_"), strings.ReplaceAll(value, "-", "_"))
 	}
-	return nil
 }
 
-func (s ScrapeAllocation) generateMetric(allocation kubecost_api.Allocation, ch chan<- prometheus.Metric, logger log.Logger) error {
-	labelNames, labelValues, err := s.getDefaultLabels(allocation)
-	if err != nil {
+func (s ScrapeAllocation) generateMetric(allocation kubecost_api.Allocation, clusters clusterInfos, series *seriesSet) error {
+	l := getLabelSet()
+	defer l.release()
+	if err := s.getDefaultLabels(l, allocation); err != nil {
 		return err
 	}
-	diskDesc := prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, promDesc, "total"),
-		"k8s total cost from Kubecost Assets API",
-		labelNames, nil,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		diskDesc, prometheus.GaugeValue, allocation.TotalCost, labelValues...,
-	)
+	if allocation.Properties != nil {
+		clusters.addLabels(l, allocation.Properties.Cluster)
+	}
+	if !series.opts.CostComponents {
+		series.send(allocationCostName, "k8s total cost from Kubecost Assets API", allocation.TotalCost, l, allocation.Window)
+		return nil
+	}
+	// send adds the interval label and sorts the set, so every component starts from a copy of the item labels
+	base := getLabelSet()
+	defer base.release()
+	for i, name := range l.names {
+		if name != costComponentLabelName {
+			base.add(name, l.values[i])
+		}
+	}
+	series.send(allocationCostName, "k8s total cost from Kubecost Assets API", allocation.TotalCost, l, allocation.Window)
+	for _, component := range allocationCostComponents(allocation) {
+		// the components that the allocation doesn't use, e.g. gpu, aren't exported
+		if component.value == 0 {
+			continue
+		}
+		l.names = append(l.names[:0], base.names...)
+		l.values = append(l.values[:0], base.values...)
+		l.add(costComponentLabelName, component.name)
+		series.send(allocationComponentCostName, "k8s cost by component from Kubecost Allocation API", component.value, l, allocation.Window)
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -1 +1,208 @@
 package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// allocationFixture returns the accumulated /model/allocation response with n allocations
+func allocationFixture(n int) []byte {
+	start := time.Date(2021, 12, 14, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	set := make(map[string]kubecost_api.Allocation, n)
+	for i := 0; i < n; i++ {
+		properties := &kubecost_api.AllocationProperties{
+			Cluster:    fmt.Sprintf("cluster-%d", i%5),
+			Node:       fmt.Sprintf("ip-10-0-%d-%d.ec2.internal", i/250%250, i%250),
+			Container:  "app",
+			Controller: fmt.Sprintf("deployment-%d", i/10),
+			Namespace:  fmt.Sprintf("namespace-%d", i%50),
+			Pod:        fmt.Sprintf("deployment-%d-%x", i/10, i),
+			ProviderID: fmt.Sprintf("i-%016x", i/30),
+			Labels: kubecost_api.AllocationLabels{
+				"app":  fmt.Sprintf("deployment-%d", i/10),
+				"team": fmt.Sprintf("team-%d", i%20),
+			},
+		}
+		name := fmt.Sprintf("%s/%s/%s/%s/%s", properties.Cluster, properties.Node, properties.Namespace, properties.Pod, properties.Container)
+		set[name] = kubecost_api.Allocation{
+			Name: name, Properties: properties, Window: kubecost_api.Window{Start: &start, End: &end}, Start: start, End: end,
+			CPUCoreHours: 12, CPUCoreRequestAverage: 0.5, CPUCoreUsageAverage: 0.3, CPUCost: 0.4,
+			RAMByteHours: 2.6e10, RAMBytesRequestAverage: 1.1e9, RAMBytesUsageAverage: 8e8, RAMCost: 0.1,
+			NetworkTransferBytes: 1e8, NetworkReceiveBytes: 2e8, PVCost: 0.05, TotalCost: 0.55,
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{"code": 200, "data": []interface{}{set}})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+// BenchmarkScrapeAllocation compares decoding the whole response with the streaming decoder, from the connection and from the buffered response
+func BenchmarkScrapeAllocation(b *testing.B) {
+	server, u := fixtureServer(allocationFixture(20000))
+	defer server.Close()
+	logger := log.NewNopLogger()
+	params := (ScrapeOptions{}).WindowParams(time.Now())
+	s := ScrapeAllocation{}
+
+	b.Run("tree", func(b *testing.B) {
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			client := kubecost_api.NewApiClient(u, namespace, false)
+			costs, err := client.GetAllocation(context.Background(), params)
+			if err != nil {
+				b.Fatal(err)
+			}
+			series := (ScrapeOptions{}).newSeriesSet(ch, s.Name())
+			for _, set := range costs.Data {
+				for _, cost := range set {
+					s.generateMetric(cost, nil, series)
+				}
+			}
+			if err := series.flush(); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+
+	// the defaults of the exporter: the request group limits the concurrency, the response is decoded from the connection
+	b.Run("stream", func(b *testing.B) {
+		opts := ScrapeOptions{Requests: kubecost_api.NewRequestGroup(4)}
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			if err := s.Scrape(context.Background(), &u, nil, ch, logger, opts); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+
+	// with the cache the raw response is read first, today's window isn't cached, so every scrape requests it
+	b.Run("buffered", func(b *testing.B) {
+		cache, err := kubecost_api.NewResponseCache(kubecost_api.CacheConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		opts := ScrapeOptions{Requests: kubecost_api.NewRequestGroup(4), Cache: cache}
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			if err := s.Scrape(context.Background(), &u, nil, ch, logger, opts); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+}
+
+// metricsCollector serves the metrics sent by a test, so the registry checks and sorts them
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// gatherSeries returns the series that fn sends as name{label="value",...} value, sorted by the registry
+func gatherSeries(t *testing.T, fn func(ch chan<- prometheus.Metric)) []string {
+	ch := make(chan prometheus.Metric)
+	var metrics metricsCollector
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	fn(ch)
+	close(ch)
+	<-done
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			pairs := make([]string, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			series = append(series, mf.GetName()+"{"+strings.Join(pairs, ",")+"} "+strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64))
+		}
+	}
+	return series
+}
+
+func TestGenerateMetricCostComponents(t *testing.T) {
+	allocation := kubecost_api.Allocation{
+		Name: "cluster-one/node/kubecost/pod/app",
+		Properties: &kubecost_api.AllocationProperties{
+			Cluster:   "cluster-one",
+			Namespace: "kubecost",
+			// the component label replaces the Kubecost label of the same name
+			Labels: kubecost_api.AllocationLabels{"cost_component": "frontend"},
+		},
+		CPUCost: 0.25, CPUCostAdjustment: 0.25, RAMCost: 0.125, SharedCost: 0.125, TotalCost: 0.75,
+	}
+	tests := []struct {
+		name       string
+		components bool
+		want       []string
+	}{
+		{
+			name: "total only",
+			want: []string{`assets_cost_cluster_allocation_total{cost_component="frontend",property_cluster="cluster-one",property_namespace="kubecost"} 0.75`},
+		},
+		{
+			name:       "components with the adjustments, without the unused ones",
+			components: true,
+			want: []string{
+				`assets_cost_cluster_allocation_component{cost_component="cpu",property_cluster="cluster-one",property_namespace="kubecost"} 0.5`,
+				`assets_cost_cluster_allocation_component{cost_component="ram",property_cluster="cluster-one",property_namespace="kubecost"} 0.125`,
+				`assets_cost_cluster_allocation_component{cost_component="shared",property_cluster="cluster-one",property_namespace="kubecost"} 0.125`,
+				`assets_cost_cluster_allocation_total{cost_component="frontend",property_cluster="cluster-one",property_namespace="kubecost"} 0.75`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := gatherSeries(t, func(ch chan<- prometheus.Metric) {
+				series := (ScrapeOptions{CostComponents: tt.components}).newSeriesSet(ch, scrapeAllocationSubsystemName)
+				if err := (ScrapeAllocation{}).generateMetric(allocation, nil, series); err != nil {
+					t.Fatal(err)
+				}
+				if err := series.flush(); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -18,6 +18,8 @@ const (
 	promDescSubsystem = "cost"
 )
 
+var assetsCostName = prometheus.BuildFQName(namespace, promDescSubsystem, "total")
+
 type ScrapeAssets struct{}
 
 func (ScrapeAssets) Name() string {
@@ -33,162 +35,98 @@ func TruncateDate(t time.Time) time.Time {
 	year, month, day := t.Date()
 	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
 }
-func (s ScrapeAssets) Scrape(ctx context.Context, apiBaseUrl **url.URL, scraperParams []string, ch chan<- prometheus.Metric, logger log.Logger, skipTLSVerify bool, offset int64) error {
-	//2021-12-14T00:00:00Z,2021-12-15T00:00:00Z
-	RFC3339local := "2006-01-02T15:04:05Z"
+func (s ScrapeAssets) Scrape(ctx context.Context, apiBaseUrl **url.URL, scraperParams []string, ch chan<- prometheus.Metric, logger log.Logger, opts ScrapeOptions) error {
 	now := time.Now()
-	dateFrom := now.AddDate(0, 0, int(-offset))
-	dateTo := now.AddDate(0, 0, int(-offset+1))
-	scraperParams = append(scraperParams, fmt.Sprintf("window=%s,%s", TruncateDate(dateFrom).Format(RFC3339local), TruncateDate(dateTo).Format(RFC3339local)))
+	scraperParams = append(scraperParams, opts.WindowParams(now)...)
 	level.Debug(logger).Log("msg", scrapeAssetsSubsystemName, "scraperParams", fmt.Sprintf("%+v, len(%d)", scraperParams, len(scraperParams)))
-	apiClient := kubecost_api.NewApiClient(*apiBaseUrl, namespace, skipTLSVerify)
-	// to avoid duplication
-	// if don't use accumulate, it would duplicate resources usage for multiple time windows
-	scraperParams = append(scraperParams, "accumulate=true")
-	assets, err := apiClient.ListAssets(scraperParams)
-	if err != nil {
-		return err
-	}
+	apiClient := opts.newClient(*apiBaseUrl)
 	cloudAssetsMapper := NewCloudAssets(logger)
-	err = cloudAssetsMapper.MapAssets(assets)
-
-	// Generate metrics for Disks
-	err = s.generateDisksMetrics(cloudAssetsMapper.GetDisks(), cloudAssetsMapper, ch, logger)
-	if err != nil {
-		return err
-	}
-
-	// Generate metrics for Clouds
-	err = s.generateCloudMetrics(cloudAssetsMapper.GetClouds(), cloudAssetsMapper, ch, logger)
-	if err != nil {
-		return err
+	series := opts.newSeriesSet(ch, s.Name())
+	clusters := opts.clusterInfo(ctx, apiClient, logger)
+	items := make(map[string]int)
+	// the metrics are generated as the assets are decoded, the assets are kept only for the records
+	err := apiClient.StreamAssets(ctx, scraperParams, func(asset interface{}) error {
+		if opts.Records != nil {
+			cloudAssetsMapper.Add(asset)
+		}
+		items[assetType(asset)]++
+		opts.Debug.item(asset)
+		if err := s.generateAssetMetric(asset, cloudAssetsMapper, clusters, series); err != nil {
+			opts.Debug.drop(err.Error())
+			return err
+		}
+		return nil
+	})
+	opts.decoded(s.Name(), items)
+	// the buffered series are sent even if the response is broken, like the ones sent before the error
+	if flushErr := series.flushTraced(ctx); err == nil {
+		err = flushErr
 	}
-
-	// Generate metrics for Nodes
-	err = s.generateNodeMetrics(cloudAssetsMapper.GetNodes(), cloudAssetsMapper, ch, logger)
 	if err != nil {
 		return err
 	}
 
-	// Generate metrics for LoadBalancers
-	err = s.generateLoadBalancerMetrics(cloudAssetsMapper.GetLoadBalancers(), cloudAssetsMapper, ch, logger)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// I know that all functions repeat same code, I'll refactor it a bit later
-// TODO: move all common code to a separate function
-func (ScrapeAssets) generateDisksMetrics(disks *[]kubecost_api.CloudAssetDisk, assetsMapper *CloudAssets, ch chan<- prometheus.Metric, logger log.Logger) error {
-	if len(*disks) > 0 {
-		for _, disk := range *disks {
-			// maybe this is not the best idea to cast asset -> interface -> asset
-			// TODO: refactor this to use common interface for all cloud assets
-			labelNames, labelValues, err := assetsMapper.GetDefaultLabelsFromAssets(disk)
-			if err != nil {
-				return err
-			}
-			diskDesc := prometheus.NewDesc(
-				prometheus.BuildFQName(namespace, promDescSubsystem, "total"),
-				"Assets total cost from Kubecost Assets API",
-				labelNames, nil,
-			)
-
-			ch <- prometheus.MustNewConstMetric(
-				diskDesc, prometheus.GaugeValue, disk.TotalCost, labelValues...,
-			)
+	if opts.Records != nil {
+		start, end := opts.Window(now)
+		records := &Records{Scraper: s.Name(), Start: start, End: end, Assets: cloudAssetsMapper}
+		// the metrics are still exported, if the records couldn't be written
+		if err := opts.Records.WriteRecords(ctx, records); err != nil {
+			level.Error(logger).Log("msg", "Error writing records", "err", err)
 		}
 	}
 	return nil
 }
 
-
-
-func (ScrapeAssets) generateCloudMetrics(clouds *[]kubecost_api.CloudAssetCloud, assetsMapper *CloudAssets, ch chan<- prometheus.Metric, logger log.Logger) error {
-	if len(*clouds) > 0 {
-		for _, cloud := range *clouds {
-			// maybe this is not the best idea to cast asset -> interface -> asset
-			// TODO: refactor this to use common interface for all cloud assets
-			labelNames, labelValues, err := assetsMapper.GetDefaultLabelsFromAssets(cloud)
-			if err != nil {
-				return err
-			}
-			diskDesc := prometheus.NewDesc(
-				prometheus.BuildFQName(namespace, promDescSubsystem, "total"),
-				"Assets total cost from Kubecost Assets API",
-				labelNames, nil,
-			)
-			ch <- prometheus.MustNewConstMetric(
-				diskDesc, prometheus.GaugeValue, cloud.TotalCost, labelValues...,
-			)
-		}
+// assetType returns the Kubecost type of the asset: Node, Disk, Cloud, LoadBalancer or ClusterManagement
+func assetType(asset interface{}) string {
+	switch a := asset.(type) {
+	case kubecost_api.CloudAssetDisk:
+		return a.Type
+	case kubecost_api.CloudAssetCloud:
+		return a.Type
+	case kubecost_api.CloudAssetNode:
+		return a.Type
+	case kubecost_api.CloudAssetLoadBalancer:
+		return a.Type
+	case kubecost_api.CloudAssetClusterManagement:
+		return a.Type
 	}
-	return nil
+	return "unknown"
 }
 
-func (ScrapeAssets) generateNodeMetrics(nodes *[]kubecost_api.CloudAssetNode, assetsMapper *CloudAssets, ch chan<- prometheus.Metric, logger log.Logger) error {
-	if len(*nodes) > 0 {
-		for _, node := range *nodes {
-			// maybe this is not the best idea to cast asset -> interface -> asset
-			// TODO: refactor this to use common interface for all cloud assets
-			labelNames, labelValues, err := assetsMapper.GetDefaultLabelsFromAssets(node)
-			if err != nil {
-				return err
-			}
-			diskDesc := prometheus.NewDesc(
-				prometheus.BuildFQName(namespace, promDescSubsystem, "total"),
-				"Assets total cost from Kubecost Assets API",
-				labelNames, nil,
-			)
-			ch <- prometheus.MustNewConstMetric(
-				diskDesc, prometheus.GaugeValue, node.TotalCost, labelValues...,
-			)
-		}
+// generateAssetMetric generates the metric for any of the assets types
+func (s ScrapeAssets) generateAssetMetric(asset interface{}, assetsMapper *CloudAssets, clusters clusterInfos, series *seriesSet) error {
+	var totalCost float64
+	var window kubecost_api.Window
+	var properties *kubecost_api.AssetProperties
+	switch a := asset.(type) {
+	case kubecost_api.CloudAssetDisk:
+		totalCost, window, properties = a.TotalCost, a.Window, a.Properties
+	case kubecost_api.CloudAssetCloud:
+		totalCost, window, properties = a.TotalCost, a.Window, a.Properties
+	case kubecost_api.CloudAssetNode:
+		totalCost, window, properties = a.TotalCost, a.Window, a.Properties
+	case kubecost_api.CloudAssetLoadBalancer:
+		totalCost, window, properties = a.TotalCost, a.Window, a.Properties
+	default:
+		return nil
 	}
-	return nil
-}
-
-func (ScrapeAssets) generateLoadBalancerMetrics(nodes *[]kubecost_api.CloudAssetLoadBalancer, assetsMapper *CloudAssets, ch chan<- prometheus.Metric, logger log.Logger) error {
-	if len(*nodes) > 0 {
-		for _, node := range *nodes {
-			// maybe this is not the best idea to cast asset -> interface -> asset
-			// TODO: refactor this to use common interface for all cloud assets
-			labelNames, labelValues, err := assetsMapper.GetDefaultLabelsFromAssets(node)
-			if err != nil {
-				return err
-			}
-			diskDesc := prometheus.NewDesc(
-				prometheus.BuildFQName(namespace, promDescSubsystem, "total"),
-				"Assets total cost from Kubecost Assets API",
-				labelNames, nil,
-			)
-			ch <- prometheus.MustNewConstMetric(
-				diskDesc, prometheus.GaugeValue, node.TotalCost, labelValues...,
-			)
-		}
+	cluster := ""
+	if properties != nil {
+		cluster = properties.Cluster
 	}
-	return nil
+	return s.generateMetric(asset, totalCost, window, assetsMapper, clusters, cluster, series)
 }
 
-func (ScrapeAssets) generateClusterManagementMetrics(cm *[]kubecost_api.CloudAssetClusterManagement, assetsMapper *CloudAssets, ch chan<- prometheus.Metric, logger log.Logger) error {
-	if len(*cm) > 0 {
-		for _, c := range *cm {
-			// maybe this is not the best idea to cast asset -> interface -> asset
-			// TODO: refactor this to use common interface for all cloud assets
-			labelNames, labelValues, err := assetsMapper.GetDefaultLabelsFromAssets(c)
-			if err != nil {
-				return err
-			}
-			diskDesc := prometheus.NewDesc(
-				prometheus.BuildFQName(namespace, promDescSubsystem, "total"),
-				"Assets total cost from Kubecost Assets API",
-				labelNames, nil,
-			)
-			ch <- prometheus.MustNewConstMetric(
-				diskDesc, prometheus.GaugeValue, c.TotalCost, labelValues...,
-			)
-		}
+// generateMetric is the common part for all assets types
+// it builds the labels from the asset and sends the total cost gauge
+func (ScrapeAssets) generateMetric(asset interface{}, totalCost float64, window kubecost_api.Window, assetsMapper *CloudAssets, clusters clusterInfos, cluster string, series *seriesSet) error {
+	l := getLabelSet()
+	defer l.release()
+	if err := assetsMapper.labelsFromAsset(l, asset); err != nil {
+		return err
 	}
+	clusters.addLabels(l, cluster)
+	series.send(assetsCostName, "Assets total cost from Kubecost Assets API", totalCost, l, window)
 	return nil
 }
@@ -1 +1,249 @@
 package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// assetsFixture returns the accumulated /model/assets response with n assets,
+// the assets are of all the types, with the labels and properties of a real cluster
+func assetsFixture(n int) []byte {
+	start := time.Date(2021, 12, 14, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	window := kubecost_api.Window{Start: &start, End: &end}
+	data := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		properties := &kubecost_api.AssetProperties{
+			Category:   "Compute",
+			Provider:   "AWS",
+			Account:    "123456789012",
+			Project:    "kubecost",
+			Service:    "Kubernetes",
+			Cluster:    fmt.Sprintf("cluster-%d", i%5),
+			Name:       fmt.Sprintf("ip-10-0-%d-%d.ec2.internal", i/250, i%250),
+			ProviderID: fmt.Sprintf("i-%016x", i),
+		}
+		labels := kubecost_api.AssetLabels{
+			"kubernetes_io_arch":               "amd64",
+			"kubernetes_io_os":                 "linux",
+			"node_kubernetes_io_instance_type": "m5.xlarge",
+			"topology_kubernetes_io_region":    "us-east-1",
+			"topology_kubernetes_io_zone":      fmt.Sprintf("us-east-1%c", 'a'+i%3),
+			"team":                             fmt.Sprintf("team-%d", i%20),
+		}
+		var asset interface{}
+		switch i % 5 {
+		case 0:
+			asset = kubecost_api.CloudAssetDisk{Type: "Disk", Properties: properties, Labels: labels, Window: window, Start: start, End: end,
+				Minutes: 1440, ByteHours: 2.5e12, Bytes: 107374182400, Breakdown: &kubecost_api.Breakdown{Idle: 0.4, User: 0.6}, TotalCost: 0.32}
+		case 1:
+			asset = kubecost_api.CloudAssetCloud{Type: "Cloud", Properties: properties, Labels: labels, Window: window, Start: start, End: end,
+				Minutes: 1440, Credit: -0.01, TotalCost: 1.7}
+		case 2:
+			asset = kubecost_api.CloudAssetLoadBalancer{Type: "LoadBalancer", Properties: properties, Labels: labels, Window: window, Start: start, End: end,
+				Minutes: 1440, TotalCost: 0.6}
+		case 3:
+			asset = kubecost_api.CloudAssetClusterManagement{Type: "ClusterManagement", Properties: properties, Labels: labels, Window: window,
+				Minutes: 1440, TotalCost: 2.4}
+		default:
+			asset = kubecost_api.CloudAssetNode{Type: "Node", Properties: properties, Labels: labels, Window: window, Start: start, End: end,
+				NodeType: "m5.xlarge", CPUCoreHours: 96, RAMByteHours: 3.9e11, CPUBreakdown: &kubecost_api.Breakdown{Idle: 0.3, User: 0.5, System: 0.2},
+				RAMBreakdown: &kubecost_api.Breakdown{Idle: 0.2, User: 0.7, System: 0.1}, CPUCost: 2.3, RAMCost: 0.9, Discount: 0.1, TotalCost: 3.2}
+		}
+		data[fmt.Sprintf("AWS/123456789012/kubecost/%d", i)] = asset
+	}
+	body, err := json.Marshal(map[string]interface{}{"code": 200, "data": data})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+// fixtureServer serves the fixture on every path
+func fixtureServer(body []byte) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return server, u
+}
+
+// drain consumes the metrics like the registry does, until the channel is closed
+func drain(ch <-chan prometheus.Metric) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range ch {
+		}
+	}()
+	return &wg
+}
+
+// peakHeap samples the heap while fn runs and returns the peak growth of the heap in use
+func peakHeap(fn func()) uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapInuse
+	peak := base
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	fn()
+	close(done)
+	<-sampled
+	return peak - base
+}
+
+// benchmarkPeakHeap runs fn b.N times and reports the average peak heap
+func benchmarkPeakHeap(b *testing.B, fn func()) {
+	b.ReportAllocs()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		peak += peakHeap(fn)
+	}
+	b.ReportMetric(float64(peak)/float64(b.N)/(1<<20), "peak-heap-MB")
+}
+
+// BenchmarkScrapeAssets compares decoding the whole response to interface{} with the streaming decoder, from the connection and from the buffered response
+func BenchmarkScrapeAssets(b *testing.B) {
+	server, u := fixtureServer(assetsFixture(20000))
+	defer server.Close()
+	logger := log.NewNopLogger()
+	params := (ScrapeOptions{}).WindowParams(time.Now())
+	s := ScrapeAssets{}
+
+	b.Run("tree", func(b *testing.B) {
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			client := kubecost_api.NewApiClient(u, namespace, false)
+			assets, err := client.ListAssets(context.Background(), params)
+			if err != nil {
+				b.Fatal(err)
+			}
+			mapper := NewCloudAssets(logger)
+			if err := mapper.MapAssets(assets); err != nil {
+				b.Fatal(err)
+			}
+			series := (ScrapeOptions{}).newSeriesSet(ch, s.Name())
+			for _, disk := range *mapper.GetDisks() {
+				s.generateAssetMetric(disk, mapper, nil, series)
+			}
+			for _, cloud := range *mapper.GetClouds() {
+				s.generateAssetMetric(cloud, mapper, nil, series)
+			}
+			for _, node := range *mapper.GetNodes() {
+				s.generateAssetMetric(node, mapper, nil, series)
+			}
+			for _, lb := range *mapper.GetLoadBalancers() {
+				s.generateAssetMetric(lb, mapper, nil, series)
+			}
+			if err := series.flush(); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+
+	// the defaults of the exporter: the request group limits the concurrency, the response is decoded from the connection
+	b.Run("stream", func(b *testing.B) {
+		opts := ScrapeOptions{Requests: kubecost_api.NewRequestGroup(4)}
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			if err := s.Scrape(context.Background(), &u, nil, ch, logger, opts); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+
+	// with the cache the raw response is read first, today's window isn't cached, so every scrape requests it
+	b.Run("buffered", func(b *testing.B) {
+		cache, err := kubecost_api.NewResponseCache(kubecost_api.CacheConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		opts := ScrapeOptions{Requests: kubecost_api.NewRequestGroup(4), Cache: cache}
+		benchmarkPeakHeap(b, func() {
+			ch := make(chan prometheus.Metric)
+			wg := drain(ch)
+			if err := s.Scrape(context.Background(), &u, nil, ch, logger, opts); err != nil {
+				b.Fatal(err)
+			}
+			close(ch)
+			wg.Wait()
+		})
+	})
+}
+
+// BenchmarkGenerateAssetMetrics measures the metrics generation alone over the assets of a big cluster
+func BenchmarkGenerateAssetMetrics(b *testing.B) {
+	server, u := fixtureServer(assetsFixture(50000))
+	defer server.Close()
+	var assets []interface{}
+	client := kubecost_api.NewApiClient(u, namespace, false)
+	err := client.StreamAssets(context.Background(), nil, func(asset interface{}) error {
+		assets = append(assets, asset)
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := ScrapeAssets{}
+	mapper := NewCloudAssets(log.NewNopLogger())
+	ch := make(chan prometheus.Metric, 1024)
+	wg := drain(ch)
+	defer wg.Wait()
+	defer close(ch)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		series := (ScrapeOptions{}).newSeriesSet(ch, s.Name())
+		for _, asset := range assets {
+			if err := s.generateAssetMetric(asset, mapper, nil, series); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := series.flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
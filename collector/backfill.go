@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Backfill walks the date range day by day, and collects the scrapers metrics for every day
+// with the day end as the sample timestamp. The metric names and labels are the same as the exporter produces.
+type Backfill struct {
+	logger         log.Logger
+	apiUrl         **url.URL
+	scrapers       []Scraper
+	scrapersParams map[string][]string
+	opts           ScrapeOptions
+}
+
+// NewBackfill returns a new Backfill, the window related options are overridden for every day
+func NewBackfill(apiBaseUrl **url.URL, scrapers []Scraper, scrapersParams map[string][]string, logger log.Logger, opts ScrapeOptions) *Backfill {
+	return &Backfill{
+		logger:         logger,
+		apiUrl:         apiBaseUrl,
+		scrapers:       scrapers,
+		scrapersParams: scrapersParams,
+		opts:           opts,
+	}
+}
+
+// dayOptions returns the options for a single day, a one-day step with timestamps
+// gives us exactly one set per day with the day end timestamp
+func (b *Backfill) dayOptions(day time.Time) ScrapeOptions {
+	opts := b.opts
+	opts.From = day
+	opts.Step = 24 * time.Hour
+	opts.StepRange = 1
+	opts.StepOutput = StepOutputTimestamp
+	return opts
+}
+
+// Run scrapes every day in [from, to) and passes the metric families of every day to write as soon as the day is gathered,
+// so the memory doesn't grow with the date range.
+// The failed days don't stop the backfill, they're logged and returned as one error at the end, an error of write stops it
+func (b *Backfill) Run(ctx context.Context, from time.Time, to time.Time, write func(day time.Time, families []*dto.MetricFamily) error) error {
+	var failedDays []string
+	for day := TruncateDate(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		level.Info(b.logger).Log("msg", "Backfilling", "day", day.Format("2006-01-02"))
+		families, err := b.gatherDay(ctx, day)
+		if err != nil {
+			level.Error(b.logger).Log("msg", "Error backfilling day", "day", day.Format("2006-01-02"), "err", err)
+			failedDays = append(failedDays, day.Format("2006-01-02"))
+		}
+		if len(families) == 0 {
+			continue
+		}
+		if err := write(day, families); err != nil {
+			return fmt.Errorf("couldn't write day %s: %s", day.Format("2006-01-02"), err)
+		}
+	}
+	if len(failedDays) > 0 {
+		return fmt.Errorf("couldn't backfill days: %s", strings.Join(failedDays, ", "))
+	}
+	return nil
+}
+
+// gatherDay uses a separate registry for every day
+// because a registry doesn't allow the same series twice, even with different timestamps
+func (b *Backfill) gatherDay(ctx context.Context, day time.Time) ([]*dto.MetricFamily, error) {
+	c := &backfillDayCollector{ctx: ctx, backfill: b, opts: b.dayOptions(day)}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return nil, err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return families, err
+	}
+	return families, c.err
+}
+
+// backfillDayCollector runs all the scrapers for one day, without the exporter's own metrics
+type backfillDayCollector struct {
+	ctx      context.Context
+	backfill *Backfill
+	opts     ScrapeOptions
+	mu       sync.Mutex
+	err      error
+}
+
+// Describe implements prometheus.Collector, it's an unchecked collector.
+func (c *backfillDayCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *backfillDayCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, scraper := range c.backfill.scrapers {
+		wg.Add(1)
+		go func(scraper Scraper) {
+			defer wg.Done()
+			logger := log.With(c.backfill.logger, "scraper", scraper.Name())
+			if err := scraper.Scrape(c.ctx, c.backfill.apiUrl, c.backfill.scrapersParams[scraper.Name()], ch, logger, c.opts); err != nil {
+				c.mu.Lock()
+				c.err = fmt.Errorf("%s: %s", scraper.Name(), err)
+				c.mu.Unlock()
+			}
+		}(scraper)
+	}
+}
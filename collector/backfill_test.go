@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// backfillServer returns an allocation for the requested day, the failed day gets 500
+type backfillServer struct {
+	failDay string
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *backfillServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.queries = append(s.queries, r.URL.Query().Get("window")+" step="+r.URL.Query().Get("step")+" accumulate="+r.URL.Query().Get("accumulate"))
+	s.mu.Unlock()
+	window := strings.Split(r.URL.Query().Get("window"), ",")
+	start, err := time.ParseInLocation(rfc3339local, window[0], time.Local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start.Format("2006-01-02") == s.failDay {
+		http.Error(w, "boom", http.StatusInternalServerError)
+		return
+	}
+	end := start.AddDate(0, 0, 1)
+	fmt.Fprintf(w, `{"code":200,"data":[{"default":{"name":"default","properties":{"namespace":"default"},"window":{"start":%q,"end":%q},"totalCost":%d}}]}`,
+		start.Format(time.RFC3339), end.Format(time.RFC3339), start.Day())
+}
+
+func TestBackfillRun(t *testing.T) {
+	s := &backfillServer{failDay: "2021-12-14"}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	// the options of the exporter are replaced by a one-day step with timestamps
+	b := NewBackfill(&u, []Scraper{ScrapeAllocation{}}, nil, log.NewNopLogger(), ScrapeOptions{StepOutput: StepOutputLabel})
+
+	from := time.Date(2021, 12, 14, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 2)
+	var days []string
+	samples := make(map[string]string)
+	err := b.Run(context.Background(), from, to, func(day time.Time, families []*dto.MetricFamily) error {
+		days = append(days, day.Format("2006-01-02"))
+		for _, family := range families {
+			if family.GetName() != prometheus.BuildFQName(namespace, promDesc, "total") {
+				continue
+			}
+			for _, m := range family.Metric {
+				samples[day.Format("2006-01-02")] = fmt.Sprintf("%v@%d", m.GetGauge().GetValue(), m.GetTimestampMs())
+			}
+		}
+		return nil
+	})
+
+	// the failed day doesn't stop the backfill, it's returned at the end
+	if err == nil || err.Error() != "couldn't backfill days: 2021-12-14" {
+		t.Errorf("got error %v, want the failed day", err)
+	}
+	if want := []string{"2021-12-15"}; !reflect.DeepEqual(days, want) {
+		t.Errorf("got the written days %q, want %q", days, want)
+	}
+	// the sample of the day has the day end as the timestamp
+	dayEnd := time.Date(2021, 12, 16, 0, 0, 0, 0, time.Local)
+	if want := map[string]string{"2021-12-15": fmt.Sprintf("15@%d", dayEnd.UnixMilli())}; !reflect.DeepEqual(samples, want) {
+		t.Errorf("got the samples %q, want %q", samples, want)
+	}
+	wantQueries := []string{
+		"2021-12-14T00:00:00Z,2021-12-15T00:00:00Z step=1d accumulate=false",
+		"2021-12-15T00:00:00Z,2021-12-16T00:00:00Z step=1d accumulate=false",
+	}
+	if !reflect.DeepEqual(s.queries, wantQueries) {
+		t.Errorf("got the queries %q, want %q", s.queries, wantQueries)
+	}
+
+	// an error of write stops the backfill
+	s.failDay, s.queries = "", nil
+	err = b.Run(context.Background(), from, to, func(day time.Time, families []*dto.MetricFamily) error {
+		return fmt.Errorf("disk full")
+	})
+	if err == nil || err.Error() != "couldn't write day 2021-12-14: disk full" || len(s.queries) != 1 {
+		t.Errorf("got error %v after %d queries, want the write error after the first day", err, len(s.queries))
+	}
+}
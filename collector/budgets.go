@@ -0,0 +1,138 @@
+package collector
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	budgetAmountName = "kubecost_budget_amount"
+	budgetCostName   = "kubecost_budget_cost"
+)
+
+var (
+	budgetAmountDesc = prometheus.NewDesc(
+		budgetAmountName,
+		"The amount of the cost budget from the configuration file.",
+		[]string{"budget"}, nil,
+	)
+	budgetCostDesc = prometheus.NewDesc(
+		budgetCostName,
+		"The cost of the series counted by the budget in the scraped window.",
+		[]string{"budget"}, nil,
+	)
+)
+
+// Budget is the cost limit of a part of the cluster, e.g. of a team's namespaces. The cost is the sum of the series
+// of the metric that have all the Match labels, after the label rules. It's the cost of the scraped window,
+// so the amount is for the same window: a daily budget for the default window of one day.
+// The alerts are up to Prometheus: kubecost_budget_cost > kubecost_budget_amount
+type Budget struct {
+	Name   string  `yaml:"name"`
+	Amount float64 `yaml:"amount"`
+	// Scraper exports the budget, scrape_allocation if it's empty
+	Scraper string `yaml:"scraper,omitempty"`
+	// Metric is the name of the summed up series, the total cost of the allocations if it's empty
+	Metric string `yaml:"metric,omitempty"`
+	// Match are the label values of the counted series, all the series of the metric are counted if it's empty
+	Match map[string]string `yaml:"match,omitempty"`
+}
+
+// ScraperName returns the scraper that exports the budget
+func (b Budget) ScraperName() string {
+	if len(b.Scraper) == 0 {
+		return scrapeAllocationSubsystemName
+	}
+	return b.Scraper
+}
+
+func (b Budget) metric() string {
+	if len(b.Metric) == 0 {
+		return allocationCostName
+	}
+	return b.Metric
+}
+
+// matches returns true if the series is counted by the budget
+func (b Budget) matches(fqName string, names []string, values []string) bool {
+	if fqName != b.metric() {
+		return false
+	}
+	for name, value := range b.Match {
+		found := false
+		for i := range names {
+			if names[i] == name {
+				found = values[i] == value
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validateBudgets checks that the budget names are unique, they are the values of the budget label
+func validateBudgets(budgets []Budget) error {
+	names := make(map[string]bool, len(budgets))
+	for _, b := range budgets {
+		if len(b.Name) == 0 {
+			return fmt.Errorf("budget name is required")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("duplicate budget %q", b.Name)
+		}
+		names[b.Name] = true
+		if b.Amount < 0 {
+			return fmt.Errorf("amount of budget %q must not be negative, got %v", b.Name, b.Amount)
+		}
+	}
+	return nil
+}
+
+// budgetCosts sums up the costs of the budgets of a single scraper run
+type budgetCosts struct {
+	budgets []Budget
+	costs   []float64
+}
+
+// newBudgetCosts returns the costs of the budgets exported by the scraper, nil if there are none
+func (o ScrapeOptions) newBudgetCosts(scraper string) *budgetCosts {
+	var budgets []Budget
+	for _, b := range o.Budgets {
+		if b.ScraperName() == scraper {
+			budgets = append(budgets, b)
+		}
+	}
+	if len(budgets) == 0 {
+		return nil
+	}
+	return &budgetCosts{budgets: budgets, costs: make([]float64, len(budgets))}
+}
+
+// add counts the exported series
+func (c *budgetCosts) add(fqName string, names []string, values []string, value float64) {
+	if c == nil {
+		return
+	}
+	for i, b := range c.budgets {
+		if b.matches(fqName, names, values) {
+			c.costs[i] += value
+		}
+	}
+}
+
+// send sends the amount and the cost of every budget, the cost is 0 if no series were counted
+func (c *budgetCosts) send(ch chan<- prometheus.Metric, debug *ScrapeDebug) {
+	if c == nil {
+		return
+	}
+	for i, b := range c.budgets {
+		debug.addSeries(budgetAmountName, []string{"budget"}, []string{b.Name}, b.Amount, "")
+		debug.addSeries(budgetCostName, []string{"budget"}, []string{b.Name}, c.costs[i], "")
+		ch <- prometheus.MustNewConstMetric(budgetAmountDesc, prometheus.GaugeValue, b.Amount, b.Name)
+		ch <- prometheus.MustNewConstMetric(budgetCostDesc, prometheus.GaugeValue, c.costs[i], b.Name)
+	}
+}
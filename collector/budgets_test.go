@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBudgets(t *testing.T) {
+	series := []testSeries{
+		{name: allocationCostName, labels: []string{"namespace", "backend", "pod", "p1"}, value: 5},
+		{name: allocationCostName, labels: []string{"namespace", "backend", "pod", "p2"}, value: 1},
+		{name: allocationCostName, labels: []string{"namespace", "frontend", "pod", "p3"}, value: 2},
+		{name: "other_cost", labels: []string{"namespace", "backend", "pod", "p1"}, value: 100},
+	}
+	tests := []struct {
+		name    string
+		opts    ScrapeOptions
+		budgets []Budget
+		want    []string
+	}{
+		{
+			name: "match",
+			budgets: []Budget{
+				{Name: "backend", Amount: 10, Match: map[string]string{"namespace": "backend"}},
+				{Name: "all", Amount: 5},
+				{Name: "none", Amount: 1, Match: map[string]string{"namespace": "backend", "team": "x"}},
+				{Name: "other", Amount: 1, Metric: "other_cost"},
+				{Name: "assets", Amount: 1, Scraper: scrapeAssetsSubsystemName},
+			},
+			want: []string{
+				`kubecost_budget_amount{budget="all"} 5`,
+				`kubecost_budget_amount{budget="backend"} 10`,
+				`kubecost_budget_amount{budget="none"} 1`,
+				`kubecost_budget_amount{budget="other"} 1`,
+				`kubecost_budget_cost{budget="all"} 8`,
+				`kubecost_budget_cost{budget="backend"} 6`,
+				`kubecost_budget_cost{budget="none"} 0`,
+				`kubecost_budget_cost{budget="other"} 100`,
+			},
+		},
+		{
+			// p2 is folded, it's still counted by the budget
+			name:    "folded series",
+			opts:    ScrapeOptions{DuplicatePolicy: DuplicatePolicyFirst, TopN: map[string]TopN{"scrape_allocation": {N: 1, By: []string{"namespace"}}}},
+			budgets: []Budget{{Name: "p2", Amount: 1, Match: map[string]string{"pod": "p2"}}},
+			want:    []string{`kubecost_budget_amount{budget="p2"} 1`, `kubecost_budget_cost{budget="p2"} 1`},
+		},
+		{
+			name:    "after the label rules",
+			opts:    ScrapeOptions{LabelRules: []LabelRule{{Action: LabelRuleRename, Source: "namespace", Target: "team"}}},
+			budgets: []Budget{{Name: "backend", Amount: 1, Match: map[string]string{"team": "backend"}}},
+			want:    []string{`kubecost_budget_amount{budget="backend"} 1`, `kubecost_budget_cost{budget="backend"} 6`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Budgets = tt.budgets
+			if err := opts.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			series, err := sendSeries(t, opts, series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range series {
+				if m := seriesPattern.FindStringSubmatch(s); m != nil && (m[1] == budgetAmountName || m[1] == budgetCostName) {
+					got = append(got, s)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got budgets\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBudgets(t *testing.T) {
+	tests := []struct {
+		budgets []Budget
+		wantErr bool
+	}{
+		{budgets: []Budget{{Name: "a", Amount: 1}, {Name: "b"}}},
+		{budgets: []Budget{{Amount: 1}}, wantErr: true},
+		{budgets: []Budget{{Name: "a", Amount: 1}, {Name: "a", Amount: 2}}, wantErr: true},
+		{budgets: []Budget{{Name: "a", Amount: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateBudgets(tt.budgets); (err != nil) != tt.wantErr {
+			t.Errorf("validateBudgets(%+v) error = %v, wantErr %v", tt.budgets, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheRequestsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "cache_requests_total"),
+		"Total number of Kubecost responses looked up in the cache by result.",
+		[]string{"result"}, nil,
+	)
+	cacheEvictionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "cache_evictions_total"),
+		"Total number of cached responses evicted before they expired to fit the cache size.",
+		nil, nil,
+	)
+	cacheEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "cache_entries"),
+		"Number of cached Kubecost responses.",
+		nil, nil,
+	)
+	cacheSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "cache_size_bytes"),
+		"Size of the cached Kubecost responses.",
+		nil, nil,
+	)
+)
+
+// Verify if CacheCollector implements prometheus.Collector
+var _ prometheus.Collector = (*CacheCollector)(nil)
+
+// CacheCollector exports the response cache counters
+type CacheCollector struct {
+	cache *kubecost_api.ResponseCache
+}
+
+// NewCacheCollector returns the collector of the cache metrics
+func NewCacheCollector(cache *kubecost_api.ResponseCache) *CacheCollector {
+	return &CacheCollector{cache: cache}
+}
+
+// Describe implements prometheus.Collector.
+func (c *CacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheRequestsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheSizeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *CacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(stats.Hits), "hit")
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(stats.Misses), "miss")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Bytes))
+}
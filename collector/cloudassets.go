@@ -18,184 +18,84 @@ type CloudAssets struct {
 	cm     []kubecost_api.CloudAssetClusterManagement
 }
 
-// we can have different exportable labels for each type
-func (c *CloudAssets) getDefaultLabelsForDisk(disk kubecost_api.CloudAssetDisk) ([]string, []string, error) {
-	labels, labelsVals, err := c.getLabelsFromAsset(disk.Labels)
-	if err != nil {
-		return []string{}, []string{}, err
-	}
-
-	propertiesLabels, propertiesLabelsVals := c.getEnabledProperties(disk.Properties)
-	diskLabels := append(propertiesLabels, "type")
-	diskLabelsValues := append(propertiesLabelsVals, disk.Type)
-	// concat array of properties labels/values with actual labels/values
-	outLabels := append(diskLabels, labels...)
-	outValues := append(diskLabelsValues, labelsVals...)
-
-	return outLabels, outValues, err
-}
-
-func (c *CloudAssets) getDefaultLabelsForCloud(cloud kubecost_api.CloudAssetCloud) ([]string, []string, error) {
-	labels, labelsVals, err := c.getLabelsFromAsset(cloud.Labels)
-	if err != nil {
-		return []string{}, []string{}, err
-	}
-	// we have to create values list according to the defaultDiskLabels
-	propertiesLabels, propertiesLabelsVals := c.getEnabledProperties(cloud.Properties)
-	cloudLabels := append(propertiesLabels, "type")
-	cloudLabelsValues := append(propertiesLabelsVals, cloud.Type)
-	// concat array of properties labels/values with actual labels/values
-	outLabels := append(cloudLabels, labels...)
-	outValues := append(cloudLabelsValues, labelsVals...)
-	return outLabels, outValues, err
-}
-
-func (c *CloudAssets) getDefaultLabelsForNode(node kubecost_api.CloudAssetNode) ([]string, []string, error) {
-	labels, labelsVals, err := c.getLabelsFromAsset(node.Labels)
-	if err != nil {
-		return []string{}, []string{}, err
-	}
-	propertiesLabels, propertiesLabelsVals := c.getEnabledProperties(node.Properties)
-	cloudLabels := append(propertiesLabels, "type")
-	cloudLabelsValues := append(propertiesLabelsVals, node.Type)
-	// concat array of properties labels/values with actual labels/values
-	outLabels := append(cloudLabels, labels...)
-	outValues := append(cloudLabelsValues, labelsVals...)
-	return outLabels, outValues, err
-}
-
-func (c *CloudAssets) getDefaultLabelsForLoadBalancer(lb kubecost_api.CloudAssetLoadBalancer) ([]string, []string, error) {
-	labels, labelsVals, err := c.getLabelsFromAsset(lb.Labels)
-	if err != nil {
-		return []string{}, []string{}, err
-	}
-	// we have to create values list according to the defaultDiskLabels
-	propertiesLabels, propertiesLabelsVals := c.getEnabledProperties(lb.Properties)
-	cloudLabels := append(propertiesLabels, "type")
-	cloudLabelsValues := append(propertiesLabelsVals, lb.Type)
-	// concat array of properties labels/values with actual labels/values
-	outLabels := append(cloudLabels, labels...)
-	outValues := append(cloudLabelsValues, labelsVals...)
-	return outLabels, outValues, err
-}
-
-func (c *CloudAssets) getDefaultLabelsForClusterManagement(cm kubecost_api.CloudAssetClusterManagement) ([]string, []string, error) {
-	labels, labelsVals, err := c.getLabelsFromAsset(cm.Labels)
-	if err != nil {
+// Sets and return the default labels set for each assets
+func (c *CloudAssets) GetDefaultLabelsFromAssets(asset interface{}) ([]string, []string, error) {
+	l := getLabelSet()
+	defer l.release()
+	if err := c.labelsFromAsset(l, asset); err != nil {
 		return []string{}, []string{}, err
 	}
-	// we have to create values list according to the defaultDiskLabels
-	propertiesLabels, propertiesLabelsVals := c.getEnabledProperties(cm.Properties)
-	cloudLabels := append(propertiesLabels, "type")
-	cloudLabelsValues := append(propertiesLabelsVals, cm.Type)
-	// concat array of properties labels/values with actual labels/values
-	outLabels := append(cloudLabels, labels...)
-	outValues := append(cloudLabelsValues, labelsVals...)
-	return outLabels, outValues, err
+	return append([]string{}, l.names...), append([]string{}, l.values...), nil
 }
 
-// Sets and return the default labels set for each assets
-// TODO: refactor common code to a separate function after POC testing
-func (c *CloudAssets) GetDefaultLabelsFromAssets(asset interface{}) ([]string, []string, error) {
-	switch asset.(type) {
+// labelsFromAsset adds the labels of the asset to the set.
+// For now all the types export the same labels, but each type may have its own ones
+func (c *CloudAssets) labelsFromAsset(l *labelSet, asset interface{}) error {
+	switch a := asset.(type) {
 	case kubecost_api.CloudAssetDisk:
-		// TODO: move this to sub functions
-		disk, ok := asset.(kubecost_api.CloudAssetDisk)
-		if !ok {
-			fmt.Errorf("couldn't cast interface to CloudAssetDisk: %+v", asset)
-		}
-		return c.getDefaultLabelsForDisk(disk)
-
+		return c.addAssetLabels(l, a.Type, a.Properties, a.Labels)
 	case kubecost_api.CloudAssetCloud:
-		cloud, ok := asset.(kubecost_api.CloudAssetCloud)
-		if !ok {
-			fmt.Errorf("couldn't cast interface to CloudAssetCloud: %+v", asset)
-		}
-		return c.getDefaultLabelsForCloud(cloud)
-
+		return c.addAssetLabels(l, a.Type, a.Properties, a.Labels)
 	case kubecost_api.CloudAssetNode:
-		node, ok := asset.(kubecost_api.CloudAssetNode)
-		if !ok {
-			fmt.Errorf("couldn't cast interface to CloudAssetNode: %+v", asset)
-		}
-		return c.getDefaultLabelsForNode(node)
-
+		return c.addAssetLabels(l, a.Type, a.Properties, a.Labels)
 	case kubecost_api.CloudAssetLoadBalancer:
-		lb, ok := asset.(kubecost_api.CloudAssetLoadBalancer)
-		if !ok {
-			fmt.Errorf("couldn't cast interface to CloudAssetLoadBalancer: %+v", asset)
-		}
-		return c.getDefaultLabelsForLoadBalancer(lb)
-
+		return c.addAssetLabels(l, a.Type, a.Properties, a.Labels)
 	case kubecost_api.CloudAssetClusterManagement:
-		cm, ok := asset.(kubecost_api.CloudAssetClusterManagement)
-		if !ok {
-			fmt.Errorf("couldn't cast interface to CloudAssetClusterManagement: %+v", asset)
-		}
-		return c.getDefaultLabelsForClusterManagement(cm)
+		return c.addAssetLabels(l, a.Type, a.Properties, a.Labels)
 	}
+	return nil
+}
 
-	return []string{}, []string{}, nil
+// addAssetLabels adds the properties, the type and the Kubernetes labels of the asset
+func (c *CloudAssets) addAssetLabels(l *labelSet, assetType string, properties *kubecost_api.AssetProperties, labels kubecost_api.AssetLabels) error {
+	c.getEnabledProperties(l, properties)
+	l.add("type", assetType)
+	return c.getLabelsFromAsset(l, labels)
 }
 
 // mapping default properties from assets api to the corresponding prometheus labels
 // not all of these fields are set for assets, so we have to check all of them, to understand which labels we have to export
-func (c *CloudAssets) getEnabledProperties(properties *kubecost_api.AssetProperties) ([]string, []string) {
+func (c *CloudAssets) getEnabledProperties(l *labelSet, properties *kubecost_api.AssetProperties) {
 	// I didn't want to make a lot of if statements
 	// my other attempts to rewrite this code had failed and I didn't want to waste time
 	// there were a lot of reflect code, which is not readable and efficient
 	// TODO: refactor this after POC testing
-	var enabledPropsLabels []string
-	var enabledPropsValues []string
 	if len(properties.Category) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_category")
-		enabledPropsValues = append(enabledPropsValues, properties.Category)
+		l.add("property_category", properties.Category)
 	}
 	if len(properties.Name) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_name")
-		enabledPropsValues = append(enabledPropsValues, properties.Name)
+		l.add("property_name", properties.Name)
 	}
 	if len(properties.Cluster) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_cluster")
-		enabledPropsValues = append(enabledPropsValues, properties.Cluster)
+		l.add("property_cluster", properties.Cluster)
 	}
 	if len(properties.Service) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_service")
-		enabledPropsValues = append(enabledPropsValues, properties.Service)
+		l.add("property_service", properties.Service)
 	}
 	if len(properties.Account) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_account")
-		enabledPropsValues = append(enabledPropsValues, properties.Account)
+		l.add("property_account", properties.Account)
 	}
 	if len(properties.Project) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_project")
-		enabledPropsValues = append(enabledPropsValues, properties.Project)
+		l.add("property_project", properties.Project)
 	}
 	if len(properties.Provider) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_provider")
-		enabledPropsValues = append(enabledPropsValues, properties.Provider)
+		l.add("property_provider", properties.Provider)
 	}
 	if len(properties.ProviderID) > 0 {
-		enabledPropsLabels = append(enabledPropsLabels, "property_provider_id")
-		enabledPropsValues = append(enabledPropsValues, properties.ProviderID)
+		l.add("property_provider_id", properties.ProviderID)
 	}
-	return enabledPropsLabels, enabledPropsValues
 }
 
-// Generates two arrays, first of them is slice of labels, second one is slice of corresponding values
-// used for prometheus metric
-func (c *CloudAssets) getLabelsFromAsset(labels kubecost_api.AssetLabels) ([]string, []string, error) {
-	var outLabels []string
-	var outValues []string
+// Adds the labels of the asset to the set, "-" is replaced with "_" in the names and values
+func (c *CloudAssets) getLabelsFromAsset(l *labelSet, labels kubecost_api.AssetLabels) error {
 	for k, v := range labels {
-		outLabels = append(outLabels, strings.ReplaceAll(k, "-", "_"))
 		val, ok := v.(string)
 		if !ok {
-			return nil, nil, fmt.Errorf("couldn't process label value to string: %+v", val)
+			return fmt.Errorf("couldn't process label value to string: %+v", v)
 		}
-		outValues = append(outValues, strings.ReplaceAll(val, "-", "_"))
+		l.add(strings.ReplaceAll(k, "-", "_"), strings.ReplaceAll(val, "-", "_"))
 	}
-	return outLabels, outValues, nil
+	return nil
 }
 
 // the function that maps different resources types eg Cloud/Disk/Node to according Cloud Assets instance
@@ -346,6 +246,20 @@ func (c *CloudAssets) GetLoadBalancers() *[]kubecost_api.CloudAssetLoadBalancer
 	return &c.lb
 }
 
+// Add adds the typed asset returned by the streaming client to the according list
+func (c *CloudAssets) Add(asset interface{}) {
+	switch a := asset.(type) {
+	case kubecost_api.CloudAssetDisk:
+		c.AddDisk(a)
+	case kubecost_api.CloudAssetCloud:
+		c.AddCloud(a)
+	case kubecost_api.CloudAssetNode:
+		c.AddNode(a)
+	case kubecost_api.CloudAssetLoadBalancer:
+		c.AddLoadBalancer(a)
+	}
+}
+
 func (c *CloudAssets) AddDisk(disk kubecost_api.CloudAssetDisk) {
 	//level.Debug(c.logger).Log("AddDisk", fmt.Sprintf("%+v", disk))
 	c.disk = append(c.disk, disk)
@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Subsystem for logging.
+	scrapeClusterInfoSubsystemName = "scrape_cluster_info"
+)
+
+// clusterInfoName is named after Kubecost, the info is the same for any exporter of it
+const clusterInfoName = "kubecost_cluster_info"
+
+var clusterInfoLabelNames = []string{"cluster_id", "cluster_name", "provider", "region", "account"}
+
+var clusterInfoDesc = prometheus.NewDesc(
+	clusterInfoName,
+	"Information about the clusters known to Kubecost, the value is always 1.",
+	clusterInfoLabelNames, nil,
+)
+
+// the labels that are added to the assets and the allocations series by ScrapeOptions.ClusterLabels
+const (
+	clusterNameLabelName     = "cluster_name"
+	clusterProviderLabelName = "cluster_provider"
+	clusterRegionLabelName   = "cluster_region"
+)
+
+type ScrapeClusterInfo struct{}
+
+func (ScrapeClusterInfo) Name() string {
+	return scrapeClusterInfoSubsystemName
+}
+
+func (ScrapeClusterInfo) Help() string {
+	return "Scrapes the information about the clusters from Cluster Info API"
+}
+
+func (s ScrapeClusterInfo) Scrape(ctx context.Context, apiBaseUrl **url.URL, scraperParams []string, ch chan<- prometheus.Metric, logger log.Logger, opts ScrapeOptions) error {
+	apiClient := opts.newClient(*apiBaseUrl)
+	clusters, err := opts.clusters(ctx, apiClient)
+	if err != nil {
+		if len(clusters) == 0 {
+			return err
+		}
+		level.Warn(logger).Log("msg", "Error refreshing cluster info, the previous one is exported", "err", err)
+	}
+	opts.decoded(s.Name(), map[string]int{"cluster": len(clusters)})
+	// the info gets the window end timestamp like the cost series, e.g. for the backfill
+	start, end := opts.Window(time.Now())
+	window := kubecost_api.Window{Start: &start, End: &end}
+	for id, info := range clusters {
+		values := []string{id, info.Name, info.Provider, info.Region, info.Account}
+		opts.Debug.item(info)
+		opts.Debug.addSeries(clusterInfoName, clusterInfoLabelNames, values, 1, "")
+		ch <- opts.newConstMetric(clusterInfoDesc, 1, values, window)
+	}
+	return nil
+}
+
+// clusterInfos are the clusters by their ID
+type clusterInfos map[string]kubecost_api.ClusterInfo
+
+// addLabels adds the name, the provider and the region of the cluster, nothing is added for an unknown cluster.
+// A Kubecost label with the same name is kept, the cluster label is skipped then, as the series can't have the label twice
+func (c clusterInfos) addLabels(l *labelSet, cluster string) {
+	info, ok := c[cluster]
+	if !ok {
+		return
+	}
+	for _, label := range []struct{ name, value string }{
+		{clusterNameLabelName, info.Name},
+		{clusterProviderLabelName, info.Provider},
+		{clusterRegionLabelName, info.Region},
+	} {
+		if len(label.value) > 0 && !l.has(label.name) {
+			l.add(label.name, label.value)
+		}
+	}
+}
+
+// fetchClusterInfos requests all the clusters of a federated Kubecost,
+// the older versions don't have /model/clusterInfoMap, so only the local cluster is returned for them
+func fetchClusterInfos(ctx context.Context, apiClient *kubecost_api.Client) (clusterInfos, error) {
+	clusters, mapErr := apiClient.GetClusterInfoMap(ctx)
+	if mapErr == nil && len(clusters) > 0 {
+		return clusters, nil
+	}
+	info, err := apiClient.GetClusterInfo(ctx)
+	if err != nil {
+		if mapErr != nil {
+			return nil, mapErr
+		}
+		return nil, err
+	}
+	return clusterInfos{info.ID: *info}, nil
+}
+
+// ClusterInfoCache keeps the clusters of every Kubecost instance between the scrapes,
+// they rarely change, so they are requested once per the refresh interval and not for every scrape
+type ClusterInfoCache struct {
+	refresh time.Duration
+
+	// mu guards only the map, every entry has its own lock for the fetch
+	mu      sync.Mutex
+	entries map[string]*clusterInfoEntry
+}
+
+type clusterInfoEntry struct {
+	// mu is held while the clusters are fetched, the concurrent scrapers of the same Kubecost wait for it,
+	// the scrapers of the other instances don't
+	mu        sync.Mutex
+	clusters  clusterInfos
+	fetchedAt time.Time
+}
+
+// NewClusterInfoCache returns the cache that requests the clusters again after the refresh interval
+func NewClusterInfoCache(refresh time.Duration) *ClusterInfoCache {
+	return &ClusterInfoCache{refresh: refresh, entries: make(map[string]*clusterInfoEntry)}
+}
+
+// entry returns the entry of the Kubecost instance, the probed targets with the same URL have their own entries
+func (c *ClusterInfoCache) entry(apiClient *kubecost_api.Client) *clusterInfoEntry {
+	key := apiClient.Target + " " + apiClient.BaseURL.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &clusterInfoEntry{}
+		c.entries[key] = entry
+	}
+	return entry
+}
+
+// get returns the clusters of the client's Kubecost instance. If they couldn't be refreshed,
+// the previous ones are returned with the error
+func (c *ClusterInfoCache) get(ctx context.Context, apiClient *kubecost_api.Client) (clusterInfos, error) {
+	entry := c.entry(apiClient)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.clusters != nil && time.Since(entry.fetchedAt) < c.refresh {
+		return entry.clusters, nil
+	}
+	clusters, err := fetchClusterInfos(ctx, apiClient)
+	if err != nil {
+		return entry.clusters, err
+	}
+	entry.clusters, entry.fetchedAt = clusters, time.Now()
+	return clusters, nil
+}
+
+// clusters returns the cached clusters, or requests them if there is no cache
+func (o ScrapeOptions) clusters(ctx context.Context, apiClient *kubecost_api.Client) (clusterInfos, error) {
+	if o.ClusterInfo == nil {
+		return fetchClusterInfos(ctx, apiClient)
+	}
+	return o.ClusterInfo.get(ctx, apiClient)
+}
+
+// clusterInfo returns the clusters for the labels of the series, nil if the cluster labels are disabled.
+// The labels are optional, so the series are still exported if the clusters couldn't be fetched, just without them
+func (o ScrapeOptions) clusterInfo(ctx context.Context, apiClient *kubecost_api.Client, logger log.Logger) clusterInfos {
+	if !o.ClusterLabels {
+		return nil
+	}
+	clusters, err := o.clusters(ctx, apiClient)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error fetching cluster info for the cluster labels", "err", err)
+	}
+	return clusters
+}
@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestClusterInfosAddLabels(t *testing.T) {
+	clusters := clusterInfos{"cluster-one": {ID: "cluster-one", Name: "Production", Provider: "AWS", Region: "us-east-1"}}
+	allocation := kubecost_api.Allocation{
+		Name: "kubecost",
+		Properties: &kubecost_api.AllocationProperties{
+			Cluster:   "cluster-one",
+			Namespace: "kubecost",
+			// the Kubecost label is kept, the cluster_name of the cluster info is skipped
+			Labels: kubecost_api.AllocationLabels{"cluster_name": "prod"},
+		},
+		TotalCost: 1,
+	}
+	got := gatherSeries(t, func(ch chan<- prometheus.Metric) {
+		series := (ScrapeOptions{}).newSeriesSet(ch, scrapeAllocationSubsystemName)
+		if err := (ScrapeAllocation{}).generateMetric(allocation, clusters, series); err != nil {
+			t.Fatal(err)
+		}
+		if err := series.flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := []string{`assets_cost_cluster_allocation_total{cluster_name="prod",cluster_provider="AWS",cluster_region="us-east-1",property_cluster="cluster-one",property_namespace="kubecost"} 1`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// nothing is added for an unknown cluster
+	l := getLabelSet()
+	defer l.release()
+	clusters.addLabels(l, "cluster-two")
+	if l.Len() != 0 {
+		t.Errorf("got the labels %v for an unknown cluster", l.names)
+	}
+}
+
+// clusterInfoServer serves the clusters of a Kubecost instance and counts the requests of them
+type clusterInfoServer struct {
+	mu       sync.Mutex
+	requests int
+	fail     bool
+	// release blocks the responses until it's closed, nil doesn't block
+	release chan struct{}
+}
+
+func (s *clusterInfoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	fail, release := s.fail, s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	if fail {
+		http.Error(w, "boom", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"code":200,"data":{"cluster-one":{"id":"cluster-one","name":"Production"}}}`))
+}
+
+func newClusterInfoClient(t *testing.T, s *clusterInfoServer) *kubecost_api.Client {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return kubecost_api.NewApiClient(u, "test", false)
+}
+
+func TestClusterInfoCacheRefresh(t *testing.T) {
+	s := &clusterInfoServer{}
+	client := newClusterInfoClient(t, s)
+	cache := NewClusterInfoCache(time.Hour)
+	for i := 0; i < 2; i++ {
+		clusters, err := cache.get(context.Background(), client)
+		if err != nil || clusters["cluster-one"].Name != "Production" {
+			t.Fatalf("got %v, %v", clusters, err)
+		}
+	}
+	if s.requests != 1 {
+		t.Errorf("got %d requests within the refresh interval, want 1", s.requests)
+	}
+
+	// the previous clusters are returned with the error of the refresh
+	cache.refresh = 0
+	s.fail = true
+	clusters, err := cache.get(context.Background(), client)
+	if err == nil || clusters["cluster-one"].Name != "Production" {
+		t.Errorf("got %v, %v, want the previous clusters with the error", clusters, err)
+	}
+}
+
+func TestClusterInfoCacheLocksPerInstance(t *testing.T) {
+	slow := &clusterInfoServer{release: make(chan struct{})}
+	slowClient := newClusterInfoClient(t, slow)
+	fast := &clusterInfoServer{}
+	fastClient := newClusterInfoClient(t, fast)
+	cache := NewClusterInfoCache(time.Hour)
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := cache.get(context.Background(), slowClient)
+		slowDone <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		slow.mu.Lock()
+		requested := slow.requests > 0
+		slow.mu.Unlock()
+		if requested {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the request of the slow instance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the fetch of the other instance doesn't wait for the slow one
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := cache.get(context.Background(), fastClient)
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch of another instance waits for the slow one")
+	}
+	close(slow.release)
+	if err := <-slowDone; err != nil {
+		t.Error(err)
+	}
+}
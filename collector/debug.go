@@ -0,0 +1,128 @@
+package collector
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+)
+
+// ScrapeDebug records what a single run of a scraper did with every decoded item, for /debug/scrape.
+// The scraper sends the series as it decodes the items, so the series are recorded for the item that is decoded last
+type ScrapeDebug struct {
+	// Kubecost records the requests and the items skipped by the client
+	Kubecost kubecost_api.Debug
+	// MaxItems limits the recorded items, the others are only counted
+	MaxItems int
+
+	mu      sync.Mutex
+	items   []*DebugItem
+	count   int
+	current *DebugItem
+	series  map[string]*DebugSeries
+}
+
+// DebugItem is a decoded item with the series generated from it
+type DebugItem struct {
+	Item   interface{}    `json:"item"`
+	Series []*DebugSeries `json:"series,omitempty"`
+	// Dropped is the reason the item wasn't exported, it's empty for the exported ones
+	Dropped string `json:"dropped,omitempty"`
+}
+
+// DebugSeries is a series as it was generated from the item
+type DebugSeries struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+	// Note is what happened to the series after it was generated, e.g. it was merged with a duplicate
+	Note string `json:"note,omitempty"`
+}
+
+// Items returns the recorded items and the number of all the decoded items
+func (d *ScrapeDebug) Items() ([]DebugItem, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	items := make([]DebugItem, len(d.items))
+	for i, item := range d.items {
+		items[i] = *item
+	}
+	return items, d.count
+}
+
+// item starts the next decoded item
+func (d *ScrapeDebug) item(item interface{}) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count++
+	d.current = nil
+	if len(d.items) >= d.MaxItems {
+		return
+	}
+	d.current = &DebugItem{Item: item}
+	d.items = append(d.items, d.current)
+}
+
+// drop marks the current item as dropped
+func (d *ScrapeDebug) drop(reason string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current != nil {
+		d.current.Dropped = reason
+	}
+}
+
+// addSeries adds the series to the current item
+func (d *ScrapeDebug) addSeries(fqName string, names []string, values []string, value float64, note string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current == nil {
+		return
+	}
+	series := &DebugSeries{Name: fqName, Labels: make(map[string]string, len(names)), Value: value, Note: note}
+	for i, name := range names {
+		series.Labels[name] = values[i]
+	}
+	d.current.Series = append(d.current.Series, series)
+	if d.series == nil {
+		d.series = make(map[string]*DebugSeries)
+	}
+	// the first one is noted if there are duplicates, the others have their own note already
+	key := debugKey(fqName, names, values)
+	if _, ok := d.series[key]; !ok {
+		d.series[key] = series
+	}
+}
+
+// folded notes that the series was folded into the "__other__" series by the top-n limit
+func (d *ScrapeDebug) folded(fqName string, names []string, values []string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if series, ok := d.series[debugKey(fqName, names, values)]; ok {
+		series.Note = "folded into the " + otherSeriesValue + " series by the top-n limit"
+	}
+}
+
+func debugKey(fqName string, names []string, values []string) string {
+	var b strings.Builder
+	b.WriteString(fqName)
+	for i, name := range names {
+		b.WriteByte(separatorByte)
+		b.WriteString(name)
+		b.WriteByte(separatorByte)
+		b.WriteString(values[i])
+	}
+	return b.String()
+}
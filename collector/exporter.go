@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/artemlive/kubecost_exporter/tracing"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
@@ -43,12 +44,11 @@ type Exporter struct {
 	scrapers       []Scraper
 	scrapersParams map[string][]string
 	metrics        Metrics
-	skipTLSVerify  bool
-	offset		   int64
+	opts           ScrapeOptions
 }
 
 // New returns a new KubeCost exporter for the provided apiDomain.
-func New(ctx context.Context, apiBaseUrl **url.URL, metrics Metrics, scrapers []Scraper, scrapersParams map[string][]string, logger log.Logger, skipTLSVerify bool, offset int64) *Exporter {
+func New(ctx context.Context, apiBaseUrl **url.URL, metrics Metrics, scrapers []Scraper, scrapersParams map[string][]string, logger log.Logger, opts ScrapeOptions) *Exporter {
 	return &Exporter{
 		ctx:            ctx,
 		logger:         logger,
@@ -56,8 +56,7 @@ func New(ctx context.Context, apiBaseUrl **url.URL, metrics Metrics, scrapers []
 		scrapers:       scrapers,
 		scrapersParams: scrapersParams,
 		metrics:        metrics,
-		skipTLSVerify:  skipTLSVerify,
-		offset: offset,
+		opts:           opts,
 	}
 }
 
@@ -66,6 +65,8 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.metrics.TotalScrapes.Desc()
 	ch <- e.metrics.Error.Desc()
 	e.metrics.ScrapeErrors.Describe(ch)
+	e.metrics.DuplicateSeries.Describe(ch)
+	e.metrics.FoldedSeries.Describe(ch)
 	ch <- e.metrics.KubeCostUp.Desc()
 }
 
@@ -76,6 +77,8 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	ch <- e.metrics.TotalScrapes
 	ch <- e.metrics.Error
 	e.metrics.ScrapeErrors.Collect(ch)
+	e.metrics.DuplicateSeries.Collect(ch)
+	e.metrics.FoldedSeries.Collect(ch)
 	ch <- e.metrics.KubeCostUp
 }
 
@@ -97,11 +100,20 @@ func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 			defer wg.Done()
 			label := "collect." + scraper.Name()
 			scrapeTime := time.Now()
-			if err := scraper.Scrape(ctx, e.apiUrl, e.scrapersParams[scraper.Name()], ch, log.With(e.logger, "scraper", scraper.Name()), e.skipTLSVerify, e.offset); err != nil {
+			// the span is a child of the /metrics request, the Kubecost requests of the scraper are its children
+			ctx, span := tracing.Start(ctx, "scrape "+scraper.Name(), tracing.SpanKindInternal, tracing.String("scraper", scraper.Name()))
+			defer span.End()
+			opts := e.opts
+			opts.duplicates = e.metrics.DuplicateSeries.WithLabelValues(label)
+			opts.folded = e.metrics.FoldedSeries.WithLabelValues(label)
+			err := scraper.Scrape(ctx, e.apiUrl, e.scrapersParams[scraper.Name()], ch, log.With(e.logger, "scraper", scraper.Name()), opts)
+			span.SetError(err)
+			if err != nil {
 				level.Error(e.logger).Log("msg", "Error from scraper", "scraper", scraper.Name(), "err", err)
 				e.metrics.ScrapeErrors.WithLabelValues(label).Inc()
 				e.metrics.Error.Set(1)
 			}
+			e.opts.Status.finished(scraper.Name(), scrapeTime, err)
 			ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, time.Since(scrapeTime).Seconds(), label)
 		}(scraper)
 	}
@@ -113,6 +125,10 @@ type Metrics struct {
 	ScrapeErrors *prometheus.CounterVec
 	Error        prometheus.Gauge
 	KubeCostUp   prometheus.Gauge
+	// DuplicateSeries counts the series that were the same as another series of the scrape after the labels processing
+	DuplicateSeries *prometheus.CounterVec
+	// FoldedSeries is the number of the series folded into the "__other__" series by the top-n limit in the last scrape
+	FoldedSeries *prometheus.GaugeVec
 }
 
 // NewMetrics creates new Metrics instance.
@@ -142,5 +158,17 @@ func NewMetrics() Metrics {
 			Name:      "up",
 			Help:      "Whether the KubeCost server is up.",
 		}),
+		DuplicateSeries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "duplicate_series_total",
+			Help:      "Total number of series that were the same as another series of the scrape after the labels processing, they're merged according to the duplicate series policy.",
+		}, []string{"collector"}),
+		FoldedSeries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "folded_series",
+			Help:      "Number of series that were folded into the __other__ series by the top-n limit in the last scrape.",
+		}, []string{"collector"}),
 	}
 }
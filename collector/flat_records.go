@@ -0,0 +1,218 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+)
+
+// RecordsSchemaVersion is increased on every incompatible change of the records columns
+const RecordsSchemaVersion = 1
+
+// kinds of the records
+const (
+	RecordKindAllocations = "allocations"
+	RecordKindAssets      = "assets"
+)
+
+// unknownCluster is used for the partition of items without the cluster property
+const unknownCluster = "unknown"
+
+// AllocationRecord is the flat representation of kubecost_api.Allocation with the stable column set
+type AllocationRecord struct {
+	WindowStart          time.Time         `json:"window_start" parquet:"window_start,timestamp(millisecond)"`
+	WindowEnd            time.Time         `json:"window_end" parquet:"window_end,timestamp(millisecond)"`
+	Cluster              string            `json:"cluster" parquet:"cluster"`
+	Name                 string            `json:"name" parquet:"name"`
+	Namespace            string            `json:"namespace" parquet:"namespace"`
+	Node                 string            `json:"node" parquet:"node"`
+	Controller           string            `json:"controller" parquet:"controller"`
+	ControllerKind       string            `json:"controller_kind" parquet:"controller_kind"`
+	Pod                  string            `json:"pod" parquet:"pod"`
+	Container            string            `json:"container" parquet:"container"`
+	ProviderID           string            `json:"provider_id" parquet:"provider_id"`
+	Labels               map[string]string `json:"labels" parquet:"labels"`
+	CPUCoreHours         float64           `json:"cpu_core_hours" parquet:"cpu_core_hours"`
+	CPUCost              float64           `json:"cpu_cost" parquet:"cpu_cost"`
+	GPUHours             float64           `json:"gpu_hours" parquet:"gpu_hours"`
+	GPUCost              float64           `json:"gpu_cost" parquet:"gpu_cost"`
+	RAMByteHours         float64           `json:"ram_byte_hours" parquet:"ram_byte_hours"`
+	RAMCost              float64           `json:"ram_cost" parquet:"ram_cost"`
+	PVCost               float64           `json:"pv_cost" parquet:"pv_cost"`
+	NetworkTransferBytes float64           `json:"network_transfer_bytes" parquet:"network_transfer_bytes"`
+	NetworkReceiveBytes  float64           `json:"network_receive_bytes" parquet:"network_receive_bytes"`
+	NetworkCost          float64           `json:"network_cost" parquet:"network_cost"`
+	LoadBalancerCost     float64           `json:"load_balancer_cost" parquet:"load_balancer_cost"`
+	SharedCost           float64           `json:"shared_cost" parquet:"shared_cost"`
+	ExternalCost         float64           `json:"external_cost" parquet:"external_cost"`
+	TotalCost            float64           `json:"total_cost" parquet:"total_cost"`
+}
+
+// AssetRecord is the flat representation of all the asset types with the stable column set,
+// the columns that don't make sense for the asset type are zero, e.g. bytes for a Node
+type AssetRecord struct {
+	WindowStart time.Time         `json:"window_start" parquet:"window_start,timestamp(millisecond)"`
+	WindowEnd   time.Time         `json:"window_end" parquet:"window_end,timestamp(millisecond)"`
+	Type        string            `json:"type" parquet:"type"`
+	Cluster     string            `json:"cluster" parquet:"cluster"`
+	Name        string            `json:"name" parquet:"name"`
+	Category    string            `json:"category" parquet:"category"`
+	Provider    string            `json:"provider" parquet:"provider"`
+	ProviderID  string            `json:"provider_id" parquet:"provider_id"`
+	Account     string            `json:"account" parquet:"account"`
+	Project     string            `json:"project" parquet:"project"`
+	Service     string            `json:"service" parquet:"service"`
+	Labels      map[string]string `json:"labels" parquet:"labels"`
+	NodeType    string            `json:"node_type" parquet:"node_type"`
+	Minutes     float64           `json:"minutes" parquet:"minutes"`
+	Bytes       int64             `json:"bytes" parquet:"bytes"`
+	CPUCost     float64           `json:"cpu_cost" parquet:"cpu_cost"`
+	RAMCost     float64           `json:"ram_cost" parquet:"ram_cost"`
+	GPUCost     float64           `json:"gpu_cost" parquet:"gpu_cost"`
+	Adjustment  float64           `json:"adjustment" parquet:"adjustment"`
+	Credit      float64           `json:"credit" parquet:"credit"`
+	TotalCost   float64           `json:"total_cost" parquet:"total_cost"`
+}
+
+// Partition returns the date and the cluster the record belongs to
+func (r AllocationRecord) Partition() (string, string) {
+	return partition(r.WindowStart, r.Cluster)
+}
+
+// Partition returns the date and the cluster the record belongs to
+func (r AssetRecord) Partition() (string, string) {
+	return partition(r.WindowStart, r.Cluster)
+}
+
+func partition(start time.Time, cluster string) (string, string) {
+	if len(cluster) == 0 {
+		cluster = unknownCluster
+	}
+	return start.UTC().Format("2006-01-02"), cluster
+}
+
+// windowTimes returns the item window, the scraped window is used if the item doesn't have it
+func windowTimes(window kubecost_api.Window, records *Records) (time.Time, time.Time) {
+	start, end := records.Start, records.End
+	if window.Start != nil {
+		start = *window.Start
+	}
+	if window.End != nil {
+		end = *window.End
+	}
+	return start.UTC(), end.UTC()
+}
+
+// NewAllocationRecords flattens the allocations of the scrape
+func NewAllocationRecords(records *Records) []AllocationRecord {
+	result := make([]AllocationRecord, 0, len(records.Allocations))
+	for _, a := range records.Allocations {
+		start, end := windowTimes(a.Window, records)
+		r := AllocationRecord{
+			WindowStart:          start,
+			WindowEnd:            end,
+			Name:                 a.Name,
+			CPUCoreHours:         a.CPUCoreHours,
+			CPUCost:              a.CPUCost + a.CPUCostAdjustment,
+			GPUHours:             a.GPUHours,
+			GPUCost:              a.GPUCost + a.GPUCostAdjustment,
+			RAMByteHours:         a.RAMByteHours,
+			RAMCost:              a.RAMCost + a.RAMCostAdjustment,
+			PVCost:               a.PVCost + a.PVCostAdjustment,
+			NetworkTransferBytes: a.NetworkTransferBytes,
+			NetworkReceiveBytes:  a.NetworkReceiveBytes,
+			NetworkCost:          a.NetworkCost + a.NetworkCostAdjustment,
+			LoadBalancerCost:     a.LoadBalancerCost + a.LoadBalancerCostAdjustment,
+			SharedCost:           a.SharedCost,
+			ExternalCost:         a.ExternalCost,
+			TotalCost:            a.TotalCost,
+		}
+		if p := a.Properties; p != nil {
+			r.Cluster = p.Cluster
+			r.Namespace = p.Namespace
+			r.Node = p.Node
+			r.Controller = p.Controller
+			r.ControllerKind = p.ControllerKind
+			r.Pod = p.Pod
+			r.Container = p.Container
+			r.ProviderID = p.ProviderID
+			r.Labels = p.Labels
+		}
+		if r.Labels == nil {
+			r.Labels = map[string]string{}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// newAssetRecord fills the common asset columns
+func newAssetRecord(assetType string, properties *kubecost_api.AssetProperties, labels kubecost_api.AssetLabels, window kubecost_api.Window, records *Records) AssetRecord {
+	start, end := windowTimes(window, records)
+	r := AssetRecord{
+		WindowStart: start,
+		WindowEnd:   end,
+		Type:        assetType,
+		Labels:      map[string]string{},
+	}
+	if properties != nil {
+		r.Cluster = properties.Cluster
+		r.Name = properties.Name
+		r.Category = properties.Category
+		r.Provider = properties.Provider
+		r.ProviderID = properties.ProviderID
+		r.Account = properties.Account
+		r.Project = properties.Project
+		r.Service = properties.Service
+	}
+	for k, v := range labels {
+		if value, ok := v.(string); ok {
+			r.Labels[k] = value
+		}
+	}
+	return r
+}
+
+// NewAssetRecords flattens the assets of all types of the scrape
+func NewAssetRecords(records *Records) []AssetRecord {
+	if records.Assets == nil {
+		return nil
+	}
+	var result []AssetRecord
+	for _, a := range *records.Assets.GetNodes() {
+		r := newAssetRecord(a.Type, a.Properties, a.Labels, a.Window, records)
+		r.NodeType = a.NodeType
+		r.Minutes = float64(a.End.Sub(a.Start) / time.Minute)
+		r.CPUCost = a.CPUCost
+		r.RAMCost = a.RAMCost
+		r.GPUCost = a.GPUCost
+		r.Adjustment = a.Adjustment
+		r.Credit = a.Credit
+		r.TotalCost = a.TotalCost
+		result = append(result, r)
+	}
+	for _, a := range *records.Assets.GetDisks() {
+		r := newAssetRecord(a.Type, a.Properties, a.Labels, a.Window, records)
+		r.Minutes = float64(a.Minutes)
+		r.Bytes = a.Bytes
+		r.Adjustment = float64(a.Adjustment)
+		r.TotalCost = a.TotalCost
+		result = append(result, r)
+	}
+	for _, a := range *records.Assets.GetClouds() {
+		r := newAssetRecord(a.Type, a.Properties, a.Labels, a.Window, records)
+		r.Minutes = a.Minutes
+		r.Adjustment = a.Adjustment
+		r.Credit = a.Credit
+		r.TotalCost = a.TotalCost
+		result = append(result, r)
+	}
+	for _, a := range *records.Assets.GetLoadBalancers() {
+		r := newAssetRecord(a.Type, a.Properties, a.Labels, a.Window, records)
+		r.Minutes = float64(a.Minutes)
+		r.Adjustment = a.Adjustment
+		r.TotalCost = a.TotalCost
+		result = append(result, r)
+	}
+	return result
+}
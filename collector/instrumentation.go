@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Verify if Instrumentation implements the interfaces
+var (
+	_ prometheus.Collector         = (*Instrumentation)(nil)
+	_ kubecost_api.RequestObserver = (*Instrumentation)(nil)
+)
+
+// Instrumentation are the exporter's own metrics about Kubecost: the requests and the decoded items.
+// They're shared by /metrics and the sinks, so they're registered once, unlike the metrics of the scrape registry
+type Instrumentation struct {
+	requestDuration *prometheus.HistogramVec
+	responseSize    *prometheus.HistogramVec
+	decodedItems    *prometheus.CounterVec
+}
+
+// NewInstrumentation returns the metrics, they're exported once they're registered
+func NewInstrumentation() *Instrumentation {
+	return &Instrumentation{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "kubecost_request_duration_seconds",
+			Help:      "Duration of the Kubecost requests until the response is read, including the decoding of the streamed responses, by the endpoint and the status code (\"error\" if there was no response).",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"endpoint", "code"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "kubecost_response_size_bytes",
+			Help:      "Decompressed size of the Kubecost responses, by the endpoint and the status code.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		}, []string{"endpoint", "code"}),
+		decodedItems: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "kubecost_decoded_items_total",
+			Help:      "Total number of the items decoded from the Kubecost responses, by the scraper and the item type: the asset type, allocation or cluster.",
+		}, []string{"scraper", "type"}),
+	}
+}
+
+// ObserveRequest implements kubecost_api.RequestObserver.
+func (i *Instrumentation) ObserveRequest(endpoint string, code int, duration time.Duration) {
+	i.requestDuration.WithLabelValues(endpoint, statusCode(code)).Observe(duration.Seconds())
+}
+
+// ObserveResponseSize implements kubecost_api.RequestObserver.
+func (i *Instrumentation) ObserveResponseSize(endpoint string, code int, bytes int64) {
+	i.responseSize.WithLabelValues(endpoint, statusCode(code)).Observe(float64(bytes))
+}
+
+func statusCode(code int) string {
+	if code == 0 {
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+// Describe implements prometheus.Collector.
+func (i *Instrumentation) Describe(ch chan<- *prometheus.Desc) {
+	i.requestDuration.Describe(ch)
+	i.responseSize.Describe(ch)
+	i.decodedItems.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (i *Instrumentation) Collect(ch chan<- prometheus.Metric) {
+	i.requestDuration.Collect(ch)
+	i.responseSize.Collect(ch)
+	i.decodedItems.Collect(ch)
+}
+
+// decoded records the numbers of the decoded items of a scraper run, for the counters and the status page
+func (o ScrapeOptions) decoded(scraper string, items map[string]int) {
+	o.Status.setItems(scraper, items)
+	if o.Instrumentation == nil {
+		return
+	}
+	for itemType, n := range items {
+		o.Instrumentation.decodedItems.WithLabelValues(scraper, itemType).Add(float64(n))
+	}
+}
@@ -0,0 +1,127 @@
+package collector
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// LabelRuleReplace sets the target label to the replacement, if the source label matches the regex
+	LabelRuleReplace = "replace"
+	// LabelRuleRename moves the value of the source label to the target label, if it matches the regex
+	LabelRuleRename = "rename"
+	// LabelRuleDrop removes the source label, if it matches the regex
+	LabelRuleDrop = "drop"
+)
+
+// Regexp is the regex of a label rule, it's anchored at both ends like the Prometheus relabeling regex
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp compiles the anchored regex
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: re, original: s}, err
+}
+
+// UnmarshalYAML compiles the regex of the configuration file
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*re = r
+	return nil
+}
+
+// MarshalYAML returns the regex the way it's written in the configuration file
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	if re.Regexp == nil {
+		return nil, nil
+	}
+	return re.original, nil
+}
+
+// LabelRule changes the labels of the assets and the allocations series before they're exported,
+// e.g. to rename a Kubecost label to the name the dashboards expect, or to drop a label with too many values.
+// The series that become the same after the rules are resolved by the duplicate policy
+type LabelRule struct {
+	// Action is LabelRuleReplace, LabelRuleRename or LabelRuleDrop, LabelRuleReplace if it's empty
+	Action string `yaml:"action,omitempty"`
+	Source string `yaml:"source"`
+	// Regex is matched against the whole value of the source label, the rule applies to any value if it's not set.
+	// The rules don't apply to the series without the source label
+	Regex Regexp `yaml:"regex,omitempty"`
+	// Target is the label set by the replace and the rename actions
+	Target string `yaml:"target,omitempty"`
+	// Replacement is the value of the target label for the replace action, the regex groups are expanded: $1.
+	// It's the whole value of the source label if it's empty, the target label is removed if the result is empty
+	Replacement string `yaml:"replacement,omitempty"`
+}
+
+// validate checks that the rule could be applied
+func (r LabelRule) validate() error {
+	if !model.LabelName(r.Source).IsValid() {
+		return fmt.Errorf("invalid source label %q", r.Source)
+	}
+	switch r.Action {
+	case "", LabelRuleReplace, LabelRuleRename:
+		if !model.LabelName(r.Target).IsValid() {
+			return fmt.Errorf("invalid target label %q", r.Target)
+		}
+		if r.Target == stepLabelName || r.Target == topNLabelName {
+			return fmt.Errorf("target label %q is set by the exporter", r.Target)
+		}
+	case LabelRuleDrop:
+		if len(r.Target) > 0 || len(r.Replacement) > 0 {
+			return fmt.Errorf("the drop action has neither target nor replacement")
+		}
+	default:
+		return fmt.Errorf("unknown label rule action %q", r.Action)
+	}
+	return nil
+}
+
+// apply changes the labels of the set, the set isn't sorted afterwards
+func (r LabelRule) apply(l *labelSet) {
+	i := l.index(r.Source)
+	if i < 0 {
+		return
+	}
+	value := l.values[i]
+	var match []int
+	if r.Regex.Regexp != nil {
+		if match = r.Regex.FindStringSubmatchIndex(value); match == nil {
+			return
+		}
+	}
+	switch r.Action {
+	case LabelRuleDrop:
+		l.remove(i)
+	case LabelRuleRename:
+		l.remove(i)
+		l.set(r.Target, value)
+	default:
+		if len(r.Replacement) > 0 && match != nil {
+			value = string(r.Regex.ExpandString(nil, r.Replacement, value, match))
+		} else if len(r.Replacement) > 0 {
+			value = r.Replacement
+		}
+		l.set(r.Target, value)
+	}
+}
+
+// applyLabelRules applies the rules of the options in their order
+func (o ScrapeOptions) applyLabelRules(l *labelSet) {
+	for _, rule := range o.LabelRules {
+		rule.apply(l)
+	}
+}
@@ -0,0 +1,122 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustRegexp(t *testing.T, s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
+
+func TestLabelRules(t *testing.T) {
+	series := []testSeries{
+		{name: "cost", labels: []string{"namespace", "team-backend", "app_name", "api", "pod_template_hash", "abc"}, value: 1},
+		{name: "cost", labels: []string{"namespace", "kube-system", "app_name", "dns", "pod_template_hash", "def"}, value: 2},
+	}
+	tests := []struct {
+		name    string
+		rules   []LabelRule
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "rename",
+			rules: []LabelRule{{Action: LabelRuleRename, Source: "app_name", Target: "app"}},
+			want: []string{
+				`cost{app="api",namespace="team-backend",pod_template_hash="abc"} 1`,
+				`cost{app="dns",namespace="kube-system",pod_template_hash="def"} 2`,
+			},
+		},
+		{
+			name:  "rename of the matching values",
+			rules: []LabelRule{{Action: LabelRuleRename, Source: "app_name", Target: "app", Regex: mustRegexp(t, "a.*")}},
+			want: []string{
+				`cost{app="api",namespace="team-backend",pod_template_hash="abc"} 1`,
+				`cost{app_name="dns",namespace="kube-system",pod_template_hash="def"} 2`,
+			},
+		},
+		{
+			name: "replace with the regex groups",
+			rules: []LabelRule{
+				{Source: "namespace", Regex: mustRegexp(t, "team-(.*)"), Target: "team", Replacement: "$1"},
+				{Action: LabelRuleReplace, Source: "namespace", Regex: mustRegexp(t, "kube-.*"), Target: "team", Replacement: "platform"},
+			},
+			want: []string{
+				`cost{app_name="api",namespace="team-backend",pod_template_hash="abc",team="backend"} 1`,
+				`cost{app_name="dns",namespace="kube-system",pod_template_hash="def",team="platform"} 2`,
+			},
+		},
+		{
+			name:  "replace with the whole value overwrites the target",
+			rules: []LabelRule{{Source: "namespace", Target: "app_name"}},
+			want: []string{
+				`cost{app_name="kube-system",namespace="kube-system",pod_template_hash="def"} 2`,
+				`cost{app_name="team-backend",namespace="team-backend",pod_template_hash="abc"} 1`,
+			},
+		},
+		{
+			// the regex is anchored, kube-system doesn't match it
+			name:  "empty replacement removes the target",
+			rules: []LabelRule{{Source: "namespace", Regex: mustRegexp(t, "team-(x*)backend"), Target: "app_name", Replacement: "$1"}},
+			want: []string{
+				`cost{namespace="team-backend",pod_template_hash="abc"} 1`,
+				`cost{app_name="dns",namespace="kube-system",pod_template_hash="def"} 2`,
+			},
+		},
+		{
+			name:  "drop",
+			rules: []LabelRule{{Action: LabelRuleDrop, Source: "pod_template_hash"}, {Action: LabelRuleDrop, Source: "missing"}},
+			want: []string{
+				`cost{app_name="api",namespace="team-backend"} 1`,
+				`cost{app_name="dns",namespace="kube-system"} 2`,
+			},
+		},
+		{
+			// the series are the same after the rules, the duplicate policy sums them up
+			name:  "duplicates after the rules",
+			rules: []LabelRule{{Action: LabelRuleDrop, Source: "app_name"}, {Action: LabelRuleDrop, Source: "pod_template_hash"}, {Action: LabelRuleDrop, Source: "namespace"}},
+			want:  []string{`cost{} 3`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := ScrapeOptions{LabelRules: tt.rules, DuplicatePolicy: DuplicatePolicySum}
+			if err := opts.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := sendSeries(t, opts, series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got series\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule    LabelRule
+		wantErr bool
+	}{
+		{rule: LabelRule{Source: "namespace", Target: "team"}},
+		{rule: LabelRule{Action: LabelRuleDrop, Source: "namespace"}},
+		{rule: LabelRule{Source: "namespace"}, wantErr: true},
+		{rule: LabelRule{Source: "namespace", Target: "team-name"}, wantErr: true},
+		{rule: LabelRule{Source: "", Target: "team"}, wantErr: true},
+		{rule: LabelRule{Source: "namespace", Target: stepLabelName}, wantErr: true},
+		{rule: LabelRule{Action: LabelRuleDrop, Source: "namespace", Target: "team"}, wantErr: true},
+		{rule: LabelRule{Action: "keep", Source: "namespace"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.rule, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxDescs limits the number of the cached descriptors, e.g. if the Kubecost labels are changing all the time
+const maxDescs = 10000
+
+// labelSet is the label names and values of a metric.
+// A set is needed for every Kubecost item, so the sets are pooled and reused between the items and the scrapes
+type labelSet struct {
+	names  []string
+	values []string
+	// key is the buffer for the descriptor cache key
+	key []byte
+}
+
+var labelSetPool = sync.Pool{
+	New: func() interface{} {
+		return &labelSet{
+			names:  make([]string, 0, 32),
+			values: make([]string, 0, 32),
+			key:    make([]byte, 0, 512),
+		}
+	},
+}
+
+func getLabelSet() *labelSet {
+	return labelSetPool.Get().(*labelSet)
+}
+
+// release returns the set to the pool, the set can't be used after it
+func (l *labelSet) release() {
+	l.names = l.names[:0]
+	l.values = l.values[:0]
+	l.key = l.key[:0]
+	labelSetPool.Put(l)
+}
+
+func (l *labelSet) add(name string, value string) {
+	l.names = append(l.names, name)
+	l.values = append(l.values, value)
+}
+
+// has returns true if the set already has the label
+func (l *labelSet) has(name string) bool {
+	return l.index(name) >= 0
+}
+
+// index returns the position of the label, -1 if the set doesn't have it
+func (l *labelSet) index(name string) int {
+	for i, n := range l.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the label at the position, the last label takes its place, so the set has to be sorted again
+func (l *labelSet) remove(i int) {
+	last := len(l.names) - 1
+	l.names[i], l.values[i] = l.names[last], l.values[last]
+	l.names, l.values = l.names[:last], l.values[:last]
+}
+
+// set replaces the value of the label or adds it, the empty value removes the label,
+// as Prometheus doesn't tell an empty label from a missing one
+func (l *labelSet) set(name string, value string) {
+	i := l.index(name)
+	switch {
+	case i < 0 && len(value) > 0:
+		l.add(name, value)
+	case i >= 0 && len(value) > 0:
+		l.values[i] = value
+	case i >= 0:
+		l.remove(i)
+	}
+}
+
+// the labels are sorted by name, so the same labels that come from a map in a random order have the same schema
+func (l *labelSet) Len() int           { return len(l.names) }
+func (l *labelSet) Less(i, j int) bool { return l.names[i] < l.names[j] }
+func (l *labelSet) Swap(i, j int) {
+	l.names[i], l.names[j] = l.names[j], l.names[i]
+	l.values[i], l.values[j] = l.values[j], l.values[i]
+}
+
+// descCache keeps a descriptor per metric name and label schema.
+// Creating a descriptor is expensive (the label names are validated and hashed),
+// while there are thousands of the items, but only a few label schemas in a scrape
+type descCache struct {
+	mu    sync.RWMutex
+	descs map[string]*cachedDesc
+}
+
+// cachedDesc is the descriptor with its name, help and label names, they aren't accessible from prometheus.Desc
+type cachedDesc struct {
+	desc       *prometheus.Desc
+	fqName     string
+	help       string
+	labelNames []string
+}
+
+var descs = &descCache{descs: make(map[string]*cachedDesc)}
+
+// get returns the descriptor for the sorted label names of the set
+func (c *descCache) get(fqName string, help string, l *labelSet) *cachedDesc {
+	l.key = append(l.key[:0], fqName...)
+	for _, name := range l.names {
+		l.key = append(l.key, 0xff)
+		l.key = append(l.key, name...)
+	}
+	c.mu.RLock()
+	desc, ok := c.descs[string(l.key)]
+	c.mu.RUnlock()
+	if ok {
+		return desc
+	}
+	// the descriptor keeps the label names slice, so it gets a copy of the pooled one
+	names := make([]string, len(l.names))
+	copy(names, l.names)
+	desc = &cachedDesc{desc: prometheus.NewDesc(fqName, help, names, nil), fqName: fqName, help: help, labelNames: names}
+	c.mu.Lock()
+	if len(c.descs) >= maxDescs {
+		c.descs = make(map[string]*cachedDesc)
+	}
+	c.descs[string(l.key)] = desc
+	c.mu.Unlock()
+	return desc
+}
@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// OpenMetricsSpool keeps the backfilled days in temporary files and merges them into a single OpenMetrics output,
+// where every family is written once and the samples of every series are together in the time order, as OpenMetrics requires.
+// Only the current sample of every day is kept in memory while merging, so the memory doesn't grow with the date range
+type OpenMetricsSpool struct {
+	dir   string
+	files []string
+}
+
+// NewOpenMetricsSpool creates the temporary directory for the days in dir, the default temporary directory if it's empty
+func NewOpenMetricsSpool(dir string) (*OpenMetricsSpool, error) {
+	dir, err := os.MkdirTemp(dir, "kubecost_backfill")
+	if err != nil {
+		return nil, err
+	}
+	return &OpenMetricsSpool{dir: dir}, nil
+}
+
+// spooledMetric is a single sample of a family, it's spooled as a family with one metric
+type spooledMetric struct {
+	mf  *dto.MetricFamily
+	key string
+}
+
+func newSpooledMetric(mf *dto.MetricFamily) spooledMetric {
+	return spooledMetric{mf: mf, key: seriesKey(mf.Metric[0])}
+}
+
+// less orders the samples by the family, the series and the timestamp
+func (m spooledMetric) less(other spooledMetric) bool {
+	if m.mf.GetName() != other.mf.GetName() {
+		return m.mf.GetName() < other.mf.GetName()
+	}
+	if m.key != other.key {
+		return m.key < other.key
+	}
+	return m.mf.Metric[0].GetTimestampMs() < other.mf.Metric[0].GetTimestampMs()
+}
+
+// seriesKey identifies the series within the family by its labels
+func seriesKey(m *dto.Metric) string {
+	var b strings.Builder
+	for _, l := range m.GetLabel() {
+		b.WriteString(l.GetName())
+		b.WriteByte('=')
+		b.WriteString(l.GetValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Add spools the families of a day to a new temporary file in the merge order
+func (s *OpenMetricsSpool) Add(families []*dto.MetricFamily) error {
+	var metrics []spooledMetric
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			metrics = append(metrics, newSpooledMetric(&dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: []*dto.Metric{m}}))
+		}
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].less(metrics[j]) })
+
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("%06d.pb", len(s.files))))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := expfmt.NewEncoder(w, expfmt.FmtProtoDelim)
+	for _, m := range metrics {
+		if err := enc.Encode(m.mf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.files = append(s.files, f.Name())
+	return f.Close()
+}
+
+// spoolReader reads the samples of a spooled day, current is the next sample to merge
+type spoolReader struct {
+	f       *os.File
+	dec     expfmt.Decoder
+	current spooledMetric
+}
+
+// next reads the next sample, it returns false at the end of the file
+func (r *spoolReader) next() (bool, error) {
+	mf := &dto.MetricFamily{}
+	if err := r.dec.Decode(mf); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, fmt.Errorf("couldn't read %s: %s", r.f.Name(), err)
+	}
+	r.current = newSpooledMetric(mf)
+	return true, nil
+}
+
+// spoolHeap orders the readers by their current samples
+type spoolHeap []*spoolReader
+
+func (h spoolHeap) Len() int            { return len(h) }
+func (h spoolHeap) Less(i, j int) bool  { return h[i].current.less(h[j].current) }
+func (h spoolHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spoolHeap) Push(x interface{}) { *h = append(*h, x.(*spoolReader)) }
+func (h *spoolHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// Write merges the spooled days into the OpenMetrics text format,
+// the output is consumable by "promtool tsdb create-blocks-from openmetrics"
+func (s *OpenMetricsSpool) Write(w io.Writer) error {
+	h := make(spoolHeap, 0, len(s.files))
+	defer func() {
+		for _, r := range h {
+			r.f.Close()
+		}
+	}()
+	for _, name := range s.files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		r := &spoolReader{f: f, dec: expfmt.NewDecoder(bufio.NewReader(f), expfmt.FmtProtoDelim)}
+		ok, err := r.next()
+		if !ok || err != nil {
+			f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+
+	var family string
+	var buf bytes.Buffer
+	for h.Len() > 0 {
+		r := h[0]
+		buf.Reset()
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, r.current.mf); err != nil {
+			return err
+		}
+		out := buf.Bytes()
+		// HELP and TYPE are written only with the first sample of the family
+		if r.current.mf.GetName() == family {
+			out = withoutMetadata(out)
+		}
+		family = r.current.mf.GetName()
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+			continue
+		}
+		r.f.Close()
+		heap.Pop(&h)
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// withoutMetadata drops the "# HELP", "# TYPE" and "# UNIT" lines, the sample lines never start with "#"
+func withoutMetadata(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		b = b[len(line):]
+		if !bytes.HasPrefix(line, []byte("# ")) {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// Close removes the temporary files
+func (s *OpenMetricsSpool) Close() error {
+	return os.RemoveAll(s.dir)
+}
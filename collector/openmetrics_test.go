@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"bytes"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func gaugeFamily(name string, samples ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: proto.String(name), Help: proto.String(name + " help"), Type: dto.MetricType_GAUGE.Enum(), Metric: samples}
+}
+
+func gaugeSample(namespace string, value float64, timestampMs int64) *dto.Metric {
+	return &dto.Metric{
+		Label:       []*dto.LabelPair{{Name: proto.String("namespace"), Value: proto.String(namespace)}},
+		Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+		TimestampMs: proto.Int64(timestampMs),
+	}
+}
+
+func TestOpenMetricsSpool(t *testing.T) {
+	spool, err := NewOpenMetricsSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	// the days are added in the time order, the series of every day are in any order
+	days := [][]*dto.MetricFamily{
+		{
+			gaugeFamily("b_cost", gaugeSample("kube-system", 1, 86400000), gaugeSample("default", 2, 86400000)),
+			gaugeFamily("a_cost", gaugeSample("default", 3, 86400000)),
+		},
+		{
+			gaugeFamily("a_cost", gaugeSample("default", 4, 172800000)),
+			gaugeFamily("b_cost", gaugeSample("default", 5, 172800000), gaugeSample("kube-system", 6, 172800000)),
+		},
+		// an empty day, e.g. all the scrapers failed
+		{},
+	}
+	for _, families := range days {
+		if err := spool.Add(families); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := spool.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP a_cost a_cost help
+# TYPE a_cost gauge
+a_cost{namespace="default"} 3.0 86400.0
+a_cost{namespace="default"} 4.0 172800.0
+# HELP b_cost b_cost help
+# TYPE b_cost gauge
+b_cost{namespace="default"} 2.0 86400.0
+b_cost{namespace="default"} 5.0 172800.0
+b_cost{namespace="kube-system"} 1.0 86400.0
+b_cost{namespace="kube-system"} 6.0 172800.0
+# EOF
+`
+	if out.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,224 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// StepOutputLabel exports every interval with the "day" label
+	StepOutputLabel = "label"
+	// StepOutputTimestamp exports every interval with the interval end as the sample timestamp
+	StepOutputTimestamp = "timestamp"
+
+	// the label that is added to the metrics in the StepOutputLabel mode
+	stepLabelName = "day"
+
+	// window format that is accepted by Kubecost: 2021-12-14T00:00:00Z,2021-12-15T00:00:00Z
+	rfc3339local = "2006-01-02T15:04:05Z"
+)
+
+// ScrapeOptions are the exporter wide settings that are passed to every scraper
+type ScrapeOptions struct {
+	SkipTLSVerify bool
+	// Offset is the number of days back from today, where the scraped window starts
+	Offset int64
+	// Step enables the time-series mode, when it's set, Kubecost returns a set of items per each Step interval
+	// instead of accumulated values for the whole window
+	Step time.Duration
+	// StepRange is the number of days covered by the window in the time-series mode
+	StepRange int64
+	// StepOutput is the way the intervals are exported: StepOutputLabel or StepOutputTimestamp
+	StepOutput string
+	// From is the explicit start of the window, if it's set, the Offset is ignored
+	From time.Time
+	// Records receives the raw typed items fetched by the scrapers, nil if it's not needed
+	Records RecordWriter
+	// Cache keeps the Kubecost responses between the scrapes, nil disables caching
+	Cache *kubecost_api.ResponseCache
+	// Requests is shared by all the scrapers to collapse the identical requests and limit the concurrency
+	Requests *kubecost_api.RequestGroup
+	// MaxResponseBytes limits the size of the decompressed Kubecost response, 0 means no limit
+	MaxResponseBytes int64
+	// HTTPClient is used for the Kubecost requests if it's set, e.g. with the authentication of the probed target,
+	// SkipTLSVerify is ignored then
+	HTTPClient *http.Client
+	// Target is the name of the probed target, it separates the cached responses of the targets with the same URL
+	Target string
+	// DuplicatePolicy resolves the series that are the same after the labels processing, DuplicatePolicyError if it's empty
+	DuplicatePolicy string
+	// TopN limits the number of the series per scraper name, the scrapers without it export all the series
+	TopN map[string]TopN
+	// LabelRules change the labels of the assets and the allocations series, in their order
+	LabelRules []LabelRule
+	// Budgets are exported along with the series of their scrapers
+	Budgets []Budget
+	// ClusterInfo keeps the clusters between the scrapes, nil requests them for every scrape
+	ClusterInfo *ClusterInfoCache
+	// ClusterLabels adds the name, the provider and the region of the cluster to the assets and the allocations series
+	ClusterLabels bool
+	// CostComponents exports the cost of every allocation by component (cpu, ram, pv...) next to the total cost,
+	// e.g. for the OTLP export where the component is an attribute of the data point
+	CostComponents bool
+	// Status keeps the last runs of the scrapers, nil if they aren't tracked, e.g. for the probes
+	Status *Status
+	// Instrumentation observes the Kubecost requests and counts the decoded items, nil if they aren't instrumented
+	Instrumentation *Instrumentation
+	// Debug records the items and the series of a single scrape, nil for the usual scrapes
+	Debug *ScrapeDebug
+
+	// duplicates counts the resolved duplicates of the scraper, it's set by the exporter
+	duplicates prometheus.Counter
+	// folded is the number of the series folded by the TopN limit in the last scrape of the scraper, it's set by the exporter
+	folded prometheus.Gauge
+}
+
+// Validate checks that the options could be used for the scrape
+func (o ScrapeOptions) Validate() error {
+	switch o.DuplicatePolicy {
+	case "", DuplicatePolicySum, DuplicatePolicyMax, DuplicatePolicyFirst, DuplicatePolicyError:
+	default:
+		return fmt.Errorf("unknown duplicate series policy %q", o.DuplicatePolicy)
+	}
+	for scraper, topN := range o.TopN {
+		if topN.N < 0 {
+			return fmt.Errorf("top-n of %s must not be negative, got %d", scraper, topN.N)
+		}
+	}
+	for i, rule := range o.LabelRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("label rule %d: %s", i+1, err)
+		}
+	}
+	if err := validateBudgets(o.Budgets); err != nil {
+		return err
+	}
+	if o.Step == 0 {
+		return nil
+	}
+	if o.Step < time.Hour || o.Step%time.Hour != 0 {
+		return fmt.Errorf("step must be a multiple of 1h, got %s", o.Step)
+	}
+	if o.StepRange < 1 {
+		return fmt.Errorf("step range must be at least 1 day, got %d", o.StepRange)
+	}
+	switch o.StepOutput {
+	case StepOutputLabel:
+	case StepOutputTimestamp:
+		// prometheus client doesn't allow the same series twice in one scrape, even with different timestamps
+		if time.Duration(o.StepRange)*24*time.Hour != o.Step {
+			return fmt.Errorf("step output %q supports only one interval per window, use the %q output or a step equal to the range", StepOutputTimestamp, StepOutputLabel)
+		}
+	default:
+		return fmt.Errorf("unknown step output %q", o.StepOutput)
+	}
+	return nil
+}
+
+// IsStepMode returns true if the time-series mode is enabled
+func (o ScrapeOptions) IsStepMode() bool {
+	return o.Step > 0
+}
+
+// newClient returns the Kubecost client configured by the options
+func (o ScrapeOptions) newClient(apiBaseUrl *url.URL) *kubecost_api.Client {
+	client := kubecost_api.NewApiClient(apiBaseUrl, namespace, o.SkipTLSVerify)
+	if o.HTTPClient != nil {
+		client = kubecost_api.NewApiClientWithHTTPClient(apiBaseUrl, namespace, o.HTTPClient)
+	}
+	client.Target = o.Target
+	client.Cache = o.Cache
+	client.Requests = o.Requests
+	client.MaxResponseBytes = o.MaxResponseBytes
+	if o.Debug != nil {
+		client.Debug = &o.Debug.Kubecost
+	}
+	// the observer is an interface, so a nil pointer isn't assigned
+	if o.Instrumentation != nil {
+		client.Observer = o.Instrumentation
+	}
+	return client
+}
+
+// Window returns the scraped window boundaries
+func (o ScrapeOptions) Window(now time.Time) (time.Time, time.Time) {
+	days := int64(1)
+	if o.IsStepMode() {
+		days = o.StepRange
+	}
+	dateFrom := now.AddDate(0, 0, int(-o.Offset))
+	if !o.From.IsZero() {
+		dateFrom = o.From
+	}
+	return TruncateDate(dateFrom), TruncateDate(dateFrom.AddDate(0, 0, int(days)))
+}
+
+// WindowParams returns the Kubecost query params for the window,
+// accumulate=true is used to avoid duplication: without it, Kubecost returns resources usage for multiple time windows.
+// In the time-series mode those multiple windows are requested on purpose
+func (o ScrapeOptions) WindowParams(now time.Time) []string {
+	from, to := o.Window(now)
+	params := []string{fmt.Sprintf("window=%s,%s", from.Format(rfc3339local), to.Format(rfc3339local))}
+	if !o.IsStepMode() {
+		return append(params, "accumulate=true")
+	}
+	return append(params, "accumulate=false", "step="+FormatStep(o.Step))
+}
+
+// FormatStep formats the step duration the way Kubecost parses it: 1d, 6h
+func FormatStep(step time.Duration) string {
+	if step%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", step/(24*time.Hour))
+	}
+	return fmt.Sprintf("%dh", step/time.Hour)
+}
+
+// ParseStep parses the step in the Kubecost format: 1d, 6h
+// an empty string means that the time-series mode is disabled
+func ParseStep(step string) (time.Duration, error) {
+	if len(step) == 0 {
+		return 0, nil
+	}
+	var n int64
+	var unit string
+	if _, err := fmt.Sscanf(step, "%d%s", &n, &unit); err != nil {
+		return 0, fmt.Errorf("couldn't parse step %q: %s", step, err)
+	}
+	// "0d" would disable the time-series mode silently
+	if n <= 0 {
+		return 0, fmt.Errorf("step must be positive, got %q", step)
+	}
+	switch unit {
+	case "d":
+		return time.Duration(n) * 24 * time.Hour, nil
+	case "h":
+		return time.Duration(n) * time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown step unit in %q, only \"d\" and \"h\" are supported", step)
+}
+
+// intervalLabels adds the "day" label with the interval start in the StepOutputLabel mode
+func (o ScrapeOptions) intervalLabels(l *labelSet, window kubecost_api.Window) {
+	if !o.IsStepMode() || o.StepOutput != StepOutputLabel || window.Start == nil {
+		return
+	}
+	format := "2006-01-02"
+	if o.Step%(24*time.Hour) != 0 {
+		format = rfc3339local
+	}
+	l.add(stepLabelName, window.Start.UTC().Format(format))
+}
+
+// newConstMetric creates the gauge for a Kubecost item, according to the step options
+func (o ScrapeOptions) newConstMetric(desc *prometheus.Desc, value float64, labelValues []string, window kubecost_api.Window) prometheus.Metric {
+	metric := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	if o.IsStepMode() && o.StepOutput == StepOutputTimestamp && window.End != nil {
+		return prometheus.NewMetricWithTimestamp(*window.End, metric)
+	}
+	return metric
+}
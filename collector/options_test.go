@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+)
+
+func TestParseStep(t *testing.T) {
+	tests := []struct {
+		step    string
+		want    time.Duration
+		wantErr bool
+	}{
+		// the time-series mode is disabled
+		{step: "", want: 0},
+		{step: "1d", want: 24 * time.Hour},
+		{step: "7d", want: 7 * 24 * time.Hour},
+		{step: "6h", want: 6 * time.Hour},
+		{step: "0d", wantErr: true},
+		{step: "0h", wantErr: true},
+		{step: "-1d", wantErr: true},
+		{step: "30m", wantErr: true},
+		{step: "1.5d", wantErr: true},
+		{step: "d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStep(tt.step)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseStep(%q) = %s, %v, want %s, error %v", tt.step, got, err, tt.want, tt.wantErr)
+		}
+		// the parsed step is passed to Kubecost as it was set
+		if err == nil && got > 0 && FormatStep(got) != tt.step {
+			t.Errorf("FormatStep(%s) = %q, want %q", got, FormatStep(got), tt.step)
+		}
+	}
+	// the days that aren't whole are passed as the hours
+	if got := FormatStep(36 * time.Hour); got != "36h" {
+		t.Errorf("FormatStep(36h) = %q, want \"36h\"", got)
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name    string
+		opts    ScrapeOptions
+		wantErr bool
+	}{
+		{name: "disabled", opts: ScrapeOptions{}},
+		{name: "daily label", opts: ScrapeOptions{Step: day, StepRange: 7, StepOutput: StepOutputLabel}},
+		{name: "hourly label", opts: ScrapeOptions{Step: time.Hour, StepRange: 1, StepOutput: StepOutputLabel}},
+		{name: "timestamp of the whole range", opts: ScrapeOptions{Step: 2 * day, StepRange: 2, StepOutput: StepOutputTimestamp}},
+		{name: "timestamp of many intervals", opts: ScrapeOptions{Step: day, StepRange: 2, StepOutput: StepOutputTimestamp}, wantErr: true},
+		{name: "less than an hour", opts: ScrapeOptions{Step: 30 * time.Minute, StepRange: 1, StepOutput: StepOutputLabel}, wantErr: true},
+		{name: "not whole hours", opts: ScrapeOptions{Step: 90 * time.Minute, StepRange: 1, StepOutput: StepOutputLabel}, wantErr: true},
+		{name: "no range", opts: ScrapeOptions{Step: day, StepOutput: StepOutputLabel}, wantErr: true},
+		{name: "unknown output", opts: ScrapeOptions{Step: day, StepRange: 1, StepOutput: "column"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntervalLabels(t *testing.T) {
+	// the interval start is in UTC, whatever the zone of the response is
+	start := time.Date(2021, 12, 14, 6, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	window := kubecost_api.Window{Start: &start}
+	tests := []struct {
+		name   string
+		opts   ScrapeOptions
+		window kubecost_api.Window
+		want   []string
+	}{
+		{name: "accumulated", opts: ScrapeOptions{}, window: window},
+		{name: "daily", opts: ScrapeOptions{Step: 24 * time.Hour, StepOutput: StepOutputLabel}, window: window, want: []string{"2021-12-14"}},
+		{name: "hourly", opts: ScrapeOptions{Step: 6 * time.Hour, StepOutput: StepOutputLabel}, window: window, want: []string{"2021-12-14T11:00:00Z"}},
+		{name: "timestamp", opts: ScrapeOptions{Step: 24 * time.Hour, StepOutput: StepOutputTimestamp}, window: window},
+		{name: "no window", opts: ScrapeOptions{Step: 24 * time.Hour, StepOutput: StepOutputLabel}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := getLabelSet()
+			defer l.release()
+			tt.opts.intervalLabels(l, tt.window)
+			var got []string
+			for i, name := range l.names {
+				if name != stepLabelName {
+					t.Errorf("got the label %q", name)
+				}
+				got = append(got, l.values[i])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got the day %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
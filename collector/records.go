@@ -0,0 +1,24 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+)
+
+// Records are the typed Kubecost items fetched by a scraper during one scrape
+// in the time-series mode they contain items of several intervals, every item has its own window
+type Records struct {
+	Scraper string
+	// Start and End of the scraped window
+	Start       time.Time
+	End         time.Time
+	Allocations []kubecost_api.Allocation
+	Assets      *CloudAssets
+}
+
+// RecordWriter receives the records of every scrape, e.g. to store them in files
+type RecordWriter interface {
+	WriteRecords(ctx context.Context, records *Records) error
+}
@@ -0,0 +1,52 @@
+package collector
+
+import (
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsInFlightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "kubecost_requests_in_flight"),
+		"Number of Kubecost requests that are being made.",
+		nil, nil,
+	)
+	requestsQueuedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "kubecost_requests_queued"),
+		"Number of Kubecost requests waiting for the concurrency limit.",
+		nil, nil,
+	)
+	requestsDeduplicatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "kubecost_requests_deduplicated_total"),
+		"Total number of Kubecost requests that were not made, because an identical request was in flight.",
+		nil, nil,
+	)
+)
+
+// Verify if RequestsCollector implements prometheus.Collector
+var _ prometheus.Collector = (*RequestsCollector)(nil)
+
+// RequestsCollector exports the request group counters
+type RequestsCollector struct {
+	requests *kubecost_api.RequestGroup
+}
+
+// NewRequestsCollector returns the collector of the request group metrics
+func NewRequestsCollector(requests *kubecost_api.RequestGroup) *RequestsCollector {
+	return &RequestsCollector{requests: requests}
+}
+
+// Describe implements prometheus.Collector.
+func (c *RequestsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsInFlightDesc
+	ch <- requestsQueuedDesc
+	ch <- requestsDeduplicatedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *RequestsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.requests.Stats()
+	ch <- prometheus.MustNewConstMetric(requestsInFlightDesc, prometheus.GaugeValue, float64(stats.InFlight))
+	ch <- prometheus.MustNewConstMetric(requestsQueuedDesc, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(requestsDeduplicatedDesc, prometheus.CounterValue, float64(stats.Deduplicated))
+}
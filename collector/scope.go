@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Scope limits the cost series to some clusters, namespaces and labels, e.g. for a team that scrapes the exporter.
+// An empty field doesn't limit anything
+type Scope struct {
+	Clusters   []string
+	Namespaces []string
+	// Labels are in the Kubecost format: "team:backend", a series with any of them is in the scope
+	Labels []string
+}
+
+// IsEmpty returns true if the scope doesn't limit anything
+func (s Scope) IsEmpty() bool {
+	return len(s.Clusters) == 0 && len(s.Namespaces) == 0 && len(s.Labels) == 0
+}
+
+// Filters returns the filters limited by the scope, false if nothing is left of the filters.
+// The clusters and the namespaces are intersected with the ones of the filters, the labels of the filters are kept
+// if they're set, Kubecost can't AND them, so the series are filtered by FilterFamilies anyway
+func (s Scope) Filters(f kubecost_api.Filters) (kubecost_api.Filters, bool) {
+	var ok bool
+	if f.Clusters, ok = intersect(f.Clusters, s.Clusters); !ok {
+		return f, false
+	}
+	if f.Namespaces, ok = intersect(f.Namespaces, s.Namespaces); !ok {
+		return f, false
+	}
+	if len(f.Labels) == 0 {
+		f.Labels = s.Labels
+	}
+	return f, true
+}
+
+// intersect returns the values that are in both lists, an empty list allows everything
+func intersect(values []string, allowed []string) ([]string, bool) {
+	if len(allowed) == 0 {
+		return values, true
+	}
+	if len(values) == 0 {
+		return allowed, true
+	}
+	var both []string
+	for _, v := range values {
+		if contains(allowed, v) {
+			both = append(both, v)
+		}
+	}
+	return both, len(both) > 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterFamilies drops the cost series that are out of the scope. The series without the scoped labels are dropped too,
+// e.g. the assets for a scope with namespaces, or the allocations aggregated by the cluster only.
+// The cluster info is limited only by the clusters, the exporter's own metrics are kept as is
+func (s Scope) FilterFamilies(families []*dto.MetricFamily) []*dto.MetricFamily {
+	if s.IsEmpty() {
+		return families
+	}
+	labels := make(map[string][]string, len(s.Labels))
+	for _, label := range s.Labels {
+		// the labels are exported with "_" instead of "-", the same as in the series
+		name, value, _ := strings.Cut(strings.ReplaceAll(label, "-", "_"), ":")
+		labels[name] = append(labels[name], value)
+	}
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		var inScope func(*dto.Metric) bool
+		switch family.GetName() {
+		case assetsCostName, allocationCostName:
+			inScope = func(m *dto.Metric) bool {
+				return s.allowed(m, "property_cluster", s.Clusters) && s.allowed(m, "property_namespace", s.Namespaces) && hasAnyLabel(m, labels)
+			}
+		case clusterInfoName:
+			inScope = func(m *dto.Metric) bool {
+				return s.allowed(m, "cluster_id", s.Clusters)
+			}
+		default:
+			filtered = append(filtered, family)
+			continue
+		}
+		var metrics []*dto.Metric
+		for _, m := range family.Metric {
+			if inScope(m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered
+}
+
+// allowed returns true if the label of the series has one of the allowed values, or nothing is allowed explicitly
+func (s Scope) allowed(m *dto.Metric, name string, values []string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	value, ok := labelValue(m, name)
+	return ok && contains(values, value)
+}
+
+// hasAnyLabel returns true if the series has any of the labels with one of their values, or there are no labels
+func hasAnyLabel(m *dto.Metric, labels map[string][]string) bool {
+	if len(labels) == 0 {
+		return true
+	}
+	for name, values := range labels {
+		if value, ok := labelValue(m, name); ok && contains(values, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func labelValue(m *dto.Metric, name string) (string, bool) {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l.GetValue(), true
+		}
+	}
+	return "", false
+}
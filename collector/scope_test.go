@@ -0,0 +1,144 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestScopeFilters(t *testing.T) {
+	scope := Scope{Namespaces: []string{"backend", "shared"}, Labels: []string{"team:api"}}
+	tests := []struct {
+		name   string
+		in     kubecost_api.Filters
+		want   kubecost_api.Filters
+		wantOk bool
+	}{
+		{
+			name:   "no filters get the scope",
+			want:   kubecost_api.Filters{Namespaces: []string{"backend", "shared"}, Labels: []string{"team:api"}},
+			wantOk: true,
+		},
+		{
+			name:   "intersection",
+			in:     kubecost_api.Filters{Clusters: []string{"one"}, Namespaces: []string{"frontend", "shared"}},
+			want:   kubecost_api.Filters{Clusters: []string{"one"}, Namespaces: []string{"shared"}, Labels: []string{"team:api"}},
+			wantOk: true,
+		},
+		{
+			// Kubecost can't AND the labels, so the ones of the filters are kept and the series are filtered afterwards
+			name:   "labels of the filters",
+			in:     kubecost_api.Filters{Labels: []string{"app:web"}},
+			want:   kubecost_api.Filters{Namespaces: []string{"backend", "shared"}, Labels: []string{"app:web"}},
+			wantOk: true,
+		},
+		{name: "empty intersection", in: kubecost_api.Filters{Namespaces: []string{"frontend"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := scope.Filters(tt.in)
+			if ok != tt.wantOk {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// scopeSample is a series with the label pairs
+func scopeSample(pairs ...string) *dto.Metric {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+	for i := 0; i < len(pairs); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(pairs[i]), Value: proto.String(pairs[i+1])})
+	}
+	return m
+}
+
+// familySeries returns the label values of the series by the family names
+func familySeries(families []*dto.MetricFamily) map[string][]string {
+	series := make(map[string][]string)
+	for _, family := range families {
+		for _, m := range family.Metric {
+			var values []string
+			for _, l := range m.Label {
+				values = append(values, l.GetValue())
+			}
+			series[family.GetName()] = append(series[family.GetName()], values...)
+		}
+	}
+	return series
+}
+
+func TestScopeFilterFamilies(t *testing.T) {
+	families := func() []*dto.MetricFamily {
+		return []*dto.MetricFamily{
+			gaugeFamily(allocationCostName,
+				scopeSample("property_cluster", "one", "property_namespace", "backend", "team", "api"),
+				scopeSample("property_cluster", "one", "property_namespace", "frontend", "team", "web"),
+				scopeSample("property_cluster", "two", "property_namespace", "backend", "app_name", "api"),
+				// aggregated by the cluster only
+				scopeSample("property_cluster", "one"),
+			),
+			gaugeFamily(assetsCostName, scopeSample("property_cluster", "one", "type", "Node")),
+			gaugeFamily(clusterInfoName, scopeSample("cluster_id", "one"), scopeSample("cluster_id", "two")),
+			gaugeFamily("assets_exporter_last_scrape_error", scopeSample("collector", "scrape_allocation")),
+		}
+	}
+	tests := []struct {
+		name  string
+		scope Scope
+		want  map[string][]string
+	}{
+		{
+			name:  "empty scope",
+			scope: Scope{},
+			want: map[string][]string{
+				allocationCostName:                  {"one", "backend", "api", "one", "frontend", "web", "two", "backend", "api", "one"},
+				assetsCostName:                      {"one", "Node"},
+				clusterInfoName:                     {"one", "two"},
+				"assets_exporter_last_scrape_error": {"scrape_allocation"},
+			},
+		},
+		{
+			// the assets and the allocation without the namespace are dropped, the families without series too
+			name:  "namespaces",
+			scope: Scope{Namespaces: []string{"backend"}},
+			want: map[string][]string{
+				allocationCostName:                  {"one", "backend", "api", "two", "backend", "api"},
+				clusterInfoName:                     {"one", "two"},
+				"assets_exporter_last_scrape_error": {"scrape_allocation"},
+			},
+		},
+		{
+			name:  "clusters",
+			scope: Scope{Clusters: []string{"two"}},
+			want: map[string][]string{
+				allocationCostName:                  {"two", "backend", "api"},
+				clusterInfoName:                     {"two"},
+				"assets_exporter_last_scrape_error": {"scrape_allocation"},
+			},
+		},
+		{
+			// any of the labels, "app-name" is exported as app_name
+			name:  "labels",
+			scope: Scope{Labels: []string{"team:web", "app-name:api"}},
+			want: map[string][]string{
+				allocationCostName:                  {"one", "frontend", "web", "two", "backend", "api"},
+				clusterInfoName:                     {"one", "two"},
+				"assets_exporter_last_scrape_error": {"scrape_allocation"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := familySeries(tt.scope.FilterFamilies(families())); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/artemlive/kubecost_exporter/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DuplicatePolicySum exports the sum of the duplicate series
+	DuplicatePolicySum = "sum"
+	// DuplicatePolicyMax exports the maximum of the duplicate series
+	DuplicatePolicyMax = "max"
+	// DuplicatePolicyFirst exports the first series and drops the others
+	DuplicatePolicyFirst = "first"
+	// DuplicatePolicyError drops the duplicates and fails the scrape
+	DuplicatePolicyError = "error"
+)
+
+// DuplicatePolicies are all the policies, for the flags
+var DuplicatePolicies = []string{DuplicatePolicySum, DuplicatePolicyMax, DuplicatePolicyFirst, DuplicatePolicyError}
+
+const (
+	// topNLabelName marks the series that are folded by the TopN limit, its value is otherSeriesValue
+	topNLabelName    = "top_n"
+	otherSeriesValue = "__other__"
+)
+
+// TopN limits the number of the series exported by a scraper, e.g. only the most expensive pods of a big cluster.
+// The other series are summed up into an "__other__" series per each combination of the By labels values,
+// so the totals by these labels are still correct
+type TopN struct {
+	// N is the number of the most expensive series of every metric that are exported as they are, 0 disables the limit
+	N int `yaml:"n"`
+	// By are the parent labels, that are kept by the folded series
+	By []string `yaml:"by,omitempty"`
+}
+
+// bufferedSeries is the series that may still be merged with a duplicate or folded
+type bufferedSeries struct {
+	desc   *cachedDesc
+	values []string
+	value  float64
+	window kubecost_api.Window
+}
+
+// seriesSet sends the metrics of a scraper and resolves the series that are the same after the labels processing,
+// e.g. the Kubecost labels "app-name" and "app_name" are both exported as "app_name".
+// The registry would fail the whole scrape because of them, so they are resolved by the duplicate policy.
+// The series are identified by the hash of the name and the labels, the same way the registry does it.
+// The sum and max policies and the TopN limit keep the series until the end of the scrape, otherwise they're sent right away
+type seriesSet struct {
+	ch   chan<- prometheus.Metric
+	opts ScrapeOptions
+	topN TopN
+
+	seen     map[uint64]int
+	buffered []bufferedSeries
+	// duplicates is the number of the resolved duplicates, example is the first of them for the error
+	duplicates int
+	example    string
+	// folded is the number of the series folded by the TopN limit on the flush
+	folded int
+	// budgets are the budgets exported by the scraper, nil if there are none
+	budgets *budgetCosts
+}
+
+// newSeriesSet returns the set for a single run of the scraper
+func (o ScrapeOptions) newSeriesSet(ch chan<- prometheus.Metric, scraper string) *seriesSet {
+	return &seriesSet{ch: ch, opts: o, topN: o.TopN[scraper], seen: make(map[uint64]int), budgets: o.newBudgetCosts(scraper)}
+}
+
+// policy returns the duplicate policy, the duplicates are errors by default
+func (s *seriesSet) policy() string {
+	if len(s.opts.DuplicatePolicy) == 0 {
+		return DuplicatePolicyError
+	}
+	return s.opts.DuplicatePolicy
+}
+
+func (s *seriesSet) buffers() bool {
+	policy := s.policy()
+	return policy == DuplicatePolicySum || policy == DuplicatePolicyMax || s.topN.N > 0
+}
+
+// send sends the gauge for a Kubecost item, according to the label rules, the step options and the duplicate policy
+func (s *seriesSet) send(fqName string, help string, value float64, l *labelSet, window kubecost_api.Window) {
+	s.opts.applyLabelRules(l)
+	s.opts.intervalLabels(l, window)
+	sort.Sort(l)
+	h := seriesHash(fqName, l)
+
+	i, ok := s.seen[h]
+	if !ok {
+		s.opts.Debug.addSeries(fqName, l.names, l.values, value, "")
+		if !s.buffers() {
+			s.seen[h] = -1
+			s.budgets.add(fqName, l.names, l.values, value)
+			s.ch <- s.opts.newConstMetric(descs.get(fqName, help, l).desc, value, l.values, window)
+			return
+		}
+		s.seen[h] = len(s.buffered)
+		// the values are copied, the label set is reused for the next item
+		values := make([]string, len(l.values))
+		copy(values, l.values)
+		s.buffered = append(s.buffered, bufferedSeries{desc: descs.get(fqName, help, l), values: values, value: value, window: window})
+		return
+	}
+
+	s.duplicates++
+	if s.opts.duplicates != nil {
+		s.opts.duplicates.Inc()
+	}
+	if len(s.example) == 0 {
+		s.example = seriesString(fqName, l)
+	}
+	s.opts.Debug.addSeries(fqName, l.names, l.values, value, "duplicate of an earlier series, resolved by the "+s.policy()+" policy")
+	switch s.policy() {
+	case DuplicatePolicySum:
+		s.buffered[i].value += value
+	case DuplicatePolicyMax:
+		if value > s.buffered[i].value {
+			s.buffered[i].value = value
+		}
+	}
+}
+
+// flush sends the buffered series and the budgets, it returns the error if there were duplicates and the policy is error
+func (s *seriesSet) flush() error {
+	buffered := s.buffered
+	// the budgets count the series before they're folded, the folded series may not have the labels of a budget
+	for _, series := range buffered {
+		s.budgets.add(series.desc.fqName, series.desc.labelNames, series.values, series.value)
+	}
+	folded := 0
+	if s.topN.N > 0 && len(buffered) > s.topN.N {
+		buffered, folded = s.fold(buffered)
+	}
+	s.folded = folded
+	if s.opts.folded != nil {
+		s.opts.folded.Set(float64(folded))
+	}
+	for _, series := range buffered {
+		s.ch <- s.opts.newConstMetric(series.desc.desc, series.value, series.values, series.window)
+	}
+	s.buffered = nil
+	s.budgets.send(s.ch, s.opts.Debug)
+	if s.duplicates > 0 && s.policy() == DuplicatePolicyError {
+		return fmt.Errorf("%d duplicate series were dropped, e.g. %s", s.duplicates, s.example)
+	}
+	return nil
+}
+
+// flushTraced is flush within the span of the metrics generation. The series that aren't buffered are sent
+// as the items are decoded, so their time is in the span of the decoding, the buffered ones are sent here
+func (s *seriesSet) flushTraced(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "generate metrics", tracing.SpanKindInternal, tracing.Int("series.buffered", len(s.buffered)))
+	defer span.End()
+	err := s.flush()
+	span.SetAttributes(tracing.Int("series.folded", s.folded), tracing.Int("series.duplicates", s.duplicates))
+	span.SetError(err)
+	return err
+}
+
+// foldKey identifies the metric and the interval, the series of the different metrics are never ranked together,
+// e.g. the total costs and the component costs of the allocations
+type foldKey struct {
+	fqName   string
+	interval int64
+}
+
+// fold keeps the N most expensive series of every metric and interval and sums up the others
+// into an "__other__" series per the parent labels values, it returns the series and the number of the folded ones
+func (s *seriesSet) fold(buffered []bufferedSeries) ([]bufferedSeries, int) {
+	sort.SliceStable(buffered, func(i, j int) bool {
+		return buffered[i].value > buffered[j].value
+	})
+	parents := make(map[string]bool, len(s.topN.By)+1)
+	for _, name := range s.topN.By {
+		parents[name] = true
+	}
+	// the intervals and the cost components are never folded together
+	parents[stepLabelName] = true
+	parents[costComponentLabelName] = true
+
+	var result []bufferedSeries
+	kept := make(map[foldKey]int)
+	others := make(map[uint64]int)
+	folded := 0
+	l := getLabelSet()
+	defer l.release()
+	for _, series := range buffered {
+		key := foldKey{fqName: series.desc.fqName, interval: intervalKey(series.window)}
+		if kept[key] < s.topN.N {
+			kept[key]++
+			result = append(result, series)
+			continue
+		}
+		folded++
+		s.opts.Debug.folded(series.desc.fqName, series.desc.labelNames, series.values)
+		l.names, l.values = l.names[:0], l.values[:0]
+		for i, name := range series.desc.labelNames {
+			if parents[name] {
+				l.add(name, series.values[i])
+			}
+		}
+		l.add(topNLabelName, otherSeriesValue)
+		sort.Sort(l)
+		h := seriesHash(series.desc.fqName, l)
+		if i, ok := others[h]; ok {
+			result[i].value += series.value
+			continue
+		}
+		others[h] = len(result)
+		values := make([]string, len(l.values))
+		copy(values, l.values)
+		result = append(result, bufferedSeries{
+			desc:   descs.get(series.desc.fqName, series.desc.help, l),
+			values: values,
+			value:  series.value,
+			window: series.window,
+		})
+	}
+	return result, folded
+}
+
+// intervalKey identifies the step interval of the series, all the series are in the same interval in the accumulated mode
+func intervalKey(window kubecost_api.Window) int64 {
+	if window.Start == nil {
+		return 0
+	}
+	return window.Start.UnixNano()
+}
+
+// seriesHash identifies the series by the name and the sorted labels
+func seriesHash(fqName string, l *labelSet) uint64 {
+	h := hashNew()
+	h = hashAdd(h, fqName)
+	for i := range l.names {
+		h = hashAddByte(h, separatorByte)
+		h = hashAdd(h, l.names[i])
+		h = hashAddByte(h, separatorByte)
+		h = hashAdd(h, l.values[i])
+	}
+	return h
+}
+
+func seriesString(fqName string, l *labelSet) string {
+	pairs := make([]string, len(l.names))
+	for i := range l.names {
+		pairs[i] = fmt.Sprintf("%s=%q", l.names[i], l.values[i])
+	}
+	return fqName + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// the inlined FNV-1a, like the one the prometheus client uses for the series
+const (
+	offset64      = 14695981039346656037
+	prime64       = 1099511628211
+	separatorByte = 255
+)
+
+func hashNew() uint64 {
+	return offset64
+}
+
+func hashAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+func hashAddByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= prime64
+	return h
+}
@@ -0,0 +1,275 @@
+package collector
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testSeries is a series sent to the seriesSet, the labels are name, value pairs
+type testSeries struct {
+	name   string
+	labels []string
+	value  float64
+	window kubecost_api.Window
+}
+
+// sendSeries sends the series to a new set of the options and flushes it, it returns the gathered series and the error of the flush
+func sendSeries(t *testing.T, opts ScrapeOptions, series []testSeries) ([]string, error) {
+	var err error
+	got := gatherSeries(t, func(ch chan<- prometheus.Metric) {
+		set := opts.newSeriesSet(ch, "scrape_allocation")
+		for _, s := range series {
+			l := getLabelSet()
+			for i := 0; i < len(s.labels); i += 2 {
+				l.add(s.labels[i], s.labels[i+1])
+			}
+			set.send(s.name, s.name+" help", s.value, l, s.window)
+			l.release()
+		}
+		err = set.flush()
+	})
+	return got, err
+}
+
+func TestSeriesSetDuplicatePolicies(t *testing.T) {
+	// "app-name" and "app_name" Kubecost labels are both exported as app_name, so the series are the same
+	series := []testSeries{
+		{name: "kubecost_cost", labels: []string{"app_name", "a", "namespace", "default"}, value: 1},
+		{name: "kubecost_cost", labels: []string{"namespace", "default", "app_name", "b"}, value: 2},
+		{name: "kubecost_cost", labels: []string{"namespace", "default", "app_name", "a"}, value: 3},
+		{name: "kubecost_cost", labels: []string{"app_name", "b", "namespace", "default"}, value: 0.5},
+	}
+	tests := []struct {
+		policy  string
+		want    []string
+		wantErr bool
+	}{
+		{policy: DuplicatePolicySum, want: []string{`kubecost_cost{app_name="a",namespace="default"} 4`, `kubecost_cost{app_name="b",namespace="default"} 2.5`}},
+		{policy: DuplicatePolicyMax, want: []string{`kubecost_cost{app_name="a",namespace="default"} 3`, `kubecost_cost{app_name="b",namespace="default"} 2`}},
+		{policy: DuplicatePolicyFirst, want: []string{`kubecost_cost{app_name="a",namespace="default"} 1`, `kubecost_cost{app_name="b",namespace="default"} 2`}},
+		{policy: DuplicatePolicyError, want: []string{`kubecost_cost{app_name="a",namespace="default"} 1`, `kubecost_cost{app_name="b",namespace="default"} 2`}, wantErr: true},
+		// the duplicates are errors by default
+		{policy: "", want: []string{`kubecost_cost{app_name="a",namespace="default"} 1`, `kubecost_cost{app_name="b",namespace="default"} 2`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if len(name) == 0 {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			duplicates := prometheus.NewCounter(prometheus.CounterOpts{Name: "duplicate_series_total"})
+			got, err := sendSeries(t, ScrapeOptions{DuplicatePolicy: tt.policy, duplicates: duplicates}, series)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("flush() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got series\n%q\nwant\n%q", got, tt.want)
+			}
+			if got := testutil.ToFloat64(duplicates); got != 2 {
+				t.Errorf("duplicate_series_total = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestSeriesSetDuplicateError(t *testing.T) {
+	series := []testSeries{
+		{name: "kubecost_cost", labels: []string{"app_name", "a"}, value: 1},
+		{name: "kubecost_cost", labels: []string{"app_name", "a"}, value: 1},
+	}
+	_, err := sendSeries(t, ScrapeOptions{}, series)
+	if want := `1 duplicate series were dropped, e.g. kubecost_cost{app_name="a"}`; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	// the series of the different metrics or with the different labels aren't duplicates
+	series = []testSeries{
+		{name: "kubecost_cost", labels: []string{"app_name", "a"}, value: 1},
+		{name: "kubecost_other_cost", labels: []string{"app_name", "a"}, value: 1},
+		{name: "kubecost_cost", labels: []string{"app", "a"}, value: 1},
+	}
+	got, err := sendSeries(t, ScrapeOptions{}, series)
+	if err != nil || len(got) != 3 {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// parentSums returns the sum of the series values by the metric and the values of the parent labels
+func parentSums(t *testing.T, series []string, parents ...string) map[string]float64 {
+	sums := make(map[string]float64)
+	for _, s := range series {
+		m := seriesPattern.FindStringSubmatch(s)
+		if m == nil {
+			t.Fatalf("unexpected series %q", s)
+		}
+		labels := make(map[string]string)
+		for _, pair := range labelPattern.FindAllStringSubmatch(m[2], -1) {
+			labels[pair[1]] = pair[2]
+		}
+		key := m[1]
+		for _, name := range parents {
+			key += "," + name + "=" + labels[name]
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[key] += value
+	}
+	return sums
+}
+
+var (
+	seriesPattern = regexp.MustCompile(`^(\w+)\{(.*)\} (\S+)$`)
+	labelPattern  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+func TestSeriesSetFold(t *testing.T) {
+	day1 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	window1 := kubecost_api.Window{Start: &day1, End: &day2}
+	day3 := day2.AddDate(0, 0, 1)
+	window2 := kubecost_api.Window{Start: &day2, End: &day3}
+	stepOpts := ScrapeOptions{Step: 24 * time.Hour, StepRange: 2, StepOutput: StepOutputLabel}
+	pod := func(name, namespace, pod string, value float64, window kubecost_api.Window) testSeries {
+		return testSeries{name: name, labels: []string{"namespace", namespace, "pod", pod}, value: value, window: window}
+	}
+
+	tests := []struct {
+		name       string
+		opts       ScrapeOptions
+		series     []testSeries
+		parents    []string
+		want       []string
+		wantFolded float64
+	}{
+		{
+			name: "top-n of every interval",
+			opts: stepOpts,
+			series: []testSeries{
+				pod("cost", "a", "p1", 5, window1), pod("cost", "a", "p2", 3, window1), pod("cost", "b", "p3", 2, window1),
+				pod("cost", "a", "p1", 1, window2), pod("cost", "b", "p3", 4, window2), pod("cost", "b", "p4", 1, window2),
+			},
+			parents: []string{"day", "namespace"},
+			want: []string{
+				`cost{day="2022-01-01",namespace="a",pod="p1"} 5`,
+				`cost{day="2022-01-01",namespace="a",top_n="__other__"} 3`,
+				`cost{day="2022-01-01",namespace="b",top_n="__other__"} 2`,
+				`cost{day="2022-01-02",namespace="a",top_n="__other__"} 1`,
+				`cost{day="2022-01-02",namespace="b",pod="p3"} 4`,
+				`cost{day="2022-01-02",namespace="b",top_n="__other__"} 1`,
+			},
+			wantFolded: 4,
+		},
+		{
+			name: "one other series per the by labels values",
+			series: []testSeries{
+				{name: "cost", labels: []string{"cluster", "one", "namespace", "a", "pod", "p1"}, value: 10},
+				{name: "cost", labels: []string{"cluster", "one", "namespace", "a", "pod", "p2"}, value: 1},
+				{name: "cost", labels: []string{"cluster", "one", "namespace", "a", "pod", "p3"}, value: 2},
+				{name: "cost", labels: []string{"cluster", "one", "namespace", "b", "pod", "p4"}, value: 3},
+				{name: "cost", labels: []string{"cluster", "two", "namespace", "a", "pod", "p5"}, value: 4},
+				{name: "cost", labels: []string{"cluster", "two", "namespace", "a", "pod", "p6"}, value: 5},
+			},
+			parents: []string{"cluster", "namespace"},
+			want: []string{
+				`cost{cluster="one",namespace="a",pod="p1"} 10`,
+				`cost{cluster="one",namespace="a",top_n="__other__"} 3`,
+				`cost{cluster="one",namespace="b",top_n="__other__"} 3`,
+				`cost{cluster="two",namespace="a",top_n="__other__"} 9`,
+			},
+			wantFolded: 5,
+		},
+		{
+			name: "every metric is ranked by itself",
+			series: []testSeries{
+				pod("cost", "a", "p1", 1, window1), pod("cost", "a", "p2", 2, window1),
+				pod("cpu_cost", "a", "p1", 0.5, window1), pod("cpu_cost", "a", "p2", 0.25, window1),
+			},
+			parents: []string{"namespace"},
+			want: []string{
+				`cost{namespace="a",pod="p2"} 2`,
+				`cost{namespace="a",top_n="__other__"} 1`,
+				`cpu_cost{namespace="a",pod="p1"} 0.5`,
+				`cpu_cost{namespace="a",top_n="__other__"} 0.25`,
+			},
+			wantFolded: 2,
+		},
+		{
+			// the duplicates are summed before the series are ranked, p2 is 1+4.5
+			name: "sum policy",
+			opts: ScrapeOptions{DuplicatePolicy: DuplicatePolicySum},
+			series: []testSeries{
+				pod("cost", "a", "p1", 5, window1), pod("cost", "a", "p2", 1, window1),
+				pod("cost", "a", "p3", 2, window1), pod("cost", "a", "p2", 4.5, window1),
+			},
+			parents: []string{"namespace"},
+			want: []string{
+				`cost{namespace="a",pod="p2"} 5.5`,
+				`cost{namespace="a",top_n="__other__"} 7`,
+			},
+			wantFolded: 2,
+		},
+		{
+			name: "max policy",
+			opts: ScrapeOptions{DuplicatePolicy: DuplicatePolicyMax},
+			series: []testSeries{
+				pod("cost", "a", "p1", 5, window1), pod("cost", "a", "p2", 1, window1),
+				pod("cost", "a", "p3", 2, window1), pod("cost", "a", "p2", 4.5, window1),
+			},
+			parents: []string{"namespace"},
+			want: []string{
+				`cost{namespace="a",pod="p1"} 5`,
+				`cost{namespace="a",top_n="__other__"} 6.5`,
+			},
+			wantFolded: 2,
+		},
+		{
+			name:    "under the limit",
+			series:  []testSeries{pod("cost", "a", "p1", 5, window1)},
+			parents: []string{"namespace"},
+			want:    []string{`cost{namespace="a",pod="p1"} 5`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if len(opts.DuplicatePolicy) == 0 {
+				opts.DuplicatePolicy = DuplicatePolicyFirst
+			}
+			opts.TopN = map[string]TopN{"scrape_allocation": {N: 1, By: tt.parents}}
+			folded := prometheus.NewGauge(prometheus.GaugeOpts{Name: "folded_series"})
+			opts.folded = folded
+			got, err := sendSeries(t, opts, tt.series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the order of the registry depends on the label names, the wanted series are listed by the parents
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got series\n%q\nwant\n%q", got, tt.want)
+			}
+			if got := testutil.ToFloat64(folded); got != tt.wantFolded {
+				t.Errorf("folded_series = %v, want %v", got, tt.wantFolded)
+			}
+
+			// the totals by the parent labels are the same as without the limit
+			opts.TopN = nil
+			unfolded, err := sendSeries(t, opts, tt.series)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := parentSums(t, got, tt.parents...), parentSums(t, unfolded, tt.parents...); !reflect.DeepEqual(got, want) {
+				t.Errorf("got sums by %v\n%v\nwant\n%v", tt.parents, got, want)
+			}
+		})
+	}
+}
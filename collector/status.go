@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status keeps the last run of every scraper and the last successful contact with Kubecost for /status and /-/ready.
+// It's shared by /metrics and the sinks, the probes of the other targets don't use it
+type Status struct {
+	mu          sync.Mutex
+	scrapers    map[string]*ScraperStatus
+	lastContact time.Time
+	version     string
+}
+
+// ScraperStatus is the last run of a scraper
+type ScraperStatus struct {
+	Name     string
+	LastRun  time.Time
+	Duration time.Duration
+	// Error is empty if the last run was successful
+	Error string
+	// Items are the numbers of the decoded items by their type, e.g. the asset types, of the last run
+	Items map[string]int
+}
+
+// NewStatus returns the empty status
+func NewStatus() *Status {
+	return &Status{scrapers: make(map[string]*ScraperStatus)}
+}
+
+// Scrapers returns the last runs sorted by the scraper name
+func (s *Status) Scrapers() []ScraperStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scrapers := make([]ScraperStatus, 0, len(s.scrapers))
+	for _, status := range s.scrapers {
+		scrapers = append(scrapers, *status)
+	}
+	sort.Slice(scrapers, func(i, j int) bool { return scrapers[i].Name < scrapers[j].Name })
+	return scrapers
+}
+
+// LastContact returns the time of the last successful Kubecost request, zero if there was none
+func (s *Status) LastContact() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastContact
+}
+
+// Version returns the Kubecost version from the cluster info, empty if it's unknown yet
+func (s *Status) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// scraper returns the status of the scraper, it's created on the first run
+func (s *Status) scraper(name string) *ScraperStatus {
+	status, ok := s.scrapers[name]
+	if !ok {
+		status = &ScraperStatus{Name: name}
+		s.scrapers[name] = status
+	}
+	return status
+}
+
+// finished records the run of the scraper, the successful run is a contact with Kubecost too
+func (s *Status) finished(name string, start time.Time, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.scraper(name)
+	status.LastRun, status.Duration, status.Error = start, time.Since(start), ""
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	s.lastContact = time.Now()
+}
+
+// setItems replaces the item counts of the scraper
+func (s *Status) setItems(name string, items map[string]int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scraper(name).Items = items
+}
+
+// contacted records a successful Kubecost request that isn't a scrape, e.g. the cluster info
+func (s *Status) contacted(version string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastContact = time.Now()
+	if len(version) > 0 {
+		s.version = version
+	}
+}
+
+// CheckKubecost requests the cluster info to check that Kubecost answers, it updates the last contact and the version
+func CheckKubecost(ctx context.Context, apiBaseUrl *url.URL, opts ScrapeOptions) error {
+	info, err := opts.newClient(apiBaseUrl).GetClusterInfo(ctx)
+	if err != nil {
+		return err
+	}
+	opts.Status.contacted(info.Version)
+	return nil
+}
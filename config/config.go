@@ -0,0 +1,234 @@
+// Package config is the configuration file of the exporter
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	promconfig "github.com/prometheus/common/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration file. The flags are the defaults for everything that isn't set in it
+type Config struct {
+	// Kubecost is the instance exported at /metrics, --kubecost.baseUrl is used if it's not set
+	Kubecost *Target `yaml:"kubecost,omitempty"`
+	// Scrape are the options of /metrics and the sinks, the modules of the probes are applied on top of them
+	Scrape *Module `yaml:"scrape,omitempty"`
+	// Sinks are read only at the start, the reload doesn't restart them
+	Sinks *Sinks `yaml:"sinks,omitempty"`
+	// Targets are the Kubecost instances that can be probed at /probe?target=<name>
+	Targets map[string]*Target `yaml:"targets,omitempty"`
+	// Modules are the sets of the scrapers and the window options that are selected by /probe?module=<name>
+	Modules map[string]*Module `yaml:"modules,omitempty"`
+	// Tenants limit /metrics by the identity of the request, it's not limited if there are no tenants
+	Tenants map[string]*Tenant `yaml:"tenants,omitempty"`
+}
+
+// Target is a Kubecost instance with its own authentication
+type Target struct {
+	URL string `yaml:"url"`
+	// Module is used if the probe doesn't set one, the flags are used if it's empty too
+	Module string `yaml:"module,omitempty"`
+	// HTTPClientConfig is the authentication and TLS configuration, the same as in Prometheus:
+	// basic_auth, authorization, bearer_token, oauth2, tls_config, proxy_url
+	HTTPClientConfig promconfig.HTTPClientConfig `yaml:",inline"`
+
+	url *url.URL
+}
+
+// UnmarshalYAML sets the defaults of the HTTP client, the inlined config doesn't get them by itself
+func (t *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*t = Target{HTTPClientConfig: promconfig.DefaultHTTPClientConfig}
+	type plain Target
+	return unmarshal((*plain)(t))
+}
+
+// BaseURL returns the parsed URL of the target
+func (t *Target) BaseURL() *url.URL {
+	return t.url
+}
+
+// Module is a set of the scrapers with the window options, the options that aren't set are taken from the flags
+type Module struct {
+	Scrapers   []string `yaml:"scrapers,omitempty"`
+	Offset     *int64   `yaml:"offset,omitempty"`
+	Step       *string  `yaml:"step,omitempty"`
+	StepRange  *int64   `yaml:"step_range,omitempty"`
+	StepOutput *string  `yaml:"step_output,omitempty"`
+	// Filters are the Kubecost filters per scraper name
+	Filters map[string]kubecost_api.Filters `yaml:"filters,omitempty"`
+	// TopN are the top-n limits per scraper name, they replace the limits of the flags for these scrapers
+	TopN            map[string]collector.TopN `yaml:"top_n,omitempty"`
+	DuplicatePolicy *string                   `yaml:"duplicate_policy,omitempty"`
+	ClusterLabels   *bool                     `yaml:"cluster_labels,omitempty"`
+	// LabelRules and Budgets of a probe module replace the ones of the scrape options, if they're set
+	LabelRules []collector.LabelRule `yaml:"label_rules,omitempty"`
+	Budgets    []collector.Budget    `yaml:"budgets,omitempty"`
+}
+
+// ScraperNames returns all the scraper names used by the module, to be checked by the caller
+func (m *Module) ScraperNames() []string {
+	names := append([]string{}, m.Scrapers...)
+	for name := range m.Filters {
+		names = append(names, name)
+	}
+	for name := range m.TopN {
+		names = append(names, name)
+	}
+	for _, b := range m.Budgets {
+		names = append(names, b.ScraperName())
+	}
+	return names
+}
+
+// ScrapeOptions returns the options with the window options of the module
+func (m *Module) ScrapeOptions(opts collector.ScrapeOptions) (collector.ScrapeOptions, error) {
+	if m.Offset != nil {
+		opts.Offset = *m.Offset
+	}
+	if m.Step != nil {
+		step, err := collector.ParseStep(*m.Step)
+		if err != nil {
+			return opts, err
+		}
+		opts.Step = step
+	}
+	if m.StepRange != nil {
+		opts.StepRange = *m.StepRange
+	}
+	if m.StepOutput != nil {
+		opts.StepOutput = *m.StepOutput
+	}
+	if m.DuplicatePolicy != nil {
+		opts.DuplicatePolicy = *m.DuplicatePolicy
+	}
+	if m.ClusterLabels != nil {
+		opts.ClusterLabels = *m.ClusterLabels
+	}
+	if len(m.LabelRules) > 0 {
+		opts.LabelRules = m.LabelRules
+	}
+	if len(m.Budgets) > 0 {
+		opts.Budgets = m.Budgets
+	}
+	if len(m.TopN) > 0 {
+		// the map of the options is shared, so it's copied
+		topN := make(map[string]collector.TopN, len(opts.TopN)+len(m.TopN))
+		for name, t := range opts.TopN {
+			topN[name] = t
+		}
+		for name, t := range m.TopN {
+			topN[name] = t
+		}
+		opts.TopN = topN
+	}
+	return opts, opts.Validate()
+}
+
+// Load reads and validates the configuration file
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", path, err)
+	}
+	// the relative paths of the certificates and the password files are relative to the config
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range cfg.Targets {
+		if target != nil {
+			target.HTTPClientConfig.SetDirectory(dir)
+		}
+	}
+	if cfg.Kubecost != nil {
+		cfg.Kubecost.HTTPClientConfig.SetDirectory(dir)
+	}
+	for name, tenant := range cfg.Tenants {
+		if tenant == nil {
+			continue
+		}
+		if err := tenant.loadTokens(dir); err != nil {
+			return nil, fmt.Errorf("invalid %s: tenant %q: %s", path, name, err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration, the scraper names are checked by the caller.
+// The bearer token files of the tenants are read by Load
+func (c *Config) Validate() error {
+	if c.Kubecost != nil {
+		if len(c.Kubecost.Module) > 0 {
+			return fmt.Errorf("kubecost: module isn't supported, the scrape options are used for /metrics")
+		}
+		if err := c.Kubecost.validate(); err != nil {
+			return fmt.Errorf("kubecost: %s", err)
+		}
+	}
+	if c.Scrape != nil {
+		if _, err := c.Scrape.ScrapeOptions(collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel}); err != nil {
+			return fmt.Errorf("scrape: %s", err)
+		}
+	}
+	if c.Sinks != nil {
+		if err := c.Sinks.Validate(); err != nil {
+			return fmt.Errorf("sinks: %s", err)
+		}
+	}
+	for name, module := range c.Modules {
+		if module == nil {
+			return fmt.Errorf("module %q is empty", name)
+		}
+		if _, err := module.ScrapeOptions(collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel}); err != nil {
+			return fmt.Errorf("module %q: %s", name, err)
+		}
+	}
+	for name, target := range c.Targets {
+		if target == nil {
+			return fmt.Errorf("target %q is empty", name)
+		}
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("target %q: %s", name, err)
+		}
+		if len(target.Module) > 0 && c.Modules[target.Module] == nil {
+			return fmt.Errorf("target %q: unknown module %q", name, target.Module)
+		}
+	}
+	return validateTenants(c.Tenants)
+}
+
+// validate parses the URL and checks the HTTP client config
+func (t *Target) validate() error {
+	u, err := parseHTTPURL(t.URL)
+	if err != nil {
+		return err
+	}
+	t.url = u
+	return t.HTTPClientConfig.Validate()
+}
+
+// Target returns the configured target by its name or URL, the other targets aren't allowed to be probed
+func (c *Config) Target(target string) (string, *Target, bool) {
+	if t, ok := c.Targets[target]; ok {
+		return target, t, true
+	}
+	for name, t := range c.Targets {
+		if t.URL == target {
+			return name, t, true
+		}
+	}
+	return "", nil, false
+}
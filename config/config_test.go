@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+)
+
+// writeConfig writes the config file to a temporary directory, it returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+kubecost:
+  url: https://kubecost.example.com
+  basic_auth:
+    username: exporter
+    password_file: kubecost.password
+scrape:
+  scrapers: [scrape_allocation]
+  step: 1d
+  step_range: 7
+  duplicate_policy: sum
+  label_rules:
+  - {action: rename, source: app_name, target: app}
+  - {source: property_namespace, regex: "team-(.*)", target: team, replacement: "$1"}
+  budgets:
+  - {name: backend, amount: 100, match: {team: backend}}
+targets:
+  a:
+    url: http://kubecost-a:9090
+    module: assets
+modules:
+  assets:
+    scrapers: [scrape_assets]
+tenants:
+  backend:
+    bearer_token_files: [backend.token]
+    namespaces: [backend]
+`)
+	dir := filepath.Dir(path)
+	if err := os.WriteFile(filepath.Join(dir, "backend.token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cfg.Kubecost.BaseURL().String(); got != "https://kubecost.example.com" {
+		t.Errorf("got the kubecost URL %q", got)
+	}
+	// the relative paths are relative to the config
+	if got, want := cfg.Kubecost.HTTPClientConfig.BasicAuth.PasswordFile, filepath.Join(dir, "kubecost.password"); got != want {
+		t.Errorf("got the password file %q, want %q", got, want)
+	}
+	if got := cfg.Tenants["backend"].Tokens(); !reflect.DeepEqual(got, []string{"secret"}) {
+		t.Errorf("got the tokens %q", got)
+	}
+
+	opts, err := cfg.Scrape.ScrapeOptions(collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.LabelRules) != 2 || opts.LabelRules[1].Regex.String() != "^(?:team-(.*))$" || opts.LabelRules[1].Replacement != "$1" {
+		t.Errorf("got the label rules %+v", opts.LabelRules)
+	}
+	wantBudgets := []collector.Budget{{Name: "backend", Amount: 100, Match: map[string]string{"team": "backend"}}}
+	if !reflect.DeepEqual(opts.Budgets, wantBudgets) {
+		t.Errorf("got the budgets %+v, want %+v", opts.Budgets, wantBudgets)
+	}
+	if opts.StepRange != 7 || opts.DuplicatePolicy != collector.DuplicatePolicySum {
+		t.Errorf("got the options %+v", opts)
+	}
+
+	// the modules without the rules and the budgets keep the ones of the scrape options
+	moduleOpts, err := cfg.Modules["assets"].ScrapeOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moduleOpts.LabelRules) != 2 || len(moduleOpts.Budgets) != 1 {
+		t.Errorf("got the module rules %+v and budgets %+v", moduleOpts.LabelRules, moduleOpts.Budgets)
+	}
+
+	for _, target := range []string{"a", "http://kubecost-a:9090"} {
+		if name, _, ok := cfg.Target(target); !ok || name != "a" {
+			t.Errorf("Target(%q) = %q, %v", target, name, ok)
+		}
+	}
+	if _, _, ok := cfg.Target("http://kubecost-b:9090"); ok {
+		t.Error("an unconfigured target is found")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "unknown field", yaml: "scrape:\n  unknown: 1\n", wantErr: "field unknown not found"},
+		{name: "relative URL", yaml: "kubecost:\n  url: kubecost:9090\n", wantErr: "kubecost: url must be an absolute http(s) URL"},
+		{name: "module of /metrics", yaml: "kubecost:\n  url: http://kubecost:9090\n  module: a\n", wantErr: "kubecost: module isn't supported"},
+		{name: "invalid step", yaml: "scrape:\n  step: 30m\n", wantErr: `scrape: unknown step unit in "30m"`},
+		{name: "unknown duplicate policy", yaml: "modules:\n  a:\n    duplicate_policy: avg\n", wantErr: `module "a": unknown duplicate series policy "avg"`},
+		{name: "empty module", yaml: "modules:\n  a:\n", wantErr: `module "a" is empty`},
+		{name: "unknown module of the target", yaml: "targets:\n  a:\n    url: http://kubecost:9090\n    module: b\n", wantErr: `target "a": unknown module "b"`},
+		{name: "invalid regex", yaml: "scrape:\n  label_rules:\n  - {source: a, target: b, regex: \"(\"}\n", wantErr: "error parsing regexp"},
+		{name: "invalid label rule", yaml: "scrape:\n  label_rules:\n  - {action: drop, source: a}\n  - {source: a, target: b-c}\n", wantErr: `scrape: label rule 2: invalid target label "b-c"`},
+		{name: "duplicate budget", yaml: "scrape:\n  budgets:\n  - {name: a, amount: 1}\n  - {name: a, amount: 2}\n", wantErr: `scrape: duplicate budget "a"`},
+		{name: "tenant without identity", yaml: "tenants:\n  a:\n    namespaces: [a]\n", wantErr: `tenant "a": neither users nor bearer tokens are set`},
+		{name: "missing token file", yaml: "tenants:\n  a:\n    bearer_token_files: [missing]\n", wantErr: `tenant "a": couldn't read the bearer token file`},
+		{name: "user of two tenants", yaml: "tenants:\n  a:\n    users: [u]\n  b:\n    users: [u]\n", wantErr: `is already used by tenant`},
+		{name: "sink without a path", yaml: "sinks:\n  history: {}\n", wantErr: "sinks: history: path is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("the missing file is loaded")
+	}
+}
+
+func TestModuleScraperNames(t *testing.T) {
+	m := &Module{
+		Scrapers: []string{"scrape_allocation"},
+		TopN:     map[string]collector.TopN{"scrape_assets": {N: 1}},
+		Budgets:  []collector.Budget{{Name: "a"}, {Name: "b", Scraper: "scrape_unknown"}},
+	}
+	got := m.ScraperNames()
+	want := []string{"scrape_allocation", "scrape_assets", "scrape_allocation", "scrape_unknown"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/artemlive/kubecost_exporter/sink"
+	"github.com/prometheus/common/model"
+)
+
+// Sinks replace the flags of the sinks, the credentials are still taken from the flags and the environment.
+// The intervals are in the Prometheus duration format: 5m, 1h
+type Sinks struct {
+	RemoteWrite *RemoteWriteSink `yaml:"remote_write,omitempty"`
+	OTLP        *OTLPSink        `yaml:"otlp,omitempty"`
+	Records     *RecordsSink     `yaml:"records,omitempty"`
+	S3          *S3Sink          `yaml:"s3,omitempty"`
+	History     *HistorySink     `yaml:"history,omitempty"`
+}
+
+type RemoteWriteSink struct {
+	URL      string            `yaml:"url"`
+	Interval model.Duration    `yaml:"interval,omitempty"`
+	Timeout  model.Duration    `yaml:"timeout,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+}
+
+type OTLPSink struct {
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol,omitempty"`
+	Interval model.Duration    `yaml:"interval,omitempty"`
+	Cluster  string            `yaml:"cluster,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+}
+
+type RecordsSink struct {
+	Dir      string         `yaml:"dir"`
+	Format   string         `yaml:"format,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+type S3Sink struct {
+	Bucket   string         `yaml:"bucket"`
+	Endpoint string         `yaml:"endpoint,omitempty"`
+	Region   string         `yaml:"region,omitempty"`
+	Prefix   string         `yaml:"prefix,omitempty"`
+	Cluster  string         `yaml:"cluster,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+type HistorySink struct {
+	Path     string         `yaml:"path"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+// Validate checks the required fields, the URLs and the formats
+func (s *Sinks) Validate() error {
+	if s.RemoteWrite != nil {
+		if _, err := parseHTTPURL(s.RemoteWrite.URL); err != nil {
+			return fmt.Errorf("remote_write: %s", err)
+		}
+	}
+	if s.OTLP != nil {
+		if len(s.OTLP.Endpoint) == 0 {
+			return fmt.Errorf("otlp: endpoint is required")
+		}
+		switch s.OTLP.Protocol {
+		case "", sink.OTLPProtocolGRPC, sink.OTLPProtocolHTTP:
+		default:
+			return fmt.Errorf("otlp: unknown protocol %q", s.OTLP.Protocol)
+		}
+	}
+	if s.Records != nil {
+		if len(s.Records.Dir) == 0 {
+			return fmt.Errorf("records: dir is required")
+		}
+		switch s.Records.Format {
+		case "", sink.RecordFormatJSONL, sink.RecordFormatCSV, sink.RecordFormatParquet:
+		default:
+			return fmt.Errorf("records: unknown format %q", s.Records.Format)
+		}
+	}
+	if s.S3 != nil {
+		if len(s.S3.Bucket) == 0 {
+			return fmt.Errorf("s3: bucket is required")
+		}
+		if len(s.S3.Endpoint) > 0 {
+			if _, err := parseHTTPURL(s.S3.Endpoint); err != nil {
+				return fmt.Errorf("s3: %s", err)
+			}
+		}
+	}
+	if s.History != nil && len(s.History.Path) == 0 {
+		return fmt.Errorf("history: path is required")
+	}
+	return nil
+}
+
+// parseHTTPURL parses an absolute http(s) URL
+func parseHTTPURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL, got %q", s)
+	}
+	return u, nil
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	promconfig "github.com/prometheus/common/config"
+)
+
+// Tenant limits what an identity gets from /metrics. The identity is a basic auth user of the web config,
+// or a bearer token. The fields that aren't set don't limit anything
+type Tenant struct {
+	// Users are the basic auth users of the web config, their passwords are checked by the web server
+	Users            []string            `yaml:"users,omitempty"`
+	BearerTokens     []promconfig.Secret `yaml:"bearer_tokens,omitempty"`
+	BearerTokenFiles []string            `yaml:"bearer_token_files,omitempty"`
+	// Scrapers are the scrapers the tenant is allowed to collect, all the enabled ones if it's empty
+	Scrapers   []string `yaml:"scrapers,omitempty"`
+	Clusters   []string `yaml:"clusters,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// Labels are in the Kubecost format: "team:backend"
+	Labels []string `yaml:"labels,omitempty"`
+
+	tokens []string
+}
+
+// Tokens returns the bearer tokens of the tenant, along with the ones from the files
+func (t *Tenant) Tokens() []string {
+	return t.tokens
+}
+
+// loadTokens reads the token files, the relative paths are relative to the config
+func (t *Tenant) loadTokens(dir string) error {
+	t.tokens = nil
+	for _, token := range t.BearerTokens {
+		t.tokens = append(t.tokens, string(token))
+	}
+	for _, path := range t.BearerTokenFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("couldn't read the bearer token file: %s", err)
+		}
+		t.tokens = append(t.tokens, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// validateTenants checks that every tenant has an identity, and an identity has only one tenant
+func validateTenants(tenants map[string]*Tenant) error {
+	users := make(map[string]string)
+	tokens := make(map[string]string)
+	for name, t := range tenants {
+		if t == nil {
+			return fmt.Errorf("tenant %q is empty", name)
+		}
+		if len(t.Users) == 0 && len(t.tokens) == 0 {
+			return fmt.Errorf("tenant %q: neither users nor bearer tokens are set", name)
+		}
+		for _, user := range t.Users {
+			if other, ok := users[user]; ok {
+				return fmt.Errorf("tenant %q: user %q is already used by tenant %q", name, user, other)
+			}
+			users[user] = name
+		}
+		for _, token := range t.tokens {
+			if len(token) == 0 {
+				return fmt.Errorf("tenant %q: empty bearer token", name)
+			}
+			if other, ok := tokens[token]; ok {
+				return fmt.Errorf("tenant %q: a bearer token is already used by tenant %q", name, other)
+			}
+			tokens[token] = name
+		}
+		for _, label := range t.Labels {
+			if labelName, value, ok := strings.Cut(label, ":"); !ok || len(labelName) == 0 || len(value) == 0 {
+				return fmt.Errorf("tenant %q: label %q isn't in the \"name:value\" format", name, label)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/artemlive/kubecost_exporter/web"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// debugMaxResponseBytes limits the raw Kubecost response in the debug output
+	debugMaxResponseBytes = 64 << 10
+	// debugDefaultItems is the number of the items in the debug output, if the limit param isn't set
+	debugDefaultItems = 100
+)
+
+// debugScrape is the output of /debug/scrape
+type debugScrape struct {
+	Scraper  string                      `json:"scraper"`
+	Params   []string                    `json:"params"`
+	Error    string                      `json:"error,omitempty"`
+	Requests []kubecost_api.DebugRequest `json:"requests"`
+	// ItemsTotal is the number of the decoded items, only the first ones up to the limit are in Items
+	ItemsTotal int                   `json:"items_total"`
+	Items      []collector.DebugItem `json:"items"`
+	Dropped    []debugDropped        `json:"dropped"`
+}
+
+// debugDropped is an item that wasn't exported, either skipped by the client or failed in the scraper
+type debugDropped struct {
+	Item   interface{} `json:"item"`
+	Reason string      `json:"reason"`
+}
+
+// newDebugHandler runs a single scraper and shows what Kubecost returned and what the scraper made of it:
+// /debug/scrape?collect=scrape_assets&scrape_assets[]=filterTypes=Node&limit=10
+// The cache and the deduplication of the requests are bypassed, so the response is always the one of the request.
+// It's served only for the authenticated requests: the basic auth users of the web config or the tenants without limits
+func newDebugHandler(currentSetup func() *scrapeSetup, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setup := currentSetup()
+		t, ok := setup.tenants.identify(r)
+		switch {
+		case !ok || t != nil && !t.unrestricted():
+			http.Error(w, "forbidden for the tenant", http.StatusForbidden)
+			return
+		case t == nil && len(web.User(r)) == 0:
+			http.Error(w, "the debug endpoint needs basic_auth_users in --web.config.file or the tenants in --config.file", http.StatusForbidden)
+			return
+		}
+
+		name := r.URL.Query().Get("collect")
+		var scraper collector.Scraper
+		for _, s := range setup.scrapers {
+			if s.Name() == name {
+				scraper = s
+			}
+		}
+		if scraper == nil {
+			http.Error(w, fmt.Sprintf("scraper %q isn't enabled", name), http.StatusBadRequest)
+			return
+		}
+		limit := debugDefaultItems
+		if l := r.URL.Query().Get("limit"); len(l) > 0 {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", l), http.StatusBadRequest)
+				return
+			}
+		}
+		// the same params as /metrics: the configured filters first, then the ones of the query
+		params := append(append([]string{}, setup.filters[name].QueryParams()...), r.URL.Query()[name+"[]"]...)
+
+		debug := &collector.ScrapeDebug{Kubecost: kubecost_api.Debug{MaxBodyBytes: debugMaxResponseBytes}, MaxItems: limit}
+		opts := setup.opts
+		opts.Debug = debug
+		opts.Cache, opts.Requests, opts.Status, opts.Instrumentation = nil, nil, nil, nil
+		opts.Records = nil
+		scrapeLogger := log.With(logger, "scraper", name)
+		level.Debug(scrapeLogger).Log("msg", "Debug scrape", "params", fmt.Sprint(params))
+
+		// the series are recorded by the debug, the metrics themselves aren't needed
+		ch := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+		baseURL := setup.baseURL
+		err := scraper.Scrape(r.Context(), &baseURL, params, ch, scrapeLogger, opts)
+		close(ch)
+		<-done
+
+		out := debugScrape{Scraper: name, Params: params, Requests: debug.Kubecost.Requests(), Dropped: []debugDropped{}}
+		if err != nil {
+			out.Error = err.Error()
+		}
+		items, total := debug.Items()
+		out.ItemsTotal = total
+		out.Items = []collector.DebugItem{}
+		for _, item := range items {
+			if len(item.Dropped) > 0 {
+				out.Dropped = append(out.Dropped, debugDropped{Item: item.Item, Reason: item.Dropped})
+				continue
+			}
+			out.Items = append(out.Items, item)
+		}
+		for _, item := range debug.Kubecost.Skipped() {
+			out.Dropped = append(out.Dropped, debugDropped{Item: item.Item, Reason: item.Reason})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			level.Error(logger).Log("msg", "Error writing the debug output", "err", err)
+		}
+	}
+}
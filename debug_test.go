@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/web"
+	"github.com/go-kit/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// debugAssets are a node, an asset of an unknown type that the client skips and a disk with a label the scraper can't export
+const debugAssets = `{"code":200,"data":{
+	"node":{"type":"Node","properties":{"name":"node-a"},"totalCost":1},
+	"mystery":{"type":"Mystery","properties":{"name":"mystery"},"totalCost":2},
+	"disk":{"type":"Disk","properties":{"name":"disk-a"},"labels":{"size":3},"totalCost":3}
+}}`
+
+// writeTestFile writes the file to a temporary directory
+func writeTestFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDebugHandler(t *testing.T) {
+	kubecost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(debugAssets))
+	}))
+	defer kubecost.Close()
+	baseURL, _ := url.Parse(kubecost.URL)
+	scrapers, err := scrapersByName([]string{collector.ScrapeAssets{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSetup := func(t *testing.T, tenantsYAML string) *scrapeSetup {
+		setup := &scrapeSetup{
+			baseURL:  baseURL,
+			scrapers: scrapers,
+			opts:     collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel, DuplicatePolicy: collector.DuplicatePolicyFirst},
+		}
+		if len(tenantsYAML) > 0 {
+			// the bearer tokens of the tenants are read by config.Load
+			cfg, err := config.Load(writeTestFile(t, "config.yml", tenantsYAML))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if setup.tenants, err = newTenants(cfg.Tenants); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return setup
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the web server sets the basic auth user of the request
+	withUsers := func(t *testing.T, handler http.Handler) http.Handler {
+		s, err := web.NewServer(writeTestFile(t, "web.yml", "basic_auth_users:\n  admin: "+string(hash)+"\n"), log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Handler(handler)
+	}
+	noUsers := func(t *testing.T, handler http.Handler) http.Handler { return handler }
+	tenantsYAML := `
+tenants:
+  admin:
+    bearer_tokens: [admin-token]
+  backend:
+    bearer_tokens: [backend-token]
+    namespaces: [backend]
+`
+
+	tests := []struct {
+		name       string
+		web        func(t *testing.T, handler http.Handler) http.Handler
+		tenants    string
+		auth       func(r *http.Request)
+		query      string
+		wantStatus int
+	}{
+		{name: "no basic auth user", web: noUsers, query: "collect=scrape_assets", wantStatus: http.StatusForbidden},
+		{name: "restricted tenant", web: noUsers, tenants: tenantsYAML, auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer backend-token") }, query: "collect=scrape_assets", wantStatus: http.StatusForbidden},
+		{name: "no tenant", web: noUsers, tenants: tenantsYAML, query: "collect=scrape_assets", wantStatus: http.StatusForbidden},
+		{name: "unrestricted tenant", web: noUsers, tenants: tenantsYAML, auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-token") }, query: "collect=scrape_assets", wantStatus: http.StatusOK},
+		{name: "basic auth user", web: withUsers, auth: func(r *http.Request) { r.SetBasicAuth("admin", "password") }, query: "collect=scrape_assets", wantStatus: http.StatusOK},
+		{name: "invalid limit", web: withUsers, auth: func(r *http.Request) { r.SetBasicAuth("admin", "password") }, query: "collect=scrape_assets&limit=ten", wantStatus: http.StatusBadRequest},
+		{name: "negative limit", web: withUsers, auth: func(r *http.Request) { r.SetBasicAuth("admin", "password") }, query: "collect=scrape_assets&limit=-1", wantStatus: http.StatusBadRequest},
+		{name: "unknown scraper", web: withUsers, auth: func(r *http.Request) { r.SetBasicAuth("admin", "password") }, query: "collect=scrape_allocation", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup := newSetup(t, tt.tenants)
+			handler := tt.web(t, newDebugHandler(func() *scrapeSetup { return setup }, log.NewNopLogger()))
+			r := httptest.NewRequest("GET", "/debug/scrape?"+tt.query, nil)
+			if tt.auth != nil {
+				tt.auth(r)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	// the node is exported, the unknown asset is skipped by the client and the disk fails in the scraper
+	setup := newSetup(t, "")
+	handler := withUsers(t, newDebugHandler(func() *scrapeSetup { return setup }, log.NewNopLogger()))
+	r := httptest.NewRequest("GET", "/debug/scrape?collect=scrape_assets&scrape_assets[]=filterTypes=Node", nil)
+	r.SetBasicAuth("admin", "password")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var out struct {
+		Error      string   `json:"error"`
+		Params     []string `json:"params"`
+		ItemsTotal int      `json:"items_total"`
+		Requests   []struct {
+			URL      string `json:"url"`
+			Response string `json:"response"`
+		} `json:"requests"`
+		Items []struct {
+			Series []struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"series"`
+		} `json:"items"`
+		Dropped []struct {
+			Item   struct{ Type string } `json:"item"`
+			Reason string                `json:"reason"`
+		} `json:"dropped"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	if out.Error != "couldn't process label value to string: 3" || out.ItemsTotal != 2 {
+		t.Errorf("got the error %q with %d items", out.Error, out.ItemsTotal)
+	}
+	if len(out.Params) == 0 || out.Params[0] != "filterTypes=Node" {
+		t.Errorf("got the params %q, want the ones of the query", out.Params)
+	}
+	if len(out.Requests) != 1 || out.Requests[0].Response != debugAssets {
+		t.Errorf("got the requests %+v, want the raw assets response", out.Requests)
+	}
+	if len(out.Items) != 1 || len(out.Items[0].Series) != 1 || out.Items[0].Series[0].Labels["property_name"] != "node-a" {
+		t.Errorf("got the items %+v, want the node", out.Items)
+	}
+	var dropped []string
+	for _, d := range out.Dropped {
+		dropped = append(dropped, d.Item.Type+": "+d.Reason)
+	}
+	if want := []string{"Disk: couldn't process label value to string: 3", `Mystery: unknown asset type "Mystery"`}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("got the dropped items %q, want %q", dropped, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/version"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// kubecostCheckTimeout limits the Kubecost request of /-/ready and /status, the probes have their own short timeouts
+const kubecostCheckTimeout = 5 * time.Second
+
+// healthyHandler answers while the process is alive
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Kubecost exporter is Healthy.")
+}
+
+// newReadyHandler answers when the config is loaded and Kubecost answered within maxContactAge.
+// Kubecost is requested by the handler itself if the scrapes haven't contacted it recently, e.g. right after the start
+func newReadyHandler(currentSetup func() *scrapeSetup, maxContactAge time.Duration, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setup := currentSetup()
+		if setup == nil {
+			http.Error(w, "the config isn't loaded", http.StatusServiceUnavailable)
+			return
+		}
+		if time.Since(setup.opts.Status.LastContact()) > maxContactAge {
+			ctx, cancel := context.WithTimeout(r.Context(), kubecostCheckTimeout)
+			defer cancel()
+			if err := collector.CheckKubecost(ctx, setup.baseURL, setup.opts); err != nil {
+				level.Warn(logger).Log("msg", "Not ready, Kubecost isn't reachable", "err", err)
+				http.Error(w, fmt.Sprintf("Kubecost isn't reachable: %s", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "Kubecost exporter is Ready.")
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"items": func(items map[string]int) string {
+		var parts []string
+		for name, n := range items {
+			parts = append(parts, fmt.Sprintf("%s: %d", name, n))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ", ")
+	},
+}).Parse(`<html>
+<head><title>KubeCost exporter status</title></head>
+<body>
+<h1>KubeCost exporter status</h1>
+<h2>Kubecost</h2>
+<table>
+<tr><th align="left">URL</th><td>{{.URL}}</td></tr>
+<tr><th align="left">Version</th><td>{{if .KubecostVersion}}{{.KubecostVersion}}{{else}}unknown{{end}}</td></tr>
+<tr><th align="left">Last contact</th><td>{{since .LastContact}}</td></tr>
+</table>
+<h2>Exporter</h2>
+<table>
+<tr><th align="left">Version</th><td>{{.Version}}</td></tr>
+<tr><th align="left">Config file</th><td>{{if .ConfigFile}}{{.ConfigFile}}{{else}}none{{end}}</td></tr>
+<tr><th align="left">Last reload</th><td>{{if .ReloadError}}failed: {{.ReloadError}}{{else}}successful{{end}}</td></tr>
+</table>
+<h2>Scrapers</h2>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Scraper</th><th>Last run</th><th>Duration</th><th>Items</th><th>Error</th></tr>
+{{range .Scrapers}}<tr><td>{{.Name}}</td><td>{{since .LastRun}}</td><td>{{.Duration}}</td><td>{{items .Items}}</td><td>{{.Error}}</td></tr>
+{{else}}<tr><td colspan="5">no scrapes yet</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// newStatusHandler shows the last runs of the scrapers and the Kubecost instance
+func newStatusHandler(reloads *reloader, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setup := reloads.current()
+		status := setup.opts.Status
+		// the version is known only after the cluster info was requested
+		if len(status.Version()) == 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), kubecostCheckTimeout)
+			defer cancel()
+			if err := collector.CheckKubecost(ctx, setup.baseURL, setup.opts); err != nil {
+				level.Debug(logger).Log("msg", "Error requesting the Kubecost version", "err", err)
+			}
+		}
+		data := struct {
+			URL             string
+			KubecostVersion string
+			LastContact     time.Time
+			Version         string
+			ConfigFile      string
+			ReloadError     string
+			Scrapers        []collector.ScraperStatus
+		}{
+			URL:             setup.baseURL.Redacted(),
+			KubecostVersion: status.Version(),
+			LastContact:     status.LastContact(),
+			Version:         version.Info(),
+			ConfigFile:      reloads.path,
+			ReloadError:     reloads.lastError(),
+			Scrapers:        status.Scrapers(),
+		}
+		if err := statusTemplate.Execute(w, data); err != nil {
+			level.Error(logger).Log("msg", "Error rendering the status page", "err", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/go-kit/log"
+)
+
+// serve returns the status and the body of the GET request
+func serve(handler http.Handler, target string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestReadyHandler(t *testing.T) {
+	k, kubecostURL := newFakeKubecost(t)
+	baseURL, _ := url.Parse(kubecostURL)
+	setup := &scrapeSetup{baseURL: baseURL, opts: collector.ScrapeOptions{Status: collector.NewStatus()}}
+	handler := newReadyHandler(func() *scrapeSetup { return setup }, time.Minute, log.NewNopLogger())
+
+	// nothing has contacted Kubecost yet, the handler requests it by itself
+	if code, body := serve(handler, "/-/ready"); code != http.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if got, want := k.paths(), []string{"/model/clusterInfo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the requests %q, want %q", got, want)
+	}
+	// the contact is recent now, Kubecost isn't requested again
+	if code, _ := serve(handler, "/-/ready"); code != http.StatusOK || len(k.paths()) != 1 {
+		t.Errorf("got status %d with the requests %q after the recent contact", code, k.paths())
+	}
+
+	// the contact is stale and Kubecost is down
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	setup.baseURL, _ = url.Parse(unreachable.URL)
+	handler = newReadyHandler(func() *scrapeSetup { return setup }, 0, log.NewNopLogger())
+	if code, body := serve(handler, "/-/ready"); code != http.StatusServiceUnavailable || !strings.Contains(body, "Kubecost isn't reachable") {
+		t.Errorf("got status %d with the unreachable Kubecost: %s", code, body)
+	}
+
+	handler = newReadyHandler(func() *scrapeSetup { return nil }, time.Minute, log.NewNopLogger())
+	if code, _ := serve(handler, "/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without the config", code)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	k, kubecostURL := newFakeKubecost(t)
+	k.allocations = `{"code":200,"data":[{`
+	baseURL, _ := url.Parse(kubecostURL)
+	scrapers, err := scrapersByName([]string{collector.ScrapeAllocation{}.Name(), collector.ScrapeAssets{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := scrapeSetup{
+		baseURL:  baseURL,
+		scrapers: scrapers,
+		opts:     collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel, DuplicatePolicy: collector.DuplicatePolicyFirst, Status: collector.NewStatus()},
+	}
+	setup, err := newScrapeSetup(&config.Config{}, flags, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := newReloader("", &config.Config{}, flags, setup, log.NewNopLogger())
+	handler := newStatusHandler(reloads, log.NewNopLogger())
+
+	_, body := serve(handler, "/status")
+	if !strings.Contains(body, "no scrapes yet") {
+		t.Errorf("got the scrapers before the first scrape:\n%s", body)
+	}
+
+	// the allocation response is broken, the assets are fine
+	serve(newHandler(collector.NewMetrics(), reloads.current, log.NewNopLogger()), "/metrics")
+	_, body = serve(handler, "/status")
+	// the rows are sorted by the scraper name, the error is in the row of its scraper
+	for _, want := range []string{
+		"<td>" + kubecostURL + "</td>",
+		"<td>unexpected end of JSON input</td></tr>\n<tr><td>scrape_assets</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the status page doesn't have %q:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(body, "<tr><td>scrape_allocation</td>") || strings.Contains(body, "no scrapes yet") {
+		t.Errorf("the status page doesn't have the scrapers:\n%s", body)
+	}
+}
+
+func TestReloadStatus(t *testing.T) {
+	_, aURL := newFakeKubecost(t)
+	_, bURL := newFakeKubecost(t)
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(kubecostURL string) {
+		if err := os.WriteFile(path, []byte("kubecost:\n  url: "+kubecostURL+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(aURL)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := scrapeSetup{opts: collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel, Status: collector.NewStatus()}}
+	setup, err := newScrapeSetup(cfg, flags, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(path, cfg, flags, setup, log.NewNopLogger())
+	status := r.current().opts.Status
+	if err := collector.CheckKubecost(context.Background(), r.current().baseURL, r.current().opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same instance keeps its last contact
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.current().opts.Status != status || r.current().opts.Status.LastContact().IsZero() {
+		t.Error("the status is replaced by the reload of the same Kubecost URL")
+	}
+
+	// the new instance hasn't been contacted yet
+	write(bURL)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.current().opts.Status; got == status || !got.LastContact().IsZero() {
+		t.Error("the status of the previous Kubecost URL is kept")
+	}
+}
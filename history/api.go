@@ -0,0 +1,116 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// defaultQueryDays is the range of the query without from and to
+const defaultQueryDays = 7
+
+// CostsResponse is the response of the costs API
+type CostsResponse struct {
+	Kind    string      `json:"kind"`
+	From    time.Time   `json:"from"`
+	To      time.Time   `json:"to"`
+	GroupBy []string    `json:"groupBy"`
+	Data    []CostGroup `json:"data"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler returns the handler of /api/v1/costs?from=&to=&groupBy=&filter=&kind=&limit=
+//
+//	from, to: YYYY-MM-DD or RFC3339, the last 7 days by default, to is exclusive
+//	groupBy: comma separated fields, e.g. namespace,day or cluster,label:team
+//	filter: namespace:"kubecost","default"+label[team]:"platform"
+//	kind: allocations (default) or assets
+func NewHandler(store *Store, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r, time.Now())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		groups, err := store.Query(r.Context(), q)
+		if err != nil {
+			// the fields are validated by the query, the other errors are ours
+			if _, ok := err.(queryError); ok {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+				return
+			}
+			level.Error(logger).Log("msg", "Error querying the cost history", "err", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, CostsResponse{
+			Kind:    q.Kind,
+			From:    q.From,
+			To:      q.To,
+			GroupBy: q.GroupBy,
+			Data:    groups,
+		})
+	}
+}
+
+func parseQuery(r *http.Request, now time.Time) (Query, error) {
+	params := r.URL.Query()
+	q := Query{Kind: params.Get("kind"), GroupBy: []string{}}
+	if len(q.Kind) == 0 {
+		q.Kind = collector.RecordKindAllocations
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	q.To = today.AddDate(0, 0, 1)
+	q.From = today.AddDate(0, 0, -defaultQueryDays+1)
+	var err error
+	if v := params.Get("from"); len(v) > 0 {
+		if q.From, err = parseTime(v); err != nil {
+			return q, fmt.Errorf("invalid from: %s", err)
+		}
+	}
+	if v := params.Get("to"); len(v) > 0 {
+		if q.To, err = parseTime(v); err != nil {
+			return q, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+	for _, field := range strings.Split(params.Get("groupBy"), ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			q.GroupBy = append(q.GroupBy, field)
+		}
+	}
+	if q.Filters, err = ParseFilter(params.Get("filter")); err != nil {
+		return q, err
+	}
+	if v := params.Get("limit"); len(v) > 0 {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return q, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
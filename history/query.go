@@ -0,0 +1,222 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// groupByDay groups the costs by the UTC day of the window start
+const groupByDay = "day"
+
+// Query selects the costs of a records kind in [From, To) and sums them by the GroupBy dimensions
+type Query struct {
+	Kind string
+	From time.Time
+	To   time.Time
+	// GroupBy are the dimension columns, "day" or "label:<name>" like in the Kubecost aggregate parameter
+	GroupBy []string
+	Filters []Filter
+	// Limit is the max number of the returned groups, the most expensive are returned, 0 is no limit
+	Limit int
+}
+
+// Filter matches the rows where the field has one of the values, or none of them if Negate is set
+type Filter struct {
+	// Field is a dimension column or "label:<name>"
+	Field  string
+	Values []string
+	Negate bool
+}
+
+// ParseFilter parses a subset of the Kubecost filter language: clauses joined with "+" or whitespace
+// ("+" of a query string decodes to a space), every clause is field:"value1","value2" or field!:"value",
+// labels are label[name]:"value", e.g. namespace:"kubecost"+label[team]:"platform".
+// The quoted values can contain the separators, any text that isn't a clause is an error
+func ParseFilter(filter string) ([]Filter, error) {
+	var filters []Filter
+	for _, clause := range splitUnquoted(filter, func(r rune) bool { return r == '+' || unicode.IsSpace(r) }) {
+		i := strings.Index(clause, ":")
+		if i < 1 || strings.Contains(clause[:i], `"`) {
+			return nil, fmt.Errorf("invalid filter clause %q, expected field:\"value\"", clause)
+		}
+		f := Filter{Field: clause[:i]}
+		if strings.HasSuffix(f.Field, "!") {
+			f.Negate = true
+			f.Field = strings.TrimSuffix(f.Field, "!")
+		}
+		if strings.HasPrefix(f.Field, "label[") && strings.HasSuffix(f.Field, "]") {
+			f.Field = "label:" + f.Field[len("label["):len(f.Field)-1]
+		}
+		for _, v := range splitUnquoted(clause[i+1:], func(r rune) bool { return r == ',' }) {
+			// the quotes are optional for the values without the separators
+			if strings.HasPrefix(v, `"`) && len(v) > 1 && strings.HasSuffix(v, `"`) {
+				v = v[1 : len(v)-1]
+			}
+			if strings.Contains(v, `"`) {
+				return nil, fmt.Errorf("invalid value in the filter clause %q, unbalanced quotes", clause)
+			}
+			f.Values = append(f.Values, v)
+		}
+		if len(f.Values) == 0 {
+			return nil, fmt.Errorf("invalid filter clause %q, expected field:\"value\"", clause)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// splitUnquoted splits s at the separators outside the double quotes, the empty parts are dropped
+func splitUnquoted(s string, separator func(rune) bool) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && separator(r):
+			if i > start {
+				parts = append(parts, s[start:i])
+			}
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	if len(s) > start {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// queryError is returned for the invalid queries, it's the client's fault
+type queryError struct {
+	error
+}
+
+// CostGroup is the sum of the costs of a group
+type CostGroup struct {
+	Group map[string]string  `json:"group"`
+	Costs map[string]float64 `json:"costs"`
+	// Items is the number of the summed rows
+	Items int `json:"items"`
+}
+
+// expression returns the SQL expression of the field and its argument
+func (t *table) expression(field string) (string, []interface{}, error) {
+	switch {
+	case field == groupByDay:
+		return "strftime('%Y-%m-%d', window_start, 'unixepoch')", nil, nil
+	case strings.HasPrefix(field, "label:"):
+		name := strings.TrimPrefix(field, "label:")
+		if len(name) == 0 || strings.ContainsAny(name, `"\`) {
+			return "", nil, queryError{fmt.Errorf("invalid label name %q", name)}
+		}
+		return "coalesce(json_extract(labels, ?), '')", []interface{}{`$."` + name + `"`}, nil
+	case t.dimensions[field]:
+		return field, nil, nil
+	}
+	return "", nil, queryError{fmt.Errorf("unknown field %q for %s, the fields are: %s, %s and label:<name>", field, t.name, strings.Join(t.dimensionNames(), ", "), groupByDay)}
+}
+
+func (t *table) dimensionNames() []string {
+	names := make([]string, 0, len(t.dimensions))
+	for name := range t.dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Query runs the query, the groups are sorted by the total cost, the most expensive first
+func (s *Store) Query(ctx context.Context, q Query) ([]CostGroup, error) {
+	t, ok := tables[q.Kind]
+	if !ok {
+		return nil, queryError{fmt.Errorf("unknown kind %q, expected %s or %s", q.Kind, allocationsTable.name, assetsTable.name)}
+	}
+	var (
+		selects []string
+		groups  []string
+		where   = []string{"window_start >= ?", "window_start < ?"}
+		args    []interface{}
+		// the arguments of the select expressions go before the where arguments
+		whereArgs = []interface{}{q.From.Unix(), q.To.Unix()}
+	)
+	for i, field := range q.GroupBy {
+		expr, exprArgs, err := t.expression(field)
+		if err != nil {
+			return nil, err
+		}
+		selects = append(selects, fmt.Sprintf("%s AS g%d", expr, i))
+		groups = append(groups, fmt.Sprintf("g%d", i))
+		args = append(args, exprArgs...)
+	}
+	for _, cost := range t.costs {
+		selects = append(selects, fmt.Sprintf("coalesce(sum(%s), 0)", cost))
+	}
+	selects = append(selects, "count(*)")
+	for _, f := range q.Filters {
+		expr, exprArgs, err := t.expression(f.Field)
+		if err != nil {
+			return nil, err
+		}
+		op := "IN"
+		if f.Negate {
+			op = "NOT IN"
+		}
+		where = append(where, fmt.Sprintf("%s %s (%s)", expr, op, strings.TrimSuffix(strings.Repeat("?, ", len(f.Values)), ", ")))
+		whereArgs = append(whereArgs, exprArgs...)
+		for _, v := range f.Values {
+			whereArgs = append(whereArgs, v)
+		}
+	}
+	stmt := fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(selects, ", "), t.name, strings.Join(where, " AND "))
+	if len(groups) > 0 {
+		stmt += " GROUP BY " + strings.Join(groups, ", ")
+	}
+	stmt += " ORDER BY sum(total_cost) DESC"
+	if q.Limit > 0 {
+		stmt += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, stmt, append(args, whereArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []CostGroup{}
+	for rows.Next() {
+		groupValues := make([]string, len(q.GroupBy))
+		costs := make([]float64, len(t.costs))
+		var items int
+		dest := make([]interface{}, 0, len(groupValues)+len(costs)+1)
+		for i := range groupValues {
+			dest = append(dest, &groupValues[i])
+		}
+		for i := range costs {
+			dest = append(dest, &costs[i])
+		}
+		dest = append(dest, &items)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		// the query without groupBy returns a row even if nothing matched
+		if items == 0 {
+			continue
+		}
+		g := CostGroup{Group: make(map[string]string, len(q.GroupBy)), Costs: make(map[string]float64, len(costs)), Items: items}
+		for i, field := range q.GroupBy {
+			g.Group[field] = groupValues[i]
+		}
+		for i, cost := range t.costs {
+			g.Costs[cost] = costs[i]
+		}
+		result = append(result, g)
+	}
+	return result, rows.Err()
+}
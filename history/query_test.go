@@ -0,0 +1,241 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		want    []Filter
+		wantErr bool
+	}{
+		{name: "empty", filter: " "},
+		{
+			name:   "clauses joined with +",
+			filter: `namespace:"kubecost","default"+label[team]!:"platform"`,
+			want: []Filter{
+				{Field: "namespace", Values: []string{"kubecost", "default"}},
+				{Field: "label:team", Values: []string{"platform"}, Negate: true},
+			},
+		},
+		{
+			// the unescaped "+" of the query string
+			name:   "clauses joined with a space",
+			filter: `namespace:"kubecost" cluster:"cluster-one"`,
+			want: []Filter{
+				{Field: "namespace", Values: []string{"kubecost"}},
+				{Field: "cluster", Values: []string{"cluster-one"}},
+			},
+		},
+		{
+			name:   "separators in the quotes",
+			filter: `label[team]:"a+b c","d,e"`,
+			want:   []Filter{{Field: "label:team", Values: []string{"a+b c", "d,e"}}},
+		},
+		{name: "unquoted value", filter: `namespace:kubecost`, want: []Filter{{Field: "namespace", Values: []string{"kubecost"}}}},
+		{name: "text after a clause", filter: `namespace:"kubecost" or cluster:"one"`, wantErr: true},
+		{name: "missing field", filter: `:"kubecost"`, wantErr: true},
+		{name: "missing value", filter: `namespace:`, wantErr: true},
+		{name: "unbalanced quotes", filter: `namespace:"kube cost`, wantErr: true},
+		{name: "text after the quotes", filter: `namespace:"kubecost"x`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilter(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFilter(%q) error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFilter(%q) = %+v, want %+v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+var (
+	day1 = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2 = day1.AddDate(0, 0, 1)
+)
+
+func testAllocation(cluster, namespace, team string, cost float64) kubecost_api.Allocation {
+	return kubecost_api.Allocation{
+		Name:       cluster + "/" + namespace,
+		Properties: &kubecost_api.AllocationProperties{Cluster: cluster, Namespace: namespace, Labels: map[string]string{"team": team}},
+		CPUCost:    cost,
+		TotalCost:  cost,
+	}
+}
+
+// newTestStore returns a store with two days of allocations
+func newTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "history.db"), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	ctx := context.Background()
+	days := []*collector.Records{
+		{Start: day1, End: day2, Allocations: []kubecost_api.Allocation{
+			testAllocation("one", "kubecost", "platform", 1),
+			testAllocation("one", "default", "web", 2),
+			testAllocation("two", "default", "web", 4),
+		}},
+		{Start: day2, End: day2.AddDate(0, 0, 1), Allocations: []kubecost_api.Allocation{
+			testAllocation("one", "kubecost", "platform", 8),
+		}},
+	}
+	for _, records := range days {
+		if err := store.WriteRecords(ctx, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first day scraped again replaces the rows of its clusters
+	if err := store.WriteRecords(ctx, &collector.Records{Start: day1, End: day2, Allocations: []kubecost_api.Allocation{
+		testAllocation("one", "kubecost", "platform", 16),
+		testAllocation("one", "default", "web", 32),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// totals returns the total cost of the groups by the values of the field
+func totals(groups []CostGroup, fields ...string) map[string]float64 {
+	result := make(map[string]float64, len(groups))
+	for _, g := range groups {
+		var key string
+		for i, field := range fields {
+			if i > 0 {
+				key += "/"
+			}
+			key += g.Group[field]
+		}
+		result[key] = g.Costs["total_cost"]
+	}
+	return result
+}
+
+func TestQuery(t *testing.T) {
+	store := newTestStore(t)
+	tests := []struct {
+		name    string
+		query   Query
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:  "group by namespace",
+			query: Query{GroupBy: []string{"namespace"}},
+			want:  map[string]float64{"kubecost": 24, "default": 36},
+		},
+		{
+			name:  "group by day and label",
+			query: Query{GroupBy: []string{groupByDay, "label:team"}},
+			want:  map[string]float64{"2022-01-01/platform": 16, "2022-01-01/web": 36, "2022-01-02/platform": 8},
+		},
+		{
+			name:  "range",
+			query: Query{GroupBy: []string{"cluster"}, To: day2},
+			want:  map[string]float64{"one": 48, "two": 4},
+		},
+		{
+			name:  "filters",
+			query: Query{GroupBy: []string{"cluster"}, Filters: []Filter{{Field: "label:team", Values: []string{"web"}}, {Field: "cluster", Values: []string{"two"}, Negate: true}}},
+			want:  map[string]float64{"one": 32},
+		},
+		{
+			name:  "limit keeps the most expensive",
+			query: Query{GroupBy: []string{"namespace", "cluster"}, Limit: 1},
+			want:  map[string]float64{"default/one": 32},
+		},
+		{name: "no group", query: Query{}, want: map[string]float64{"": 60}},
+		{name: "nothing matched", query: Query{Filters: []Filter{{Field: "namespace", Values: []string{"none"}}}}, want: map[string]float64{}},
+		{name: "unknown field", query: Query{GroupBy: []string{"team"}}, wantErr: true},
+		{name: "invalid label", query: Query{GroupBy: []string{`label:a"b`}}, wantErr: true},
+		{name: "unknown kind", query: Query{Kind: "pods"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			if len(q.Kind) == 0 {
+				q.Kind = collector.RecordKindAllocations
+			}
+			if q.From.IsZero() {
+				q.From = day1
+			}
+			if q.To.IsZero() {
+				q.To = day2.AddDate(0, 0, 1)
+			}
+			groups, err := store.Query(context.Background(), q)
+			if err != nil {
+				if _, ok := err.(queryError); !ok || !tt.wantErr {
+					t.Fatalf("Query() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("Query() returned no error")
+			}
+			if got := totals(groups, q.GroupBy...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got totals %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := NewHandler(newTestStore(t), log.NewNopLogger())
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       map[string]float64
+	}{
+		{
+			// "+" of the query string is a space
+			query:      `from=2022-01-01&to=2022-01-03&groupBy=cluster&filter=namespace:"default"+label[team]:"web"`,
+			wantStatus: http.StatusOK,
+			want:       map[string]float64{"one": 32, "two": 4},
+		},
+		{
+			query:      `from=2022-01-01&to=2022-01-03&groupBy=cluster&filter=namespace:"default"%2Bcluster!:"two"`,
+			wantStatus: http.StatusOK,
+			want:       map[string]float64{"one": 32},
+		},
+		{query: `from=2022-01-01&filter=namespace:"default"+and+more`, wantStatus: http.StatusBadRequest},
+		{query: `groupBy=team`, wantStatus: http.StatusBadRequest},
+		{query: `from=2022-01-02&to=2022-01-01`, wantStatus: http.StatusBadRequest},
+		{query: `limit=-1`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/api/v1/costs?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response CostsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if got := totals(response.Data, response.GroupBy...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got totals %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Package history keeps the allocations and assets fetched by the scrapers in a local SQLite database,
+// so the costs can be queried after they are gone from Kubecost
+package history
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	// pure Go SQLite driver, the exporter is built without cgo
+	_ "modernc.org/sqlite"
+)
+
+// Verify if Store implements collector.RecordWriter
+var _ collector.RecordWriter = (*Store)(nil)
+
+// column is a column of the table, it's derived from the json tag of the record struct field,
+// so the tables have the same columns as the records files
+type column struct {
+	name    string
+	sqlType string
+	field   int
+}
+
+// table describes the table of a records kind
+type table struct {
+	name    string
+	columns []column
+	// dimensions are the text columns, they can be used in groupBy and filter
+	dimensions map[string]bool
+	// costs are the summed columns
+	costs []string
+}
+
+func newTable(name string, sample interface{}) *table {
+	t := &table{name: name, dimensions: make(map[string]bool)}
+	typ := reflect.TypeOf(sample)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		c := column{name: strings.Split(f.Tag.Get("json"), ",")[0], field: i}
+		switch f.Type.Kind() {
+		case reflect.Float64:
+			c.sqlType = "REAL NOT NULL"
+			if strings.HasSuffix(c.name, "_cost") || c.name == "adjustment" || c.name == "credit" {
+				t.costs = append(t.costs, c.name)
+			}
+		case reflect.Int64:
+			c.sqlType = "INTEGER NOT NULL"
+		case reflect.String:
+			c.sqlType = "TEXT NOT NULL"
+			t.dimensions[c.name] = true
+		case reflect.Map:
+			// labels are kept as JSON and queried with json_extract
+			c.sqlType = "TEXT NOT NULL"
+		case reflect.Struct:
+			// time.Time, unix seconds
+			c.sqlType = "INTEGER NOT NULL"
+		default:
+			panic(fmt.Sprintf("unsupported record field %s of type %s", f.Name, f.Type))
+		}
+		t.columns = append(t.columns, c)
+	}
+	return t
+}
+
+func (t *table) createStatements() []string {
+	defs := make([]string, 0, len(t.columns))
+	for _, c := range t.columns {
+		defs = append(defs, c.name+" "+c.sqlType)
+	}
+	return []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.name, strings.Join(defs, ", ")),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_window ON %s (window_start, cluster)", t.name, t.name),
+	}
+}
+
+func (t *table) insertStatement() string {
+	names := make([]string, 0, len(t.columns))
+	for _, c := range t.columns {
+		names = append(names, c.name)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, strings.Join(names, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+}
+
+// values returns the values of the record in the column order
+func (t *table) values(record interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(record)
+	values := make([]interface{}, 0, len(t.columns))
+	for _, c := range t.columns {
+		switch field := v.Field(c.field).Interface().(type) {
+		case time.Time:
+			values = append(values, field.Unix())
+		case map[string]string:
+			if field == nil {
+				field = map[string]string{}
+			}
+			encoded, err := json.Marshal(field)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, string(encoded))
+		default:
+			values = append(values, field)
+		}
+	}
+	return values, nil
+}
+
+var (
+	allocationsTable = newTable(collector.RecordKindAllocations, collector.AllocationRecord{})
+	assetsTable      = newTable(collector.RecordKindAssets, collector.AssetRecord{})
+	tables           = map[string]*table{
+		collector.RecordKindAllocations: allocationsTable,
+		collector.RecordKindAssets:      assetsTable,
+	}
+)
+
+// Store is the SQLite cost history
+type Store struct {
+	db     *sql.DB
+	logger log.Logger
+}
+
+// Open opens or creates the database file and its tables
+func Open(path string, logger log.Logger) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer anyway, one connection avoids the "database is locked" errors
+	db.SetMaxOpenConns(1)
+	for _, t := range []*table{allocationsTable, assetsTable} {
+		for _, stmt := range t.createStatements() {
+			if _, err := db.Exec(stmt); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("couldn't create the %s table: %s", t.name, err)
+			}
+		}
+	}
+	return &Store{db: db, logger: logger}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// WriteRecords implements collector.RecordWriter.
+// A scrape replaces all the rows of its window for the clusters it returned,
+// so the same day scraped again doesn't duplicate the costs
+func (s *Store) WriteRecords(ctx context.Context, records *collector.Records) error {
+	var allocations, assets []interface{}
+	for _, r := range collector.NewAllocationRecords(records) {
+		allocations = append(allocations, r)
+	}
+	for _, r := range collector.NewAssetRecords(records) {
+		assets = append(assets, r)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.replace(ctx, tx, allocationsTable, allocations, records); err != nil {
+		return err
+	}
+	if err := s.replace(ctx, tx, assetsTable, assets, records); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	level.Debug(s.logger).Log("msg", "Stored records", "scraper", records.Scraper, "allocations", len(allocations), "assets", len(assets))
+	return nil
+}
+
+func (s *Store) replace(ctx context.Context, tx *sql.Tx, t *table, rows []interface{}, records *collector.Records) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	clusters := make(map[string]bool)
+	for _, r := range rows {
+		clusters[reflect.ValueOf(r).FieldByName("Cluster").String()] = true
+	}
+	for cluster := range clusters {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE window_start >= ? AND window_start < ? AND cluster = ?", t.name),
+			records.Start.Unix(), records.End.Unix(), cluster)
+		if err != nil {
+			return err
+		}
+	}
+	insert, err := tx.PrepareContext(ctx, t.insertStatement())
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, r := range rows {
+		values, err := t.values(r)
+		if err != nil {
+			return err
+		}
+		if _, err := insert.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package kubecost_api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// windowTimeFormat is the format of the window boundaries sent by the exporter
+const windowTimeFormat = time.RFC3339
+
+// CacheConfig is the configuration of the response cache.
+// Kubecost keeps recomputing the recent data, so the TTL depends on the window of the query:
+// an open window (it ends in the future) changes all the time, a closed window may still change
+// until Kubecost's ETL settles it, after SettleDelay the window is considered immutable
+type CacheConfig struct {
+	// OpenTTL is for the windows that are not finished yet, 0 disables caching of them
+	OpenTTL time.Duration
+	// ClosedTTL is for the finished windows that are not settled yet
+	ClosedTTL time.Duration
+	// SettledTTL is for the windows that ended more than SettleDelay ago
+	SettledTTL  time.Duration
+	SettleDelay time.Duration
+	// MaxBytes limits the size of the cached responses, the entries that expire first are evicted
+	MaxBytes int64
+	// Dir persists the responses, so they survive restarts, empty keeps them only in memory
+	Dir string
+}
+
+// CacheStats are the counters of the cache for the metrics
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+type cacheEntry struct {
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+// cacheFileHeader is the first line of the persisted entry, the body follows it
+type cacheFileHeader struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// ResponseCache keeps the raw Kubecost responses keyed by the normalized query.
+// It's safe for concurrent use, a single cache is shared by all the clients
+type ResponseCache struct {
+	config CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	stats   CacheStats
+}
+
+// NewResponseCache returns the cache, the persisted entries that are not expired are loaded
+func NewResponseCache(config CacheConfig) (*ResponseCache, error) {
+	c := &ResponseCache{
+		config:  config,
+		entries: make(map[string]*cacheEntry),
+	}
+	if len(config.Dir) == 0 {
+		return c, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(config.Dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, file := range files {
+		entry, err := readCacheFile(file)
+		if err != nil || !entry.expires.After(now) {
+			os.Remove(file)
+			continue
+		}
+		c.add(entry, now)
+	}
+	return c, nil
+}
+
+// CacheKey normalizes the query, the order of the params doesn't matter
+func CacheKey(path string, params []string) string {
+	sorted := make([]string, 0, len(params))
+	for _, p := range params {
+		if len(p) > 0 {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.Strings(sorted)
+	return strings.TrimPrefix(path, "/") + "?" + strings.Join(sorted, "&")
+}
+
+// TTL returns how long the response of the query can be cached, 0 if it can't
+func (c *ResponseCache) TTL(params []string, now time.Time) time.Duration {
+	end, ok := windowEnd(params)
+	switch {
+	case !ok || end.After(now):
+		return c.config.OpenTTL
+	case end.Add(c.config.SettleDelay).After(now):
+		return c.config.ClosedTTL
+	}
+	return c.config.SettledTTL
+}
+
+// windowEnd returns the end of the window=start,end param, the relative windows like "1d" or "today" are not parsed
+func windowEnd(params []string) (time.Time, bool) {
+	for _, p := range params {
+		if !strings.HasPrefix(p, "window=") {
+			continue
+		}
+		bounds := strings.Split(strings.TrimPrefix(p, "window="), ",")
+		if len(bounds) != 2 {
+			return time.Time{}, false
+		}
+		end, err := time.Parse(windowTimeFormat, bounds[1])
+		return end, err == nil
+	}
+	return time.Time{}, false
+}
+
+// Get returns the cached response
+func (c *ResponseCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !entry.expires.After(time.Now()) {
+		c.remove(entry)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	return entry.body, true
+}
+
+// Set caches the response for the ttl, the responses bigger than the cache are not cached
+func (c *ResponseCache) Set(key string, body []byte, ttl time.Duration) error {
+	if ttl <= 0 || (c.config.MaxBytes > 0 && int64(len(body)) > c.config.MaxBytes) {
+		return nil
+	}
+	now := time.Now()
+	entry := &cacheEntry{key: key, body: body, expires: now.Add(ttl)}
+	c.mu.Lock()
+	c.add(entry, now)
+	c.mu.Unlock()
+	if len(c.config.Dir) == 0 {
+		return nil
+	}
+	return writeCacheFile(c.path(key), entry)
+}
+
+// Stats returns the current counters
+func (c *ResponseCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// add adds the entry and evicts the expired entries and then the ones that expire first to fit MaxBytes
+func (c *ResponseCache) add(entry *cacheEntry, now time.Time) {
+	if old, ok := c.entries[entry.key]; ok {
+		c.stats.Bytes -= int64(len(old.body))
+	}
+	c.entries[entry.key] = entry
+	c.stats.Bytes += int64(len(entry.body))
+	if c.config.MaxBytes <= 0 || c.stats.Bytes <= c.config.MaxBytes {
+		return
+	}
+	byExpiry := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if e != entry {
+			byExpiry = append(byExpiry, e)
+		}
+	}
+	sort.Slice(byExpiry, func(i, j int) bool {
+		return byExpiry[i].expires.Before(byExpiry[j].expires)
+	})
+	for _, e := range byExpiry {
+		if c.stats.Bytes <= c.config.MaxBytes {
+			break
+		}
+		c.remove(e)
+		if e.expires.After(now) {
+			c.stats.Evictions++
+		}
+	}
+}
+
+func (c *ResponseCache) remove(entry *cacheEntry) {
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= int64(len(entry.body))
+	if len(c.config.Dir) > 0 {
+		os.Remove(c.path(entry.key))
+	}
+}
+
+func (c *ResponseCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.config.Dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func writeCacheFile(path string, entry *cacheEntry) error {
+	header, err := json.Marshal(cacheFileHeader{Key: entry.key, Expires: entry.expires})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	w.Write(header)
+	w.WriteByte('\n')
+	w.Write(entry.body)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readCacheFile(path string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, os.ErrInvalid
+	}
+	var header cacheFileHeader
+	if err := json.Unmarshal(data[:i], &header); err != nil {
+		return nil, err
+	}
+	return &cacheEntry{key: header.Key, body: data[i+1:], expires: header.Expires}, nil
+}
+
+// cacheable returns false for the Kubecost errors and for the responses without data,
+// e.g. the window that is not built by the ETL yet.
+// The data is a set of items or an array of sets in the non accumulated responses
+func cacheable(body []byte) bool {
+	var response struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false
+	}
+	if response.Code != 0 && response.Code != http.StatusOK {
+		return false
+	}
+	data := bytes.TrimSpace(response.Data)
+	if len(data) == 0 || data[0] != '[' {
+		return isNonEmptySet(data)
+	}
+	var sets []json.RawMessage
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return false
+	}
+	for _, set := range sets {
+		if isNonEmptySet(bytes.TrimSpace(set)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNonEmptySet returns true if the JSON object has at least one item
+func isNonEmptySet(set []byte) bool {
+	if len(set) < 2 || set[0] != '{' {
+		return false
+	}
+	return len(bytes.TrimSpace(set[1:len(set)-1])) > 0
+}
@@ -2,64 +2,307 @@ package kubecost_api
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Client struct {
 	BaseURL   *url.URL
 	UserAgent string
+	// Target is the name of the configured target the client requests, empty for the Kubecost of /metrics.
+	// The targets can have the same URL with the different credentials, so it's a part of the cache key
+	Target string
+	// Cache is optional, it keeps the responses of the queries with closed windows
+	Cache *ResponseCache
+	// Requests is optional, it collapses the identical concurrent requests and limits the concurrency
+	Requests *RequestGroup
+	// MaxResponseBytes limits the size of the decompressed response, 0 means no limit
+	MaxResponseBytes int64
+	// Debug records the requests and the skipped items, nil if they aren't recorded
+	Debug *Debug
+	// Observer is notified about every request, nil if they aren't observed
+	Observer RequestObserver
 
 	httpClient *http.Client
 }
 
 const ListAssetsURI = "model/assets"
 const AllocationURI = "model/allocation"
+const ClusterInfoURI = "model/clusterInfo"
+const ClusterInfoMapURI = "model/clusterInfoMap"
+
+// RequestObserver is notified about the Kubecost requests, e.g. for the exporter's own metrics
+type RequestObserver interface {
+	// ObserveRequest is called with the time until the response is read and closed, the code is 0 if there was no response.
+	// The streamed responses are read as they're decoded, so their time includes the decoding
+	ObserveRequest(endpoint string, code int, duration time.Duration)
+	// ObserveResponseSize is called with the decompressed size once the response is read
+	ObserveResponseSize(endpoint string, code int, bytes int64)
+}
+
+// the transports are shared by all the clients, so the connections are reused between the scrapes
+var (
+	transports     = make(map[bool]*http.Transport)
+	transportsLock sync.Mutex
+)
+
+func transport(skipTLSVerify bool) *http.Transport {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	t, ok := transports[skipTLSVerify]
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipTLSVerify}
+		transports[skipTLSVerify] = t
+	}
+	return t
+}
 
 func NewApiClient(apiUrl *url.URL, userAgent string, skipTLSVerify bool) *Client {
-	// Disable TLS verification globally
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: skipTLSVerify}
+	return NewApiClientWithHTTPClient(apiUrl, userAgent, &http.Client{Transport: transport(skipTLSVerify)})
+}
+
+// NewApiClientWithHTTPClient returns the client that uses the HTTP client, e.g. with the authentication of the target
+func NewApiClientWithHTTPClient(apiUrl *url.URL, userAgent string, httpClient *http.Client) *Client {
 	return &Client{
 		BaseURL:    apiUrl,
 		UserAgent:  userAgent,
-		httpClient: new(http.Client),
+		httpClient: httpClient,
 	}
 }
 
 // This method returns interface, because the /model/assets endpoint returns array of different objects
 // that can't be mapped here
-func (c *Client) ListAssets(extraQueryParams []string) (interface{}, error) {
-	req, err := c.newRequest("GET", ListAssetsURI, strings.Join(extraQueryParams, "&"), nil)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) ListAssets(ctx context.Context, extraQueryParams []string) (interface{}, error) {
 	var assets interface{}
-	_, err = c.do(req, &assets)
+	err := c.get(ctx, ListAssetsURI, extraQueryParams, &assets)
 	return assets, err
 }
 
+// StreamAssets calls fn for every asset as soon as it's decoded, unlike ListAssets the whole response is never kept in memory.
+// The asset is one of CloudAssetDisk, CloudAssetCloud, CloudAssetNode, CloudAssetLoadBalancer (the cluster management too),
+// the assets of the other types are skipped
+func (c *Client) StreamAssets(ctx context.Context, extraQueryParams []string, fn func(asset interface{}) error) error {
+	return c.stream(ctx, ListAssetsURI, extraQueryParams, func(ctx context.Context, body io.Reader) error {
+		items := newItemHandler(ctx)
+		defer items.end()
+		_, err := decodeResponse(body, func(dec *json.Decoder) error {
+			asset, raw, err := decodeAsset(dec)
+			if err != nil {
+				return err
+			}
+			if asset == nil {
+				if c.Debug != nil {
+					var t assetType
+					json.Unmarshal(raw, &t)
+					c.Debug.skip(raw, "unknown asset type %q", t.Type)
+				}
+				return nil
+			}
+			return items.handle(func() error {
+				return fn(asset)
+			})
+		})
+		return err
+	})
+}
+
 // Method for getting information about namespace costs
 // Such a strange response structure: Array with one element, which has a map inside
-func (c *Client) GetAllocation(extraQueryParams []string) (*CostDataResponse, error) {
-	req, err := c.newRequest("GET", AllocationURI, strings.Join(extraQueryParams, "&"), nil)
+func (c *Client) GetAllocation(ctx context.Context, extraQueryParams []string) (*CostDataResponse, error) {
+	var assets CostDataResponse
+	err := c.get(ctx, AllocationURI, extraQueryParams, &assets)
 	if err != nil {
 		return nil, err
 	}
-	var assets CostDataResponse
-	_, err = c.do(req, &assets)
+	return &assets, err
+}
+
+// StreamAllocation calls fn for every allocation as soon as it's decoded, it returns the number of the sets in the response:
+// one set per step interval, or a single set for the accumulated response
+func (c *Client) StreamAllocation(ctx context.Context, extraQueryParams []string, fn func(allocation Allocation) error) (int, error) {
+	sets := 0
+	err := c.stream(ctx, AllocationURI, extraQueryParams, func(ctx context.Context, body io.Reader) error {
+		items := newItemHandler(ctx)
+		defer items.end()
+		var err error
+		sets, err = decodeResponse(body, func(dec *json.Decoder) error {
+			var allocation Allocation
+			if err := dec.Decode(&allocation); err != nil {
+				return err
+			}
+			return items.handle(func() error {
+				return fn(allocation)
+			})
+		})
+		return err
+	})
+	return sets, err
+}
+
+// get requests the path and decodes the whole response to v
+func (c *Client) get(ctx context.Context, path string, extraQueryParams []string, v interface{}) error {
+	return c.stream(ctx, path, extraQueryParams, func(ctx context.Context, body io.Reader) error {
+		return json.NewDecoder(body).Decode(v)
+	})
+}
+
+// stream requests the path and passes the response body to decode, the cached response is used if there is one.
+// Without the cache the body is decoded straight from the connection, the request group only limits the concurrency.
+// With the cache the raw response is read first, so it can be cached and shared by the identical concurrent requests,
+// but it's still decoded as a stream. The decoding is traced, its context has the span of the decoding
+func (c *Client) stream(ctx context.Context, path string, extraQueryParams []string, decode func(ctx context.Context, body io.Reader) error) error {
+	if c.Cache == nil {
+		if c.Requests != nil {
+			release, err := c.Requests.Acquire(ctx)
+			if err != nil {
+				return err
+			}
+			// the slot is held until the response is decoded, the connection is open until then
+			defer release()
+		}
+		resp, body, err := c.open(ctx, path, extraQueryParams)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		counter := &countingReader{r: body}
+		err = c.decode(ctx, path, false, counter, decode)
+		c.observeSize(path, resp.StatusCode, counter.n)
+		return err
+	}
+
+	// the cache and the request group are shared by the clients of the different Kubecost instances
+	key := c.cacheKey(path, extraQueryParams)
+	if body, ok := c.Cache.Get(key); ok {
+		return c.decode(ctx, path, true, bytes.NewReader(body), decode)
+	}
+	fetch := func(ctx context.Context) ([]byte, error) {
+		return c.fetch(ctx, path, extraQueryParams, key)
+	}
+	var body []byte
+	var err error
+	if c.Requests != nil {
+		body, err = c.Requests.Do(ctx, key, fetch)
+	} else {
+		body, err = fetch(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return c.decode(ctx, path, false, bytes.NewReader(body), decode)
+}
+
+// cacheKey is the key of the response in the cache and in the request group: the target, the base URL without the password
+// (the key is persisted with the response) and the normalized query
+func (c *Client) cacheKey(path string, extraQueryParams []string) string {
+	return c.Target + " " + strings.TrimSuffix(c.BaseURL.Redacted(), "/") + "/" + CacheKey(path, extraQueryParams)
+}
+
+// open requests the path, the returned body is decompressed and limited by MaxResponseBytes
+func (c *Client) open(ctx context.Context, path string, extraQueryParams []string) (*http.Response, io.Reader, error) {
+	req, err := c.newRequest("GET", path, strings.Join(extraQueryParams, "&"), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the transport asks for gzip by itself only if the header isn't set,
+	// it's set explicitly to apply the size limit to the decompressed response
+	req.Header.Set("Accept-Encoding", "gzip")
+	ctx, span := c.startRequestSpan(ctx, req)
+	start := time.Now()
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if c.Observer != nil {
+			c.Observer.ObserveRequest(path, 0, time.Since(start))
+		}
+		span.SetError(err)
+		span.End()
+		return nil, nil, err
+	}
+	tracedResponse(resp, span)
+	c.observedResponse(resp, path, start)
+	body, err := responseBody(resp, c.MaxResponseBytes)
+	if err != nil {
+		span.SetError(err)
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp, c.Debug.record(req.URL.Redacted(), resp.StatusCode, body), nil
+}
+
+// fetch requests the path and returns the raw response, the successful responses are cached
+func (c *Client) fetch(ctx context.Context, path string, extraQueryParams []string, key string) ([]byte, error) {
+	resp, reader, err := c.open(ctx, path, extraQueryParams)
 	if err != nil {
 		return nil, err
 	}
-	return &assets, err
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(reader)
+	c.observeSize(path, resp.StatusCode, int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	// only the successful responses, an error or an empty window shouldn't stick for days
+	if c.Cache != nil && resp.StatusCode == http.StatusOK && cacheable(body) {
+		return body, c.Cache.Set(key, body, c.Cache.TTL(extraQueryParams, time.Now()))
+	}
+	return body, nil
+}
+
+// observedResponse observes the request when the response is closed, the time until the headers
+// would hide the slow responses, Kubecost starts sending the big ones before they're ready
+func (c *Client) observedResponse(resp *http.Response, path string, start time.Time) {
+	if c.Observer == nil {
+		return
+	}
+	resp.Body = &observedBody{ReadCloser: resp.Body, observe: func() {
+		c.Observer.ObserveRequest(path, resp.StatusCode, time.Since(start))
+	}}
+}
+
+// observedBody calls observe once, when the response is closed
+type observedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	observe func()
+}
+
+func (b *observedBody) Close() error {
+	b.once.Do(b.observe)
+	return b.ReadCloser.Close()
+}
+
+func (c *Client) observeSize(path string, code int, bytes int64) {
+	if c.Observer != nil {
+		c.Observer.ObserveResponseSize(path, code, bytes)
+	}
+}
+
+// countingReader counts the bytes read from the response
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func (c *Client) newRequest(method, path string, query string, body interface{}) (*http.Request, error) {
-	c.BaseURL.Path = path
-	c.BaseURL.RawQuery = query
+	// the base URL is shared by the concurrent scrapers, so it's copied rather than modified
+	u := *c.BaseURL
+	u.Path = path
+	u.RawQuery = query
 	var buf io.ReadWriter
 	if body != nil {
 		buf = new(bytes.Buffer)
@@ -68,7 +311,7 @@ func (c *Client) newRequest(method, path string, query string, body interface{})
 			return nil, err
 		}
 	}
-	req, err := http.NewRequest(method, c.BaseURL.String(), buf)
+	req, err := http.NewRequest(method, u.String(), buf)
 	if err != nil {
 		return nil, err
 	}
@@ -79,13 +322,3 @@ func (c *Client) newRequest(method, path string, query string, body interface{})
 	req.Header.Set("User-Agent", c.UserAgent)
 	return req, nil
 }
-
-func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(v)
-	return resp, err
-}
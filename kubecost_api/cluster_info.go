@@ -0,0 +1,65 @@
+package kubecost_api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ClusterInfo describes a cluster, the ID is the one that is set in the properties of the assets and the allocations
+type ClusterInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Profile     string `json:"clusterProfile,omitempty"`
+	Provider    string `json:"provider"`
+	Account     string `json:"account,omitempty"`
+	Project     string `json:"project,omitempty"`
+	Region      string `json:"region"`
+	Provisioner string `json:"provisioner,omitempty"`
+	Version     string `json:"version,omitempty"`
+}
+
+type ClusterInfoResponse struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    ClusterInfo `json:"data"`
+}
+
+type ClusterInfoMapResponse struct {
+	Code    int                    `json:"code"`
+	Message string                 `json:"message"`
+	Data    map[string]ClusterInfo `json:"data"`
+}
+
+// GetClusterInfo returns the information about the cluster, where Kubecost is running
+func (c *Client) GetClusterInfo(ctx context.Context) (*ClusterInfo, error) {
+	var info ClusterInfoResponse
+	if err := c.get(ctx, ClusterInfoURI, nil, &info); err != nil {
+		return nil, err
+	}
+	if err := checkCode(info.Code, info.Message); err != nil {
+		return nil, err
+	}
+	return &info.Data, nil
+}
+
+// GetClusterInfoMap returns the information about all the clusters by their ID,
+// in a federated Kubecost these are all the clusters that report to it
+func (c *Client) GetClusterInfoMap(ctx context.Context) (map[string]ClusterInfo, error) {
+	var info ClusterInfoMapResponse
+	if err := c.get(ctx, ClusterInfoMapURI, nil, &info); err != nil {
+		return nil, err
+	}
+	if err := checkCode(info.Code, info.Message); err != nil {
+		return nil, err
+	}
+	return info.Data, nil
+}
+
+// checkCode returns the error for the code of the response, the code isn't set by some Kubecost versions
+func checkCode(code int, message string) error {
+	if code != 0 && code != http.StatusOK {
+		return fmt.Errorf("kubecost returned code %d: %s", code, message)
+	}
+	return nil
+}
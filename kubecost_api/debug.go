@@ -0,0 +1,98 @@
+package kubecost_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Debug records the requests of the client and the items it skips, it's set only for a single debug scrape
+type Debug struct {
+	// MaxBodyBytes limits the recorded raw response, the decoding still reads the whole response
+	MaxBodyBytes int
+
+	mu       sync.Mutex
+	requests []*DebugRequest
+	skipped  []SkippedItem
+}
+
+// DebugRequest is a Kubecost request with the beginning of its raw response
+type DebugRequest struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	// Response is the decompressed response, up to MaxBodyBytes
+	Response      string `json:"response"`
+	ResponseBytes int64  `json:"response_bytes"`
+	Truncated     bool   `json:"truncated"`
+}
+
+// SkippedItem is an item of the response that wasn't passed to the scraper
+type SkippedItem struct {
+	Item   json.RawMessage `json:"item"`
+	Reason string          `json:"reason"`
+}
+
+// Requests returns the recorded requests, the responses are complete once the scrape is finished
+func (d *Debug) Requests() []DebugRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	requests := make([]DebugRequest, len(d.requests))
+	for i, r := range d.requests {
+		requests[i] = *r
+	}
+	return requests
+}
+
+// Skipped returns the skipped items
+func (d *Debug) Skipped() []SkippedItem {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]SkippedItem{}, d.skipped...)
+}
+
+// record adds the request and returns the body that copies the response to it as it's read
+func (d *Debug) record(url string, statusCode int, body io.Reader) io.Reader {
+	if d == nil {
+		return body
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := &DebugRequest{URL: url, StatusCode: statusCode}
+	d.requests = append(d.requests, r)
+	return io.TeeReader(body, &debugBody{debug: d, request: r})
+}
+
+// skip adds the skipped item
+func (d *Debug) skip(item json.RawMessage, format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.skipped = append(d.skipped, SkippedItem{Item: item, Reason: fmt.Sprintf(format, args...)})
+}
+
+// debugBody keeps the beginning of the response and counts the rest of it
+type debugBody struct {
+	debug   *Debug
+	request *DebugRequest
+}
+
+func (b *debugBody) Write(p []byte) (int, error) {
+	b.debug.mu.Lock()
+	defer b.debug.mu.Unlock()
+	r := b.request
+	r.ResponseBytes += int64(len(p))
+	if left := b.debug.MaxBodyBytes - len(r.Response); left > 0 {
+		if len(p) > left {
+			r.Response += string(p[:left])
+			r.Truncated = true
+		} else {
+			r.Response += string(p)
+		}
+	} else if len(p) > 0 {
+		r.Truncated = true
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package kubecost_api
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Filters maps to the filter query parameters understood by the Kubecost Assets and Allocation APIs.
+// Every non-empty field is sent as a comma separated list, e.g. Namespaces: []string{"kubecost", "default"}
+// becomes filterNamespaces=kubecost,default
+// Not all of them make sense for every endpoint: Types, Categories and Services are only used by /model/assets,
+// Kubecost ignores unknown filters, so we don't validate that here.
+type Filters struct {
+	Clusters   []string `yaml:"clusters,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// Labels are in the Kubecost format: "app:cost-analyzer"
+	Labels     []string `yaml:"labels,omitempty"`
+	Types      []string `yaml:"types,omitempty"`
+	Categories []string `yaml:"categories,omitempty"`
+	Services   []string `yaml:"services,omitempty"`
+	// Filter is the newer Kubecost filter language, e.g. namespace:"kubecost"+cluster:"cluster-one"
+	// it's passed as is in the "filter" parameter
+	Filter string `yaml:"filter,omitempty"`
+}
+
+// IsEmpty returns true if there is no filter set
+func (f Filters) IsEmpty() bool {
+	return len(f.QueryParams()) == 0
+}
+
+// QueryParams returns the filters as a list of escaped "key=value" pairs,
+// the same format that is used for the extra query params of the api client.
+func (f Filters) QueryParams() []string {
+	var params []string
+	add := func(key string, values []string) {
+		var nonEmpty []string
+		for _, v := range values {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				nonEmpty = append(nonEmpty, url.QueryEscape(v))
+			}
+		}
+		if len(nonEmpty) > 0 {
+			params = append(params, key+"="+strings.Join(nonEmpty, ","))
+		}
+	}
+	add("filterClusters", f.Clusters)
+	add("filterNamespaces", f.Namespaces)
+	add("filterLabels", f.Labels)
+	add("filterTypes", f.Types)
+	add("filterCategories", f.Categories)
+	add("filterServices", f.Services)
+	if len(f.Filter) > 0 {
+		params = append(params, "filter="+url.QueryEscape(f.Filter))
+	}
+	return params
+}
@@ -0,0 +1,71 @@
+package kubecost_api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFiltersQueryParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		want    []string
+	}{
+		{
+			name: "empty",
+			want: nil,
+		},
+		{
+			name:    "blank values are skipped",
+			filters: Filters{Namespaces: []string{"", "  "}, Clusters: []string{" "}},
+			want:    nil,
+		},
+		{
+			name:    "values are trimmed and joined",
+			filters: Filters{Namespaces: []string{" kubecost", "default "}},
+			want:    []string{"filterNamespaces=kubecost,default"},
+		},
+		{
+			name: "all the filters in the fixed order",
+			filters: Filters{
+				Filter:     `namespace:"kubecost"`,
+				Services:   []string{"AmazonEC2"},
+				Categories: []string{"Compute"},
+				Types:      []string{"Node", "Disk"},
+				Labels:     []string{"app:cost-analyzer"},
+				Namespaces: []string{"kubecost"},
+				Clusters:   []string{"cluster-one"},
+			},
+			want: []string{
+				"filterClusters=cluster-one",
+				"filterNamespaces=kubecost",
+				"filterLabels=app%3Acost-analyzer",
+				"filterTypes=Node,Disk",
+				"filterCategories=Compute",
+				"filterServices=AmazonEC2",
+				"filter=namespace%3A%22kubecost%22",
+			},
+		},
+		{
+			name:    "values are escaped, the separators are not",
+			filters: Filters{Labels: []string{"team:a&b", "app:x,y"}},
+			want:    []string{"filterLabels=team%3Aa%26b,app%3Ax%2Cy"},
+		},
+		{
+			name:    "the filter language is escaped as a whole",
+			filters: Filters{Filter: `namespace:"kubecost"+cluster:"cluster-one"`},
+			want:    []string{"filter=namespace%3A%22kubecost%22%2Bcluster%3A%22cluster-one%22"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.filters.QueryParams()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryParams() = %q, want %q", got, tt.want)
+			}
+			if empty := tt.filters.IsEmpty(); empty != (len(tt.want) == 0) {
+				t.Errorf("IsEmpty() = %v, want %v", empty, len(tt.want) == 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package kubecost_api
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestStats are the counters of the request group for the metrics
+type RequestStats struct {
+	InFlight     int
+	Queued       int
+	Deduplicated uint64
+}
+
+// flight is a Kubecost request that is being made, the identical requests wait for its result
+type flight struct {
+	done chan struct{}
+	body []byte
+	err  error
+	// waiters is the number of the callers waiting for the result, the request is canceled when all of them are gone
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// RequestGroup is shared by all the clients: the number of concurrent requests to Kubecost is limited,
+// as every request to a big cluster is heavy for Kubecost, and the identical requests of the cached responses
+// that are made at the same time (e.g. by two Prometheus replicas) are collapsed into one
+type RequestGroup struct {
+	// semaphore is nil if the concurrency is not limited
+	semaphore chan struct{}
+
+	mu      sync.Mutex
+	flights map[string]*flight
+	stats   RequestStats
+}
+
+// NewRequestGroup returns the request group, maxConcurrent <= 0 means no limit
+func NewRequestGroup(maxConcurrent int) *RequestGroup {
+	g := &RequestGroup{flights: make(map[string]*flight)}
+	if maxConcurrent > 0 {
+		g.semaphore = make(chan struct{}, maxConcurrent)
+	}
+	return g
+}
+
+// Do calls fn once for all the concurrent calls with the same key and returns its result to all of them.
+// fn runs with the context of the first caller without its cancellation: a caller stops waiting when its context is done,
+// the request itself is canceled only when all the callers are gone, so one of them giving up doesn't fail the others
+func (g *RequestGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		g.stats.Deduplicated++
+	} else {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			f.body, f.err = g.run(flightCtx, fn)
+			cancel()
+			g.mu.Lock()
+			g.forget(key, f)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.body, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// the next caller starts a new request instead of joining the canceled one
+			g.forget(key, f)
+			f.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes the flight, unless it's already replaced by a new one
+func (g *RequestGroup) forget(key string, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
+
+// run waits for a free slot and calls fn
+func (g *RequestGroup) run(ctx context.Context, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	release, err := g.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return fn(ctx)
+}
+
+// Acquire waits for a free slot of the concurrency limit without collapsing the request with the others,
+// e.g. for the response that is decoded straight from the connection. release must be called once the request is done
+func (g *RequestGroup) Acquire(ctx context.Context) (release func(), err error) {
+	if g.semaphore != nil {
+		g.add(&g.stats.Queued, 1)
+		select {
+		case g.semaphore <- struct{}{}:
+			g.add(&g.stats.Queued, -1)
+		case <-ctx.Done():
+			g.add(&g.stats.Queued, -1)
+			return nil, ctx.Err()
+		}
+	}
+	g.add(&g.stats.InFlight, 1)
+	return func() {
+		g.add(&g.stats.InFlight, -1)
+		if g.semaphore != nil {
+			<-g.semaphore
+		}
+	}, nil
+}
+
+func (g *RequestGroup) add(counter *int, delta int) {
+	g.mu.Lock()
+	*counter += delta
+	g.mu.Unlock()
+}
+
+// Stats returns the current counters
+func (g *RequestGroup) Stats() RequestStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
@@ -0,0 +1,182 @@
+package kubecost_api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition, the group has no hooks to wait for a caller to join a flight
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type doResult struct {
+	body []byte
+	err  error
+}
+
+// doAsync calls Do in a goroutine, the result is sent to the returned channel
+func doAsync(ctx context.Context, g *RequestGroup, key string, fn func(ctx context.Context) ([]byte, error)) <-chan doResult {
+	result := make(chan doResult, 1)
+	go func() {
+		body, err := g.Do(ctx, key, fn)
+		result <- doResult{body, err}
+	}()
+	return result
+}
+
+func TestRequestGroupDeduplicates(t *testing.T) {
+	g := NewRequestGroup(0)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	fn := func(ctx context.Context) ([]byte, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return []byte("body"), nil
+	}
+	first := doAsync(context.Background(), g, "key", fn)
+	waitFor(t, "the request", func() bool { return g.Stats().InFlight == 1 })
+	second := doAsync(context.Background(), g, "key", fn)
+	waitFor(t, "the second caller", func() bool { return g.Stats().Deduplicated == 1 })
+	close(release)
+	for _, result := range []<-chan doResult{first, second} {
+		if r := <-result; r.err != nil || string(r.body) != "body" {
+			t.Errorf("got %q, %v", r.body, r.err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn is called %d times, want 1", calls)
+	}
+	// the finished flight isn't joined
+	if _, err := g.Do(context.Background(), "key", func(ctx context.Context) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if stats := g.Stats(); stats != (RequestStats{Deduplicated: 1}) {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestRequestGroupCancel(t *testing.T) {
+	g := NewRequestGroup(0)
+	release := make(chan struct{})
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		select {
+		case <-release:
+			return []byte("body"), nil
+		case <-ctx.Done():
+			close(canceled)
+			return nil, ctx.Err()
+		}
+	}
+
+	// the first caller gives up, the request goes on for the second one
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	first := doAsync(firstCtx, g, "key", fn)
+	waitFor(t, "the request", func() bool { return g.Stats().InFlight == 1 })
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	second := doAsync(secondCtx, g, "key", fn)
+	waitFor(t, "the second caller", func() bool { return g.Stats().Deduplicated == 1 })
+	cancelFirst()
+	if r := <-first; r.err != context.Canceled {
+		t.Errorf("the canceled caller got %q, %v", r.body, r.err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("the request is canceled with the context of the first caller")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if r := <-second; r.err != nil || string(r.body) != "body" {
+		t.Errorf("the second caller got %q, %v", r.body, r.err)
+	}
+
+	// the request is canceled when all the callers are gone, the next caller doesn't join it
+	release = make(chan struct{})
+	canceled = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	result := doAsync(ctx, g, "key", fn)
+	waitFor(t, "the request", func() bool { return g.Stats().InFlight == 1 })
+	cancel()
+	if r := <-result; r.err != context.Canceled {
+		t.Errorf("the canceled caller got %q, %v", r.body, r.err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request isn't canceled when all the callers are gone")
+	}
+	body, err := g.Do(context.Background(), "key", func(ctx context.Context) ([]byte, error) { return []byte("new"), nil })
+	if err != nil || string(body) != "new" {
+		t.Errorf("the next caller got %q, %v", body, err)
+	}
+}
+
+func TestRequestGroupLimit(t *testing.T) {
+	const limit = 2
+	g := NewRequestGroup(limit)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	fn := func(ctx context.Context) ([]byte, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, nil
+	}
+	var results []<-chan doResult
+	for i := 0; i < 5; i++ {
+		results = append(results, doAsync(context.Background(), g, fmt.Sprint(i), fn))
+	}
+	waitFor(t, "the queued requests", func() bool {
+		stats := g.Stats()
+		return stats.InFlight == limit && stats.Queued == 3
+	})
+
+	// a queued caller that gives up leaves the queue without calling fn
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := doAsync(ctx, g, "queued", func(ctx context.Context) ([]byte, error) {
+		t.Error("fn of the canceled queued request is called")
+		return nil, nil
+	})
+	waitFor(t, "the queued request", func() bool { return g.Stats().Queued == 4 })
+	cancel()
+	if r := <-queued; r.err != context.Canceled {
+		t.Errorf("the canceled caller got %v", r.err)
+	}
+	waitFor(t, "the canceled request to leave the queue", func() bool { return g.Stats().Queued == 3 })
+
+	close(release)
+	for _, result := range results {
+		if r := <-result; r.err != nil {
+			t.Error(r.err)
+		}
+	}
+	if maxRunning != limit {
+		t.Errorf("got %d concurrent requests, want %d", maxRunning, limit)
+	}
+	if stats := g.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Errorf("got stats %+v after all the requests", stats)
+	}
+}
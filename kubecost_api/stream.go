@@ -0,0 +1,188 @@
+package kubecost_api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrResponseTooLarge is returned when the decompressed Kubecost response exceeds Client.MaxResponseBytes
+var ErrResponseTooLarge = errors.New("kubecost response is too large")
+
+// assetType is decoded first to find out the type of the asset
+type assetType struct {
+	Type string `json:"type"`
+}
+
+// decodeResponse walks the {"code": ..., "data": ...} response token by token and calls item for each item of the data,
+// the item decodes the next value from the decoder itself, so only one item is kept in memory at a time.
+// The data is a set (map) of items, or an array of sets in the non accumulated responses.
+// It returns the number of the sets in the response
+func decodeResponse(r io.Reader, item func(dec *json.Decoder) error) (int, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+	var code int
+	var message string
+	sets := 0
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return sets, err
+		}
+		switch key {
+		case "data":
+			if sets, err = decodeData(dec, item); err != nil {
+				return sets, err
+			}
+		case "code":
+			err = dec.Decode(&code)
+		case "message":
+			err = dec.Decode(&message)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return sets, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return sets, err
+	}
+	return sets, checkCode(code, message)
+}
+
+// decodeData decodes the set or the array of sets
+func decodeData(dec *json.Decoder, item func(dec *json.Decoder) error) (int, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	switch t {
+	case nil:
+		return 0, nil
+	case json.Delim('{'):
+		return 1, decodeSet(dec, item)
+	case json.Delim('['):
+		sets := 0
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return sets, err
+			}
+			// an interval without items is null in some Kubecost versions
+			if t == nil {
+				continue
+			}
+			if t != json.Delim('{') {
+				return sets, fmt.Errorf("unexpected %v in the data array", t)
+			}
+			if err := decodeSet(dec, item); err != nil {
+				return sets, err
+			}
+			sets++
+		}
+		return sets, expectDelim(dec, ']')
+	}
+	return 0, fmt.Errorf("unexpected %v in the data", t)
+}
+
+// decodeSet decodes the items of the set, the opening brace is already read
+func decodeSet(dec *json.Decoder, item func(dec *json.Decoder) error) error {
+	for dec.More() {
+		// the key is the name of the item, it's also inside the item
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		if err := item(dec); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("unexpected %v in the response, expected %v", t, delim)
+	}
+	return nil
+}
+
+// decodeAsset decodes the next asset to the type according to its "type" field,
+// the unknown types are returned as nil, the raw asset is returned for any of them
+func decodeAsset(dec *json.Decoder) (interface{}, json.RawMessage, error) {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	var t assetType
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, raw, err
+	}
+	var err error
+	switch t.Type {
+	case "Disk":
+		var disk CloudAssetDisk
+		err = json.Unmarshal(raw, &disk)
+		return disk, raw, err
+	case "Cloud":
+		var cloud CloudAssetCloud
+		err = json.Unmarshal(raw, &cloud)
+		return cloud, raw, err
+	case "Node":
+		var node CloudAssetNode
+		err = json.Unmarshal(raw, &node)
+		return node, raw, err
+	// the cluster management fees are exported as the load balancers, the same as the assets mapper does
+	case "LoadBalancer", "ClusterManagement":
+		var lb CloudAssetLoadBalancer
+		err = json.Unmarshal(raw, &lb)
+		return lb, raw, err
+	}
+	return nil, raw, nil
+}
+
+// responseBody returns the decompressed body, that fails with ErrResponseTooLarge after maxBytes
+func responseBody(resp *http.Response, maxBytes int64) (io.Reader, error) {
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = gz
+	}
+	if maxBytes > 0 {
+		body = &limitedReader{r: body, remaining: maxBytes, limit: maxBytes}
+	}
+	return body, nil
+}
+
+// limitedReader is like io.LimitedReader, but it fails instead of truncating the response silently
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// one more byte is read to tell the response of exactly limit bytes from the bigger one
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrResponseTooLarge, l.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,300 @@
+package kubecost_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantNames []string
+		wantSets  int
+		wantErr   string
+	}{
+		{
+			name:      "accumulated set",
+			body:      `{"code":200,"data":{"a":{"name":"a"},"b":{"name":"b"}},"message":""}`,
+			wantNames: []string{"a", "b"},
+			wantSets:  1,
+		},
+		{
+			name:      "sets of the intervals, the empty interval is null",
+			body:      `{"data":[{"a":{"name":"a"}},null,{"b":{"name":"b"}}],"code":200,"extra":{"x":[1]}}`,
+			wantNames: []string{"a", "b"},
+			wantSets:  2,
+		},
+		{name: "no data", body: `{"code":200,"data":null}`},
+		{name: "kubecost error", body: `{"code":500,"message":"boom","data":null}`, wantErr: "kubecost returned code 500: boom"},
+		{
+			name:      "broken in the middle",
+			body:      `{"code":200,"data":{"a":{"name":"a"},"b":{"name":`,
+			wantNames: []string{"a"},
+			wantSets:  1,
+			wantErr:   "unexpected EOF",
+		},
+		{name: "not an object", body: `[1]`, wantErr: "unexpected [ in the response, expected {"},
+		{name: "unexpected data", body: `{"data":"text"}`, wantErr: "unexpected text in the data"},
+		{name: "unexpected set", body: `{"data":[1]}`, wantErr: "unexpected 1 in the data array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			sets, err := decodeResponse(strings.NewReader(tt.body), func(dec *json.Decoder) error {
+				var item struct {
+					Name string `json:"name"`
+				}
+				if err := dec.Decode(&item); err != nil {
+					return err
+				}
+				names = append(names, item.Name)
+				return nil
+			})
+			if (err == nil && len(tt.wantErr) > 0) || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+			if sets != tt.wantSets || !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("got %d sets with %q, want %d sets with %q", sets, names, tt.wantSets, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestDecodeAsset(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{raw: `{"type":"Disk","bytes":10}`, want: CloudAssetDisk{Type: "Disk", Bytes: 10}},
+		{raw: `{"type":"Node","nodeType":"m5.large"}`, want: CloudAssetNode{Type: "Node", NodeType: "m5.large"}},
+		// the cluster management fees are the load balancers
+		{raw: `{"type":"ClusterManagement","totalCost":2}`, want: CloudAssetLoadBalancer{Type: "ClusterManagement", TotalCost: 2}},
+		{raw: `{"type":"Network"}`, want: nil},
+	}
+	for _, tt := range tests {
+		dec := json.NewDecoder(strings.NewReader(tt.raw))
+		got, raw, err := decodeAsset(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) || string(raw) != tt.raw {
+			t.Errorf("decodeAsset(%s) = %#v, %s, want %#v", tt.raw, got, raw, tt.want)
+		}
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResponseBody(t *testing.T) {
+	data := []byte(`{"code":200,"data":null}`)
+	tests := []struct {
+		name     string
+		gzip     bool
+		maxBytes int64
+		wantErr  bool
+	}{
+		{name: "plain"},
+		{name: "gzip", gzip: true},
+		{name: "exactly the limit", gzip: true, maxBytes: int64(len(data))},
+		// the limit is of the decompressed response, the compressed one is smaller than it
+		{name: "over the limit", gzip: true, maxBytes: int64(len(data)) - 1, wantErr: true},
+		{name: "plain over the limit", maxBytes: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(data))}
+			if tt.gzip {
+				resp.Header.Set("Content-Encoding", "gzip")
+				resp.Body = ioutil.NopCloser(bytes.NewReader(gzipped(t, data)))
+			}
+			body, err := responseBody(resp, tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(body)
+			if tt.wantErr {
+				if !errors.Is(err, ErrResponseTooLarge) {
+					t.Errorf("got error %v, want ErrResponseTooLarge", err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("got %q, %v", got, err)
+			}
+		})
+	}
+
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: ioutil.NopCloser(bytes.NewReader(data))}
+	if _, err := responseBody(resp, 0); err == nil {
+		t.Error("the invalid gzip body is accepted")
+	}
+}
+
+// allocationServer serves the gzipped allocations and counts the requests
+type allocationServer struct {
+	mu       sync.Mutex
+	requests int
+	body     []byte
+	// release blocks the responses until it's closed, nil doesn't block
+	release chan struct{}
+}
+
+func (s *allocationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	if s.release != nil {
+		<-s.release
+	}
+	if r.Header.Get("Accept-Encoding") != "gzip" {
+		http.Error(w, "gzip isn't accepted", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Write(s.body)
+}
+
+func newAllocationServer(t *testing.T, body string) (*allocationServer, *url.URL) {
+	s := &allocationServer{body: gzipped(t, []byte(body))}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return s, u
+}
+
+func TestStreamAllocation(t *testing.T) {
+	const body = `{"code":200,"data":[{"a":{"name":"a","totalCost":1}},{"b":{"name":"b","totalCost":2}}]}`
+	_, u := newAllocationServer(t, body)
+	client := NewApiClient(u, "test", false)
+	var got []Allocation
+	sets, err := client.StreamAllocation(context.Background(), nil, func(a Allocation) error {
+		got = append(got, a)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sets != 2 || len(got) != 2 || got[0].Name != "a" || got[1].TotalCost != 2 {
+		t.Errorf("got %d sets with %+v", sets, got)
+	}
+
+	// the limit applies to the decompressed response
+	client.MaxResponseBytes = int64(len(body)) - 10
+	_, err = client.StreamAllocation(context.Background(), nil, func(a Allocation) error { return nil })
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("got error %v, want ErrResponseTooLarge", err)
+	}
+	client.MaxResponseBytes = int64(len(body))
+	if _, err := client.StreamAllocation(context.Background(), nil, func(a Allocation) error { return nil }); err != nil {
+		t.Errorf("the response of exactly the limit failed: %s", err)
+	}
+}
+
+func TestStreamWithoutCache(t *testing.T) {
+	// without the cache the identical requests aren't collapsed, each of them streams its own response
+	s, u := newAllocationServer(t, `{"code":200,"data":{"a":{"name":"a"}}}`)
+	s.release = make(chan struct{})
+	client := NewApiClient(u, "test", false)
+	client.Requests = NewRequestGroup(4)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.StreamAllocation(context.Background(), []string{"window=1d"}, func(Allocation) error { return nil })
+			errs <- err
+		}()
+	}
+	waitFor(t, "the requests", func() bool { return client.Requests.Stats().InFlight == 2 })
+	close(s.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if stats := client.Requests.Stats(); s.requests != 2 || stats != (RequestStats{}) {
+		t.Errorf("got %d requests and stats %+v, want 2 requests", s.requests, stats)
+	}
+}
+
+// requestObserver records the observed requests
+type requestObserver struct {
+	mu        sync.Mutex
+	codes     []int
+	durations []time.Duration
+}
+
+func (o *requestObserver) ObserveRequest(endpoint string, code int, duration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.codes = append(o.codes, code)
+	o.durations = append(o.durations, duration)
+}
+
+func (o *requestObserver) ObserveResponseSize(endpoint string, code int, bytes int64) {}
+
+func TestObserveRequest(t *testing.T) {
+	// Kubecost sends the headers of a big response right away, the rest of it is slow
+	const delay = 100 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":200,"data":{"a":`))
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		w.Write([]byte(`{"name":"a"}}}`))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	cache, err := NewResponseCache(CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cache := range []*ResponseCache{nil, cache} {
+		observer := &requestObserver{}
+		client := NewApiClient(u, "test", false)
+		client.Cache = cache
+		client.Observer = observer
+		if _, err := client.StreamAllocation(context.Background(), []string{"window=1d"}, func(Allocation) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if len(observer.durations) != 1 || observer.codes[0] != http.StatusOK || observer.durations[0] < delay {
+			t.Errorf("cache %v: got the requests %v with the codes %v, want one longer than %s", cache != nil, observer.durations, observer.codes, delay)
+		}
+	}
+
+	// the requests without a response are observed with the code 0
+	observer := &requestObserver{}
+	server.Close()
+	client := NewApiClient(u, "test", false)
+	client.Observer = observer
+	if _, err := client.StreamAllocation(context.Background(), nil, func(Allocation) error { return nil }); err == nil {
+		t.Fatal("the request to the closed server succeeded")
+	}
+	if !reflect.DeepEqual(observer.codes, []int{0}) {
+		t.Errorf("got the codes %v, want [0]", observer.codes)
+	}
+}
@@ -0,0 +1,96 @@
+package kubecost_api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/tracing"
+)
+
+// startRequestSpan starts the span of the Kubecost request and adds the trace context headers to it,
+// so the request can be found in the traces of Kubecost too
+func (c *Client) startRequestSpan(ctx context.Context, req *http.Request) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, req.Method+" "+req.URL.Path, tracing.SpanKindClient,
+		tracing.String("http.request.method", req.Method),
+		tracing.String("server.address", req.URL.Host),
+		// the query isn't recorded, it may have the Kubecost credentials
+		tracing.String("url.path", req.URL.Path),
+	)
+	tracing.Inject(ctx, req.Header)
+	return ctx, span
+}
+
+// tracedResponse records the status of the response, the span ends when the body is closed,
+// so it includes reading the response, which is decoded from the connection without the cache
+func tracedResponse(resp *http.Response, span *tracing.Span) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(tracing.StatusError, fmt.Sprintf("HTTP status %s", resp.Status))
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+}
+
+// tracedBody ends the span of the request when the response is closed
+type tracedBody struct {
+	io.ReadCloser
+	span *tracing.Span
+	// n is the size of the body as it's transferred, e.g. gzipped
+	n int64
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.span.SetAttributes(tracing.Int64("http.response.body.size", b.n))
+	b.span.End()
+	return b.ReadCloser.Close()
+}
+
+// decode traces the decoding of the response
+func (c *Client) decode(ctx context.Context, path string, cached bool, body io.Reader, decode func(ctx context.Context, body io.Reader) error) error {
+	ctx, span := tracing.Start(ctx, "decode "+path, tracing.SpanKindInternal, tracing.Bool("kubecost.cached", cached))
+	defer span.End()
+	err := decode(ctx, body)
+	span.SetError(err)
+	return err
+}
+
+// itemHandler counts the decoded items and the time spent in the callback for the span of the decoding.
+// The scrapers generate the metrics in the callback as the items are decoded, so that's the time of the metrics generation
+type itemHandler struct {
+	span     *tracing.Span
+	items    int
+	handling time.Duration
+}
+
+func newItemHandler(ctx context.Context) *itemHandler {
+	return &itemHandler{span: tracing.SpanFromContext(ctx)}
+}
+
+func (h *itemHandler) handle(fn func() error) error {
+	if !h.span.IsRecording() {
+		return fn()
+	}
+	h.items++
+	start := time.Now()
+	err := fn()
+	h.handling += time.Since(start)
+	return err
+}
+
+func (h *itemHandler) end() {
+	h.span.SetAttributes(
+		tracing.Int("kubecost.items", h.items),
+		tracing.Float64("kubecost.items.handling_seconds", h.handling.Seconds()),
+	)
+}
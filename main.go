@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/history"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/artemlive/kubecost_exporter/sink"
+	"github.com/artemlive/kubecost_exporter/tracing"
 	"github.com/artemlive/kubecost_exporter/version"
+	"github.com/artemlive/kubecost_exporter/web"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -21,16 +34,124 @@ var (
 		"web.listen-address",
 		"Address to listen on for web interface and telemetry.",
 	).Default(":9150").String()
+	webConfigFile = kingpin.Flag(
+		"web.config.file",
+		"Path to the web config file with TLS, client certificates and basic auth, the same format as the other Prometheus exporters have.",
+	).Default("").String()
 	metricPath = kingpin.Flag(
 		"web.telemetry-path",
 		"Path under which to expose metrics.",
 	).Default("/metrics").String()
+	readyMaxContactAge = kingpin.Flag(
+		"web.ready-max-contact-age",
+		"/-/ready fails if Kubecost hasn't answered for longer than this, the probe requests Kubecost by itself then.",
+	).Default("5m").Duration()
+	shutdownGracePeriod = kingpin.Flag(
+		"web.shutdown-grace-period",
+		"How long the running scrapes and sinks are waited for on SIGTERM, their Kubecost requests are cancelled after it.",
+	).Default("25s").Duration()
 	tlsInsecureSkipVerify = kingpin.Flag(
 		"tls.insecure-skip-verify",
 		"Ignore certificate and server verification when using a tls connection.",
 	).Bool()
 	offsetDays = kingpin.Flag("offset", "Data offset window").Default("2").Int64()
-	kubecostUrl = kingpin.Flag("kubecost.baseUrl", "KubeCost base URL with schema: https://kubecost.example.com").Required().Envar("KUBECOST_URL").URL()
+	step       = kingpin.Flag("step", "Enables the time-series mode: the window is split into step intervals (e.g. 1d, 1h), each of them is exported separately. Disabled by default, the accumulated window cost is exported.").Default("").String()
+	stepRange  = kingpin.Flag("step.range", "Number of days in the window for the time-series mode, starting from the offset.").Default("1").Int64()
+	stepOutput = kingpin.Flag("step.output", "How the intervals are exported in the time-series mode: \"label\" adds the \"day\" label, \"timestamp\" sets the interval end as the sample timestamp.").Default(collector.StepOutputLabel).Enum(collector.StepOutputLabel, collector.StepOutputTimestamp)
+	kubecostUrl = kingpin.Flag("kubecost.baseUrl", "KubeCost base URL with schema: https://kubecost.example.com, required if it isn't set in the config file.").Envar("KUBECOST_URL").URL()
+	configFile  = kingpin.Flag("config.file", "Configuration file with the Kubecost instance, the scrape options, the sinks and the /probe targets, it's reloaded on SIGHUP and POST /-/reload.").String()
+
+	remoteWriteURL             = kingpin.Flag("remote-write.url", "Prometheus remote write endpoint, when it's set, the collected metrics are pushed to it every remote-write.interval.").URL()
+	remoteWriteInterval        = kingpin.Flag("remote-write.interval", "How often the metrics are collected and pushed to the remote write endpoint.").Default("5m").Duration()
+	remoteWriteTimeout         = kingpin.Flag("remote-write.timeout", "Timeout of a single remote write request.").Default("30s").Duration()
+	remoteWriteRetries         = kingpin.Flag("remote-write.retries", "Number of retries for network errors, 5xx and 429 responses.").Default("3").Int()
+	remoteWriteLabels          = kingpin.Flag("remote-write.label", "Label added to every pushed series, repeatable: --remote-write.label=job=kubecost_exporter.").StringMap()
+	remoteWriteUsername        = kingpin.Flag("remote-write.basic-auth.username", "Basic auth username for the remote write endpoint.").String()
+	remoteWritePassword        = kingpin.Flag("remote-write.basic-auth.password", "Basic auth password for the remote write endpoint.").Envar("REMOTE_WRITE_PASSWORD").String()
+	remoteWriteBearerTokenFile = kingpin.Flag("remote-write.bearer-token-file", "File with the bearer token for the remote write endpoint.").String()
+	remoteWriteSkipTLSVerify   = kingpin.Flag("remote-write.tls-insecure-skip-verify", "Ignore certificate verification of the remote write endpoint.").Bool()
+
+	otlpEndpoint      = kingpin.Flag("otlp.endpoint", "OTLP receiver endpoint, e.g. otel-collector:4317, when it's set, the collected metrics are exported to it every otlp.interval.").String()
+	otlpProtocol      = kingpin.Flag("otlp.protocol", "OTLP protocol: grpc or http/protobuf.").Default(sink.OTLPProtocolGRPC).Enum(sink.OTLPProtocolGRPC, sink.OTLPProtocolHTTP)
+	otlpInsecure      = kingpin.Flag("otlp.insecure", "Disable TLS for the OTLP endpoint.").Bool()
+	otlpSkipTLSVerify = kingpin.Flag("otlp.tls-insecure-skip-verify", "Ignore certificate verification of the OTLP endpoint.").Bool()
+	otlpHeaders       = kingpin.Flag("otlp.header", "Header added to the OTLP requests, repeatable: --otlp.header=Authorization=\"Bearer TOKEN\".").StringMap()
+	otlpInterval      = kingpin.Flag("otlp.interval", "How often the metrics are collected and exported to the OTLP endpoint.").Default("5m").Duration()
+	otlpTimeout       = kingpin.Flag("otlp.timeout", "Timeout of a single OTLP export request.").Default("30s").Duration()
+	otlpRetries       = kingpin.Flag("otlp.retries", "Number of retries for the retryable OTLP errors.").Default("3").Int()
+	otlpCluster       = kingpin.Flag("otlp.cluster", "Value of the k8s.cluster.name resource attribute.").String()
+	otlpCostUnit      = kingpin.Flag("otlp.cost-unit", "Unit of the cost metrics, the currency configured in Kubecost.").Default("USD").String()
+
+	tracingEndpoint      = kingpin.Flag("tracing.endpoint", "OTLP receiver endpoint of the traces, e.g. otel-collector:4317, when it's set, the /metrics requests are traced.").String()
+	tracingProtocol      = kingpin.Flag("tracing.protocol", "OTLP protocol of the traces: grpc or http/protobuf.").Default(sink.OTLPProtocolGRPC).Enum(sink.OTLPProtocolGRPC, sink.OTLPProtocolHTTP)
+	tracingInsecure      = kingpin.Flag("tracing.insecure", "Disable TLS for the traces endpoint.").Bool()
+	tracingSkipTLSVerify = kingpin.Flag("tracing.tls-insecure-skip-verify", "Ignore certificate verification of the traces endpoint.").Bool()
+	tracingHeaders       = kingpin.Flag("tracing.header", "Header added to the traces export requests, repeatable: --tracing.header=Authorization=\"Bearer TOKEN\".").StringMap()
+	tracingSampleRatio   = kingpin.Flag("tracing.sample-ratio", "Ratio of the traced /metrics requests from 0 to 1, the requests with the traceparent header are traced if their parent is sampled.").Default("1").Float64()
+
+	recordsDir            = kingpin.Flag("records.dir", "Directory for the raw allocation and asset records, when it's set, the records are written every records.interval (and by backfill and oneshot).").String()
+	recordsFormat         = kingpin.Flag("records.format", "Format of the records files: jsonl, csv or parquet.").Default(sink.RecordFormatJSONL).Enum(sink.RecordFormatJSONL, sink.RecordFormatCSV, sink.RecordFormatParquet)
+	recordsMaxRowsPerFile = kingpin.Flag("records.max-rows-per-file", "Maximum number of rows in a single records file, bigger partitions are split into parts.").Default(strconv.Itoa(sink.DefaultMaxRowsPerFile)).Int()
+	recordsPartition      = kingpin.Flag("records.partition-template", "Template of the partition directory, the fields are .Kind, .Date and .Cluster.").Default(sink.DefaultPartitionTemplate).String()
+	recordsInterval       = kingpin.Flag("records.interval", "How often the records are fetched and written.").Default("1h").Duration()
+
+	s3Bucket         = kingpin.Flag("s3.bucket", "S3 bucket for the daily reports and the raw records, when it's set, they are uploaded every s3.interval (and by backfill and oneshot).").String()
+	s3Endpoint       = kingpin.Flag("s3.endpoint", "S3 compatible endpoint, e.g. https://storage.googleapis.com or http://minio:9000. Defaults to AWS S3 in the s3.region.").URL()
+	s3Region         = kingpin.Flag("s3.region", "Bucket region.").Default("us-east-1").String()
+	s3Prefix         = kingpin.Flag("s3.prefix", "Template of the prefix of all the uploaded object keys, e.g. kubecost/{{.Cluster}}/{{.Date}}, the fields are the ones of s3.report-template.").String()
+	s3Cluster        = kingpin.Flag("s3.cluster", "Value of .Cluster in s3.prefix and s3.report-template.").String()
+	s3PathStyle      = kingpin.Flag("s3.path-style", "Use the path-style URLs, needed for MinIO.").Bool()
+	s3AccessKey      = kingpin.Flag("s3.access-key-id", "S3 access key id.").Envar("AWS_ACCESS_KEY_ID").String()
+	s3SecretKey      = kingpin.Flag("s3.secret-access-key", "S3 secret access key.").Envar("AWS_SECRET_ACCESS_KEY").String()
+	s3SessionToken   = kingpin.Flag("s3.session-token", "S3 session token for the temporary credentials.").Envar("AWS_SESSION_TOKEN").String()
+	s3SSE            = kingpin.Flag("s3.sse", "Server-side encryption: AES256 or aws:kms, empty to use the bucket default.").Enum("", sink.S3SSEAES256, sink.S3SSEKMS)
+	s3SSEKMSKeyID    = kingpin.Flag("s3.sse-kms-key-id", "KMS key id for the aws:kms server-side encryption.").String()
+	s3Report         = kingpin.Flag("s3.report", "Upload the CSV report of the cost metrics of every window.").Default("true").Bool()
+	s3ReportTemplate = kingpin.Flag("s3.report-template", "Template of the report object key, the fields are .Date, .Start and .End of the window and .Cluster.").Default(sink.DefaultReportTemplate).String()
+	s3Records        = kingpin.Flag("s3.records", "Upload the raw allocation and asset records.").Default("true").Bool()
+	s3RecordsFormat  = kingpin.Flag("s3.records-format", "Format of the uploaded records: jsonl, csv or parquet.").Default(sink.RecordFormatParquet).Enum(sink.RecordFormatJSONL, sink.RecordFormatCSV, sink.RecordFormatParquet)
+	s3Interval       = kingpin.Flag("s3.interval", "How often the reports and the records are uploaded, the keys contain the window, so the uploads of the same window replace each other.").Default("1h").Duration()
+	s3Timeout        = kingpin.Flag("s3.timeout", "Timeout of a single S3 request.").Default("1m").Duration()
+	s3Retries        = kingpin.Flag("s3.retries", "Number of retries for the network errors, 5xx and 429 responses.").Default("3").Int()
+	s3SkipTLSVerify  = kingpin.Flag("s3.tls-insecure-skip-verify", "Ignore certificate verification of the S3 endpoint.").Bool()
+
+	historyPath     = kingpin.Flag("history.path", "SQLite database for the cost history, when it's set, the allocations and assets are stored every history.interval (and by backfill and oneshot) and can be queried at /api/v1/costs.").String()
+	historyInterval = kingpin.Flag("history.interval", "How often the allocations and assets are fetched and stored in the history.").Default("1h").Duration()
+
+	maxConcurrentRequests = kingpin.Flag("kubecost.max-concurrent-requests", "Maximum number of concurrent requests to Kubecost, the identical concurrent requests are always collapsed into one. 0 is no limit.").Default("4").Int()
+	maxResponseSize       = kingpin.Flag("kubecost.max-response-size", "Maximum size of the decompressed Kubecost response, the scrape fails if it's exceeded. 0 is no limit.").Default("1GB").Bytes()
+
+	clusterInfoLabels  = kingpin.Flag("cluster-info.labels", "Add the cluster_name, cluster_provider and cluster_region labels to the assets and allocations series, they're resolved by the property_cluster from the Kubecost cluster info.").Bool()
+	clusterInfoRefresh = kingpin.Flag("cluster-info.refresh", "How often the cluster info is requested for the cluster labels and the scrape_cluster_info scraper.").Default("10m").Duration()
+
+	duplicatePolicy = kingpin.Flag("duplicate-series.policy", "How the series that are the same after the labels processing are resolved: sum, max, first, or error (the duplicates are dropped and the scrape fails).").Default(collector.DuplicatePolicyError).Enum(collector.DuplicatePolicies...)
+
+	cacheEnabled     = kingpin.Flag("cache.enabled", "Cache the Kubecost responses, the TTL depends on whether the queried window is open, closed or settled.").Bool()
+	cacheOpenTTL     = kingpin.Flag("cache.open-ttl", "TTL of the responses for the windows that are not finished yet, 0 disables caching of them.").Default("0s").Duration()
+	cacheClosedTTL   = kingpin.Flag("cache.closed-ttl", "TTL of the responses for the finished windows that are not settled by the Kubecost ETL yet.").Default("10m").Duration()
+	cacheSettledTTL  = kingpin.Flag("cache.settled-ttl", "TTL of the responses for the settled windows, they don't change anymore.").Default("168h").Duration()
+	cacheSettleDelay = kingpin.Flag("cache.settle-delay", "Time after the window end when the window is considered settled.").Default("6h").Duration()
+	cacheMaxSize     = kingpin.Flag("cache.max-size", "Maximum size of the cached responses, e.g. 256MB.").Default("256MB").Bytes()
+	cacheDir         = kingpin.Flag("cache.dir", "Directory to persist the cached responses across restarts, empty keeps them only in memory.").String()
+
+	serveCmd       = kingpin.Command("serve", "Run the exporter, the default command.").Default()
+	backfillCmd    = kingpin.Command("backfill", "Walk the date range day by day and write the metrics with timestamps in the OpenMetrics format, consumable by \"promtool tsdb create-blocks-from openmetrics\".")
+	backfillFrom   = backfillCmd.Flag("from", "The first day to backfill, YYYY-MM-DD.").Required().String()
+	backfillTo     = backfillCmd.Flag("to", "The day to stop the backfill at (exclusive), YYYY-MM-DD. Defaults to the offset day.").String()
+	backfillOutput = backfillCmd.Flag("output", "Output file, \"-\" for stdout.").Default("-").String()
+	backfillPush   = backfillCmd.Flag("remote-write", "Push the backfilled samples to the remote-write.url endpoint instead of writing the output. Prometheus needs out_of_order_time_window to cover the date range.").Bool()
+
+	checkConfigCmd   = kingpin.Command("check-config", "Check the configuration files and exit, the exit code is 1 if any of them is invalid.")
+	checkConfigFiles = checkConfigCmd.Arg("config-files", "Configuration files to check, --config.file by default.").Strings()
+
+	oneshotCmd                 = kingpin.Command("oneshot", "Collect the enabled scrapers once, push the result to a Pushgateway and/or write it to a textfile for the node_exporter textfile collector and exit. The exit code is 2 if any scraper failed.")
+	oneshotPushgatewayURL      = oneshotCmd.Flag("pushgateway.url", "Pushgateway URL, e.g. http://pushgateway:9091.").String()
+	oneshotPushgatewayJob      = oneshotCmd.Flag("pushgateway.job", "Pushgateway job name.").Default("kubecost_exporter").String()
+	oneshotPushgatewayGrouping = oneshotCmd.Flag("pushgateway.grouping", "Pushgateway grouping key, repeatable: --pushgateway.grouping=cluster=prod. The \"window\" key is set to the scraped day, unless it's set explicitly.").StringMap()
+	oneshotPushgatewayUsername = oneshotCmd.Flag("pushgateway.basic-auth.username", "Basic auth username for the Pushgateway.").String()
+	oneshotPushgatewayPassword = oneshotCmd.Flag("pushgateway.basic-auth.password", "Basic auth password for the Pushgateway.").Envar("PUSHGATEWAY_PASSWORD").String()
+	oneshotPushgatewayTimeout  = oneshotCmd.Flag("pushgateway.timeout", "Timeout of the push request.").Default("30s").Duration()
+	oneshotTextfile            = oneshotCmd.Flag("textfile.path", "Write the metrics to this file atomically, the name must end with .prom for the node_exporter textfile collector.").String()
 )
 
 // scrapers lists all possible collection methods and if they should be enabled by default.
@@ -38,17 +159,140 @@ var (
 var scrapers = map[collector.Scraper]bool{
 	collector.ScrapeAssets{}: true,
 	collector.ScrapeAllocation{}: true,
+	collector.ScrapeClusterInfo{}: false,
+}
+
+// infoScrapers export a single series per cluster, they have no filters and top-n limits
+var infoScrapers = map[string]bool{
+	collector.ScrapeClusterInfo{}.Name(): true,
+}
+
+// scraperFilters holds the flags with Kubecost filters for a single scraper
+type scraperFilters struct {
+	clusters   *[]string
+	namespaces *[]string
+	labels     *[]string
+	types      *[]string
+	categories *[]string
+	services   *[]string
+	filter     *string
+}
+
+func (f scraperFilters) Filters() kubecost_api.Filters {
+	return kubecost_api.Filters{
+		Clusters:   *f.clusters,
+		Namespaces: *f.namespaces,
+		Labels:     *f.labels,
+		Types:      *f.types,
+		Categories: *f.categories,
+		Services:   *f.services,
+		Filter:     *f.filter,
+	}
+}
+
+// newScraperFilters generates the filter flags for the scraper
+// e.g. --scrape_assets.filter.namespaces=kubecost --scrape_assets.filter.namespaces=default
+func newScraperFilters(scraper collector.Scraper) scraperFilters {
+	flagName := func(name string) string {
+		return fmt.Sprintf("%s.filter.%s", scraper.Name(), name)
+	}
+	return scraperFilters{
+		clusters:   kingpin.Flag(flagName("clusters"), "Kubecost filterClusters value, repeatable.").Strings(),
+		namespaces: kingpin.Flag(flagName("namespaces"), "Kubecost filterNamespaces value, repeatable.").Strings(),
+		labels:     kingpin.Flag(flagName("labels"), "Kubecost filterLabels value in the \"label:value\" format, repeatable.").Strings(),
+		types:      kingpin.Flag(flagName("types"), "Kubecost filterTypes value, repeatable.").Strings(),
+		categories: kingpin.Flag(flagName("categories"), "Kubecost filterCategories value, repeatable.").Strings(),
+		services:   kingpin.Flag(flagName("services"), "Kubecost filterServices value, repeatable.").Strings(),
+		filter:     kingpin.Flag(flagName("filter"), "Kubecost filter expression in the filter language, e.g. namespace:\"kubecost\".").String(),
+	}
+}
+
+// topNParents are the default parent labels of the folded series
+var topNParents = map[string][]string{
+	collector.ScrapeAssets{}.Name():     {"property_cluster", "type"},
+	collector.ScrapeAllocation{}.Name(): {"property_cluster", "property_namespace"},
+}
+
+// scraperTopN holds the flags of the top-n limit for a single scraper
+type scraperTopN struct {
+	n  *int
+	by *[]string
+}
+
+func (f scraperTopN) TopN() collector.TopN {
+	return collector.TopN{N: *f.n, By: *f.by}
 }
 
-func newHandler(metrics collector.Metrics, scrapers []collector.Scraper, logger log.Logger) http.HandlerFunc {
+// newScraperTopN generates the top-n flags for the scraper
+// e.g. --scrape_allocation.top-n=100 --scrape_allocation.top-n.by=property_cluster
+func newScraperTopN(scraper collector.Scraper) scraperTopN {
+	return scraperTopN{
+		n:  kingpin.Flag(scraper.Name()+".top-n", "Export only the N most expensive series, the other series are summed up into the top_n=\"__other__\" series. 0 exports all the series.").Default("0").Int(),
+		by: kingpin.Flag(scraper.Name()+".top-n.by", "Parent labels that are kept by the __other__ series, there is one __other__ series per their values, repeatable.").Default(topNParents[scraper.Name()]...).Strings(),
+	}
+}
+
+// newGatherers returns the exporter metrics along with the default ones
+func newGatherers(ctx context.Context, metrics collector.Metrics, setup *scrapeSetup, scrapers []collector.Scraper, scrapersParams map[string][]string, logger log.Logger) prometheus.Gatherers {
+	return prometheus.Gatherers{
+		prometheus.DefaultGatherer,
+		newRegistry(ctx, metrics, setup, scrapers, scrapersParams, logger),
+	}
+}
+
+// newRegistry returns the registry of a single scrape, without the exporter's own metrics
+func newRegistry(ctx context.Context, metrics collector.Metrics, setup *scrapeSetup, scrapers []collector.Scraper, scrapersParams map[string][]string, logger log.Logger) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.New(ctx, &setup.baseURL, metrics, scrapers, scrapersParams, logger, setup.opts))
+	return registry
+}
+
+// filtersParams returns the configured filters as the scrapers params
+func filtersParams(filters map[string]kubecost_api.Filters) map[string][]string {
+	scrapersParams := make(map[string][]string)
+	for name, f := range filters {
+		scrapersParams[name] = f.QueryParams()
+	}
+	return scrapersParams
+}
+
+func newHandler(metrics collector.Metrics, currentSetup func() *scrapeSetup, logger log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		filteredScrapers := scrapers
+		// the scrape keeps the setup it started with, even if the config is reloaded in the meantime
+		setup := currentSetup()
+		scrapers, filters := setup.scrapers, setup.filters
 		scrapersFilterQuery := r.URL.Query()["collect[]"]
 		scrapersParams := make(map[string][]string)
 		// Use request context for cancellation when connection gets closed.
 		ctx := r.Context()
 		level.Debug(logger).Log("msg", "collect[] scrapersFilterQuery", "scrapersFilterQuery", strings.Join(scrapersFilterQuery, ","))
 
+		// the tenant of the request gets only its scrapers and its scope
+		tenant, ok := setup.tenants.identify(r)
+		if !ok {
+			http.Error(w, "no tenant for the identity of the request", http.StatusForbidden)
+			return
+		}
+		if tenant != nil {
+			tracing.SpanFromContext(ctx).SetAttributes(tracing.String("tenant", tenant.name))
+		}
+		if tenant != nil && !tenant.unrestricted() {
+			for _, name := range scrapersFilterQuery {
+				if !tenant.allows(name) {
+					http.Error(w, fmt.Sprintf("scraper %q isn't permitted for tenant %q", name, tenant.name), http.StatusForbidden)
+					return
+				}
+			}
+			var allowed []collector.Scraper
+			for _, scraper := range scrapers {
+				if tenant.allows(scraper.Name()) {
+					allowed = append(allowed, scraper)
+				}
+			}
+			scrapers = allowed
+		}
+		filteredScrapers := scrapers
+
 		// Check if we have some "collect[]" query parameters.
 		if len(scrapersFilterQuery) > 0 {
 			filters := make(map[string]bool)
@@ -73,15 +317,38 @@ func newHandler(metrics collector.Metrics, scrapers []collector.Scraper, logger
 
 		}
 
-		registry := prometheus.NewRegistry()
-		registry.MustRegister(collector.New(ctx, kubecostUrl, metrics, filteredScrapers, scrapersParams, logger, *tlsInsecureSkipVerify, *offsetDays))
+		// Configured filters go first, so they are always applied
+		// the params from the query are able to add more filters on top of them
+		var scoped []collector.Scraper
+		for _, scraper := range filteredScrapers {
+			f := filters[scraper.Name()]
+			if tenant != nil && !infoScrapers[scraper.Name()] {
+				// the scraper is skipped if nothing is left of its filters in the tenant's scope
+				if f, ok = tenant.scope.Filters(f); !ok {
+					continue
+				}
+			}
+			scoped = append(scoped, scraper)
+			if filterParams := f.QueryParams(); len(filterParams) > 0 {
+				scrapersParams[scraper.Name()] = append(filterParams, scrapersParams[scraper.Name()]...)
+			}
+		}
+		filteredScrapers = scoped
 
-		gatherers := prometheus.Gatherers{
-			prometheus.DefaultGatherer,
-			registry,
+		var gatherer prometheus.Gatherer
+		if tenant == nil || tenant.scope.IsEmpty() {
+			gatherer = newGatherers(ctx, metrics, setup, filteredScrapers, scrapersParams, logger)
+		} else {
+			// Kubecost filters are only a part of the scope, e.g. the custom params can widen them,
+			// so the series are filtered again. The tenant gets only the metrics of the scrape
+			registry := newRegistry(ctx, metrics, setup, filteredScrapers, scrapersParams, logger)
+			gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				families, err := registry.Gather()
+				return tenant.scope.FilterFamilies(families), err
+			})
 		}
 		// Delegate http serving to Prometheus client library, which will call collector.Collect.
-		h := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+		h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
 		h.ServeHTTP(w, r)
 	}
 }
@@ -89,6 +356,8 @@ func newHandler(metrics collector.Metrics, scrapers []collector.Scraper, logger
 func main() {
 	// Generate ON/OFF flags for all scrapers.
 	scraperFlags := map[collector.Scraper]*bool{}
+	scraperFiltersFlags := map[collector.Scraper]scraperFilters{}
+	scraperTopNFlags := map[collector.Scraper]scraperTopN{}
 	for scraper, enabledByDefault := range scrapers {
 		defaultOn := "false"
 		if enabledByDefault {
@@ -101,6 +370,11 @@ func main() {
 		).Default(defaultOn).Bool()
 
 		scraperFlags[scraper] = f
+		if infoScrapers[scraper.Name()] {
+			continue
+		}
+		scraperFiltersFlags[scraper] = newScraperFilters(scraper)
+		scraperTopNFlags[scraper] = newScraperTopN(scraper)
 	}
 
 	// Parse flags.
@@ -108,7 +382,7 @@ func main() {
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("kubecost_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
 
 	// landingPage contains the HTML served at '/'.
@@ -118,6 +392,7 @@ func main() {
 <body>
 <h1>KubeCost Assets API exporter</h1>
 <p><a href='` + *metricPath + `'>Metrics</a></p>
+<p><a href='/status'>Status</a></p>
 </body>
 </html>
 `)
@@ -127,21 +402,288 @@ func main() {
 	// Register only scrapers enabled by flag.
 	// As for now we have only one scraper that gets the info about assets
 	var enabledScrapers []collector.Scraper
+	filters := make(map[string]kubecost_api.Filters)
+	topN := make(map[string]collector.TopN)
 	for scraper, enabled := range scraperFlags {
 		if *enabled {
 			level.Info(logger).Log("msg", "Scraper enabled", "scraper", scraper.Name())
 			enabledScrapers = append(enabledScrapers, scraper)
+			if infoScrapers[scraper.Name()] {
+				continue
+			}
+			filters[scraper.Name()] = scraperFiltersFlags[scraper].Filters()
+			if !filters[scraper.Name()].IsEmpty() {
+				level.Info(logger).Log("msg", "Scraper filters", "scraper", scraper.Name(), "filters", strings.Join(filters[scraper.Name()].QueryParams(), "&"))
+			}
+			if t := scraperTopNFlags[scraper].TopN(); t.N > 0 {
+				topN[scraper.Name()] = t
+				level.Info(logger).Log("msg", "Scraper top-n limit", "scraper", scraper.Name(), "n", t.N, "by", strings.Join(t.By, ","))
+			}
 		}
 	}
-	handlerFunc := newHandler(collector.NewMetrics(), enabledScrapers, logger)
-	http.Handle(*metricPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handlerFunc))
+	stepDuration, err := collector.ParseStep(*step)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing step", "err", err)
+		os.Exit(1)
+	}
+	scrapeOpts := collector.ScrapeOptions{
+		SkipTLSVerify: *tlsInsecureSkipVerify,
+		Offset:        *offsetDays,
+		Step:          stepDuration,
+		StepRange:     *stepRange,
+		StepOutput:    *stepOutput,
+
+		MaxResponseBytes: int64(*maxResponseSize),
+		DuplicatePolicy:  *duplicatePolicy,
+		TopN:             topN,
+	}
+	scrapeOpts.ClusterInfo = collector.NewClusterInfoCache(*clusterInfoRefresh)
+	scrapeOpts.Status = collector.NewStatus()
+	// the exporter's own metrics are shared by all the scrapes, so they're registered once
+	scrapeOpts.Instrumentation = collector.NewInstrumentation()
+	prometheus.MustRegister(version.NewCollector("kubecost_exporter"), scrapeOpts.Instrumentation, sink.Retries)
+	scrapeOpts.ClusterLabels = *clusterInfoLabels
+	if err := scrapeOpts.Validate(); err != nil {
+		level.Error(logger).Log("msg", "Invalid time-series mode options", "err", err)
+		os.Exit(1)
+	}
+	if command == checkConfigCmd.FullCommand() {
+		paths := *checkConfigFiles
+		if len(paths) == 0 && len(*configFile) > 0 {
+			paths = []string{*configFile}
+		}
+		if len(paths) == 0 && len(*webConfigFile) == 0 {
+			level.Error(logger).Log("msg", "No configuration files to check, pass them as the arguments or set --config.file")
+			os.Exit(1)
+		}
+		os.Exit(checkConfig(paths, *webConfigFile, scrapeSetup{baseURL: *kubecostUrl, scrapers: enabledScrapers, filters: filters, opts: scrapeOpts}, logger))
+	}
+	cfg := &config.Config{}
+	if len(*configFile) > 0 {
+		if cfg, err = config.Load(*configFile); err != nil {
+			level.Error(logger).Log("msg", "Error loading config", "err", err)
+			os.Exit(1)
+		}
+		// the sinks aren't reloaded, so they're just the flags values
+		applySinksConfig(cfg.Sinks)
+	}
+
+	scrapeOpts.Requests = kubecost_api.NewRequestGroup(*maxConcurrentRequests)
+	prometheus.MustRegister(collector.NewRequestsCollector(scrapeOpts.Requests))
+	if *cacheEnabled {
+		cache, err := kubecost_api.NewResponseCache(kubecost_api.CacheConfig{
+			OpenTTL:     *cacheOpenTTL,
+			ClosedTTL:   *cacheClosedTTL,
+			SettledTTL:  *cacheSettledTTL,
+			SettleDelay: *cacheSettleDelay,
+			MaxBytes:    int64(*cacheMaxSize),
+			Dir:         *cacheDir,
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating the response cache", "err", err)
+			os.Exit(1)
+		}
+		stats := cache.Stats()
+		level.Info(logger).Log("msg", "Response cache enabled", "dir", *cacheDir, "loaded_entries", stats.Entries, "loaded_bytes", stats.Bytes)
+		scrapeOpts.Cache = cache
+		prometheus.MustRegister(collector.NewCacheCollector(cache))
+	}
+
+	fileRecords, err := newFileRecords(logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error configuring records export", "err", err)
+		os.Exit(1)
+	}
+	bucketRecords, err := newS3Records(logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error configuring S3 upload", "err", err)
+		os.Exit(1)
+	}
+	var historyStore *history.Store
+	var historyRecords collector.RecordWriter
+	if len(*historyPath) > 0 {
+		historyStore, err = history.Open(*historyPath, log.With(logger, "component", "history"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error opening the cost history", "path", *historyPath, "err", err)
+			os.Exit(1)
+		}
+		// the store is closed by the commands and by the shutdown, os.Exit doesn't run the deferred calls
+		historyRecords = historyStore
+	}
+	if command != serveCmd.FullCommand() {
+		// backfill and oneshot write the records of the same run
+		scrapeOpts.Records = joinRecordWriters(fileRecords, bucketRecords, historyRecords)
+	}
+
+	flags := scrapeSetup{baseURL: *kubecostUrl, scrapers: enabledScrapers, filters: filters, opts: scrapeOpts}
+	setup, err := newScrapeSetup(cfg, flags, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid config", "err", err)
+		os.Exit(1)
+	}
+	// backfill, oneshot and the sinks use the setup of the start
+	*kubecostUrl = setup.baseURL
+	enabledScrapers, filters, scrapeOpts = setup.scrapers, setup.filters, setup.opts
+
+	if command == backfillCmd.FullCommand() || command == oneshotCmd.FullCommand() {
+		var exitCode int
+		if command == backfillCmd.FullCommand() {
+			exitCode = runBackfill(enabledScrapers, filters, scrapeOpts, logger)
+		} else {
+			exitCode = runOneshot(enabledScrapers, filters, scrapeOpts, logger)
+		}
+		// the records of the run are in the history, it's closed before the exit
+		if historyStore != nil {
+			if err := historyStore.Close(); err != nil {
+				level.Error(logger).Log("msg", "Error closing the cost history", "path", *historyPath, "err", err)
+				if exitCode == 0 {
+					exitCode = 1
+				}
+			}
+		}
+		os.Exit(exitCode)
+	}
+
+	if scrapeOpts.IsStepMode() {
+		level.Info(logger).Log("msg", "Time-series mode enabled", "step", collector.FormatStep(scrapeOpts.Step), "range", scrapeOpts.StepRange, "output", scrapeOpts.StepOutput)
+	}
+	reloads := newReloader(*configFile, cfg, flags, setup, log.With(logger, "component", "reload"))
+	prometheus.MustRegister(reloads)
+	go reloads.watchSignals()
+
+	shutdowns := newShutdown(log.With(logger, "component", "shutdown"))
+	var tracer *tracing.Tracer
+	if len(*tracingEndpoint) > 0 {
+		tracer, err = newTracer(log.With(logger, "component", "tracing"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error configuring tracing", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Tracing enabled", "endpoint", *tracingEndpoint, "protocol", *tracingProtocol, "sample_ratio", *tracingSampleRatio)
+		go tracer.Run(shutdowns.ctx)
+	}
+	metrics := collector.NewMetrics()
+	gather := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+		setup := reloads.current()
+		return newGatherers(ctx, metrics, setup, setup.scrapers, filtersParams(setup.filters), logger).Gather()
+	}
+	if *remoteWriteURL != nil {
+		remoteWrite, err := newRemoteWriteSink(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error configuring remote write", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Remote write enabled", "url", (*remoteWriteURL).Redacted(), "interval", *remoteWriteInterval)
+		shutdowns.goSink("remote_write", func(ctx context.Context, stop <-chan struct{}) {
+			sink.Loop(ctx, stop, *remoteWriteInterval, gather, []sink.Sink{remoteWrite}, logger)
+		})
+	}
+	if len(*otlpEndpoint) > 0 {
+		otlp, err := newOTLPSink(logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error configuring OTLP export", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "OTLP export enabled", "endpoint", *otlpEndpoint, "protocol", *otlpProtocol, "interval", *otlpInterval)
+		// the OTLP data points get the cost components as the attributes, they aren't in /metrics
+		gatherOTLP := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+			otlpSetup := *reloads.current()
+			otlpSetup.opts.CostComponents = true
+			return newGatherers(ctx, metrics, &otlpSetup, otlpSetup.scrapers, filtersParams(otlpSetup.filters), logger).Gather()
+		}
+		shutdowns.goSink("otlp", func(ctx context.Context, stop <-chan struct{}) {
+			sink.Loop(ctx, stop, *otlpInterval, gatherOTLP, []sink.Sink{otlp}, logger)
+		})
+	}
+
+	// the records and the uploads have their own loops, so /metrics scrapes don't write files
+	startExport := func(name string, interval time.Duration, records collector.RecordWriter, sinks []sink.Sink) {
+		exportMetrics := collector.NewMetrics()
+		gatherExport := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+			setup := reloads.current()
+			exportOpts := setup.opts
+			exportOpts.Records = records
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(collector.New(ctx, &setup.baseURL, exportMetrics, setup.scrapers, filtersParams(setup.filters), logger, exportOpts))
+			return registry.Gather()
+		}
+		shutdowns.goSink(name, func(ctx context.Context, stop <-chan struct{}) {
+			sink.Loop(ctx, stop, interval, gatherExport, sinks, logger)
+		})
+	}
+	if fileRecords != nil {
+		level.Info(logger).Log("msg", "Records export enabled", "dir", *recordsDir, "format", *recordsFormat, "interval", *recordsInterval)
+		startExport("records", *recordsInterval, fileRecords, nil)
+	}
+	if len(*s3Bucket) > 0 {
+		var s3Sinks []sink.Sink
+		if *s3Report {
+			report, err := newS3ReportSink(scrapeOpts, logger)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error configuring S3 upload", "err", err)
+				os.Exit(1)
+			}
+			s3Sinks = append(s3Sinks, report)
+		}
+		level.Info(logger).Log("msg", "S3 upload enabled", "bucket", *s3Bucket, "prefix", *s3Prefix, "report", *s3Report, "records", *s3Records, "interval", *s3Interval)
+		startExport("s3", *s3Interval, bucketRecords, s3Sinks)
+	}
+
+	if historyStore != nil {
+		level.Info(logger).Log("msg", "Cost history enabled", "path", *historyPath, "interval", *historyInterval)
+		startExport("history", *historyInterval, historyStore, nil)
+		http.Handle("/api/v1/costs", restrictTenants(reloads.current, history.NewHandler(historyStore, logger)))
+	}
+
+	if len(cfg.Targets) > 0 {
+		level.Info(logger).Log("msg", "Probe targets configured", "targets", len(cfg.Targets), "modules", len(cfg.Modules))
+	}
+
+	handlerFunc := newHandler(metrics, reloads.current, logger)
+	http.Handle(*metricPath, tracer.Handler(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handlerFunc)))
+	http.Handle("/probe", restrictTenants(reloads.current, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reloads.current().probe.ServeHTTP(w, r)
+	})))
+	http.Handle("/-/reload", restrictTenants(reloads.current, reloads))
+	http.Handle("/debug/scrape", newDebugHandler(reloads.current, log.With(logger, "component", "debug")))
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.Handle("/-/ready", newReadyHandler(reloads.current, *readyMaxContactAge, log.With(logger, "component", "ready")))
+	http.Handle("/status", restrictTenants(reloads.current, newStatusHandler(reloads, logger)))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
 	})
 
+	webServer, err := web.NewServer(*webConfigFile, log.With(logger, "component", "web"))
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading web config", "err", err)
+		os.Exit(1)
+	}
+	webServer.BearerAuth = func(token string) bool {
+		return reloads.current().tenants.hasToken(token)
+	}
 	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	server := shutdowns.server(*listenAddress, http.DefaultServeMux)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- webServer.ListenAndServe(server)
+	}()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
+	case sig := <-term:
+		level.Info(logger).Log("msg", "Received signal", "signal", sig)
+	}
+	// the history is written by the sinks, so it's closed after them
+	closers := make(map[string]io.Closer)
+	if historyStore != nil {
+		closers["history"] = historyStore
+	}
+	// the spans of the last requests are exported once they're finished
+	if tracer != nil {
+		closers["tracing"] = tracer
 	}
+	shutdowns.run(server, *shutdownGracePeriod, closers)
 }
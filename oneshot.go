@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/artemlive/kubecost_exporter/sink"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// exit codes of the oneshot command
+const (
+	oneshotExitOK          = 0
+	oneshotExitError       = 1
+	oneshotExitScrapeError = 2
+)
+
+// runOneshot runs the oneshot command and returns the exit code
+func runOneshot(scrapers []collector.Scraper, filters map[string]kubecost_api.Filters, scrapeOpts collector.ScrapeOptions, logger log.Logger) int {
+	// the Pushgateway rejects the whole push if any sample has a timestamp, node_exporter drops the whole textfile
+	if scrapeOpts.IsStepMode() && scrapeOpts.StepOutput == collector.StepOutputTimestamp && (len(*oneshotPushgatewayURL) > 0 || len(*oneshotTextfile) > 0) {
+		level.Error(logger).Log("msg", "Pushgateway and node_exporter textfile collector don't accept the samples with timestamps, use --step.output=label")
+		return oneshotExitError
+	}
+	var sinks []sink.Sink
+	if len(*oneshotPushgatewayURL) > 0 {
+		grouping := map[string]string{}
+		for k, v := range *oneshotPushgatewayGrouping {
+			grouping[k] = v
+		}
+		if _, ok := grouping["window"]; !ok {
+			from, _ := scrapeOpts.Window(time.Now())
+			grouping["window"] = from.Format(backfillDateFormat)
+		}
+		sinks = append(sinks, sink.NewPushgateway(sink.PushgatewayConfig{
+			URL:           *oneshotPushgatewayURL,
+			Job:           *oneshotPushgatewayJob,
+			Grouping:      grouping,
+			BasicAuthUser: *oneshotPushgatewayUsername,
+			BasicAuthPass: *oneshotPushgatewayPassword,
+			Timeout:       *oneshotPushgatewayTimeout,
+		}))
+	}
+	if len(*oneshotTextfile) > 0 {
+		if !strings.HasSuffix(*oneshotTextfile, ".prom") {
+			level.Warn(logger).Log("msg", "node_exporter textfile collector reads only *.prom files", "path", *oneshotTextfile)
+		}
+		sinks = append(sinks, sink.NewTextfile(*oneshotTextfile))
+	}
+	if len(*s3Bucket) > 0 && *s3Report {
+		report, err := newS3ReportSink(scrapeOpts, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error configuring S3 upload", "err", err)
+			return oneshotExitError
+		}
+		sinks = append(sinks, report)
+	}
+	if len(sinks) == 0 && scrapeOpts.Records == nil {
+		level.Error(logger).Log("msg", "Nothing to do, set --pushgateway.url, --textfile.path, --records.dir or --s3.bucket")
+		return oneshotExitError
+	}
+
+	// only the exporter metrics, the go runtime metrics of a short living process are useless
+	ctx := context.Background()
+	metrics := collector.NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.New(ctx, kubecostUrl, metrics, scrapers, filtersParams(filters), logger, scrapeOpts))
+	families, err := registry.Gather()
+	if err != nil {
+		level.Error(logger).Log("msg", "Error gathering metrics", "err", err)
+		return oneshotExitError
+	}
+
+	exitCode := oneshotExitOK
+	for _, s := range sinks {
+		if err := s.Send(ctx, families); err != nil {
+			level.Error(logger).Log("msg", "Error sending metrics", "sink", s.Name(), "err", err)
+			exitCode = oneshotExitError
+			continue
+		}
+		level.Info(logger).Log("msg", "Metrics sent", "sink", s.Name())
+	}
+	if exitCode == oneshotExitOK && scrapeFailed(metrics) {
+		level.Error(logger).Log("msg", "Some scrapers failed, see the errors above")
+		return oneshotExitScrapeError
+	}
+	return exitCode
+}
+
+// scrapeFailed returns true if the last scrape resulted in an error
+func scrapeFailed(metrics collector.Metrics) bool {
+	var m dto.Metric
+	if err := metrics.Error.Write(&m); err != nil {
+		return true
+	}
+	return m.GetGauge().GetValue() > 0
+}
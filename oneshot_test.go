@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/go-kit/log"
+)
+
+// fakePushgateway records the pushes by their method and path
+type fakePushgateway struct {
+	mu     sync.Mutex
+	pushes map[string]string
+}
+
+func (p *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	p.pushes[r.Method+" "+groupingPath(r.URL.Path)] = string(body)
+	p.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// groupingPath sorts the grouping labels of the push path, the push package adds them in the map order
+func groupingPath(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	if len(parts) < 2 {
+		return path
+	}
+	var pairs []string
+	for i := 2; i+1 < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+"/"+parts[i+1])
+	}
+	sort.Strings(pairs)
+	return "/metrics/" + strings.Join(append(parts[:2:2], pairs...), "/")
+}
+
+// setOneshotFlags sets the flags of the oneshot command, they're restored after the test
+func setOneshotFlags(t *testing.T, kubecostURL string, pushgatewayURL string, textfile string, grouping map[string]string) {
+	baseURL, _ := url.Parse(kubecostURL)
+	oldURL, oldPushgateway, oldJob, oldGrouping, oldTextfile := *kubecostUrl, *oneshotPushgatewayURL, *oneshotPushgatewayJob, *oneshotPushgatewayGrouping, *oneshotTextfile
+	t.Cleanup(func() {
+		*kubecostUrl, *oneshotPushgatewayURL, *oneshotPushgatewayJob, *oneshotPushgatewayGrouping, *oneshotTextfile = oldURL, oldPushgateway, oldJob, oldGrouping, oldTextfile
+	})
+	*kubecostUrl, *oneshotPushgatewayURL, *oneshotPushgatewayJob, *oneshotPushgatewayGrouping, *oneshotTextfile = baseURL, pushgatewayURL, "kubecost_exporter", grouping, textfile
+}
+
+func TestRunOneshot(t *testing.T) {
+	scrapers := []collector.Scraper{collector.ScrapeAllocation{}}
+	opts := collector.ScrapeOptions{
+		StepRange:  1,
+		StepOutput: collector.StepOutputLabel,
+		From:       time.Date(2021, 12, 14, 0, 0, 0, 0, time.Local),
+	}
+	timestampOpts := opts
+	timestampOpts.Step, timestampOpts.StepOutput = 24*time.Hour, collector.StepOutputTimestamp
+
+	tests := []struct {
+		name        string
+		opts        collector.ScrapeOptions
+		pushgateway bool
+		textfile    bool
+		grouping    map[string]string
+		// allocations is the broken Kubecost response, if it's set
+		allocations string
+		wantCode    int
+		wantPushes  []string
+	}{
+		{
+			name:        "pushgateway and textfile",
+			opts:        opts,
+			pushgateway: true,
+			textfile:    true,
+			grouping:    map[string]string{"cluster": "prod"},
+			wantCode:    oneshotExitOK,
+			wantPushes:  []string{"PUT /metrics/job/kubecost_exporter/cluster/prod/window/2021-12-14"},
+		},
+		{
+			name:        "explicit window",
+			opts:        opts,
+			pushgateway: true,
+			grouping:    map[string]string{"window": "last"},
+			wantCode:    oneshotExitOK,
+			wantPushes:  []string{"PUT /metrics/job/kubecost_exporter/window/last"},
+		},
+		{
+			// the metrics of the other scrapers are delivered anyway
+			name:        "failed scrape",
+			opts:        opts,
+			pushgateway: true,
+			textfile:    true,
+			allocations: `{"code":200,"data":[{`,
+			wantCode:    oneshotExitScrapeError,
+			wantPushes:  []string{"PUT /metrics/job/kubecost_exporter/window/2021-12-14"},
+		},
+		{name: "pushgateway with timestamps", opts: timestampOpts, pushgateway: true, wantCode: oneshotExitError},
+		{name: "textfile with timestamps", opts: timestampOpts, textfile: true, wantCode: oneshotExitError},
+		{name: "nothing to do", opts: opts, wantCode: oneshotExitError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, kubecostURL := newFakeKubecost(t)
+			k.allocations = tt.allocations
+			pushgateway := &fakePushgateway{pushes: make(map[string]string)}
+			server := httptest.NewServer(pushgateway)
+			defer server.Close()
+			var pushgatewayURL, textfile string
+			if tt.pushgateway {
+				pushgatewayURL = server.URL
+			}
+			dir := t.TempDir()
+			if tt.textfile {
+				textfile = filepath.Join(dir, "kubecost.prom")
+				// the previous file is replaced
+				if err := os.WriteFile(textfile, []byte("stale 1\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setOneshotFlags(t, kubecostURL, pushgatewayURL, textfile, tt.grouping)
+
+			if code := runOneshot(scrapers, nil, tt.opts, log.NewNopLogger()); code != tt.wantCode {
+				t.Fatalf("got exit code %d, want %d", code, tt.wantCode)
+			}
+			if len(pushgateway.pushes) != len(tt.wantPushes) {
+				t.Fatalf("got the pushes %q, want %q", pushgateway.pushes, tt.wantPushes)
+			}
+			for _, push := range tt.wantPushes {
+				if body, ok := pushgateway.pushes[push]; !ok || !strings.Contains(body, "assets_exporter_last_scrape_error") {
+					t.Errorf("got the pushes %q, want %q with the metrics", pushgateway.pushes, push)
+				}
+			}
+			if !tt.textfile {
+				return
+			}
+			content, err := os.ReadFile(textfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantWritten := tt.wantCode != oneshotExitError
+			if written := strings.Contains(string(content), "assets_exporter_last_scrape_error") && !strings.Contains(string(content), "stale"); written != wantWritten {
+				t.Errorf("got the textfile written %v, want %v:\n%s", written, wantWritten, content)
+			}
+			// the file is renamed from a temporary one, nothing else is left in the directory
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("got %d files in the textfile directory, want 1", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	promconfig "github.com/prometheus/common/config"
+)
+
+// probeTargetLabel is added to all the series of the probe, the instance label is set by the Prometheus relabeling
+const probeTargetLabel = "kubecost_target"
+
+// probeHandler serves /probe?target=<name>&module=<name>.
+// Only the targets from the config file can be probed, so the exporter can't be used
+// to send the requests with the configured credentials to an arbitrary URL
+type probeHandler struct {
+	config  *config.Config
+	clients map[string]*http.Client
+	// setup is the one of /metrics, the module is applied on top of it
+	setup  scrapeSetup
+	logger log.Logger
+}
+
+// newProbeHandler checks the modules and creates the HTTP clients of the targets
+func newProbeHandler(cfg *config.Config, setup scrapeSetup, logger log.Logger) (*probeHandler, error) {
+	for name, module := range cfg.Modules {
+		if _, err := setup.withModule(module); err != nil {
+			return nil, fmt.Errorf("module %q: %s", name, err)
+		}
+	}
+	clients := make(map[string]*http.Client, len(cfg.Targets))
+	for name, target := range cfg.Targets {
+		client, err := promconfig.NewClientFromConfig(target.HTTPClientConfig, "kubecost_"+name)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %s", name, err)
+		}
+		clients[name] = client
+	}
+	return &probeHandler{
+		config:  cfg,
+		clients: clients,
+		setup:   setup,
+		logger:  logger,
+	}, nil
+}
+
+// scrapersByName returns the scrapers with the names
+func scrapersByName(names []string) ([]collector.Scraper, error) {
+	var result []collector.Scraper
+	for _, name := range names {
+		found := false
+		for scraper := range scrapers {
+			if scraper.Name() == name {
+				result = append(result, scraper)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown scraper %q", name)
+		}
+	}
+	return result, nil
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if len(target) == 0 {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	name, t, ok := h.config.Target(target)
+	if !ok {
+		http.Error(w, fmt.Sprintf("target %q isn't configured", target), http.StatusForbidden)
+		return
+	}
+
+	setup := h.setup
+	moduleName := params.Get("module")
+	if len(moduleName) == 0 {
+		moduleName = t.Module
+	}
+	if len(moduleName) > 0 {
+		module, ok := h.config.Modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+		// the modules are checked when the handler is created
+		var err error
+		if setup, err = setup.withModule(module); err != nil {
+			http.Error(w, fmt.Sprintf("module %q: %s", moduleName, err), http.StatusBadRequest)
+			return
+		}
+	}
+	setup.opts.HTTPClient, setup.opts.Target = h.clients[name], name
+	// the status and the instrumentation are of the Kubecost of /metrics, the probed targets aren't tracked
+	setup.opts.Status, setup.opts.Instrumentation = nil, nil
+
+	logger := log.With(h.logger, "target", name, "module", moduleName)
+	level.Debug(logger).Log("msg", "Probing the target")
+	registry := prometheus.NewRegistry()
+	baseURL := t.BaseURL()
+	exporter := collector.New(r.Context(), &baseURL, collector.NewMetrics(), setup.scrapers, filtersParams(setup.filters), logger, setup.opts)
+	prometheus.WrapRegistererWith(prometheus.Labels{probeTargetLabel: name}, registry).MustRegister(exporter)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+)
+
+// fakeKubecost records the requests and serves an allocation and an empty set of assets
+type fakeKubecost struct {
+	mu       sync.Mutex
+	requests []string
+	auth     []string
+	// traceparents are the trace context headers of the requests
+	traceparents []string
+	// allocations replace the default allocation response if they're set, the filters aren't applied to them
+	allocations string
+}
+
+func (k *fakeKubecost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	k.requests = append(k.requests, r.URL.Path+"?"+r.URL.RawQuery)
+	k.auth = append(k.auth, r.Header.Get("Authorization"))
+	k.traceparents = append(k.traceparents, r.Header.Get("traceparent"))
+	k.mu.Unlock()
+	switch r.URL.Path {
+	case "/model/allocation":
+		if len(k.allocations) > 0 {
+			w.Write([]byte(k.allocations))
+			return
+		}
+		w.Write([]byte(`{"code":200,"data":[{"kubecost":{"name":"kubecost","properties":{"namespace":"kubecost"},"totalCost":1}}]}`))
+	default:
+		w.Write([]byte(`{"code":200,"data":{}}`))
+	}
+}
+
+// paths returns the requested paths and the filter params, the window isn't checked
+func (k *fakeKubecost) paths() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var paths []string
+	for _, r := range k.requests {
+		u, _ := url.Parse(r)
+		path := u.Path
+		if f := u.Query().Get("filterNamespaces"); len(f) > 0 {
+			path += " filterNamespaces=" + f
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func newFakeKubecost(t *testing.T) (*fakeKubecost, string) {
+	k := &fakeKubecost{}
+	server := httptest.NewServer(k)
+	t.Cleanup(server.Close)
+	return k, server.URL
+}
+
+func newTestProbeHandler(t *testing.T, yaml string) *probeHandler {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrapers, err := scrapersByName([]string{collector.ScrapeAllocation{}.Name(), collector.ScrapeAssets{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the setup of the flags, the filters of /metrics are replaced by the ones of the module
+	flags := scrapeSetup{
+		scrapers: scrapers,
+		filters:  map[string]kubecost_api.Filters{"scrape_allocation": {Namespaces: []string{"default"}}},
+		opts:     collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel},
+	}
+	h, err := newProbeHandler(cfg, flags, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestProbe(t *testing.T) {
+	a, aURL := newFakeKubecost(t)
+	b, bURL := newFakeKubecost(t)
+	h := newTestProbeHandler(t, `
+targets:
+  a:
+    url: `+aURL+`
+    module: allocation
+    authorization:
+      credentials: token-a
+  b:
+    url: `+bURL+`
+    basic_auth:
+      username: user
+      password: password
+modules:
+  allocation:
+    scrapers: [scrape_allocation]
+    filters:
+      scrape_allocation:
+        namespaces: [kubecost]
+  assets:
+    scrapers: [scrape_assets]
+`)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		kubecost   *fakeKubecost
+		wantPaths  []string
+		wantAuth   string
+		wantTarget string
+	}{
+		{
+			name:       "by name with the module of the target",
+			query:      "target=a",
+			wantStatus: http.StatusOK,
+			kubecost:   a,
+			wantPaths:  []string{"/model/allocation filterNamespaces=kubecost"},
+			wantAuth:   "Bearer token-a",
+			wantTarget: "a",
+		},
+		{
+			name:       "by URL with the flags",
+			query:      "target=" + url.QueryEscape(bURL),
+			wantStatus: http.StatusOK,
+			kubecost:   b,
+			wantPaths:  []string{"/model/allocation filterNamespaces=default", "/model/assets"},
+			wantAuth:   "Basic dXNlcjpwYXNzd29yZA==",
+			wantTarget: "b",
+		},
+		{
+			name:       "module overrides the module of the target",
+			query:      "target=a&module=assets",
+			wantStatus: http.StatusOK,
+			kubecost:   a,
+			wantPaths:  []string{"/model/assets"},
+			wantAuth:   "Bearer token-a",
+			wantTarget: "a",
+		},
+		{name: "unconfigured target", query: "target=" + url.QueryEscape("http://kubecost.example:9090"), wantStatus: http.StatusForbidden},
+		{name: "URL of a target with another path", query: "target=" + url.QueryEscape(aURL+"/model"), wantStatus: http.StatusForbidden},
+		{name: "missing target", query: "module=assets", wantStatus: http.StatusBadRequest},
+		{name: "unknown module", query: "target=a&module=unknown", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.requests, a.auth, b.requests, b.auth = nil, nil, nil, nil
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/probe?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.kubecost == nil {
+				if len(a.requests)+len(b.requests) > 0 {
+					t.Errorf("the rejected probe made the requests %q %q", a.requests, b.requests)
+				}
+				return
+			}
+			other := a
+			if tt.kubecost == a {
+				other = b
+			}
+			if got := tt.kubecost.paths(); !reflect.DeepEqual(got, tt.wantPaths) {
+				t.Errorf("got requests %q, want %q", got, tt.wantPaths)
+			}
+			if len(other.requests) > 0 {
+				t.Errorf("the other target got the requests %q", other.requests)
+			}
+			for _, auth := range tt.kubecost.auth {
+				if auth != tt.wantAuth {
+					t.Errorf("got Authorization %q, want %q", auth, tt.wantAuth)
+				}
+			}
+			if want := probeTargetLabel + `="` + tt.wantTarget + `"`; !strings.Contains(w.Body.String(), want) {
+				t.Errorf("the series don't have %s:\n%s", want, w.Body)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerInvalidModule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte("modules:\n  bad:\n    scrapers: [scrape_unknown]\n"), 0644)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newProbeHandler(cfg, scrapeSetup{}, log.NewNopLogger()); err == nil {
+		t.Error("the module with an unknown scraper is accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/sink"
+	"github.com/artemlive/kubecost_exporter/tracing"
+	"github.com/artemlive/kubecost_exporter/version"
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+)
+
+// newRemoteWriteSink creates the remote write sink from the flags
+func newRemoteWriteSink(logger log.Logger) (*sink.RemoteWrite, error) {
+	if *remoteWriteURL == nil {
+		return nil, fmt.Errorf("--remote-write.url is not set")
+	}
+	config := sink.RemoteWriteConfig{
+		URL:            *remoteWriteURL,
+		ExternalLabels: *remoteWriteLabels,
+		Timeout:        *remoteWriteTimeout,
+		MaxRetries:     *remoteWriteRetries,
+		BasicAuthUser:  *remoteWriteUsername,
+		BasicAuthPass:  *remoteWritePassword,
+		SkipTLSVerify:  *remoteWriteSkipTLSVerify,
+	}
+	if len(*remoteWriteBearerTokenFile) > 0 {
+		token, err := ioutil.ReadFile(*remoteWriteBearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the bearer token: %s", err)
+		}
+		config.BearerToken = strings.TrimSpace(string(token))
+	}
+	return sink.NewRemoteWrite(config, log.With(logger, "sink", "remote_write")), nil
+}
+
+// otlpResourceAttributes describe the exporter in the OTLP metrics and traces
+func otlpResourceAttributes() map[string]string {
+	resourceAttributes := map[string]string{
+		"service.name": "kubecost_exporter",
+		"kubecost.url": (*kubecostUrl).Redacted(),
+	}
+	if len(version.Version) > 0 {
+		resourceAttributes["service.version"] = version.Version
+	}
+	if len(*otlpCluster) > 0 {
+		resourceAttributes["k8s.cluster.name"] = *otlpCluster
+	}
+	return resourceAttributes
+}
+
+// newOTLPSink creates the OTLP metrics sink from the flags
+func newOTLPSink(logger log.Logger) (*sink.OTLP, error) {
+	return sink.NewOTLP(sink.OTLPConfig{
+		Endpoint:           *otlpEndpoint,
+		Protocol:           *otlpProtocol,
+		Insecure:           *otlpInsecure,
+		SkipTLSVerify:      *otlpSkipTLSVerify,
+		Headers:            *otlpHeaders,
+		Timeout:            *otlpTimeout,
+		MaxRetries:         *otlpRetries,
+		ResourceAttributes: otlpResourceAttributes(),
+		CostUnit:           *otlpCostUnit,
+		ScopeVersion:       version.Version,
+	}, log.With(logger, "sink", "otlp"))
+}
+
+// newTracer creates the tracer of the /metrics requests with the OTLP exporter from the flags,
+// the k8s.cluster.name resource attribute is the one of --otlp.cluster
+func newTracer(logger log.Logger) (*tracing.Tracer, error) {
+	exporter, err := sink.NewOTLPTraces(sink.OTLPConfig{
+		Endpoint:           *tracingEndpoint,
+		Protocol:           *tracingProtocol,
+		Insecure:           *tracingInsecure,
+		SkipTLSVerify:      *tracingSkipTLSVerify,
+		Headers:            *tracingHeaders,
+		Timeout:            10 * time.Second,
+		MaxRetries:         2,
+		ResourceAttributes: otlpResourceAttributes(),
+		ScopeVersion:       version.Version,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	return tracing.NewTracer(exporter, *tracingSampleRatio, logger)
+}
+
+// newS3Config creates the S3 bucket configuration from the flags
+func newS3Config() sink.S3Config {
+	endpoint := *s3Endpoint
+	if endpoint == nil {
+		endpoint = &url.URL{Scheme: "https", Host: "s3." + *s3Region + ".amazonaws.com"}
+	}
+	return sink.S3Config{
+		Endpoint:      endpoint,
+		Bucket:        *s3Bucket,
+		Region:        *s3Region,
+		Prefix:        *s3Prefix,
+		Cluster:       *s3Cluster,
+		AccessKey:     *s3AccessKey,
+		SecretKey:     *s3SecretKey,
+		SessionToken:  *s3SessionToken,
+		PathStyle:     *s3PathStyle,
+		SSE:           *s3SSE,
+		SSEKMSKeyID:   *s3SSEKMSKeyID,
+		Timeout:       *s3Timeout,
+		MaxRetries:    *s3Retries,
+		SkipTLSVerify: *s3SkipTLSVerify,
+	}
+}
+
+// newS3ReportSink creates the report sink for the window of the scrape options
+func newS3ReportSink(scrapeOpts collector.ScrapeOptions, logger log.Logger) (*sink.Report, error) {
+	return sink.NewS3Report(newS3Config(), sink.ReportConfig{
+		KeyTemplate: *s3ReportTemplate,
+		Window:      scrapeOpts.Window,
+	}, log.With(logger, "sink", "s3_report"))
+}
+
+// newFileRecords creates the local records files sink, nil if it's disabled
+func newFileRecords(logger log.Logger) (collector.RecordWriter, error) {
+	if len(*recordsDir) == 0 {
+		return nil, nil
+	}
+	return sink.NewRecordFiles(*recordsDir, sink.RecordsConfig{
+		Format:            *recordsFormat,
+		MaxRowsPerFile:    *recordsMaxRowsPerFile,
+		PartitionTemplate: *recordsPartition,
+	}, log.With(logger, "sink", "records"))
+}
+
+// newS3Records creates the records sink of the bucket, nil if it's disabled
+func newS3Records(logger log.Logger) (collector.RecordWriter, error) {
+	if len(*s3Bucket) == 0 || !*s3Records {
+		return nil, nil
+	}
+	return sink.NewS3Records(newS3Config(), sink.RecordsConfig{
+		Format:            *s3RecordsFormat,
+		MaxRowsPerFile:    *recordsMaxRowsPerFile,
+		PartitionTemplate: *recordsPartition,
+	}, log.With(logger, "sink", "s3_records"))
+}
+
+// joinRecordWriters returns a writer for all the non-nil writers, nil if there are none
+func joinRecordWriters(writers ...collector.RecordWriter) collector.RecordWriter {
+	var result sink.RecordWriters
+	for _, w := range writers {
+		if w != nil {
+			result = append(result, w)
+		}
+	}
+	switch len(result) {
+	case 0:
+		return nil
+	case 1:
+		return result[0]
+	}
+	return result
+}
+
+// applySinksConfig sets the flags of the sinks from the config file, the sinks are created from the flags then
+func applySinksConfig(sinks *config.Sinks) {
+	if sinks == nil {
+		return
+	}
+	if rw := sinks.RemoteWrite; rw != nil {
+		// the URL is checked by the config validation
+		*remoteWriteURL, _ = url.Parse(rw.URL)
+		setDuration(remoteWriteInterval, rw.Interval)
+		setDuration(remoteWriteTimeout, rw.Timeout)
+		for name, value := range rw.Labels {
+			(*remoteWriteLabels)[name] = value
+		}
+	}
+	if otlp := sinks.OTLP; otlp != nil {
+		*otlpEndpoint = otlp.Endpoint
+		setString(otlpProtocol, otlp.Protocol)
+		setString(otlpCluster, otlp.Cluster)
+		setDuration(otlpInterval, otlp.Interval)
+		for name, value := range otlp.Headers {
+			(*otlpHeaders)[name] = value
+		}
+	}
+	if records := sinks.Records; records != nil {
+		*recordsDir = records.Dir
+		setString(recordsFormat, records.Format)
+		setDuration(recordsInterval, records.Interval)
+	}
+	if s3 := sinks.S3; s3 != nil {
+		*s3Bucket = s3.Bucket
+		if len(s3.Endpoint) > 0 {
+			*s3Endpoint, _ = url.Parse(s3.Endpoint)
+		}
+		setString(s3Region, s3.Region)
+		setString(s3Prefix, s3.Prefix)
+		setString(s3Cluster, s3.Cluster)
+		setDuration(s3Interval, s3.Interval)
+	}
+	if history := sinks.History; history != nil {
+		*historyPath = history.Path
+		setDuration(historyInterval, history.Interval)
+	}
+}
+
+// setString sets the flag if the value is set in the config
+func setString(flag *string, value string) {
+	if len(value) > 0 {
+		*flag = value
+	}
+}
+
+// setDuration sets the flag if the duration is set in the config
+func setDuration(flag *time.Duration, value model.Duration) {
+	if value > 0 {
+		*flag = time.Duration(value)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/artemlive/kubecost_exporter/web"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	promconfig "github.com/prometheus/common/config"
+)
+
+// scrapeSetup is everything a scrape needs: the Kubecost instance, the scrapers with their filters and the options.
+// The reload replaces it as a whole, the scrapes that are already running keep the previous one
+type scrapeSetup struct {
+	baseURL  *url.URL
+	scrapers []collector.Scraper
+	filters  map[string]kubecost_api.Filters
+	opts     collector.ScrapeOptions
+	// probe serves /probe with the targets of the same config
+	probe *probeHandler
+	// tenants limit /metrics by the identity, nil if there are none
+	tenants *tenants
+}
+
+// newScrapeSetup applies the config on top of the setup from the flags
+func newScrapeSetup(cfg *config.Config, flags scrapeSetup, logger log.Logger) (*scrapeSetup, error) {
+	setTopNDefaults(cfg)
+	setup := flags
+	if cfg.Kubecost != nil {
+		client, err := promconfig.NewClientFromConfig(cfg.Kubecost.HTTPClientConfig, "kubecost")
+		if err != nil {
+			return nil, fmt.Errorf("kubecost: %s", err)
+		}
+		setup.baseURL = cfg.Kubecost.BaseURL()
+		setup.opts.HTTPClient = client
+	}
+	if setup.baseURL == nil {
+		return nil, fmt.Errorf("the Kubecost URL isn't set, neither by --kubecost.baseUrl nor in the config file")
+	}
+	if cfg.Scrape != nil {
+		var err error
+		if setup, err = setup.withModule(cfg.Scrape); err != nil {
+			return nil, fmt.Errorf("scrape: %s", err)
+		}
+	}
+	probe, err := newProbeHandler(cfg, setup, log.With(logger, "component", "probe"))
+	if err != nil {
+		return nil, err
+	}
+	setup.probe = probe
+	if setup.tenants, err = newTenants(cfg.Tenants); err != nil {
+		return nil, err
+	}
+	return &setup, nil
+}
+
+// withModule returns the setup with the scrapers and the options of the module,
+// the filters and the top-n limits of the module replace the ones of the same scrapers
+func (s scrapeSetup) withModule(m *config.Module) (scrapeSetup, error) {
+	if _, err := scrapersByName(m.ScraperNames()); err != nil {
+		return s, err
+	}
+	if len(m.Scrapers) > 0 {
+		s.scrapers, _ = scrapersByName(m.Scrapers)
+	}
+	if len(m.Filters) > 0 {
+		filters := make(map[string]kubecost_api.Filters, len(s.filters)+len(m.Filters))
+		for name, f := range s.filters {
+			filters[name] = f
+		}
+		for name, f := range m.Filters {
+			filters[name] = f
+		}
+		s.filters = filters
+	}
+	var err error
+	s.opts, err = m.ScrapeOptions(s.opts)
+	return s, err
+}
+
+// setTopNDefaults sets the default parent labels of the top-n limits, the same as the flags have
+func setTopNDefaults(cfg *config.Config) {
+	modules := []*config.Module{cfg.Scrape}
+	for _, module := range cfg.Modules {
+		modules = append(modules, module)
+	}
+	for _, module := range modules {
+		if module == nil {
+			continue
+		}
+		for name, t := range module.TopN {
+			if len(t.By) == 0 {
+				t.By = topNParents[name]
+				module.TopN[name] = t
+			}
+		}
+	}
+}
+
+// reloader keeps the current scrape setup and replaces it when the config file is reloaded
+type reloader struct {
+	path   string
+	flags  scrapeSetup
+	logger log.Logger
+
+	// mu serializes the reloads, the setup itself is read without it
+	mu          sync.Mutex
+	setup       atomic.Pointer[scrapeSetup]
+	config      *config.Config
+	err         error
+	success     prometheus.Gauge
+	lastSuccess prometheus.Gauge
+}
+
+// newReloader returns the reloader with the setup of the already loaded config
+func newReloader(path string, cfg *config.Config, flags scrapeSetup, setup *scrapeSetup, logger log.Logger) *reloader {
+	r := &reloader{
+		path:   path,
+		flags:  flags,
+		logger: logger,
+		config: cfg,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "assets",
+			Subsystem: "exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "assets",
+			Subsystem: "exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		}),
+	}
+	r.setup.Store(setup)
+	r.success.Set(1)
+	r.lastSuccess.SetToCurrentTime()
+	return r
+}
+
+// current returns the setup for a new scrape
+func (r *reloader) current() *scrapeSetup {
+	return r.setup.Load()
+}
+
+// reload reads the config file again, the current setup is kept if it's invalid
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.path) == 0 {
+		return fmt.Errorf("--config.file isn't set")
+	}
+	err := r.load()
+	r.err = err
+	if err != nil {
+		r.success.Set(0)
+		level.Error(r.logger).Log("msg", "Error reloading config", "file", r.path, "err", err)
+		return err
+	}
+	r.success.Set(1)
+	r.lastSuccess.SetToCurrentTime()
+	level.Info(r.logger).Log("msg", "Config reloaded", "file", r.path)
+	return nil
+}
+
+func (r *reloader) load() error {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		return err
+	}
+	setup, err := newScrapeSetup(cfg, r.flags, r.logger)
+	if err != nil {
+		return err
+	}
+	// the status is of the Kubecost instance, a new URL starts without the last contact of the previous one
+	if current := r.current(); current.baseURL.String() == setup.baseURL.String() {
+		setup.opts.Status = current.opts.Status
+	} else {
+		setup.opts.Status = collector.NewStatus()
+	}
+	if !reflect.DeepEqual(cfg.Sinks, r.config.Sinks) {
+		level.Warn(r.logger).Log("msg", "The sinks were changed, they're applied only after a restart")
+	}
+	r.config = cfg
+	r.setup.Store(setup)
+	return nil
+}
+
+// lastError returns the error of the last reload, empty if it was successful
+func (r *reloader) lastError() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		return ""
+	}
+	return r.err.Error()
+}
+
+// watchSignals reloads the config on SIGHUP
+func (r *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		r.reload()
+	}
+}
+
+// ServeHTTP reloads the config on POST /-/reload
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *reloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.success.Desc()
+	ch <- r.lastSuccess.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (r *reloader) Collect(ch chan<- prometheus.Metric) {
+	ch <- r.success
+	ch <- r.lastSuccess
+}
+
+// checkConfig validates the config files the same way they're loaded, without any requests to Kubecost.
+// The web config is checked along with its certificates, if it's set
+func checkConfig(paths []string, webConfig string, flags scrapeSetup, logger log.Logger) int {
+	failed := false
+	if len(webConfig) > 0 {
+		if _, err := web.NewServer(webConfig, logger); err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+			failed = true
+		} else {
+			fmt.Printf("SUCCESS: %s is valid\n", webConfig)
+		}
+	}
+	for _, path := range paths {
+		cfg, err := config.Load(path)
+		if err == nil {
+			_, err = newScrapeSetup(cfg, flags, logger)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("SUCCESS: %s is valid, %d targets, %d modules\n", path, len(cfg.Targets), len(cfg.Modules))
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(yaml string) {
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("scrape:\n  scrapers: [scrape_allocation]\n")
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, _ := url.Parse("http://kubecost:9090")
+	flags := scrapeSetup{baseURL: baseURL, opts: collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel}}
+	setup, err := newScrapeSetup(cfg, flags, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(path, cfg, flags, setup, log.NewNopLogger())
+
+	// a running scrape keeps the setup it started with
+	running := r.current()
+	write("scrape:\n  scrapers: [scrape_assets]\n  budgets:\n  - {name: a, amount: 1}\n")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/-/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if got := r.current(); got == running || len(got.scrapers) != 1 || got.scrapers[0].Name() != "scrape_assets" || len(got.opts.Budgets) != 1 {
+		t.Errorf("the setup isn't replaced: %+v", got)
+	}
+	if len(running.scrapers) != 1 || running.scrapers[0].Name() != "scrape_allocation" || len(running.opts.Budgets) != 0 {
+		t.Errorf("the setup of the running scrape is changed: %+v", running)
+	}
+	if got := testutil.ToFloat64(r.success); got != 1 {
+		t.Errorf("config_last_reload_successful = %v, want 1", got)
+	}
+
+	// the invalid config is rejected, the previous setup is kept
+	reloaded := r.current()
+	for _, yaml := range []string{
+		"scrape:\n  scrapers: [scrape_unknown]\n",
+		"scrape:\n  label_rules:\n  - {source: a}\n",
+		"scrape: [\n",
+	} {
+		write(yaml)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/-/reload", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%q: got status %d, want 500", yaml, w.Code)
+		}
+		if r.current() != reloaded {
+			t.Errorf("%q: the setup is replaced by the invalid config", yaml)
+		}
+		if got := testutil.ToFloat64(r.success); got != 0 {
+			t.Errorf("%q: config_last_reload_successful = %v, want 0", yaml, got)
+		}
+		if len(r.lastError()) == 0 {
+			t.Errorf("%q: the reload error isn't kept", yaml)
+		}
+	}
+
+	write("scrape:\n  scrapers: [scrape_allocation]\n")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(r.success); got != 1 || len(r.lastError()) > 0 {
+		t.Errorf("config_last_reload_successful = %v with the error %q after the successful reload", got, r.lastError())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/-/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got status %d, want 405", w.Code)
+	}
+}
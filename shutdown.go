@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// shutdown stops the exporter gracefully: the server stops accepting the requests and the sinks don't start new iterations,
+// the running requests and iterations get the grace period to finish, then their Kubecost calls are cancelled
+type shutdown struct {
+	// ctx is the base of all the requests and the sinks, it's cancelled when the grace period is over
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stop is closed when the shutdown starts
+	stop   chan struct{}
+	logger log.Logger
+
+	mu sync.Mutex
+	// active is the work in progress: the sinks and the requests by their path
+	active map[string]int
+	wg     sync.WaitGroup
+}
+
+func newShutdown(logger log.Logger) *shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shutdown{ctx: ctx, cancel: cancel, stop: make(chan struct{}), logger: logger, active: make(map[string]int)}
+}
+
+// begin marks the work in progress, the returned func marks it done
+func (s *shutdown) begin(name string) func() {
+	s.mu.Lock()
+	s.active[name]++
+	s.wg.Add(1)
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		if s.active[name]--; s.active[name] == 0 {
+			delete(s.active, name)
+		}
+		s.mu.Unlock()
+		s.wg.Done()
+	}
+}
+
+// goSink runs the sink loop, it's waited for on the shutdown
+func (s *shutdown) goSink(name string, loop func(ctx context.Context, stop <-chan struct{})) {
+	done := s.begin("sink " + name)
+	go func() {
+		defer done()
+		loop(s.ctx, s.stop)
+	}()
+}
+
+// handler tracks the requests, so the abandoned ones can be logged
+func (s *shutdown) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer s.begin("request " + r.URL.Path)()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// server returns the HTTP server, the contexts of its requests are cancelled when the grace period is over
+func (s *shutdown) server(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:        addr,
+		Handler:     s.handler(handler),
+		BaseContext: func(net.Listener) context.Context { return s.ctx },
+	}
+}
+
+// inProgress returns the work that is still in progress, e.g. "request /metrics (2)"
+func (s *shutdown) inProgress() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name, n := range s.active {
+		if n > 1 {
+			name = fmt.Sprintf("%s (%d)", name, n)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run shuts the server down and waits for the requests and the sinks until the grace period is over,
+// the work that isn't finished by then is cancelled and logged. The closers are closed at the end, e.g. the history database
+func (s *shutdown) run(server *http.Server, grace time.Duration, closers map[string]io.Closer) {
+	level.Info(s.logger).Log("msg", "Shutting down", "grace_period", grace)
+	close(s.stop)
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), grace)
+	defer cancelDeadline()
+
+	// Shutdown closes the listeners right away and waits for the requests
+	if err := server.Shutdown(deadline); err != nil {
+		level.Warn(s.logger).Log("msg", "The requests weren't finished within the grace period", "err", err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-deadline.Done():
+		if abandoned := s.inProgress(); len(abandoned) > 0 {
+			level.Warn(s.logger).Log("msg", "Grace period is over, cancelling the Kubecost requests", "abandoned", fmt.Sprint(abandoned))
+		}
+		s.cancel()
+		server.Close()
+		// the cancelled work returns quickly, but it's not waited for forever
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			level.Warn(s.logger).Log("msg", "Not finished after the cancellation", "abandoned", fmt.Sprint(s.inProgress()))
+		}
+	}
+	s.cancel()
+
+	for name, closer := range closers {
+		if err := closer.Close(); err != nil {
+			level.Error(s.logger).Log("msg", "Error closing", "name", name, "err", err)
+		}
+	}
+	level.Info(s.logger).Log("msg", "Shutdown complete")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// syncBuffer is the log output of the shutdown, it's written by the goroutines of the requests too
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// closerFunc is an io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func TestShutdown(t *testing.T) {
+	logs := &syncBuffer{}
+	s := newShutdown(log.NewLogfmtLogger(logs))
+
+	// the scrape waits for Kubecost until its request is cancelled
+	started := make(chan struct{})
+	cancelled := make(chan time.Time, 1)
+	server := s.server("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		cancelled <- time.Now()
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String() + "/metrics"
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// remote write finishes its iteration when it's stopped, OTLP is stuck in the Kubecost request
+	var mu sync.Mutex
+	finished := make(map[string]bool)
+	sinkLoop := func(name string, waitForCancel bool) {
+		s.goSink(name, func(ctx context.Context, stop <-chan struct{}) {
+			<-stop
+			if waitForCancel {
+				<-ctx.Done()
+			}
+			mu.Lock()
+			finished[name] = true
+			mu.Unlock()
+		})
+	}
+	sinkLoop("remote_write", false)
+	sinkLoop("otlp", true)
+
+	// the history is written by the sinks, it's closed after them
+	var closedAfterSinks bool
+	closers := map[string]io.Closer{"history": closerFunc(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		closedAfterSinks = finished["remote_write"] && finished["otlp"]
+		return nil
+	})}
+
+	grace := 200 * time.Millisecond
+	start := time.Now()
+	s.run(server, grace, closers)
+
+	select {
+	case at := <-cancelled:
+		if elapsed := at.Sub(start); elapsed < grace {
+			t.Errorf("the request was cancelled after %s, before the grace period %s", elapsed, grace)
+		}
+	default:
+		t.Error("the request isn't cancelled")
+	}
+	if !closedAfterSinks {
+		t.Error("the history is closed before the sinks are finished")
+	}
+	if !strings.Contains(logs.String(), `abandoned="[request /metrics sink otlp]"`) {
+		t.Errorf("the abandoned work isn't logged:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "Not finished after the cancellation") {
+		t.Errorf("the cancelled work isn't finished:\n%s", logs)
+	}
+	if len(s.inProgress()) > 0 {
+		t.Errorf("got the work in progress %q after the shutdown", s.inProgress())
+	}
+	// the listener is closed, the new requests aren't accepted
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("the request is accepted after the shutdown")
+	}
+}
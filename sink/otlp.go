@@ -0,0 +1,277 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+)
+
+const (
+	otlpSinkName = "otlp"
+
+	// OTLPProtocolGRPC is OTLP over gRPC, the default port is 4317
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP is OTLP over HTTP with the binary protobuf encoding, the default port is 4318
+	OTLPProtocolHTTP = "http/protobuf"
+
+	otlpMetricsHTTPPath = "/v1/metrics"
+	otlpMetricsGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+)
+
+// OTLPConfig is the configuration of the OTLP endpoint
+type OTLPConfig struct {
+	// Endpoint is host:port or URL of the OTLP receiver, e.g. otel-collector:4317
+	Endpoint string
+	// Protocol is OTLPProtocolGRPC or OTLPProtocolHTTP
+	Protocol string
+	// Insecure disables TLS
+	Insecure      bool
+	SkipTLSVerify bool
+	Headers       map[string]string
+	Timeout       time.Duration
+	MaxRetries    int
+	MinBackoff    time.Duration
+	// ResourceAttributes describe the source of the data, e.g. kubecost.url and k8s.cluster.name
+	ResourceAttributes map[string]string
+	// CostUnit is the unit of the cost metrics, Kubecost reports costs in the configured currency
+	CostUnit     string
+	ScopeVersion string
+}
+
+// otlpClient sends the encoded OTLP requests over gRPC or HTTP
+type otlpClient struct {
+	// name is the sink name of the retries metric
+	name       string
+	config     OTLPConfig
+	baseURL    *url.URL
+	httpClient *http.Client
+	logger     log.Logger
+}
+
+func newOTLPClient(name string, config OTLPConfig, logger log.Logger) (*otlpClient, error) {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 500 * time.Millisecond
+	}
+	endpoint := config.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https://"
+		if config.Insecure {
+			scheme = "http://"
+		}
+		endpoint = scheme + endpoint
+	}
+	baseURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse OTLP endpoint: %s", err)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipTLSVerify}
+
+	var transport http.RoundTripper
+	switch config.Protocol {
+	case OTLPProtocolGRPC:
+		h2 := &http2.Transport{TLSClientConfig: tlsConfig}
+		if baseURL.Scheme == "http" {
+			// gRPC without TLS is HTTP/2 with prior knowledge (h2c)
+			h2.AllowHTTP = true
+			h2.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		transport = h2
+	case OTLPProtocolHTTP:
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", config.Protocol)
+	}
+	return &otlpClient{
+		name:    name,
+		config:  config,
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+// export sends the request to the http path or the grpc method, depending on the protocol
+func (c *otlpClient) export(ctx context.Context, httpPath string, grpcPath string, payload []byte) error {
+	return retry(ctx, c.name, c.config.MaxRetries, c.config.MinBackoff, c.logger, func() error {
+		if c.config.Protocol == OTLPProtocolGRPC {
+			return c.exportGRPC(ctx, grpcPath, payload)
+		}
+		return c.exportHTTP(ctx, httpPath, payload)
+	})
+}
+
+func (c *otlpClient) newRequest(ctx context.Context, path string, body []byte) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "kubecost_exporter")
+	for k, v := range c.config.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (c *otlpClient) exportHTTP(ctx context.Context, path string, payload []byte) error {
+	req, err := c.newRequest(ctx, path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return recoverableError{err}
+	}
+	return err
+}
+
+// retryable gRPC status codes according to the OTLP specification:
+// CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE, DATA_LOSS
+var grpcRetryableCodes = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+// exportGRPC makes the unary gRPC call by hand: a length-prefixed message in the HTTP/2 request body,
+// the status is returned in the grpc-status trailer, or in the headers for the trailers-only responses
+func (c *otlpClient) exportGRPC(ctx context.Context, path string, payload []byte) error {
+	body := make([]byte, 5, 5+len(payload))
+	// the first byte is the compression flag
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(payload)))
+	body = append(body, payload...)
+
+	req, err := c.newRequest(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	// trailers are available only after the body is read
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		// a proxy in front of the receiver, gRPC maps only these statuses to UNAVAILABLE, the others aren't retryable
+		err := fmt.Errorf("server returned HTTP status %s", resp.Status)
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return recoverableError{err}
+		}
+		return err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid grpc-status %q", status)
+	}
+	if code == 0 {
+		return nil
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	err = fmt.Errorf("server returned gRPC status %d: %s", code, message)
+	if grpcRetryableCodes[code] {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// OTLP sends the metrics to an OpenTelemetry receiver, e.g. OpenTelemetry Collector
+type OTLP struct {
+	client  *otlpClient
+	encoder otlpMetricsEncoder
+	logger  log.Logger
+}
+
+// NewOTLP returns a new OTLP metrics sink
+func NewOTLP(config OTLPConfig, logger log.Logger) (*OTLP, error) {
+	client, err := newOTLPClient(otlpSinkName, config, logger)
+	if err != nil {
+		return nil, err
+	}
+	costUnit := config.CostUnit
+	return &OTLP{
+		client: client,
+		encoder: otlpMetricsEncoder{
+			resourceAttributes: config.ResourceAttributes,
+			scopeName:          "github.com/artemlive/kubecost_exporter",
+			scopeVersion:       config.ScopeVersion,
+			startTime:          time.Now(),
+			unit: func(name string) string {
+				return metricUnit(name, costUnit)
+			},
+		},
+		logger: logger,
+	}, nil
+}
+
+func (o *OTLP) Name() string {
+	return otlpSinkName
+}
+
+// Send implements Sink.
+func (o *OTLP) Send(ctx context.Context, families []*dto.MetricFamily) error {
+	payload := o.encoder.encode(families, time.Now())
+	if err := o.client.export(ctx, otlpMetricsHTTPPath, otlpMetricsGRPCPath, payload); err != nil {
+		return err
+	}
+	level.Debug(o.logger).Log("msg", "Metrics sent", "sink", o.Name(), "families", len(families))
+	return nil
+}
+
+// metricUnit returns the UCUM unit by the prometheus naming conventions
+// the cost metrics get the currency unit
+func metricUnit(name string, costUnit string) string {
+	switch {
+	case strings.Contains(name, "_cost"):
+		return costUnit
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"), strings.HasSuffix(name, "_bytes_total"):
+		return "By"
+	case strings.HasSuffix(name, "_total"):
+		return "1"
+	}
+	return ""
+}
@@ -0,0 +1,239 @@
+package sink
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP protobuf messages are encoded by hand, the same way as the remote write ones,
+// the field numbers are from opentelemetry-proto: opentelemetry/proto/{common,resource,metrics}/v1
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+const aggregationTemporalityCumulative = 2
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendFixed64(b, num, math.Float64bits(v))
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendKeyValue encodes KeyValue { string key = 1; AnyValue value = 2; } with AnyValue { string string_value = 1; }
+func appendKeyValue(b []byte, num protowire.Number, key string, value string) []byte {
+	kv := appendString(nil, 1, key)
+	kv = appendMessage(kv, 2, appendString(nil, 1, value))
+	return appendMessage(b, num, kv)
+}
+
+// appendAttributes encodes the map as KeyValue fields sorted by key
+func appendAttributes(b []byte, num protowire.Number, attributes map[string]string) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = appendKeyValue(b, num, k, attributes[k])
+	}
+	return b
+}
+
+// appendResource encodes Resource { repeated KeyValue attributes = 1; }
+func appendResource(b []byte, num protowire.Number, attributes map[string]string) []byte {
+	return appendMessage(b, num, appendAttributes(nil, 1, attributes))
+}
+
+// appendScope encodes InstrumentationScope { string name = 1; string version = 2; }
+func appendScope(b []byte, num protowire.Number, name string, version string) []byte {
+	scope := appendString(nil, 1, name)
+	if len(version) > 0 {
+		scope = appendString(scope, 2, version)
+	}
+	return appendMessage(b, num, scope)
+}
+
+func unixNano(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+// otlpMetricsEncoder converts the prometheus metric families to ExportMetricsServiceRequest
+type otlpMetricsEncoder struct {
+	resourceAttributes map[string]string
+	scopeName          string
+	scopeVersion       string
+	// startTime is the start of the cumulative sums, the exporter start time
+	startTime time.Time
+	// unit returns the unit for the metric name
+	unit func(name string) string
+}
+
+// encode returns ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//
+//	ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+func (e otlpMetricsEncoder) encode(families []*dto.MetricFamily, now time.Time) []byte {
+	scopeMetrics := appendScope(nil, 1, e.scopeName, e.scopeVersion)
+	for _, mf := range families {
+		if metric := e.encodeMetric(mf, now); metric != nil {
+			scopeMetrics = appendMessage(scopeMetrics, 2, metric)
+		}
+	}
+	resourceMetrics := appendResource(nil, 1, e.resourceAttributes)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+// encodeMetric returns
+//
+//	Metric { string name = 1; string description = 2; string unit = 3;
+//	  oneof data { Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9; Summary summary = 11; } }
+func (e otlpMetricsEncoder) encodeMetric(mf *dto.MetricFamily, now time.Time) []byte {
+	if len(mf.GetMetric()) == 0 {
+		return nil
+	}
+	metric := appendString(nil, 1, mf.GetName())
+	metric = appendString(metric, 2, mf.GetHelp())
+	if e.unit != nil {
+		if unit := e.unit(mf.GetName()); len(unit) > 0 {
+			metric = appendString(metric, 3, unit)
+		}
+	}
+
+	var data []byte
+	switch mf.GetType() {
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		// Gauge { repeated NumberDataPoint data_points = 1; }
+		for _, m := range mf.GetMetric() {
+			value := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				value = m.GetUntyped().GetValue()
+			}
+			data = appendMessage(data, 1, e.numberDataPoint(m, value, false, now))
+		}
+		return appendMessage(metric, 5, data)
+	case dto.MetricType_COUNTER:
+		// Sum { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, e.numberDataPoint(m, m.GetCounter().GetValue(), true, now))
+		}
+		data = appendVarint(data, 2, aggregationTemporalityCumulative)
+		data = appendVarint(data, 3, 1)
+		return appendMessage(metric, 7, data)
+	case dto.MetricType_HISTOGRAM:
+		// Histogram { repeated HistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; }
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, e.histogramDataPoint(m, now))
+		}
+		data = appendVarint(data, 2, aggregationTemporalityCumulative)
+		return appendMessage(metric, 9, data)
+	case dto.MetricType_SUMMARY:
+		// Summary { repeated SummaryDataPoint data_points = 1; }
+		for _, m := range mf.GetMetric() {
+			data = appendMessage(data, 1, e.summaryDataPoint(m, now))
+		}
+		return appendMessage(metric, 11, data)
+	}
+	return nil
+}
+
+// timestamp returns the sample timestamp, the samples without it are sent with the collection time
+func timestamp(m *dto.Metric, now time.Time) time.Time {
+	if m.TimestampMs != nil {
+		return time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+	}
+	return now
+}
+
+func metricAttributes(m *dto.Metric) map[string]string {
+	attributes := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		attributes[l.GetName()] = l.GetValue()
+	}
+	return attributes
+}
+
+// numberDataPoint returns
+//
+//	NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2;
+//	  fixed64 time_unix_nano = 3; double as_double = 4; }
+func (e otlpMetricsEncoder) numberDataPoint(m *dto.Metric, value float64, cumulative bool, now time.Time) []byte {
+	dp := appendAttributes(nil, 7, metricAttributes(m))
+	if cumulative {
+		dp = appendFixed64(dp, 2, unixNano(e.startTime))
+	}
+	dp = appendFixed64(dp, 3, unixNano(timestamp(m, now)))
+	return appendDouble(dp, 4, value)
+}
+
+// histogramDataPoint returns
+//
+//	HistogramDataPoint { repeated KeyValue attributes = 9; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	  fixed64 count = 4; double sum = 5; repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; }
+//
+// the prometheus buckets are cumulative, the OTLP ones are not and have the overflow bucket in the end
+func (e otlpMetricsEncoder) histogramDataPoint(m *dto.Metric, now time.Time) []byte {
+	h := m.GetHistogram()
+	dp := appendAttributes(nil, 9, metricAttributes(m))
+	dp = appendFixed64(dp, 2, unixNano(e.startTime))
+	dp = appendFixed64(dp, 3, unixNano(timestamp(m, now)))
+	dp = appendFixed64(dp, 4, h.GetSampleCount())
+	dp = appendDouble(dp, 5, h.GetSampleSum())
+
+	var counts, bounds []byte
+	var previous uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-previous)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+		previous = b.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-previous)
+	dp = appendMessage(dp, 6, counts)
+	if len(bounds) > 0 {
+		dp = appendMessage(dp, 7, bounds)
+	}
+	return dp
+}
+
+// summaryDataPoint returns
+//
+//	SummaryDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	  fixed64 count = 4; double sum = 5; repeated ValueAtQuantile quantile_values = 6; }
+//	ValueAtQuantile { double quantile = 1; double value = 2; }
+func (e otlpMetricsEncoder) summaryDataPoint(m *dto.Metric, now time.Time) []byte {
+	s := m.GetSummary()
+	dp := appendAttributes(nil, 7, metricAttributes(m))
+	dp = appendFixed64(dp, 2, unixNano(e.startTime))
+	dp = appendFixed64(dp, 3, unixNano(timestamp(m, now)))
+	dp = appendFixed64(dp, 4, s.GetSampleCount())
+	dp = appendDouble(dp, 5, s.GetSampleSum())
+	for _, q := range s.GetQuantile() {
+		quantile := appendDouble(nil, 1, q.GetQuantile())
+		quantile = appendDouble(quantile, 2, q.GetValue())
+		dp = appendMessage(dp, 6, quantile)
+	}
+	return dp
+}
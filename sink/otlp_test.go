@@ -0,0 +1,398 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/tracing"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsReceiver is an in-process OTLP receiver, it replies with the queued errors and then accepts the requests
+type metricsReceiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	errs     []error
+	attempts int
+	headers  []string
+	requests []*collectormetrics.ExportMetricsServiceRequest
+}
+
+func (r *metricsReceiver) receive(authorization string, req *collectormetrics.ExportMetricsServiceRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return err
+	}
+	r.headers = append(r.headers, authorization)
+	r.requests = append(r.requests, req)
+	return nil
+}
+
+func (r *metricsReceiver) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if values := md.Get("authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	if err := r.receive(authorization, req); err != nil {
+		return nil, err
+	}
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *metricsReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != otlpMetricsHTTPPath || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected request", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := &collectormetrics.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := r.receive(req.Header.Get("Authorization"), request); err != nil {
+		// the status codes of the OTLP/HTTP specification
+		code := http.StatusBadRequest
+		if status.Code(err) == codes.Unavailable {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(nil)
+}
+
+// startReceiver starts the gRPC or HTTP receiver and returns its endpoint
+func startReceiver(t *testing.T, protocol string, receiver *metricsReceiver) string {
+	if protocol == OTLPProtocolHTTP {
+		server := httptest.NewServer(receiver)
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func newTestOTLP(t *testing.T, protocol string, endpoint string) *OTLP {
+	otlp, err := NewOTLP(OTLPConfig{
+		Endpoint:           endpoint,
+		Protocol:           protocol,
+		Insecure:           true,
+		SkipTLSVerify:      true,
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		Timeout:            5 * time.Second,
+		MaxRetries:         2,
+		MinBackoff:         time.Millisecond,
+		ResourceAttributes: map[string]string{"service.name": "kubecost_exporter", "k8s.cluster.name": "prod"},
+		CostUnit:           "USD",
+		ScopeVersion:       "1.0.0",
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return otlp
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func TestOTLPSend(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("assets_cost_cluster_allocation_component"),
+			Help: proto.String("k8s cost by component"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("property_namespace"), Value: proto.String("kubecost")},
+					{Name: proto.String("cost_component"), Value: proto.String("cpu")},
+				},
+				Gauge:       &dto.Gauge{Value: proto.Float64(0.5)},
+				TimestampMs: proto.Int64(86400000),
+			}},
+		},
+		{
+			Name:   proto.String("assets_exporter_sink_retries_total"),
+			Help:   proto.String("retries"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}},
+		},
+		{
+			Name: proto.String("assets_exporter_kubecost_request_duration_seconds"),
+			Help: proto.String("duration"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(4),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+				},
+			}}},
+		},
+	}
+	want := &collectormetrics.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("k8s.cluster.name", "prod"),
+			stringAttribute("service.name", "kubecost_exporter"),
+		}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{
+			Scope: &commonpb.InstrumentationScope{Name: "github.com/artemlive/kubecost_exporter", Version: "1.0.0"},
+			Metrics: []*metricspb.Metric{
+				{
+					Name: "assets_cost_cluster_allocation_component", Description: "k8s cost by component", Unit: "USD",
+					Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{{
+						Attributes:   []*commonpb.KeyValue{stringAttribute("cost_component", "cpu"), stringAttribute("property_namespace", "kubecost")},
+						TimeUnixNano: uint64(86400 * time.Second),
+						Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: 0.5},
+					}}}},
+				},
+				{
+					Name: "assets_exporter_sink_retries_total", Description: "retries", Unit: "1",
+					Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+						DataPoints:             []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 3}}},
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+						IsMonotonic:            true,
+					}},
+				},
+				{
+					Name: "assets_exporter_kubecost_request_duration_seconds", Description: "duration", Unit: "s",
+					Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+						DataPoints: []*metricspb.HistogramDataPoint{{
+							Count:          4,
+							Sum:            proto.Float64(2.5),
+							BucketCounts:   []uint64{1, 2, 1},
+							ExplicitBounds: []float64{0.1, 1},
+						}},
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					}},
+				},
+			},
+		}},
+	}}}
+
+	for _, protocol := range []string{OTLPProtocolGRPC, OTLPProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			receiver := &metricsReceiver{}
+			otlp := newTestOTLP(t, protocol, startReceiver(t, protocol, receiver))
+			before := uint64(time.Now().UnixNano())
+			if err := otlp.Send(context.Background(), families); err != nil {
+				t.Fatal(err)
+			}
+			after := uint64(time.Now().UnixNano())
+			if len(receiver.requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(receiver.requests))
+			}
+			if receiver.headers[0] != "Bearer token" {
+				t.Errorf("Authorization = %q, want the configured header", receiver.headers[0])
+			}
+
+			// the samples without timestamps are sent with the collection time, the cumulative ones start with the exporter
+			got := receiver.requests[0]
+			metrics := got.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+			sum := metrics[1].GetSum().GetDataPoints()[0]
+			histogram := metrics[2].GetHistogram().GetDataPoints()[0]
+			for _, dp := range []interface {
+				GetStartTimeUnixNano() uint64
+				GetTimeUnixNano() uint64
+			}{sum, histogram} {
+				if dp.GetTimeUnixNano() < before || dp.GetTimeUnixNano() > after {
+					t.Errorf("time_unix_nano %d isn't the collection time", dp.GetTimeUnixNano())
+				}
+				if dp.GetStartTimeUnixNano() == 0 || dp.GetStartTimeUnixNano() > before {
+					t.Errorf("start_time_unix_nano %d isn't the exporter start", dp.GetStartTimeUnixNano())
+				}
+			}
+			sum.StartTimeUnixNano, sum.TimeUnixNano = 0, 0
+			histogram.StartTimeUnixNano, histogram.TimeUnixNano = 0, 0
+			if !proto.Equal(got, want) {
+				t.Errorf("got request\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestOTLPRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		protocol     string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "UNAVAILABLE is retried", protocol: OTLPProtocolGRPC, errs: []error{status.Error(codes.Unavailable, "busy")}, wantAttempts: 2},
+		{name: "RESOURCE_EXHAUSTED is retried", protocol: OTLPProtocolGRPC, errs: []error{status.Error(codes.ResourceExhausted, "limit")}, wantAttempts: 2},
+		{name: "INVALID_ARGUMENT isn't retried", protocol: OTLPProtocolGRPC, errs: []error{status.Error(codes.InvalidArgument, "bad")}, wantAttempts: 1, wantErr: true},
+		{name: "503 is retried", protocol: OTLPProtocolHTTP, errs: []error{status.Error(codes.Unavailable, "busy")}, wantAttempts: 2},
+		{name: "400 isn't retried", protocol: OTLPProtocolHTTP, errs: []error{status.Error(codes.InvalidArgument, "bad")}, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &metricsReceiver{errs: tt.errs}
+			otlp := newTestOTLP(t, tt.protocol, startReceiver(t, tt.protocol, receiver))
+			err := otlp.Send(context.Background(), []*dto.MetricFamily{testGauge("kubecost_cost", "default", 1, 86400000)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if receiver.attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", receiver.attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// TestOTLPGRPCHTTPStatus checks the HTTP statuses of a proxy in front of the gRPC receiver,
+// only the ones that gRPC maps to UNAVAILABLE are retried
+func TestOTLPGRPCHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status       int
+		wantAttempts int
+	}{
+		{status: http.StatusTooManyRequests, wantAttempts: 3},
+		{status: http.StatusBadGateway, wantAttempts: 3},
+		{status: http.StatusServiceUnavailable, wantAttempts: 3},
+		{status: http.StatusGatewayTimeout, wantAttempts: 3},
+		{status: http.StatusBadRequest, wantAttempts: 1},
+		{status: http.StatusUnauthorized, wantAttempts: 1},
+		{status: http.StatusNotFound, wantAttempts: 1},
+		{status: http.StatusInternalServerError, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+				if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+					t.Errorf("unexpected request %s %s", r.Proto, r.Header.Get("Content-Type"))
+				}
+				w.WriteHeader(tt.status)
+			}))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			defer server.Close()
+
+			otlp := newTestOTLP(t, OTLPProtocolGRPC, server.URL)
+			retries := Retries.WithLabelValues(otlpSinkName)
+			before := testutil.ToFloat64(retries)
+			if err := otlp.Send(context.Background(), []*dto.MetricFamily{testGauge("kubecost_cost", "default", 1, 86400000)}); err == nil {
+				t.Fatal("Send() succeeded, want an error")
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if got := testutil.ToFloat64(retries) - before; got != float64(tt.wantAttempts-1) {
+				t.Errorf("sink_retries_total increased by %v, want %d", got, tt.wantAttempts-1)
+			}
+		})
+	}
+}
+
+func TestOTLPTracesExportSpans(t *testing.T) {
+	var got *collectortrace.ExportTraceServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpTracesHTTPPath {
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		got = &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPTraces(OTLPConfig{Endpoint: server.URL, Protocol: OTLPProtocolHTTP, Timeout: 5 * time.Second,
+		ResourceAttributes: map[string]string{"service.name": "kubecost_exporter"}}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1640000000, 0)
+	span := tracing.SpanData{
+		SpanContext:  tracing.SpanContext{TraceID: tracing.TraceID{1, 2, 3}, SpanID: tracing.SpanID{4, 5, 6}, TraceState: "vendor=value"},
+		ParentSpanID: tracing.SpanID{7, 8, 9},
+		Name:         "GET /model/allocation",
+		Kind:         tracing.SpanKindClient,
+		Start:        start,
+		End:          start.Add(time.Second),
+		Attributes: []tracing.Attribute{
+			tracing.String("url.path", "/model/allocation"),
+			tracing.Int("http.response.status_code", 500),
+			tracing.Bool("cache.hit", false),
+			tracing.Float64("ratio", 0.5),
+		},
+		StatusCode:    tracing.StatusError,
+		StatusMessage: "Internal Server Error",
+	}
+	if err := exporter.ExportSpans(context.Background(), []tracing.SpanData{span}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &collectortrace.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", "kubecost_exporter")}},
+		ScopeSpans: []*tracepb.ScopeSpans{{
+			Scope: &commonpb.InstrumentationScope{Name: "github.com/artemlive/kubecost_exporter"},
+			Spans: []*tracepb.Span{{
+				TraceId:           span.TraceID[:],
+				SpanId:            span.SpanID[:],
+				TraceState:        "vendor=value",
+				ParentSpanId:      span.ParentSpanID[:],
+				Name:              "GET /model/allocation",
+				Kind:              tracepb.Span_SPAN_KIND_CLIENT,
+				StartTimeUnixNano: uint64(start.UnixNano()),
+				EndTimeUnixNano:   uint64(start.Add(time.Second).UnixNano()),
+				Attributes: []*commonpb.KeyValue{
+					stringAttribute("url.path", "/model/allocation"),
+					{Key: "http.response.status_code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 500}}},
+					{Key: "cache.hit", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: false}}},
+					{Key: "ratio", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 0.5}}},
+				},
+				Status: &tracepb.Status{Message: "Internal Server Error", Code: tracepb.Status_STATUS_CODE_ERROR},
+			}},
+		}},
+	}}}
+	if !proto.Equal(got, want) {
+		t.Errorf("got request\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/artemlive/kubecost_exporter/tracing"
+	"github.com/go-kit/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpTracesSinkName = "otlp_traces"
+
+	otlpTracesHTTPPath = "/v1/traces"
+	otlpTracesGRPCPath = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+)
+
+// Verify if OTLPTraces implements tracing.SpanExporter
+var _ tracing.SpanExporter = (*OTLPTraces)(nil)
+
+// OTLPTraces sends the spans of the exporter to an OpenTelemetry receiver, it's the exporter of the tracer
+type OTLPTraces struct {
+	client             *otlpClient
+	resourceAttributes map[string]string
+	scopeVersion       string
+}
+
+// NewOTLPTraces returns the span exporter, CostUnit of the config isn't used
+func NewOTLPTraces(config OTLPConfig, logger log.Logger) (*OTLPTraces, error) {
+	client, err := newOTLPClient(otlpTracesSinkName, config, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPTraces{client: client, resourceAttributes: config.ResourceAttributes, scopeVersion: config.ScopeVersion}, nil
+}
+
+// ExportSpans implements tracing.SpanExporter.
+func (o *OTLPTraces) ExportSpans(ctx context.Context, spans []tracing.SpanData) error {
+	return o.client.export(ctx, otlpTracesHTTPPath, otlpTracesGRPCPath, o.encode(spans))
+}
+
+// encode returns ExportTraceServiceRequest { repeated ResourceSpans resource_spans = 1; }
+//
+//	ResourceSpans { Resource resource = 1; repeated ScopeSpans scope_spans = 2; }
+//	ScopeSpans { InstrumentationScope scope = 1; repeated Span spans = 2; }
+func (o *OTLPTraces) encode(spans []tracing.SpanData) []byte {
+	scopeSpans := appendScope(nil, 1, "github.com/artemlive/kubecost_exporter", o.scopeVersion)
+	for _, span := range spans {
+		scopeSpans = appendMessage(scopeSpans, 2, encodeSpan(span))
+	}
+	resourceSpans := appendResource(nil, 1, o.resourceAttributes)
+	resourceSpans = appendMessage(resourceSpans, 2, scopeSpans)
+	return appendMessage(nil, 1, resourceSpans)
+}
+
+// encodeSpan returns
+//
+//	Span { bytes trace_id = 1; bytes span_id = 2; string trace_state = 3; bytes parent_span_id = 4; string name = 5;
+//	  SpanKind kind = 6; fixed64 start_time_unix_nano = 7; fixed64 end_time_unix_nano = 8;
+//	  repeated KeyValue attributes = 9; Status status = 15; }
+//	Status { string message = 2; StatusCode code = 3; }
+func encodeSpan(span tracing.SpanData) []byte {
+	b := appendBytes(nil, 1, span.TraceID[:])
+	b = appendBytes(b, 2, span.SpanID[:])
+	if len(span.TraceState) > 0 {
+		b = appendString(b, 3, span.TraceState)
+	}
+	if span.ParentSpanID.IsValid() {
+		b = appendBytes(b, 4, span.ParentSpanID[:])
+	}
+	b = appendString(b, 5, span.Name)
+	b = appendVarint(b, 6, uint64(span.Kind))
+	b = appendFixed64(b, 7, unixNano(span.Start))
+	b = appendFixed64(b, 8, unixNano(span.End))
+	for _, attr := range span.Attributes {
+		b = appendAttribute(b, 9, attr)
+	}
+	if span.StatusCode != tracing.StatusUnset {
+		var status []byte
+		if len(span.StatusMessage) > 0 {
+			status = appendString(status, 2, span.StatusMessage)
+		}
+		status = appendVarint(status, 3, uint64(span.StatusCode))
+		b = appendMessage(b, 15, status)
+	}
+	return b
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendAttribute encodes KeyValue { string key = 1; AnyValue value = 2; } with
+// AnyValue { string string_value = 1; bool bool_value = 2; int64 int_value = 3; double double_value = 4; }
+func appendAttribute(b []byte, num protowire.Number, attr tracing.Attribute) []byte {
+	var value []byte
+	switch v := attr.Value.(type) {
+	case string:
+		value = appendString(value, 1, v)
+	case bool:
+		var i uint64
+		if v {
+			i = 1
+		}
+		value = appendVarint(value, 2, i)
+	case int64:
+		value = appendVarint(value, 3, uint64(v))
+	case float64:
+		value = appendDouble(value, 4, v)
+	default:
+		return b
+	}
+	kv := appendString(nil, 1, attr.Key)
+	kv = appendMessage(kv, 2, value)
+	return appendMessage(b, num, kv)
+}
@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const pushgatewaySinkName = "pushgateway"
+
+// PushgatewayConfig is the configuration of the Pushgateway sink
+type PushgatewayConfig struct {
+	URL string
+	Job string
+	// Grouping is the grouping key, e.g. cluster="prod", window="2021-12-14"
+	Grouping      map[string]string
+	BasicAuthUser string
+	BasicAuthPass string
+	Timeout       time.Duration
+}
+
+// Pushgateway replaces the metrics of the group in a Pushgateway, the pushed samples can't have timestamps
+type Pushgateway struct {
+	config PushgatewayConfig
+}
+
+// NewPushgateway returns a new Pushgateway sink
+func NewPushgateway(config PushgatewayConfig) *Pushgateway {
+	return &Pushgateway{config: config}
+}
+
+func (p *Pushgateway) Name() string {
+	return pushgatewaySinkName
+}
+
+// Send implements Sink.
+func (p *Pushgateway) Send(ctx context.Context, families []*dto.MetricFamily) error {
+	pusher := push.New(p.config.URL, p.config.Job).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, nil
+		})).
+		Client(contextDoer{ctx: ctx, client: &http.Client{Timeout: p.config.Timeout}})
+	for name, value := range p.config.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if len(p.config.BasicAuthUser) > 0 {
+		pusher = pusher.BasicAuth(p.config.BasicAuthUser, p.config.BasicAuthPass)
+	}
+	// PUT replaces all the metrics in the group, so the series that disappeared from Kubecost don't stay there forever
+	return pusher.Push()
+}
+
+// contextDoer adds the context to the requests of the push package, that doesn't support it
+type contextDoer struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+func (d contextDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.client.Do(req.WithContext(d.ctx))
+}
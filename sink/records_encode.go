@@ -0,0 +1,136 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// record file formats
+const (
+	RecordFormatJSONL   = "jsonl"
+	RecordFormatCSV     = "csv"
+	RecordFormatParquet = "parquet"
+)
+
+// recordEncoder writes records of one type to a file
+type recordEncoder interface {
+	Encode(record interface{}) error
+	Close() error
+}
+
+// newRecordEncoder returns the encoder for the format, the sample defines the schema
+func newRecordEncoder(format string, w io.Writer, sample interface{}) (recordEncoder, error) {
+	switch format {
+	case RecordFormatJSONL:
+		return &jsonlEncoder{encoder: json.NewEncoder(w)}, nil
+	case RecordFormatCSV:
+		e := &csvEncoder{writer: csv.NewWriter(w)}
+		// header is written even for an empty file, so the schema is always there
+		return e, e.writer.Write(recordColumns(sample))
+	case RecordFormatParquet:
+		return &parquetEncoder{writer: parquet.NewWriter(w, parquet.SchemaOf(sample))}, nil
+	}
+	return nil, fmt.Errorf("unknown records format %q", format)
+}
+
+// encodeRecords encodes the records to a byte slice
+func encodeRecords(format string, sample interface{}, records []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := newRecordEncoder(format, &buf, sample)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type jsonlEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *jsonlEncoder) Encode(record interface{}) error {
+	return e.encoder.Encode(record)
+}
+
+func (e *jsonlEncoder) Close() error {
+	return nil
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvEncoder) Encode(record interface{}) error {
+	return e.writer.Write(recordValues(record))
+}
+
+func (e *csvEncoder) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type parquetEncoder struct {
+	writer *parquet.Writer
+}
+
+func (e *parquetEncoder) Encode(record interface{}) error {
+	return e.writer.Write(record)
+}
+
+func (e *parquetEncoder) Close() error {
+	return e.writer.Close()
+}
+
+// recordColumns returns the column names from the json tags of the record struct,
+// so all formats share the same column names
+func recordColumns(record interface{}) []string {
+	t := reflect.Indirect(reflect.ValueOf(record)).Type()
+	columns := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		columns = append(columns, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return columns
+}
+
+// recordValues returns the CSV values of the record: RFC3339 for time and JSON for maps
+func recordValues(record interface{}) []string {
+	v := reflect.Indirect(reflect.ValueOf(record))
+	values := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		switch field := v.Field(i).Interface().(type) {
+		case time.Time:
+			values = append(values, field.UTC().Format(time.RFC3339))
+		case string:
+			values = append(values, field)
+		case float64:
+			values = append(values, strconv.FormatFloat(field, 'f', -1, 64))
+		case int64:
+			values = append(values, strconv.FormatInt(field, 10))
+		default:
+			encoded, _ := json.Marshal(field)
+			values = append(values, string(encoded))
+		}
+	}
+	return values
+}
+
+// recordFormatExtension returns the file extension for the format
+func recordFormatExtension(format string) string {
+	return "." + format
+}
@@ -0,0 +1,302 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// DefaultPartitionTemplate is the hive-style layout understood by DuckDB and Spark
+	DefaultPartitionTemplate = "{{.Kind}}/date={{.Date}}/cluster={{.Cluster}}"
+	// DefaultMaxRowsPerFile rotates the files of big partitions
+	DefaultMaxRowsPerFile = 100000
+
+	manifestKey      = "manifest.json"
+	windowNameFormat = "20060102T150405Z"
+
+	// maxManifests limits the number of the loaded manifests, there is one per prefix, e.g. per day with a templated S3 prefix
+	maxManifests = 100
+)
+
+// Verify if RecordsSink implements collector.RecordWriter
+var _ collector.RecordWriter = (*RecordsSink)(nil)
+
+// RecordsConfig is the configuration of the records files
+type RecordsConfig struct {
+	// Format is RecordFormatJSONL, RecordFormatCSV or RecordFormatParquet
+	Format string
+	// MaxRowsPerFile splits a partition into several part files
+	MaxRowsPerFile int
+	// PartitionTemplate is the text/template of the partition path, the fields are .Kind, .Date and .Cluster
+	PartitionTemplate string
+}
+
+// partitionKey is the data for the partition template
+type partitionKey struct {
+	Kind    string
+	Date    string
+	Cluster string
+}
+
+// RecordsSink writes the raw allocation and asset records of every scrape to files partitioned by date and cluster.
+// The file names contain the scraped window, so the same window scraped again replaces its files,
+// the manifest file in the root lists all the files with their schema. With a templated S3 prefix
+// every prefix is a root with its own manifest.
+type RecordsSink struct {
+	name      string
+	store     objectStore
+	config    RecordsConfig
+	partition *template.Template
+	logger    log.Logger
+
+	mu sync.Mutex
+	// manifests are the loaded manifests by the prefix of the store
+	manifests map[string]*recordsManifest
+}
+
+// NewRecordFiles returns the records sink that writes to a local directory
+func NewRecordFiles(dir string, config RecordsConfig, logger log.Logger) (*RecordsSink, error) {
+	store, err := newLocalStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordsSink("files", store, config, logger)
+}
+
+func newRecordsSink(name string, store objectStore, config RecordsConfig, logger log.Logger) (*RecordsSink, error) {
+	if _, err := newRecordEncoder(config.Format, &bytes.Buffer{}, collector.AllocationRecord{}); err != nil {
+		return nil, err
+	}
+	if config.MaxRowsPerFile <= 0 {
+		config.MaxRowsPerFile = DefaultMaxRowsPerFile
+	}
+	if len(config.PartitionTemplate) == 0 {
+		config.PartitionTemplate = DefaultPartitionTemplate
+	}
+	partition, err := template.New("partition").Option("missingkey=error").Parse(config.PartitionTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the partition template: %s", err)
+	}
+	return &RecordsSink{
+		name:      name,
+		store:     store,
+		config:    config,
+		partition: partition,
+		logger:    logger,
+		manifests: make(map[string]*recordsManifest),
+	}, nil
+}
+
+func (s *RecordsSink) Name() string {
+	return s.name
+}
+
+// partitionedRecord is implemented by all the record types
+type partitionedRecord interface {
+	Partition() (string, string)
+}
+
+// WriteRecords implements collector.RecordWriter.
+func (s *RecordsSink) WriteRecords(ctx context.Context, records *collector.Records) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store, prefix, err := storeForWindow(s.store, records.Start, records.End)
+	if err != nil {
+		return err
+	}
+	manifest, err := s.loadManifest(ctx, store, prefix)
+	if err != nil {
+		return err
+	}
+
+	var allocations, assets []partitionedRecord
+	for _, r := range collector.NewAllocationRecords(records) {
+		allocations = append(allocations, r)
+	}
+	for _, r := range collector.NewAssetRecords(records) {
+		assets = append(assets, r)
+	}
+	if err := s.writeKind(ctx, store, manifest, collector.RecordKindAllocations, collector.AllocationRecord{}, allocations, records); err != nil {
+		return err
+	}
+	if err := s.writeKind(ctx, store, manifest, collector.RecordKindAssets, collector.AssetRecord{}, assets, records); err != nil {
+		return err
+	}
+	manifest.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, manifestKey, data)
+}
+
+// writeKind writes the records of one kind, grouped by partitions
+func (s *RecordsSink) writeKind(ctx context.Context, store objectStore, manifest *recordsManifest, kind string, sample interface{}, rows []partitionedRecord, records *collector.Records) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var order []partitionKey
+	partitions := make(map[partitionKey][]interface{})
+	for _, r := range rows {
+		date, cluster := r.Partition()
+		key := partitionKey{Kind: kind, Date: date, Cluster: cluster}
+		if _, ok := partitions[key]; !ok {
+			order = append(order, key)
+		}
+		partitions[key] = append(partitions[key], r)
+	}
+
+	for _, key := range order {
+		var dir bytes.Buffer
+		if err := s.partition.Execute(&dir, key); err != nil {
+			return err
+		}
+		prefix := fmt.Sprintf("%s/%s_%s_%s_part-", strings.Trim(dir.String(), "/"), kind,
+			records.Start.UTC().Format(windowNameFormat), records.End.UTC().Format(windowNameFormat))
+		written := make(map[string]bool)
+		partRows := partitions[key]
+		for part := 0; len(partRows) > 0; part++ {
+			n := len(partRows)
+			if n > s.config.MaxRowsPerFile {
+				n = s.config.MaxRowsPerFile
+			}
+			objectKey := fmt.Sprintf("%s%04d%s", prefix, part, recordFormatExtension(s.config.Format))
+			data, err := encodeRecords(s.config.Format, sample, partRows[:n])
+			if err != nil {
+				return err
+			}
+			if err := store.Put(ctx, objectKey, data); err != nil {
+				return err
+			}
+			written[objectKey] = true
+			manifest.add(recordsManifestFile{
+				Key:         objectKey,
+				Kind:        kind,
+				Date:        key.Date,
+				Cluster:     key.Cluster,
+				WindowStart: records.Start.UTC(),
+				WindowEnd:   records.End.UTC(),
+				Rows:        n,
+				Bytes:       len(data),
+				WrittenAt:   time.Now().UTC(),
+			})
+			partRows = partRows[n:]
+		}
+
+		// the previous write of the same window might have had more parts
+		existing, err := store.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, objectKey := range existing {
+			if !written[objectKey] {
+				level.Debug(s.logger).Log("msg", "Removing stale records file", "key", objectKey)
+				if err := store.Delete(ctx, objectKey); err != nil {
+					return err
+				}
+				manifest.remove(objectKey)
+			}
+		}
+	}
+	return nil
+}
+
+// recordsManifest describes all the records files, so the readers don't have to list the store
+type recordsManifest struct {
+	SchemaVersion int                   `json:"schema_version"`
+	Format        string                `json:"format"`
+	Columns       map[string][]string   `json:"columns"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+	Files         []recordsManifestFile `json:"files"`
+}
+
+type recordsManifestFile struct {
+	Key         string    `json:"key"`
+	Kind        string    `json:"kind"`
+	Date        string    `json:"date"`
+	Cluster     string    `json:"cluster"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Rows        int       `json:"rows"`
+	Bytes       int       `json:"bytes"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+// add adds or replaces the file, keeping the files sorted by key
+func (m *recordsManifest) add(file recordsManifestFile) {
+	i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Key >= file.Key })
+	if i < len(m.Files) && m.Files[i].Key == file.Key {
+		m.Files[i] = file
+		return
+	}
+	m.Files = append(m.Files, recordsManifestFile{})
+	copy(m.Files[i+1:], m.Files[i:])
+	m.Files[i] = file
+}
+
+func (m *recordsManifest) remove(key string) {
+	i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Key >= key })
+	if i < len(m.Files) && m.Files[i].Key == key {
+		m.Files = append(m.Files[:i], m.Files[i+1:]...)
+	}
+}
+
+// loadManifest reads the existing manifest of the prefix once, the files written before the restart stay in it
+func (s *RecordsSink) loadManifest(ctx context.Context, store objectStore, prefix string) (*recordsManifest, error) {
+	if manifest, ok := s.manifests[prefix]; ok {
+		return manifest, nil
+	}
+	manifest := &recordsManifest{}
+	data, err := store.Get(ctx, manifestKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("couldn't parse the records manifest: %s", err)
+		}
+		if manifest.Format != s.config.Format || manifest.SchemaVersion != collector.RecordsSchemaVersion {
+			level.Warn(s.logger).Log("msg", "Records format or schema changed, the old files stay as they are", "format", manifest.Format, "schema_version", manifest.SchemaVersion)
+		}
+	case !store.IsNotExist(err):
+		return nil, err
+	}
+	manifest.SchemaVersion = collector.RecordsSchemaVersion
+	manifest.Format = s.config.Format
+	manifest.Columns = map[string][]string{
+		collector.RecordKindAllocations: recordColumns(collector.AllocationRecord{}),
+		collector.RecordKindAssets:      recordColumns(collector.AssetRecord{}),
+	}
+	// the manifests that are dropped are read again when they're needed
+	if len(s.manifests) >= maxManifests {
+		s.manifests = make(map[string]*recordsManifest)
+	}
+	s.manifests[prefix] = manifest
+	return manifest, nil
+}
+
+// RecordWriters writes the records to all the writers, e.g. local files and a bucket
+type RecordWriters []collector.RecordWriter
+
+// WriteRecords implements collector.RecordWriter.
+func (w RecordWriters) WriteRecords(ctx context.Context, records *collector.Records) error {
+	var errs []string
+	for _, writer := range w {
+		if err := writer.WriteRecords(ctx, records); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
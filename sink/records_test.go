@@ -0,0 +1,269 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+	"github.com/parquet-go/parquet-go"
+)
+
+var (
+	testWindowStart = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	testWindowEnd   = testWindowStart.AddDate(0, 0, 1)
+)
+
+func testAllocationRecords() []collector.AllocationRecord {
+	return []collector.AllocationRecord{
+		{
+			WindowStart: testWindowStart, WindowEnd: testWindowEnd, Cluster: "cluster-one", Name: "cluster-one/node/kubecost/pod/app",
+			Namespace: "kubecost", Pod: "pod", Container: "app", Labels: map[string]string{"app": "cost-analyzer", "team": "a,b"},
+			CPUCoreHours: 12, CPUCost: 0.5, RAMByteHours: 2.5e10, RAMCost: 0.125, TotalCost: 0.625,
+		},
+		{
+			WindowStart: testWindowStart, WindowEnd: testWindowEnd, Cluster: "cluster-one", Name: "__idle__",
+			Labels: map[string]string{}, CPUCost: 1.25, TotalCost: 1.25,
+		},
+	}
+}
+
+func TestRecordEncoders(t *testing.T) {
+	want := testAllocationRecords()
+	records := make([]interface{}, len(want))
+	for i, r := range want {
+		records[i] = r
+	}
+	columns := recordColumns(collector.AllocationRecord{})
+
+	tests := []struct {
+		format string
+		decode func(t *testing.T, data []byte) []collector.AllocationRecord
+	}{
+		{
+			format: RecordFormatJSONL,
+			decode: func(t *testing.T, data []byte) []collector.AllocationRecord {
+				var got []collector.AllocationRecord
+				decoder := json.NewDecoder(bytes.NewReader(data))
+				for {
+					var r collector.AllocationRecord
+					if err := decoder.Decode(&r); err == io.EOF {
+						return got
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, r)
+				}
+			},
+		},
+		{
+			format: RecordFormatCSV,
+			decode: func(t *testing.T, data []byte) []collector.AllocationRecord {
+				rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(rows[0], columns) {
+					t.Errorf("got header %q, want %q", rows[0], columns)
+				}
+				// the values are compared as the CSV of the wanted records, the maps are JSON and the floats are exact
+				for i, r := range want {
+					if !reflect.DeepEqual(rows[i+1], recordValues(r)) {
+						t.Errorf("got row %q, want %q", rows[i+1], recordValues(r))
+					}
+				}
+				if rows[1][0] != "2022-01-01T00:00:00Z" || rows[1][11] != `{"app":"cost-analyzer","team":"a,b"}` || rows[1][17] != "0.125" {
+					t.Errorf("unexpected values of time, labels or float: %q", rows[1])
+				}
+				return want[:len(rows)-1]
+			},
+		},
+		{
+			format: RecordFormatParquet,
+			decode: func(t *testing.T, data []byte) []collector.AllocationRecord {
+				got, err := parquet.Read[collector.AllocationRecord](bytes.NewReader(data), int64(len(data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range got {
+					got[i].WindowStart, got[i].WindowEnd = got[i].WindowStart.UTC(), got[i].WindowEnd.UTC()
+				}
+				return got
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			data, err := encodeRecords(tt.format, collector.AllocationRecord{}, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.decode(t, data); !reflect.DeepEqual(got, want) {
+				t.Errorf("got records\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRecordEncodersEmpty(t *testing.T) {
+	// an empty CSV file still has the header
+	data, err := encodeRecords(RecordFormatCSV, collector.AssetRecord{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(recordColumns(collector.AssetRecord{}), ",") + "\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	if _, err := encodeRecords("xml", collector.AssetRecord{}, nil); err == nil {
+		t.Error("an unknown format is accepted")
+	}
+}
+
+// testRecords returns the records of the scrape with n allocations of cluster-one and one without a cluster
+func testRecords(n int) *collector.Records {
+	records := &collector.Records{Scraper: "scrape_allocation", Start: testWindowStart, End: testWindowEnd}
+	for i := 0; i < n; i++ {
+		records.Allocations = append(records.Allocations, kubecost_api.Allocation{
+			Name:       "allocation",
+			Properties: &kubecost_api.AllocationProperties{Cluster: "cluster-one"},
+			TotalCost:  float64(i),
+		})
+	}
+	records.Allocations = append(records.Allocations, kubecost_api.Allocation{Name: "__unallocated__"})
+	return records
+}
+
+// listFiles returns the files in the directory as the slash separated keys
+func listFiles(t *testing.T, dir string) []string {
+	var keys []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readManifest(t *testing.T, dir string) recordsManifest {
+	data, err := os.ReadFile(filepath.Join(dir, manifestKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest recordsManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func manifestRows(manifest recordsManifest) map[string]int {
+	rows := make(map[string]int, len(manifest.Files))
+	for _, f := range manifest.Files {
+		rows[f.Key] = f.Rows
+	}
+	return rows
+}
+
+func TestRecordsSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	config := RecordsConfig{Format: RecordFormatJSONL, MaxRowsPerFile: 2}
+	records, err := NewRecordFiles(dir, config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cluster = "allocations/date=2022-01-01/cluster=cluster-one/allocations_20220101T000000Z_20220102T000000Z_part-"
+	const unknown = "allocations/date=2022-01-01/cluster=unknown/allocations_20220101T000000Z_20220102T000000Z_part-"
+	if err := records.WriteRecords(ctx, testRecords(5)); err != nil {
+		t.Fatal(err)
+	}
+	wantRows := map[string]int{cluster + "0000.jsonl": 2, cluster + "0001.jsonl": 2, cluster + "0002.jsonl": 1, unknown + "0000.jsonl": 1}
+	wantFiles := []string{cluster + "0000.jsonl", cluster + "0001.jsonl", cluster + "0002.jsonl", unknown + "0000.jsonl", manifestKey}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("got files\n%q\nwant\n%q", got, wantFiles)
+	}
+	manifest := readManifest(t, dir)
+	if got := manifestRows(manifest); !reflect.DeepEqual(got, wantRows) {
+		t.Errorf("got manifest rows %v, want %v", got, wantRows)
+	}
+	if manifest.SchemaVersion != collector.RecordsSchemaVersion || manifest.Format != RecordFormatJSONL {
+		t.Errorf("got schema version %d and format %q", manifest.SchemaVersion, manifest.Format)
+	}
+	if !reflect.DeepEqual(manifest.Columns[collector.RecordKindAllocations], recordColumns(collector.AllocationRecord{})) {
+		t.Errorf("got allocation columns %q", manifest.Columns[collector.RecordKindAllocations])
+	}
+	if !sort.SliceIsSorted(manifest.Files, func(i, j int) bool { return manifest.Files[i].Key < manifest.Files[j].Key }) {
+		t.Error("manifest files aren't sorted by key")
+	}
+	f := manifest.Files[0]
+	if f.Kind != collector.RecordKindAllocations || f.Date != "2022-01-01" || f.Cluster != "cluster-one" || !f.WindowStart.Equal(testWindowStart) || f.Bytes == 0 {
+		t.Errorf("unexpected manifest file %+v", f)
+	}
+
+	// the same window scraped again replaces its files, the parts that aren't written anymore are removed,
+	// the sink of the restarted exporter keeps the files of the manifest
+	records, err = NewRecordFiles(dir, config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := records.WriteRecords(ctx, testRecords(3)); err != nil {
+		t.Fatal(err)
+	}
+	next := testRecords(1)
+	next.Start, next.End = testWindowEnd, testWindowEnd.AddDate(0, 0, 1)
+	if err := records.WriteRecords(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	const nextCluster = "allocations/date=2022-01-02/cluster=cluster-one/allocations_20220102T000000Z_20220103T000000Z_part-"
+	const nextUnknown = "allocations/date=2022-01-02/cluster=unknown/allocations_20220102T000000Z_20220103T000000Z_part-"
+	wantRows = map[string]int{cluster + "0000.jsonl": 2, cluster + "0001.jsonl": 1, unknown + "0000.jsonl": 1, nextCluster + "0000.jsonl": 1, nextUnknown + "0000.jsonl": 1}
+	wantFiles = []string{cluster + "0000.jsonl", cluster + "0001.jsonl", unknown + "0000.jsonl", nextCluster + "0000.jsonl", nextUnknown + "0000.jsonl", manifestKey}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("got files\n%q\nwant\n%q", got, wantFiles)
+	}
+	if got := manifestRows(readManifest(t, dir)); !reflect.DeepEqual(got, wantRows) {
+		t.Errorf("got manifest rows %v, want %v", got, wantRows)
+	}
+}
+
+func TestRecordsSinkPartitionTemplate(t *testing.T) {
+	dir := t.TempDir()
+	records, err := NewRecordFiles(dir, RecordsConfig{Format: RecordFormatCSV, PartitionTemplate: "{{.Cluster}}/{{.Kind}}/{{.Date}}"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := records.WriteRecords(context.Background(), testRecords(1)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"cluster-one/allocations/2022-01-01/allocations_20220101T000000Z_20220102T000000Z_part-0000.csv",
+		manifestKey,
+		"unknown/allocations/2022-01-01/allocations_20220101T000000Z_20220102T000000Z_part-0000.csv",
+	}
+	if got := listFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got files\n%q\nwant\n%q", got, want)
+	}
+
+	if _, err := NewRecordFiles(dir, RecordsConfig{Format: RecordFormatCSV, PartitionTemplate: "{{.Unknown}"}, log.NewNopLogger()); err == nil {
+		t.Error("an invalid partition template is accepted")
+	}
+}
@@ -0,0 +1,293 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const remoteWriteSinkName = "remote_write"
+
+// RemoteWriteConfig is the configuration of the Prometheus remote write endpoint
+type RemoteWriteConfig struct {
+	URL *url.URL
+	// ExternalLabels are added to every series, e.g. job="kubecost_exporter"
+	ExternalLabels map[string]string
+	Timeout        time.Duration
+	// MaxRetries is the number of retries for recoverable errors: network errors, 5xx and 429 responses
+	MaxRetries    int
+	MinBackoff    time.Duration
+	BasicAuthUser string
+	BasicAuthPass string
+	BearerToken   string
+	SkipTLSVerify bool
+	// MaxSamplesPerSend splits big requests, the backfilled history may contain millions of samples
+	MaxSamplesPerSend int
+}
+
+// RemoteWrite sends the metrics to a Prometheus remote write endpoint
+// using the protobuf + snappy encoding of the remote write protocol 0.1.0
+type RemoteWrite struct {
+	config     RemoteWriteConfig
+	logger     log.Logger
+	httpClient *http.Client
+}
+
+// NewRemoteWrite returns a new remote write sink
+func NewRemoteWrite(config RemoteWriteConfig, logger log.Logger) *RemoteWrite {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.SkipTLSVerify}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 500 * time.Millisecond
+	}
+	if config.MaxSamplesPerSend <= 0 {
+		config.MaxSamplesPerSend = 10000
+	}
+	return &RemoteWrite{
+		config: config,
+		logger: logger,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+	}
+}
+
+func (r *RemoteWrite) Name() string {
+	return remoteWriteSinkName
+}
+
+// Send implements Sink.
+func (r *RemoteWrite) Send(ctx context.Context, families []*dto.MetricFamily) error {
+	series := toTimeSeries(families, r.config.ExternalLabels, time.Now())
+	for _, batch := range splitTimeSeries(series, r.config.MaxSamplesPerSend) {
+		if err := r.sendWithRetries(ctx, encodeWriteRequest(batch)); err != nil {
+			return err
+		}
+	}
+	level.Debug(r.logger).Log("msg", "Metrics sent", "sink", r.Name(), "series", len(series))
+	return nil
+}
+
+func (r *RemoteWrite) sendWithRetries(ctx context.Context, payload []byte) error {
+	return retry(ctx, r.Name(), r.config.MaxRetries, r.config.MinBackoff, r.logger, func() error {
+		return r.send(ctx, payload)
+	})
+}
+
+func (r *RemoteWrite) send(ctx context.Context, payload []byte) error {
+	compressed := snappy.Encode(nil, payload)
+	req, err := http.NewRequest("POST", r.config.URL.String(), bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "kubecost_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(r.config.BasicAuthUser) > 0 {
+		req.SetBasicAuth(r.config.BasicAuthUser, r.config.BasicAuthPass)
+	} else if len(r.config.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+r.config.BearerToken)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	value       float64
+	timestampMs int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// toTimeSeries converts the metric families to the remote write time series,
+// the samples of the same series are merged, as the backfilled families contain the same series for every day
+func toTimeSeries(families []*dto.MetricFamily, externalLabels map[string]string, now time.Time) []*timeSeries {
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	index := make(map[string]*timeSeries)
+	var result []*timeSeries
+	add := func(name string, m *dto.Metric, extra []label, value float64) {
+		labels := make([]label, 0, len(m.GetLabel())+len(extra)+len(externalLabels)+1)
+		labels = append(labels, label{name: model.MetricNameLabel, value: name})
+		for _, l := range m.GetLabel() {
+			labels = append(labels, label{name: l.GetName(), value: l.GetValue()})
+		}
+		labels = append(labels, extra...)
+		for k, v := range externalLabels {
+			if !hasLabel(labels, k) {
+				labels = append(labels, label{name: k, value: v})
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].name < labels[j].name
+		})
+		ts := m.GetTimestampMs()
+		if ts == 0 {
+			ts = nowMs
+		}
+		key := labelsKey(labels)
+		series, ok := index[key]
+		if !ok {
+			series = &timeSeries{labels: labels}
+			index[key] = series
+			result = append(result, series)
+		}
+		series.samples = append(series.samples, sample{value: value, timestampMs: ts})
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, nil, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, nil, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, m, []label{{name: model.QuantileLabel, value: formatFloat(q.GetQuantile())}}, q.GetValue())
+				}
+				add(name+"_sum", m, nil, m.GetSummary().GetSampleSum())
+				add(name+"_count", m, nil, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					add(name+"_bucket", m, []label{{name: model.BucketLabel, value: formatFloat(b.GetUpperBound())}}, float64(b.GetCumulativeCount()))
+				}
+				add(name+"_bucket", m, []label{{name: model.BucketLabel, value: "+Inf"}}, float64(m.GetHistogram().GetSampleCount()))
+				add(name+"_sum", m, nil, m.GetHistogram().GetSampleSum())
+				add(name+"_count", m, nil, float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	for _, series := range result {
+		sort.Slice(series.samples, func(i, j int) bool {
+			return series.samples[i].timestampMs < series.samples[j].timestampMs
+		})
+	}
+	return result
+}
+
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func labelsKey(labels []label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// splitTimeSeries splits the series into batches of about maxSamples samples
+func splitTimeSeries(series []*timeSeries, maxSamples int) [][]*timeSeries {
+	var batches [][]*timeSeries
+	var batch []*timeSeries
+	samples := 0
+	for _, s := range series {
+		if samples > 0 && samples+len(s.samples) > maxSamples {
+			batches = append(batches, batch)
+			batch, samples = nil, 0
+		}
+		batch = append(batch, s)
+		samples += len(s.samples)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// encodeWriteRequest encodes the prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// it's small enough to be written by hand instead of pulling the whole prometheus module for the generated code
+func encodeWriteRequest(series []*timeSeries) []byte {
+	var out, ts, buf []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			buf = buf[:0]
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.name)
+			buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, buf)
+		}
+		for _, smp := range s.samples {
+			buf = buf[:0]
+			buf = protowire.AppendTag(buf, 1, protowire.Fixed64Type)
+			buf = protowire.AppendFixed64(buf, math.Float64bits(smp.value))
+			buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+			buf = protowire.AppendVarint(buf, uint64(smp.timestampMs))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, buf)
+		}
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, ts)
+	}
+	return out
+}
@@ -0,0 +1,235 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeWriteRequest decodes the WriteRequest written by encodeWriteRequest back to the time series
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	var result []timeSeries
+	forEachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		var ts timeSeries
+		forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var l label
+				forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						l.name = string(v)
+					} else {
+						l.value = string(v)
+					}
+				})
+				ts.labels = append(ts.labels, l)
+			case 2:
+				var s sample
+				forEachField(t, v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(n)
+					} else {
+						s.timestampMs = int64(n)
+					}
+				})
+				ts.samples = append(ts.samples, s)
+			}
+		})
+		result = append(result, ts)
+	})
+	return result
+}
+
+// forEachField calls fn with the bytes of the length-delimited fields and the number of the others
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, v []byte, n uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			fn(num, nil, v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			fn(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+	}
+}
+
+// remoteWriteReceiver is an in-process remote write endpoint, it replies with the queued status codes and then with 204
+type remoteWriteReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	attempts int
+	requests [][]timeSeries
+}
+
+func (rw *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.attempts++
+	if len(rw.statuses) > 0 {
+		status := rw.statuses[0]
+		rw.statuses = rw.statuses[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := r.Header.Get(header); got != want {
+			rw.t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rw.t.Fatal(err)
+	}
+	payload, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		rw.t.Fatalf("invalid snappy body: %s", err)
+	}
+	rw.requests = append(rw.requests, decodeWriteRequest(rw.t, payload))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newTestRemoteWrite(t *testing.T, receiver *remoteWriteReceiver, maxSamples int) *RemoteWrite {
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return NewRemoteWrite(RemoteWriteConfig{
+		URL:               u,
+		ExternalLabels:    map[string]string{"job": "kubecost_exporter", "namespace": "ignored"},
+		Timeout:           5 * time.Second,
+		MaxRetries:        2,
+		MinBackoff:        time.Millisecond,
+		MaxSamplesPerSend: maxSamples,
+	}, log.NewNopLogger())
+}
+
+func testGauge(name, namespace string, value float64, timestampMs int64) *dto.MetricFamily {
+	m := &dto.Metric{
+		Label: []*dto.LabelPair{{Name: proto.String("namespace"), Value: proto.String(namespace)}},
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	}
+	if timestampMs != 0 {
+		m.TimestampMs = proto.Int64(timestampMs)
+	}
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+}
+
+func TestRemoteWriteSend(t *testing.T) {
+	receiver := &remoteWriteReceiver{t: t}
+	rw := newTestRemoteWrite(t, receiver, 2)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	// the two days of the same series are merged into one series with two samples
+	families := []*dto.MetricFamily{
+		testGauge("kubecost_cost", "default", 2, 172800000),
+		testGauge("kubecost_cost", "default", 1, 86400000),
+		testGauge("kubecost_cost", "kube-system", 3, 86400000),
+		testGauge("kubecost_live", "default", 4, 0),
+	}
+	if err := rw.Send(context.Background(), families); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	seriesLabels := func(name, namespace string) []label {
+		// the external label doesn't override the label of the metric
+		return []label{{"__name__", name}, {"job", "kubecost_exporter"}, {"namespace", namespace}}
+	}
+	want := [][]timeSeries{
+		{{labels: seriesLabels("kubecost_cost", "default"), samples: []sample{{1, 86400000}, {2, 172800000}}}},
+		{
+			{labels: seriesLabels("kubecost_cost", "kube-system"), samples: []sample{{3, 86400000}}},
+			{labels: seriesLabels("kubecost_live", "default"), samples: []sample{{4, 0}}},
+		},
+	}
+	if len(receiver.requests) != len(want) {
+		t.Fatalf("got %d requests, want %d: %+v", len(receiver.requests), len(want), receiver.requests)
+	}
+	// the sample without a timestamp is sent with the current time
+	live := &receiver.requests[1][1].samples[0]
+	if live.timestampMs < before || live.timestampMs > after {
+		t.Errorf("timestamp of the sample without one is %d, want between %d and %d", live.timestampMs, before, after)
+	}
+	live.timestampMs = 0
+	if !reflect.DeepEqual(receiver.requests, want) {
+		t.Errorf("got requests\n%+v\nwant\n%+v", receiver.requests, want)
+	}
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantRetries  float64
+		wantErr      bool
+	}{
+		{name: "5xx is retried", statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, wantAttempts: 3, wantRetries: 2},
+		{name: "429 is retried", statuses: []int{http.StatusTooManyRequests}, wantAttempts: 2, wantRetries: 1},
+		{name: "retries are exhausted", statuses: []int{502, 502, 502}, wantAttempts: 3, wantRetries: 2, wantErr: true},
+		{name: "4xx isn't retried", statuses: []int{http.StatusBadRequest}, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &remoteWriteReceiver{t: t, statuses: tt.statuses}
+			rw := newTestRemoteWrite(t, receiver, 0)
+			retries := Retries.WithLabelValues(remoteWriteSinkName)
+			before := testutil.ToFloat64(retries)
+
+			err := rw.Send(context.Background(), []*dto.MetricFamily{testGauge("kubecost_cost", "default", 1, 86400000)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if receiver.attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", receiver.attempts, tt.wantAttempts)
+			}
+			if got := testutil.ToFloat64(retries) - before; got != tt.wantRetries {
+				t.Errorf("sink_retries_total increased by %v, want %v", got, tt.wantRetries)
+			}
+			if !tt.wantErr && len(receiver.requests) != 1 {
+				t.Errorf("got %d written requests, want 1", len(receiver.requests))
+			}
+		})
+	}
+}
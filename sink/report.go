@@ -0,0 +1,197 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultReportTemplate is the object key of the report, one report per scraped window
+const DefaultReportTemplate = "reports/date={{.Date}}/kubecost_{{.Start}}_{{.End}}.csv"
+
+// ReportConfig is the configuration of the cost report
+type ReportConfig struct {
+	// KeyTemplate is the text/template of the report key, the fields are .Date, .Start, .End and .Cluster
+	KeyTemplate string
+	// Cluster is the .Cluster of the key template, the one of the S3 config if it's empty
+	Cluster string
+	// Window returns the window of the collected metrics, it's a part of the key,
+	// so the report of the same window is replaced rather than duplicated
+	Window func(now time.Time) (time.Time, time.Time)
+}
+
+// windowKey is the data for the report key and the S3 prefix templates
+type windowKey struct {
+	Date    string
+	Start   string
+	End     string
+	Cluster string
+}
+
+func parseWindowTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+// executeWindowTemplate returns the template executed for the window, the times are in UTC
+func executeWindowTemplate(t *template.Template, start, end time.Time, cluster string) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, windowKey{
+		Date:    start.UTC().Format("2006-01-02"),
+		Start:   start.UTC().Format(windowNameFormat),
+		End:     end.UTC().Format(windowNameFormat),
+		Cluster: cluster,
+	})
+	return b.String(), err
+}
+
+// Report writes the collected cost metrics as a CSV table: the metric name, a column per label and the value.
+// It's meant for the people who don't use Prometheus, e.g. a daily drop for the finance team
+type Report struct {
+	name   string
+	store  objectStore
+	config ReportConfig
+	key    *template.Template
+	logger log.Logger
+}
+
+// NewS3Report returns the report sink that uploads the reports to the bucket
+func NewS3Report(s3 S3Config, config ReportConfig, logger log.Logger) (*Report, error) {
+	store, err := newS3Store(s3, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Cluster) == 0 {
+		config.Cluster = s3.Cluster
+	}
+	return newReport("s3_report", store, config, logger)
+}
+
+func newReport(name string, store objectStore, config ReportConfig, logger log.Logger) (*Report, error) {
+	if config.Window == nil {
+		return nil, fmt.Errorf("report window is not set")
+	}
+	if len(config.KeyTemplate) == 0 {
+		config.KeyTemplate = DefaultReportTemplate
+	}
+	key, err := parseWindowTemplate("report key", config.KeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &Report{
+		name:   name,
+		store:  store,
+		config: config,
+		key:    key,
+		logger: logger,
+	}, nil
+}
+
+func (r *Report) Name() string {
+	return r.name
+}
+
+// Send implements Sink.
+func (r *Report) Send(ctx context.Context, families []*dto.MetricFamily) error {
+	start, end := r.config.Window(time.Now())
+	key, err := executeWindowTemplate(r.key, start, end, r.config.Cluster)
+	if err != nil {
+		return err
+	}
+	store, _, err := storeForWindow(r.store, start, end)
+	if err != nil {
+		return err
+	}
+	data, rows, err := encodeReport(families)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		level.Warn(r.logger).Log("msg", "No cost metrics collected, the report is not written", "key", key)
+		return nil
+	}
+	if err := store.Put(ctx, strings.TrimPrefix(key, "/"), data); err != nil {
+		return err
+	}
+	level.Debug(r.logger).Log("msg", "Report written", "key", key, "rows", rows)
+	return nil
+}
+
+// encodeReport writes the cost gauges, counters and untyped metrics as CSV, the exporter's own metrics
+// and the other types are skipped. The columns are the union of the labels of all the metrics sorted by name
+func encodeReport(families []*dto.MetricFamily) ([]byte, int, error) {
+	labelSet := make(map[string]bool)
+	for _, mf := range families {
+		if !isReported(mf) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				labelSet[l.GetName()] = true
+			}
+		}
+	}
+	labelNames := make([]string, 0, len(labelSet))
+	for name := range labelSet {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(append(append([]string{"metric"}, labelNames...), "value")); err != nil {
+		return nil, 0, err
+	}
+	rows := 0
+	row := make([]string, len(labelNames)+2)
+	for _, mf := range families {
+		if !isReported(mf) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for i := range row {
+				row[i] = ""
+			}
+			row[0] = mf.GetName()
+			for _, l := range m.GetLabel() {
+				row[1+sort.SearchStrings(labelNames, l.GetName())] = l.GetValue()
+			}
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			default:
+				value = m.GetUntyped().GetValue()
+			}
+			row[len(row)-1] = formatFloat(value)
+			if err := w.Write(row); err != nil {
+				return nil, 0, err
+			}
+			rows++
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), rows, w.Error()
+}
+
+func isReported(mf *dto.MetricFamily) bool {
+	if !strings.Contains(mf.GetName(), "_cost") {
+		return false
+	}
+	t := mf.GetType()
+	return t == dto.MetricType_GAUGE || t == dto.MetricType_COUNTER || t == dto.MetricType_UNTYPED
+}
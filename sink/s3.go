@@ -0,0 +1,400 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	// S3SSEAES256 is the server-side encryption with the keys managed by S3
+	S3SSEAES256 = "AES256"
+	// S3SSEKMS is the server-side encryption with a KMS key
+	S3SSEKMS = "aws:kms"
+
+	s3Service        = "s3"
+	s3DateFormat     = "20060102"
+	s3DateTimeFormat = "20060102T150405Z"
+	s3EmptyHash      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config is the configuration of an S3 compatible bucket: AWS S3, GCS with the interoperability HMAC keys, MinIO
+type S3Config struct {
+	// Endpoint is the URL of the storage, e.g. https://s3.eu-west-1.amazonaws.com, https://storage.googleapis.com, http://minio:9000
+	Endpoint *url.URL
+	Bucket   string
+	Region   string
+	// Prefix is the text/template of the prefix of all the object keys, e.g. kubecost/{{.Cluster}},
+	// the fields are the ones of the report key: .Date, .Start and .End of the window and .Cluster
+	Prefix string
+	// Cluster is the .Cluster of the prefix and the report key templates
+	Cluster      string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle uses http://endpoint/bucket/key instead of http://bucket.endpoint/key, MinIO needs it
+	PathStyle bool
+	// SSE is empty, S3SSEAES256 or S3SSEKMS
+	SSE           string
+	SSEKMSKeyID   string
+	Timeout       time.Duration
+	MaxRetries    int
+	MinBackoff    time.Duration
+	SkipTLSVerify bool
+}
+
+// Validate checks the configuration before the first upload
+func (c S3Config) Validate() error {
+	if len(c.Bucket) == 0 {
+		return fmt.Errorf("bucket is not set")
+	}
+	if c.Endpoint == nil || len(c.Endpoint.Host) == 0 {
+		return fmt.Errorf("endpoint is not set")
+	}
+	if len(c.Region) == 0 {
+		return fmt.Errorf("region is not set")
+	}
+	if len(c.AccessKey) == 0 || len(c.SecretKey) == 0 {
+		return fmt.Errorf("access key and secret key must be set")
+	}
+	if _, err := parseWindowTemplate("prefix", c.Prefix); err != nil {
+		return err
+	}
+	switch c.SSE {
+	case "", S3SSEAES256:
+		if len(c.SSEKMSKeyID) > 0 {
+			return fmt.Errorf("KMS key id requires %q server-side encryption", S3SSEKMS)
+		}
+	case S3SSEKMS:
+	default:
+		return fmt.Errorf("unknown server-side encryption %q", c.SSE)
+	}
+	return nil
+}
+
+// s3Store keeps the objects in an S3 bucket, the requests are signed with AWS Signature Version 4.
+// S3 PUT is atomic, the readers see either the old or the new object.
+// The prefix of the config is the executed template in the stores of the windows
+type s3Store struct {
+	config     S3Config
+	prefix     *template.Template
+	logger     log.Logger
+	httpClient *http.Client
+}
+
+// s3Error is the error response of S3
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("s3 returned HTTP status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3 returned HTTP status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func newS3Store(config S3Config, logger log.Logger) (*s3Store, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 500 * time.Millisecond
+	}
+	prefix, err := parseWindowTemplate("prefix", config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.SkipTLSVerify}
+	return &s3Store{
+		config: config,
+		prefix: prefix,
+		logger: logger,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+	}, nil
+}
+
+// forWindow implements windowStore, the prefix of the returned store is the one of the window
+func (s *s3Store) forWindow(start, end time.Time) (objectStore, string, error) {
+	prefix, err := executeWindowTemplate(s.prefix, start, end, s.config.Cluster)
+	if err != nil {
+		return nil, "", err
+	}
+	store := *s
+	store.config.Prefix = strings.Trim(prefix, "/")
+	return &store, store.config.Prefix, nil
+}
+
+// objectKey returns the key in the bucket
+func (s *s3Store) objectKey(key string) string {
+	if len(s.config.Prefix) == 0 {
+		return key
+	}
+	return s.config.Prefix + "/" + key
+}
+
+// objectURL returns the URL of the object, an empty key is the bucket itself
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.config.Endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		p += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = p + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	header := http.Header{}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if len(s.config.SSE) > 0 {
+		header.Set("X-Amz-Server-Side-Encryption", s.config.SSE)
+	}
+	if len(s.config.SSEKMSKeyID) > 0 {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.config.SSEKMSKeyID)
+	}
+	_, err := s.do(ctx, "PUT", s.objectKey(key), nil, header, data)
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, "GET", s.objectKey(key), nil, nil, nil)
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DELETE", s.objectKey(key), nil, nil, nil)
+	if s.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3ListResult is the response of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.objectKey(prefix))
+	for {
+		body, err := s.do(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("couldn't parse the list response: %s", err)
+		}
+		for _, c := range result.Contents {
+			key := c.Key
+			if len(s.config.Prefix) > 0 {
+				key = strings.TrimPrefix(key, s.config.Prefix+"/")
+			}
+			keys = append(keys, key)
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Store) IsNotExist(err error) bool {
+	var s3err *s3Error
+	return errors.As(err, &s3err) && (s3err.StatusCode == http.StatusNotFound || s3err.Code == "NoSuchKey")
+}
+
+// do sends the signed request with retries and returns the response body
+func (s *s3Store) do(ctx context.Context, method string, key string, query url.Values, header http.Header, data []byte) ([]byte, error) {
+	var body []byte
+	err := retry(ctx, "s3", s.config.MaxRetries, s.config.MinBackoff, s.logger, func() error {
+		var err error
+		body, err = s.send(ctx, method, key, query, header, data)
+		return err
+	})
+	return body, err
+}
+
+func (s *s3Store) send(ctx context.Context, method string, key string, query url.Values, header http.Header, data []byte) ([]byte, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", "kubecost_exporter")
+	s.sign(req, u, data, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, recoverableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	s3err := &s3Error{StatusCode: resp.StatusCode}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	xml.Unmarshal(respBody, s3err)
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, recoverableError{s3err}
+	}
+	return nil, s3err
+}
+
+// sign adds the AWS Signature Version 4 authorization header,
+// all the x-amz-* headers and the host are signed
+func (s *s3Store) sign(req *http.Request, u *url.URL, data []byte, now time.Time) {
+	payloadHash := s3EmptyHash
+	if len(data) > 0 {
+		sum := sha256.Sum256(data)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", now.Format(s3DateTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(s.config.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	signed := map[string]string{"host": u.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "content-type" {
+			signed[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.config.Region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(s3DateTimeFormat),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes the string the way SigV4 expects: everything except the unreserved characters
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery returns the query with the SigV4 encoding sorted by the encoded keys and then by the values
+func s3CanonicalQuery(query url.Values) string {
+	var pairs [][2]string
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, [2]string{s3Escape(k, false), s3Escape(v, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// NewS3Records returns the records sink that uploads the files to the bucket
+func NewS3Records(s3 S3Config, config RecordsConfig, logger log.Logger) (*RecordsSink, error) {
+	store, err := newS3Store(s3, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordsSink("s3", store, config, logger)
+}
@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Retries counts the retries of the sinks, it's shared by all of them and registered once by the exporter
+var Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "assets",
+	Subsystem: "exporter",
+	Name:      "sink_retries_total",
+	Help:      "Total number of the retried requests of the sinks after a recoverable error, the Kubecost requests aren't retried.",
+}, []string{"sink"})
+
+// Sink receives the metric families collected by the exporter and delivers them somewhere else
+// e.g. to a Prometheus remote write endpoint
+type Sink interface {
+	// Name of the Sink, used for logging
+	Name() string
+
+	// Send delivers the metric families, the samples without timestamp are sent with the collection time
+	Send(ctx context.Context, families []*dto.MetricFamily) error
+}
+
+// GatherFunc collects the metric families, it's called once per iteration of the collection loop
+type GatherFunc func(ctx context.Context) ([]*dto.MetricFamily, error)
+
+// Loop gathers the metrics every interval and sends them to every sink until stop is closed or the context is cancelled.
+// The first iteration starts immediately. The iteration in progress is finished after stop is closed,
+// the context cancels it, e.g. when the shutdown grace period is over
+func Loop(ctx context.Context, stop <-chan struct{}, interval time.Duration, gather GatherFunc, sinks []Sink, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		families, err := gather(ctx)
+		if err != nil {
+			// the families are still sent, a failed scraper doesn't affect the others
+			level.Error(logger).Log("msg", "Error gathering metrics for sinks", "err", err)
+		}
+		for _, s := range sinks {
+			if err := s.Send(ctx, families); err != nil {
+				level.Error(logger).Log("msg", "Error sending metrics", "sink", s.Name(), "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoverableError marks the errors that are worth a retry
+type recoverableError struct {
+	error
+}
+
+// retry calls fn until it succeeds or returns an error that is not recoverable,
+// the backoff is doubled after every attempt
+func retry(ctx context.Context, name string, maxRetries int, backoff time.Duration, logger log.Logger, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			level.Warn(logger).Log("msg", "Retrying", "attempt", attempt, "err", err)
+			Retries.WithLabelValues(name).Inc()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		err = fn()
+		if _, ok := err.(recoverableError); !ok {
+			return err
+		}
+	}
+	return err
+}
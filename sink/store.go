@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// objectStore is the place where the records files are kept: a local directory or an object storage bucket
+type objectStore interface {
+	// Put writes the object atomically, a reader never sees a partially written object
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// List returns the keys with the prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// IsNotExist returns true if the error is returned for a missing object
+	IsNotExist(err error) bool
+}
+
+// windowStore is implemented by the stores with the keys that depend on the scraped window, e.g. the S3 prefix template
+type windowStore interface {
+	// forWindow returns the store of the window objects and its prefix
+	forWindow(start, end time.Time) (objectStore, string, error)
+}
+
+// storeForWindow returns the store of the window objects, the stores that don't depend on the window are returned as they are
+func storeForWindow(store objectStore, start, end time.Time) (objectStore, string, error) {
+	if w, ok := store.(windowStore); ok {
+		return w.forWindow(start, end)
+	}
+	return store, "", nil
+}
+
+// localStore keeps the objects as files in a directory, the keys are slash separated paths
+type localStore struct {
+	dir string
+}
+
+// newLocalStore returns the store for the directory, the directory is created if it doesn't exist
+func newLocalStore(dir string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStore{dir: dir}, nil
+}
+
+func (s *localStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file in the same directory and renames it
+func (s *localStore) Put(ctx context.Context, key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// the temporary file starts with a dot, so the readers that scan the directory skip it
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	// walk only the directory of the prefix, not the whole store
+	root := s.path(prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		root = filepath.Dir(root)
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *localStore) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
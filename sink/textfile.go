@@ -0,0 +1,32 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const textfileSinkName = "textfile"
+
+// Textfile writes the metrics to a .prom file for the node_exporter textfile collector.
+// The file is written to a temporary file first and renamed, so node_exporter never reads a partial file
+type Textfile struct {
+	path string
+}
+
+// NewTextfile returns a new textfile sink, the path should end with .prom
+func NewTextfile(path string) *Textfile {
+	return &Textfile{path: path}
+}
+
+func (t *Textfile) Name() string {
+	return textfileSinkName
+}
+
+// Send implements Sink.
+func (t *Textfile) Send(ctx context.Context, families []*dto.MetricFamily) error {
+	return prometheus.WriteToTextfile(t.path, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	}))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/web"
+)
+
+// tenant is what an identity is allowed to get from /metrics
+type tenant struct {
+	name string
+	// scrapers are the allowed scrapers, all of them if it's nil
+	scrapers map[string]bool
+	scope    collector.Scope
+}
+
+// allows returns true if the tenant is allowed to collect the scraper
+func (t *tenant) allows(scraper string) bool {
+	return t.scrapers == nil || t.scrapers[scraper]
+}
+
+// unrestricted returns true if the tenant gets everything, e.g. the central Prometheus
+func (t *tenant) unrestricted() bool {
+	return t.scrapers == nil && t.scope.IsEmpty()
+}
+
+// tenants map the identities of the requests to the tenants, nil means there are no tenants and nothing is limited
+type tenants struct {
+	users  map[string]*tenant
+	tokens []tenantToken
+}
+
+type tenantToken struct {
+	token  []byte
+	tenant *tenant
+}
+
+// newTenants returns the tenants of the config, nil if there are none
+func newTenants(cfg map[string]*config.Tenant) (*tenants, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	t := &tenants{users: make(map[string]*tenant)}
+	for name, c := range cfg {
+		if _, err := scrapersByName(c.Scrapers); err != nil {
+			return nil, fmt.Errorf("tenant %q: %s", name, err)
+		}
+		tn := &tenant{
+			name:  name,
+			scope: collector.Scope{Clusters: c.Clusters, Namespaces: c.Namespaces, Labels: c.Labels},
+		}
+		if len(c.Scrapers) > 0 {
+			tn.scrapers = make(map[string]bool, len(c.Scrapers))
+			for _, scraper := range c.Scrapers {
+				tn.scrapers[scraper] = true
+			}
+		}
+		for _, user := range c.Users {
+			t.users[user] = tn
+		}
+		for _, token := range c.Tokens() {
+			t.tokens = append(t.tokens, tenantToken{token: []byte(token), tenant: tn})
+		}
+	}
+	return t, nil
+}
+
+// byToken returns the tenant of the bearer token, all the tokens are compared, so it takes the same time for any of them
+func (t *tenants) byToken(token string) *tenant {
+	var found *tenant
+	for _, tt := range t.tokens {
+		if subtle.ConstantTimeCompare(tt.token, []byte(token)) == 1 {
+			found = tt.tenant
+		}
+	}
+	return found
+}
+
+// hasToken returns true if the bearer token belongs to a tenant, the web server lets such requests in
+func (t *tenants) hasToken(token string) bool {
+	return t != nil && t.byToken(token) != nil
+}
+
+// identify returns the tenant of the request, false if there are tenants, but none of them is of the request.
+// The basic auth user is taken only if the web server has authenticated it
+func (t *tenants) identify(r *http.Request) (*tenant, bool) {
+	if t == nil {
+		return nil, true
+	}
+	if token, ok := web.BearerToken(r); ok {
+		found := t.byToken(token)
+		return found, found != nil
+	}
+	if user := web.User(r); len(user) > 0 {
+		found, ok := t.users[user]
+		return found, ok
+	}
+	return nil, false
+}
+
+// restrictTenants allows only the unrestricted tenants, it's for the endpoints that can't be limited by a scope: /probe, /-/reload
+func restrictTenants(currentSetup func() *scrapeSetup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := currentSetup().tenants.identify(r)
+		if !ok || t != nil && !t.unrestricted() {
+			http.Error(w, "forbidden for the tenant", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
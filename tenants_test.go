@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/config"
+	"github.com/artemlive/kubecost_exporter/kubecost_api"
+	"github.com/go-kit/log"
+)
+
+// the allocations of two teams and one aggregated by the cluster only, without the namespace
+const tenantAllocations = `{"code":200,"data":[{
+	"backend":{"name":"backend","properties":{"cluster":"one","namespace":"backend","labels":{"team":"api"}},"totalCost":1},
+	"frontend":{"name":"frontend","properties":{"cluster":"one","namespace":"frontend","labels":{"team":"web"}},"totalCost":2},
+	"one":{"name":"one","properties":{"cluster":"one"},"totalCost":3}
+}]}`
+
+// allocationNames returns the names of the exported allocations by their namespace, "-" for the one without it
+func allocationNames(body string) []string {
+	var names []string
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "assets_cost_cluster_allocation_total{") {
+			continue
+		}
+		name := "-"
+		if i := strings.Index(line, `property_namespace="`); i >= 0 {
+			name = strings.SplitN(line[i+len(`property_namespace="`):], `"`, 2)[0]
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestHandlerTenants(t *testing.T) {
+	k, kubecostURL := newFakeKubecost(t)
+	k.allocations = tenantAllocations
+	baseURL, _ := url.Parse(kubecostURL)
+	// the bearer tokens of the tenants are read by config.Load
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(`
+tenants:
+  admin:
+    bearer_tokens: [admin-token]
+  backend:
+    bearer_tokens: [backend-token]
+    scrapers: [scrape_allocation]
+    namespaces: [backend]
+  web:
+    bearer_tokens: [web-token]
+    labels: ["team:web"]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := newTenants(cfg.Tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrapers, err := scrapersByName([]string{collector.ScrapeAllocation{}.Name(), collector.ScrapeAssets{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		query string
+		// filters are the configured filters of the allocations
+		filters    []string
+		wantStatus int
+		wantNames  []string
+		// wantRequests are the allocation and the assets requests with their filterNamespaces params
+		wantRequests []string
+	}{
+		{name: "no identity", wantStatus: http.StatusForbidden},
+		{name: "unknown token", token: "other-token", wantStatus: http.StatusForbidden},
+		{name: "disallowed collect[]", token: "backend-token", query: "collect[]=scrape_allocation&collect[]=scrape_assets", wantStatus: http.StatusForbidden},
+		{
+			name:       "unrestricted tenant",
+			token:      "admin-token",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"-", "backend", "frontend"},
+			wantRequests: []string{
+				"/model/allocation",
+				"/model/assets",
+			},
+		},
+		{
+			// the assets aren't allowed, the allocation without the namespace isn't in the scope
+			name:         "scope of the namespaces",
+			token:        "backend-token",
+			wantStatus:   http.StatusOK,
+			wantNames:    []string{"backend"},
+			wantRequests: []string{"/model/allocation filterNamespaces=backend"},
+		},
+		{
+			name:         "configured filters are intersected with the scope",
+			token:        "backend-token",
+			filters:      []string{"backend", "frontend"},
+			wantStatus:   http.StatusOK,
+			wantNames:    []string{"backend"},
+			wantRequests: []string{"/model/allocation filterNamespaces=backend"},
+		},
+		{
+			name:       "nothing is left of the configured filters",
+			token:      "backend-token",
+			filters:    []string{"frontend"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			// the params of the query are added to the filters, Kubecost would return the other namespace too
+			name:         "query params don't widen the scope",
+			token:        "backend-token",
+			query:        "collect[]=scrape_allocation&scrape_allocation[]=filterNamespaces=frontend",
+			wantStatus:   http.StatusOK,
+			wantNames:    []string{"backend"},
+			wantRequests: []string{"/model/allocation filterNamespaces=backend,filterNamespaces=frontend"},
+		},
+		{
+			// the series without the team label are out of the scope of the labels
+			name:       "scope of the labels",
+			token:      "web-token",
+			wantStatus: http.StatusOK,
+			wantNames:  []string{"frontend"},
+			wantRequests: []string{
+				"/model/allocation",
+				"/model/assets",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k.mu.Lock()
+			k.requests = nil
+			k.mu.Unlock()
+			setup := &scrapeSetup{
+				baseURL:  baseURL,
+				scrapers: scrapers,
+				opts:     collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel, DuplicatePolicy: collector.DuplicatePolicyFirst},
+				tenants:  tenants,
+			}
+			if len(tt.filters) > 0 {
+				setup.filters = map[string]kubecost_api.Filters{"scrape_allocation": {Namespaces: tt.filters}}
+			}
+			handler := newHandler(collector.NewMetrics(), func() *scrapeSetup { return setup }, log.NewNopLogger())
+			r := httptest.NewRequest("GET", "/metrics?"+tt.query, nil)
+			if len(tt.token) > 0 {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := allocationNames(w.Body.String()); !reflect.DeepEqual(got, tt.wantNames) {
+				t.Errorf("got the allocations %q, want %q", got, tt.wantNames)
+			}
+			if got := tenantRequests(k); !reflect.DeepEqual(got, tt.wantRequests) {
+				t.Errorf("got the requests %q, want %q", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// tenantRequests returns the requested paths with all their filterNamespaces params
+func tenantRequests(k *fakeKubecost) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var requests []string
+	for _, r := range k.requests {
+		u, _ := url.Parse(r)
+		request := u.Path
+		var filters []string
+		for _, f := range u.Query()["filterNamespaces"] {
+			filters = append(filters, "filterNamespaces="+f)
+		}
+		if len(filters) > 0 {
+			request += " " + strings.Join(filters, ",")
+		}
+		requests = append(requests, request)
+	}
+	sort.Strings(requests)
+	return requests
+}
@@ -0,0 +1,379 @@
+// Package tracing records the spans of the scrapes and exports them in batches, e.g. over OTLP.
+// It's a small subset of OpenTelemetry tracing: the spans are started from the context, the trace context is
+// propagated with the W3C traceparent header, and the traces are sampled by the trace ID ratio or by the parent
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// maxQueuedSpans limits the ended spans waiting for the export, the newer ones are dropped
+	maxQueuedSpans = 4096
+	// exportInterval is how often the queued spans are exported
+	exportInterval = 5 * time.Second
+	// closeTimeout limits the export of the last spans on the shutdown
+	closeTimeout = 10 * time.Second
+)
+
+// TraceID identifies the trace
+type TraceID [16]byte
+
+// IsValid is false for the zero ID
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies the span within the trace
+type SpanID [8]byte
+
+// IsValid is false for the zero ID
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of the span that is propagated to the children and the other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// TraceState is the vendor specific tracestate header, it's passed on as it is
+	TraceState string
+	// Remote is true for the parent extracted from the request headers
+	Remote bool
+}
+
+// IsValid is true if both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind is the role of the span, the values are the ones of the OTLP SpanKind
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the status of the span, the values are the ones of the OTLP Status.StatusCode
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a span attribute, the value is a string, bool, int64 or float64
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Float64(key string, value float64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is the ended span as it's exported
+type SpanData struct {
+	SpanContext
+	ParentSpanID  SpanID
+	Name          string
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// Attribute returns the value of the attribute, nil if it isn't set
+func (d SpanData) Attribute(key string) interface{} {
+	for _, attr := range d.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// Span is a timed operation of the trace. All the methods are safe to call on nil,
+// e.g. the span of a context without tracing, and on the spans that aren't sampled, they don't record anything
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the context of the span, it's zero for nil
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// IsRecording is true if the span is sampled, so its attributes are worth computing
+func (s *Span) IsRecording() bool {
+	return s != nil && s.data.Sampled
+}
+
+// SetAttributes adds the attributes, the existing ones are replaced
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.data.Attributes {
+			if s.data.Attributes[i].Key == attr.Key {
+				s.data.Attributes[i].Value = attr.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.data.Attributes = append(s.data.Attributes, attr)
+		}
+	}
+}
+
+// SetError marks the span failed with the error, nil is ignored
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// SetStatus sets the status of the span, the message is kept only for the errors
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.StatusCode = code
+	if code == StatusError {
+		s.data.StatusMessage = message
+	}
+}
+
+// End ends the span and queues it for the export, the repeated calls are ignored
+func (s *Span) End() {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.enqueue(data)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns the context with the span, the spans started from it are its children
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span of the context, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext returns the context with the parent of another service,
+// the first span started from it is its child
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a child of the current span of the context by the same tracer.
+// Without a span in the context nothing is traced, the returned span is nil
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind, attrs...)
+}
+
+// SpanExporter sends the ended spans somewhere, e.g. to an OTLP receiver
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// Tracer starts the spans and exports the ended ones in batches. A nil tracer doesn't trace anything
+type Tracer struct {
+	exporter SpanExporter
+	// threshold is compared with the lower 8 bytes of the trace ID, as the OpenTelemetry TraceIdRatioBased sampler does
+	threshold uint64
+	logger    log.Logger
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+	// exporting serializes the exports, so the batches aren't sent concurrently
+	exporting sync.Mutex
+}
+
+// NewTracer returns the tracer that samples the sampleRatio (0-1) of the new traces,
+// the traces started by another service are sampled if their parent is
+func NewTracer(exporter SpanExporter, sampleRatio float64, logger log.Logger) (*Tracer, error) {
+	if sampleRatio < 0 || sampleRatio > 1 || math.IsNaN(sampleRatio) {
+		return nil, fmt.Errorf("sample ratio %v isn't within 0 and 1", sampleRatio)
+	}
+	threshold := uint64(sampleRatio * (1 << 63))
+	if sampleRatio == 1 {
+		threshold = math.MaxUint64
+	}
+	return &Tracer{exporter: exporter, threshold: threshold, logger: logger}, nil
+}
+
+// Start starts a child of the current span of the context, of the remote parent,
+// or the root span of a new trace, the context with the new span is returned
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext()
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	data := SpanData{Name: name, Kind: kind, Start: time.Now()}
+	if parent.IsValid() {
+		data.TraceID, data.ParentSpanID = parent.TraceID, parent.SpanID
+		data.Sampled, data.TraceState = parent.Sampled, parent.TraceState
+	} else {
+		rand.Read(data.TraceID[:])
+		data.Sampled = t.sampled(data.TraceID)
+	}
+	rand.Read(data.SpanID[:])
+	if data.Sampled {
+		data.Attributes = append([]Attribute{}, attrs...)
+	}
+	span := &Span{tracer: t, data: data}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) sampled(id TraceID) bool {
+	if t.threshold == math.MaxUint64 {
+		return true
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < t.threshold
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, data)
+}
+
+// Flush exports the queued spans right away
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.exporting.Lock()
+	defer t.exporting.Unlock()
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		level.Warn(t.logger).Log("msg", "The spans were dropped, the export queue was full", "dropped", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	if err := t.exporter.ExportSpans(ctx, spans); err != nil {
+		return fmt.Errorf("couldn't export %d spans: %s", len(spans), err)
+	}
+	level.Debug(t.logger).Log("msg", "Spans exported", "spans", len(spans))
+	return nil
+}
+
+// Run exports the queued spans every few seconds until the context is cancelled
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.Flush(ctx); err != nil {
+				level.Error(t.logger).Log("msg", "Error exporting spans", "err", err)
+			}
+		}
+	}
+}
+
+// Close exports the last spans, it's called on the shutdown once the requests are finished
+func (t *Tracer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return t.Flush(ctx)
+}
@@ -0,0 +1,175 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func newTestTracer(t *testing.T, sampleRatio float64) (*Tracer, *InMemoryExporter) {
+	exporter := &InMemoryExporter{}
+	tracer, err := NewTracer(exporter, sampleRatio, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracer, exporter
+}
+
+// flush exports the ended spans and returns them by the name
+func flush(t *testing.T, tracer *Tracer, exporter *InMemoryExporter) map[string]SpanData {
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]SpanData)
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+	exporter.Reset()
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantOk      bool
+		wantSampled bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantOk: true, wantSampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", wantOk: true},
+		// the later versions may have more fields
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantOk: true, wantSampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+		{value: ""},
+	}
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.value)
+		if ok != tt.wantOk || sc.Sampled != tt.wantSampled {
+			t.Errorf("parseTraceparent(%q) = %+v, %v, want ok %v and sampled %v", tt.value, sc, ok, tt.wantOk, tt.wantSampled)
+		}
+		if ok && (sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7") {
+			t.Errorf("parseTraceparent(%q) = %s-%s", tt.value, sc.TraceID, sc.SpanID)
+		}
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	tracer, _ := newTestTracer(t, 1)
+	ctx, span := tracer.Start(context.Background(), "scrape", SpanKindInternal)
+	header := http.Header{}
+	Inject(ctx, header)
+	sc := span.SpanContext()
+	if want := "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-01"; header.Get("traceparent") != want {
+		t.Errorf("got traceparent %q, want %q", header.Get("traceparent"), want)
+	}
+
+	// the span of the other service is a child of the injected one, the trace state is passed along
+	header.Set("tracestate", "vendor=value")
+	_, child := tracer.Start(Extract(context.Background(), header), "kubecost", SpanKindServer)
+	got := child.SpanContext()
+	if got.TraceID != sc.TraceID || child.data.ParentSpanID != sc.SpanID || !got.Sampled || got.TraceState != "vendor=value" {
+		t.Errorf("got the child %+v of %+v", child.data, sc)
+	}
+
+	// nothing is injected without a span, an invalid header isn't extracted
+	header = http.Header{}
+	Inject(context.Background(), header)
+	if len(header) > 0 {
+		t.Errorf("got the headers %v without a span", header)
+	}
+	header.Set("traceparent", "garbage")
+	if ctx := Extract(context.Background(), header); ctx != context.Background() {
+		t.Error("the invalid traceparent is extracted")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	sampledParent := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	unsampledParent := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}}
+	tests := []struct {
+		name        string
+		ratio       float64
+		header      http.Header
+		wantSampled bool
+	}{
+		{name: "always", ratio: 1, wantSampled: true},
+		{name: "never", ratio: 0},
+		// the parent decides, whatever the ratio is
+		{name: "sampled parent", ratio: 0, header: sampledParent, wantSampled: true},
+		{name: "unsampled parent", ratio: 1, header: unsampledParent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer, exporter := newTestTracer(t, tt.ratio)
+			ctx := context.Background()
+			if tt.header != nil {
+				ctx = Extract(ctx, tt.header)
+			}
+			ctx, root := tracer.Start(ctx, "root", SpanKindServer)
+			_, child := Start(ctx, "child", SpanKindInternal)
+			if root.IsRecording() != tt.wantSampled || child.IsRecording() != tt.wantSampled {
+				t.Errorf("got recording %v and %v, want %v", root.IsRecording(), child.IsRecording(), tt.wantSampled)
+			}
+			// the unsampled spans are still propagated, so the other services follow the decision
+			if !child.SpanContext().IsValid() || child.SpanContext().TraceID != root.SpanContext().TraceID {
+				t.Errorf("got the child context %+v of %+v", child.SpanContext(), root.SpanContext())
+			}
+			child.End()
+			root.End()
+			if spans := flush(t, tracer, exporter); tt.wantSampled != (len(spans) == 2) || !tt.wantSampled && len(spans) > 0 {
+				t.Errorf("got %d exported spans, want sampled %v", len(spans), tt.wantSampled)
+			}
+		})
+	}
+
+	// the ratio is of the lower half of the trace ID, the same one for any tracer
+	tracer, _ := newTestTracer(t, 0.5)
+	low, high := TraceID{}, TraceID{}
+	low[8], high[8] = 0x3f, 0xc0
+	if !tracer.sampled(low) || tracer.sampled(high) {
+		t.Errorf("got sampled %v for %s and %v for %s with the ratio 0.5", tracer.sampled(low), low, tracer.sampled(high), high)
+	}
+	if _, err := NewTracer(&InMemoryExporter{}, 1.5, log.NewNopLogger()); err == nil {
+		t.Error("the ratio 1.5 is accepted")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tracer, exporter := newTestTracer(t, 1)
+	handler := tracer.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "scrape", SpanKindInternal)
+		span.End()
+		if r.URL.Query().Get("fail") == "1" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/metrics?collect[]=scrape_allocation", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	spans := flush(t, tracer, exporter)
+	server, scrape := spans["GET /metrics"], spans["scrape"]
+	if server.Kind != SpanKindServer || server.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("got the server span %+v", server)
+	}
+	if scrape.TraceID != server.TraceID || scrape.ParentSpanID != server.SpanID {
+		t.Errorf("got the scrape span %+v of %+v", scrape, server)
+	}
+	if server.Attribute("url.path") != "/metrics" || server.Attribute("http.response.status_code") != int64(http.StatusOK) || server.StatusCode == StatusError {
+		t.Errorf("got the server span attributes %v and status %v", server.Attributes, server.StatusCode)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics?fail=1", nil))
+	server = flush(t, tracer, exporter)["GET /metrics"]
+	if server.ParentSpanID.IsValid() || server.StatusCode != StatusError || server.Attribute("http.response.status_code") != int64(http.StatusInternalServerError) {
+		t.Errorf("got the failed server span %+v", server)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/artemlive/kubecost_exporter/collector"
+	"github.com/artemlive/kubecost_exporter/tracing"
+	"github.com/go-kit/log"
+)
+
+func TestHandlerSpans(t *testing.T) {
+	k, kubecostURL := newFakeKubecost(t)
+	baseURL, _ := url.Parse(kubecostURL)
+	scrapers, err := scrapersByName([]string{collector.ScrapeAllocation{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup := &scrapeSetup{
+		baseURL:  baseURL,
+		scrapers: scrapers,
+		opts:     collector.ScrapeOptions{StepRange: 1, StepOutput: collector.StepOutputLabel, DuplicatePolicy: collector.DuplicatePolicyFirst},
+	}
+	exporter := &tracing.InMemoryExporter{}
+	tracer, err := tracing.NewTracer(exporter, 1, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := tracer.Handler(newHandler(collector.NewMetrics(), func() *scrapeSetup { return setup }, log.NewNopLogger()))
+
+	// the scrape is a part of the trace of Prometheus
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]tracing.SpanData)
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+
+	// server -> scrape -> Kubecost client
+	server, scrape, client := spans["GET /metrics"], spans["scrape scrape_allocation"], spans["GET /model/allocation"]
+	if server.Kind != tracing.SpanKindServer || server.ParentSpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("got the server span %+v", server)
+	}
+	if scrape.Kind != tracing.SpanKindInternal || scrape.ParentSpanID != server.SpanID || scrape.Attribute("scraper") != "scrape_allocation" {
+		t.Errorf("got the scrape span %+v of %+v", scrape, server)
+	}
+	if client.Kind != tracing.SpanKindClient || client.ParentSpanID != scrape.SpanID || client.Attribute("http.response.status_code") != int64(200) {
+		t.Errorf("got the client span %+v of %+v", client, scrape)
+	}
+	for name, span := range spans {
+		if span.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("the span %q is in the trace %s", name, span.TraceID)
+		}
+	}
+
+	// Kubecost gets the client span as its parent
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanID.String() + "-01"; len(k.traceparents) != 1 || k.traceparents[0] != want {
+		t.Errorf("Kubecost got traceparent %q, want %q", k.traceparents, want)
+	}
+}
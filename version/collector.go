@@ -0,0 +1,20 @@
+package version
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// NewCollector returns the <program>_build_info metric with the version labels, like the other Prometheus exporters have
+func NewCollector(program string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: program + "_build_info",
+			Help: "A metric with a constant '1' value labeled by version, revision, branch, and goversion from which " + program + " was built.",
+			ConstLabels: prometheus.Labels{
+				"version":   Version,
+				"revision":  Revision,
+				"branch":    Branch,
+				"goversion": GoVersion,
+			},
+		},
+		func() float64 { return 1 },
+	)
+}
@@ -0,0 +1,198 @@
+// Package web serves the exporter endpoints with the Prometheus web config file:
+// TLS, client certificates, basic auth users and the HTTP/2 toggle.
+// The file has the same format as the one of the Prometheus exporter toolkit
+package web
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	promconfig "github.com/prometheus/common/config"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the web config file
+type Config struct {
+	TLSConfig      TLSConfig                    `yaml:"tls_server_config"`
+	HTTPConfig     HTTPConfig                   `yaml:"http_server_config"`
+	BasicAuthUsers map[string]promconfig.Secret `yaml:"basic_auth_users"`
+}
+
+// TLSConfig is the server side TLS, it's disabled if there is no certificate
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientAuth   string `yaml:"client_auth_type"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAllowedSans limits the client certificates by their SANs, any of them is allowed if it's empty
+	ClientAllowedSans        []string   `yaml:"client_allowed_sans"`
+	CipherSuites             []Cipher   `yaml:"cipher_suites"`
+	CurvePreferences         []Curve    `yaml:"curve_preferences"`
+	MinVersion               TLSVersion `yaml:"min_version"`
+	MaxVersion               TLSVersion `yaml:"max_version"`
+	PreferServerCipherSuites bool       `yaml:"prefer_server_cipher_suites"`
+}
+
+// HTTPConfig are the HTTP server options
+type HTTPConfig struct {
+	HTTP2   bool              `yaml:"http2"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// enabled returns true if the server must use TLS
+func (c *TLSConfig) enabled() bool {
+	return len(c.CertFile) > 0 || len(c.KeyFile) > 0
+}
+
+// setDirectory makes the relative paths relative to the web config file
+func (c *TLSConfig) setDirectory(dir string) {
+	join := func(path string) string {
+		if len(path) == 0 || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	c.CertFile = join(c.CertFile)
+	c.KeyFile = join(c.KeyFile)
+	c.ClientCAFile = join(c.ClientCAFile)
+}
+
+// LoadConfig reads and validates the web config file
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{
+		TLSConfig: TLSConfig{
+			MinVersion:               tls.VersionTLS12,
+			MaxVersion:               tls.VersionTLS13,
+			PreferServerCipherSuites: true,
+		},
+		HTTPConfig: HTTPConfig{HTTP2: true},
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", path, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	c.TLSConfig.setDirectory(dir)
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the config, the certificates are checked when they're loaded
+func (c *Config) Validate() error {
+	t := c.TLSConfig
+	if t.enabled() && (len(t.CertFile) == 0 || len(t.KeyFile) == 0) {
+		return fmt.Errorf("both cert_file and key_file must be set for TLS")
+	}
+	if !t.enabled() && (len(t.ClientCAFile) > 0 || len(t.ClientAuth) > 0) {
+		return fmt.Errorf("client certificates need TLS, cert_file and key_file aren't set")
+	}
+	if _, err := clientAuthType(t.ClientAuth); err != nil {
+		return err
+	}
+	if len(t.ClientCAFile) > 0 && len(t.ClientAuth) == 0 {
+		return fmt.Errorf("client_ca_file is set, but client_auth_type isn't")
+	}
+	if len(t.ClientAllowedSans) > 0 && len(t.ClientCAFile) == 0 {
+		return fmt.Errorf("client_allowed_sans needs client_ca_file")
+	}
+	if t.MinVersion > t.MaxVersion {
+		return fmt.Errorf("min_version is greater than max_version")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("basic_auth_users: the password of %q isn't a bcrypt hash: %s", user, err)
+		}
+	}
+	return nil
+}
+
+// clientAuthType parses the client_auth_type, the names are the same as in crypto/tls
+func clientAuthType(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "NoClientCert":
+		return tls.NoClientCert, nil
+	case "RequestClientCert":
+		return tls.RequestClientCert, nil
+	case "RequireAnyClientCert", "RequireClientCert":
+		return tls.RequireAnyClientCert, nil
+	case "VerifyClientCertIfGiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "RequireAndVerifyClientCert":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client_auth_type %q", s)
+}
+
+// Cipher is a TLS cipher suite by its name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+type Cipher uint16
+
+func (c *Cipher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			*c = Cipher(suite.ID)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown or insecure cipher suite %q", name)
+}
+
+// Curve is an elliptic curve by its name: CurveP256, CurveP384, CurveP521, X25519
+type Curve tls.CurveID
+
+var curves = map[string]Curve{
+	"CurveP256": Curve(tls.CurveP256),
+	"CurveP384": Curve(tls.CurveP384),
+	"CurveP521": Curve(tls.CurveP521),
+	"X25519":    Curve(tls.X25519),
+}
+
+func (c *Curve) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	curve, ok := curves[name]
+	if !ok {
+		return fmt.Errorf("unknown curve %q", name)
+	}
+	*c = curve
+	return nil
+}
+
+// TLSVersion is a TLS version by its name: TLS10, TLS11, TLS12, TLS13
+type TLSVersion uint16
+
+var tlsVersions = map[string]TLSVersion{
+	"TLS13": tls.VersionTLS13,
+	"TLS12": tls.VersionTLS12,
+	"TLS11": tls.VersionTLS11,
+	"TLS10": tls.VersionTLS10,
+}
+
+func (v *TLSVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q", name)
+	}
+	*v = version
+	return nil
+}
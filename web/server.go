@@ -0,0 +1,334 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// checkInterval is how often the files are checked for changes, they're checked on the requests, not in background
+	checkInterval = time.Second
+	// maxCachedPasswords limits the cache of the checked passwords, the bcrypt check takes tens of milliseconds
+	maxCachedPasswords = 100
+)
+
+// Server applies the web config to an HTTP server. The config file and the certificates are read again
+// when they change, so the certificates can be renewed and the users changed without a restart.
+// TLS itself and HTTP/2 can't be switched on or off without a restart
+type Server struct {
+	// BearerAuth accepts the bearer tokens of the requests, they don't need the basic auth then.
+	// The tokens are rejected if it's nil
+	BearerAuth func(token string) bool
+
+	path   string
+	logger log.Logger
+
+	mu        sync.Mutex
+	config    *Config
+	tlsConfig *tls.Config
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+
+	passwordsMu sync.Mutex
+	passwords   map[string]bool
+}
+
+// NewServer loads the web config file, an empty path returns the server without TLS and authentication
+func NewServer(path string, logger log.Logger) (*Server, error) {
+	s := &Server{path: path, logger: logger, config: &Config{HTTPConfig: HTTPConfig{HTTP2: true}}, passwords: make(map[string]bool)}
+	if len(path) == 0 {
+		return s, nil
+	}
+	config, tlsConfig, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.config, s.tlsConfig = config, tlsConfig
+	s.modTimes = s.files(config)
+	s.checkedAt = time.Now()
+	return s, nil
+}
+
+// load reads the config and the certificates
+func (s *Server) load() (*Config, *tls.Config, error) {
+	config, err := LoadConfig(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !config.TLSConfig.enabled() {
+		return config, nil, nil
+	}
+	tlsConfig, err := config.TLSConfig.build()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %s", s.path, err)
+	}
+	return config, tlsConfig, nil
+}
+
+// files returns the modification times of the config and the files it refers to
+func (s *Server) files(config *Config) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{s.path, config.TLSConfig.CertFile, config.TLSConfig.KeyFile, config.TLSConfig.ClientCAFile} {
+		if len(path) == 0 {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// current returns the config, it's loaded again if any of the files were changed.
+// The previous config is kept if the new one is invalid, e.g. the certificate is renewed before the key
+func (s *Server) current() (*Config, *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.path) == 0 || time.Since(s.checkedAt) < checkInterval {
+		return s.config, s.tlsConfig
+	}
+	s.checkedAt = time.Now()
+	modTimes := s.files(s.config)
+	changed := len(modTimes) != len(s.modTimes)
+	for path, modTime := range modTimes {
+		if !s.modTimes[path].Equal(modTime) {
+			changed = true
+		}
+	}
+	if !changed {
+		return s.config, s.tlsConfig
+	}
+	config, tlsConfig, err := s.load()
+	if err != nil {
+		level.Error(s.logger).Log("msg", "Error reloading the web config, the previous one is used", "err", err)
+		return s.config, s.tlsConfig
+	}
+	if config.TLSConfig.enabled() != s.config.TLSConfig.enabled() || config.HTTPConfig.HTTP2 != s.config.HTTPConfig.HTTP2 {
+		level.Warn(s.logger).Log("msg", "TLS and HTTP/2 can't be switched without a restart, only the certificates, the client CA and the users are reloaded")
+		config.TLSConfig.CertFile, config.TLSConfig.KeyFile = s.config.TLSConfig.CertFile, s.config.TLSConfig.KeyFile
+		config.HTTPConfig.HTTP2 = s.config.HTTPConfig.HTTP2
+		if tlsConfig == nil {
+			tlsConfig = s.tlsConfig
+		}
+	}
+	level.Info(s.logger).Log("msg", "Web config reloaded", "file", s.path)
+	s.config, s.tlsConfig = config, tlsConfig
+	s.modTimes = s.files(config)
+	s.resetPasswords()
+	return config, tlsConfig
+}
+
+// ListenAndServe serves the server with the web config, the server handler gets the basic auth and the headers
+func (s *Server) ListenAndServe(server *http.Server) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(server, listener)
+}
+
+// Serve serves the server on the listener
+func (s *Server) Serve(server *http.Server, listener net.Listener) error {
+	config, tlsConfig := s.current()
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = s.Handler(handler)
+	if !config.HTTPConfig.HTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if tlsConfig == nil {
+		level.Info(s.logger).Log("msg", "TLS is disabled", "http2", config.HTTPConfig.HTTP2, "address", listener.Addr())
+		return server.Serve(listener)
+	}
+	level.Info(s.logger).Log("msg", "TLS is enabled", "http2", config.HTTPConfig.HTTP2, "address", listener.Addr())
+	// the certificates are taken for every connection, so the reloaded ones are used right away
+	server.TLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			_, tlsConfig := s.current()
+			return &tlsConfig.Certificates[0], nil
+		},
+	}
+	nextProtos := []string{"http/1.1"}
+	if config.HTTPConfig.HTTP2 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	server.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, tlsConfig := s.current()
+		tlsConfig = tlsConfig.Clone()
+		// the config for the client replaces the one of the server, along with its HTTP/2 protocol
+		tlsConfig.NextProtos = nextProtos
+		return tlsConfig, nil
+	}
+	return server.ServeTLS(listener, "", "")
+}
+
+// Handler checks the basic auth of the requests and sets the configured headers
+func (s *Server) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _ := s.current()
+		for name, value := range config.HTTPConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		if token, ok := BearerToken(r); ok {
+			if s.BearerAuth != nil && s.BearerAuth(token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kubecost_exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if len(config.BasicAuthUsers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if ok {
+			hash, exists := config.BasicAuthUsers[user]
+			// the unknown users are checked against a dummy hash, so they take the same time as the known ones
+			if !exists {
+				hash = dummyHash
+			}
+			if s.checkPassword(user, string(hash), password) && exists {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="kubecost_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+type userKey struct{}
+
+// User returns the basic auth user that was authenticated by the server,
+// it's empty if there are no basic auth users in the web config
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// BearerToken returns the bearer token of the Authorization header
+func BearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// dummyHash is the bcrypt hash of an empty password, the cost is the default one
+const dummyHash = "$2a$10$kyWGuvkiGG8Kx02N0bYMwOkG7Pp2o4dBbfzlCVMsEnhVzrAp2mw2e"
+
+// checkPassword checks the password against the bcrypt hash, the results are cached
+func (s *Server) checkPassword(user string, hash string, password string) bool {
+	sum := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	s.passwordsMu.Lock()
+	valid, ok := s.passwords[key]
+	s.passwordsMu.Unlock()
+	if ok {
+		return valid
+	}
+	valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	s.passwordsMu.Lock()
+	if len(s.passwords) >= maxCachedPasswords {
+		s.passwords = make(map[string]bool)
+	}
+	s.passwords[key] = valid
+	s.passwordsMu.Unlock()
+	return valid
+}
+
+func (s *Server) resetPasswords() {
+	s.passwordsMu.Lock()
+	s.passwords = make(map[string]bool)
+	s.passwordsMu.Unlock()
+}
+
+// build loads the certificates and the client CA
+func (c *TLSConfig) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the certificate: %s", err)
+	}
+	clientAuth, err := clientAuthType(c.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               uint16(c.MinVersion),
+		MaxVersion:               uint16(c.MaxVersion),
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+		ClientAuth:               clientAuth,
+	}
+	for _, cipher := range c.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, uint16(cipher))
+	}
+	for _, curve := range c.CurvePreferences {
+		config.CurvePreferences = append(config.CurvePreferences, tls.CurveID(curve))
+	}
+	if len(c.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in the client CA file %s", c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+	if len(c.ClientAllowedSans) > 0 {
+		config.VerifyPeerCertificate = c.verifySans
+	}
+	return config, nil
+}
+
+// verifySans allows only the client certificates with one of the allowed SANs
+func (c *TLSConfig) verifySans(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, allowed := range c.ClientAllowedSans {
+		for _, san := range sans {
+			if subtle.ConstantTimeCompare([]byte(allowed), []byte(san)) == 1 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the client certificate SANs aren't allowed: %v", sans)
+}
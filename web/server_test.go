@@ -0,0 +1,264 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeFile writes the file to the directory, it returns its path
+func writeFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestServer loads the web config from a temporary directory
+func newTestServer(t *testing.T, yaml string) *Server {
+	path := writeFile(t, t.TempDir(), "web.yml", []byte(yaml))
+	s, err := NewServer(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHandlerAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, "basic_auth_users:\n  alice: "+string(hash)+"\nhttp_server_config:\n  headers:\n    X-Frame-Options: deny\n")
+	s.BearerAuth = func(token string) bool { return token == "token" }
+	handler := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user=" + User(r)))
+	}))
+
+	tests := []struct {
+		name          string
+		auth          func(r *http.Request)
+		wantStatus    int
+		wantBody      string
+		wantChallenge string
+	}{
+		{name: "basic auth", auth: func(r *http.Request) { r.SetBasicAuth("alice", "password") }, wantStatus: http.StatusOK, wantBody: "user=alice"},
+		{name: "wrong password", auth: func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, wantStatus: http.StatusUnauthorized, wantChallenge: "Basic"},
+		{name: "unknown user", auth: func(r *http.Request) { r.SetBasicAuth("bob", "password") }, wantStatus: http.StatusUnauthorized, wantChallenge: "Basic"},
+		// the password of the dummy hash isn't accepted for an unknown user
+		{name: "unknown user with the dummy password", auth: func(r *http.Request) { r.SetBasicAuth("bob", "") }, wantStatus: http.StatusUnauthorized, wantChallenge: "Basic"},
+		{name: "no auth", auth: func(r *http.Request) {}, wantStatus: http.StatusUnauthorized, wantChallenge: "Basic"},
+		// the bearer token doesn't need the basic auth, and it's not the basic auth user
+		{name: "bearer token", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, wantStatus: http.StatusOK, wantBody: "user="},
+		{name: "lowercase bearer", auth: func(r *http.Request) { r.Header.Set("Authorization", "bearer token") }, wantStatus: http.StatusOK, wantBody: "user="},
+		{name: "wrong bearer token", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, wantStatus: http.StatusUnauthorized, wantChallenge: "Bearer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			tt.auth(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if len(tt.wantBody) > 0 && w.Body.String() != tt.wantBody {
+				t.Errorf("got body %q, want %q", w.Body, tt.wantBody)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); len(tt.wantChallenge) > 0 && challenge != tt.wantChallenge+` realm="kubecost_exporter"` {
+				t.Errorf("got challenge %q, want %s", challenge, tt.wantChallenge)
+			}
+			if got := w.Header().Get("X-Frame-Options"); got != "deny" {
+				t.Errorf("got X-Frame-Options %q", got)
+			}
+		})
+	}
+
+	// the unknown user is checked against the dummy hash, so it takes the same time as a known one
+	sum := sha256.Sum256([]byte("bob\x00" + dummyHash + "\x00password"))
+	if _, ok := s.passwords[hex.EncodeToString(sum[:])]; !ok {
+		t.Error("the password of the unknown user isn't checked against the dummy hash")
+	}
+	if cost, err := bcrypt.Cost([]byte(dummyHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("the dummy hash has cost %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(dummyHash), nil); err != nil {
+		t.Errorf("the dummy hash isn't the hash of an empty password: %s", err)
+	}
+}
+
+func TestHandlerBearerOnly(t *testing.T) {
+	s, err := NewServer("", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// without the basic auth users the requests are allowed, but the bearer tokens are rejected without BearerAuth
+	for _, tt := range []struct {
+		auth       string
+		wantStatus int
+	}{
+		{auth: "", wantStatus: http.StatusOK},
+		{auth: "Basic YWxpY2U6cGFzc3dvcmQ=", wantStatus: http.StatusOK},
+		{auth: "Bearer token", wantStatus: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if len(tt.auth) > 0 {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: got status %d, want %d", tt.auth, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+// newCertificate returns the PEM certificate and key, self-signed with the SANs of the template
+func newCertificate(t *testing.T, serial int64, template x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(serial)
+	template.Subject = pkix.Name{CommonName: "kubecost_exporter"}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestVerifySans(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/monitoring/sa/prometheus")
+	certPEM, _ := newCertificate(t, 1, x509.Certificate{
+		DNSNames:       []string{"prometheus.monitoring.svc"},
+		EmailAddresses: []string{"prometheus@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:           []*url.URL{spiffe},
+	})
+	block, _ := pem.Decode(certPEM)
+
+	tests := []struct {
+		allowed []string
+		wantErr bool
+	}{
+		{allowed: []string{"prometheus.monitoring.svc"}},
+		{allowed: []string{"other", "prometheus@example.com"}},
+		{allowed: []string{"10.0.0.1"}},
+		{allowed: []string{spiffe.String()}},
+		{allowed: []string{"prometheus"}, wantErr: true},
+		{allowed: []string{"10.0.0.2", "kubecost.monitoring.svc"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		c := &TLSConfig{ClientAllowedSans: tt.allowed}
+		if err := c.verifySans([][]byte{block.Bytes}, nil); (err != nil) != tt.wantErr {
+			t.Errorf("verifySans(%q) error = %v, wantErr %v", tt.allowed, err, tt.wantErr)
+		}
+	}
+
+	c := &TLSConfig{ClientAllowedSans: []string{"prometheus.monitoring.svc"}}
+	if err := c.verifySans(nil, nil); err == nil {
+		t.Error("no client certificate is accepted")
+	}
+	if err := c.verifySans([][]byte{[]byte("garbage")}, nil); err == nil {
+		t.Error("the invalid certificate is accepted")
+	}
+}
+
+// servedSerial connects to the server and returns the serial number of its certificate
+func servedSerial(t *testing.T, addr string) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := newCertificate(t, 1, x509.Certificate{DNSNames: []string{"localhost"}})
+	certFile := writeFile(t, dir, "tls.crt", certPEM)
+	keyFile := writeFile(t, dir, "tls.key", keyPEM)
+	path := writeFile(t, dir, "web.yml", []byte("tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n"))
+	s, err := NewServer(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go s.Serve(server, listener)
+	t.Cleanup(func() { server.Close() })
+	addr := listener.Addr().String()
+	if got := servedSerial(t, addr); got != 1 {
+		t.Fatalf("got the certificate %d, want 1", got)
+	}
+
+	// the files are checked once per checkInterval, the check time is moved back instead of waiting for it
+	expire := func() {
+		s.mu.Lock()
+		s.checkedAt = time.Time{}
+		s.mu.Unlock()
+	}
+	touch := func(path string, content []byte, modTime time.Time) {
+		writeFile(t, dir, filepath.Base(path), content)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the renewed certificate is written before its key, the previous pair is used until both are written
+	newCertPEM, newKeyPEM := newCertificate(t, 2, x509.Certificate{DNSNames: []string{"localhost"}})
+	touch(certFile, newCertPEM, time.Now().Add(time.Minute))
+	expire()
+	if got := servedSerial(t, addr); got != 1 {
+		t.Errorf("got the certificate %d without its key, want the previous one", got)
+	}
+	touch(keyFile, newKeyPEM, time.Now().Add(2*time.Minute))
+	expire()
+	if got := servedSerial(t, addr); got != 2 {
+		t.Errorf("got the certificate %d after the renewal, want 2", got)
+	}
+
+	// the files aren't loaded again while their modification times are the same
+	certInfo, _ := os.Stat(certFile)
+	keyInfo, _ := os.Stat(keyFile)
+	newCertPEM, newKeyPEM = newCertificate(t, 3, x509.Certificate{DNSNames: []string{"localhost"}})
+	touch(certFile, newCertPEM, certInfo.ModTime())
+	touch(keyFile, newKeyPEM, keyInfo.ModTime())
+	expire()
+	if got := servedSerial(t, addr); got != 2 {
+		t.Errorf("got the certificate %d with the same modification times, want 2", got)
+	}
+}